@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sync"
+)
+
+const (
+	// defaultAccountName is the name of the account given by the username and password flags
+	defaultAccountName = "default"
+
+	defaultSessionSecretKey = "session.json"
+)
+
+// accountNameRegexp limits account names to characters allowed in secret keys
+var accountNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+// account holds the credentials of one evohome account; its session is kept under its own key in the session secret
+type account struct {
+	Name     string `json:"name" yaml:"name"`
+	Username string `json:"username" yaml:"username"`
+	Password string `json:"password" yaml:"password"`
+}
+
+// sessionSecretKey returns the key the account's session is kept under in the session secret; the default account keeps using session.json
+func (a account) sessionSecretKey() string {
+	if a.Name == defaultAccountName {
+		return defaultSessionSecretKey
+	}
+
+	return "session-" + a.Name + ".json"
+}
+
+// accountNames returns the names of the accounts
+func accountNames(accounts []account) (names []string) {
+	names = []string{}
+	for _, a := range accounts {
+		names = append(names, a.Name)
+	}
+
+	return
+}
+
+// readAccounts reads a json array of accounts and checks them
+func readAccounts(path string) (accounts []account, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &accounts); err != nil {
+		return nil, fmt.Errorf("Unmarshalling accounts from %v failed: %w", path, err)
+	}
+
+	return accounts, validateAccounts(accounts)
+}
+
+func validateAccounts(accounts []account) error {
+	if len(accounts) == 0 {
+		return fmt.Errorf("No accounts configured")
+	}
+
+	names := map[string]bool{}
+	for i, a := range accounts {
+		if !accountNameRegexp.MatchString(a.Name) {
+			return fmt.Errorf("Account %v has name %q, which should only contain letters, digits, '.', '_' and '-'", i+1, a.Name)
+		}
+		if names[a.Name] {
+			return fmt.Errorf("Account name %v is used more than once", a.Name)
+		}
+		names[a.Name] = true
+
+		if a.Username == "" || a.Password == "" {
+			return fmt.Errorf("Account %v has no username or password", a.Name)
+		}
+	}
+
+	return nil
+}
+
+// accountResult holds the locations fetched for an account, or the error fetching them failed with
+type accountResult struct {
+	Account   account
+	Locations []LocationResponse
+	Err       error
+}
+
+// fetchAccounts fetches the locations of all accounts, at most concurrency at a time; an account failing doesn't stop the others
+func fetchAccounts(ctx context.Context, accounts []account, concurrency int, fetch func(ctx context.Context, a account) ([]LocationResponse, error)) []accountResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	results := make([]accountResult, len(accounts))
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, a := range accounts {
+		wg.Add(1)
+		go func(i int, a account) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			locations, err := fetch(ctx, a)
+			results[i] = accountResult{Account: a, Locations: locations, Err: err}
+		}(i, a)
+	}
+	wg.Wait()
+
+	return results
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadAccounts(t *testing.T) {
+
+	writeAccounts := func(t *testing.T, content string) string {
+		path := filepath.Join(t.TempDir(), "accounts.json")
+		assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+		return path
+	}
+
+	t.Run("ReadsAccounts", func(t *testing.T) {
+
+		path := writeAccounts(t, `[{"name":"thuis","username":"me@example.com","password":"secret"},{"name":"oma","username":"oma@example.com","password":"secret"}]`)
+
+		// act
+		accounts, err := readAccounts(path)
+
+		assert.Nil(t, err)
+		assert.Equal(t, []account{
+			{Name: "thuis", Username: "me@example.com", Password: "secret"},
+			{Name: "oma", Username: "oma@example.com", Password: "secret"},
+		}, accounts)
+	})
+
+	t.Run("ReturnsErrorForNameNotAllowedInSecretKey", func(t *testing.T) {
+
+		path := writeAccounts(t, `[{"name":"oma's huis","username":"oma@example.com","password":"secret"}]`)
+
+		// act
+		_, err := readAccounts(path)
+
+		assert.NotNil(t, err)
+	})
+
+	t.Run("ReturnsErrorForDuplicateName", func(t *testing.T) {
+
+		path := writeAccounts(t, `[{"name":"thuis","username":"me@example.com","password":"secret"},{"name":"thuis","username":"oma@example.com","password":"secret"}]`)
+
+		// act
+		_, err := readAccounts(path)
+
+		assert.NotNil(t, err)
+	})
+
+	t.Run("ReturnsErrorForMissingPassword", func(t *testing.T) {
+
+		path := writeAccounts(t, `[{"name":"thuis","username":"me@example.com"}]`)
+
+		// act
+		_, err := readAccounts(path)
+
+		assert.NotNil(t, err)
+	})
+}
+
+func TestAccountSessionSecretKey(t *testing.T) {
+
+	t.Run("KeepsSessionJSONForDefaultAccount", func(t *testing.T) {
+
+		// act
+		key := account{Name: defaultAccountName}.sessionSecretKey()
+
+		assert.Equal(t, "session.json", key)
+	})
+
+	t.Run("ReturnsKeyPerAccount", func(t *testing.T) {
+
+		// act
+		key := account{Name: "oma"}.sessionSecretKey()
+
+		assert.Equal(t, "session-oma.json", key)
+	})
+}
+
+func TestFetchAccounts(t *testing.T) {
+
+	accounts := []account{{Name: "thuis"}, {Name: "oma"}, {Name: "opa"}, {Name: "zus"}}
+
+	t.Run("ReturnsResultsInOrderOfAccountsWithFailuresIsolated", func(t *testing.T) {
+
+		fetch := func(ctx context.Context, a account) ([]LocationResponse, error) {
+			if a.Name == "oma" {
+				return nil, ErrInvalidCredentials
+			}
+			return []LocationResponse{{Name: a.Name}}, nil
+		}
+
+		// act
+		results := fetchAccounts(context.Background(), accounts, 2, fetch)
+
+		if assert.Equal(t, 4, len(results)) {
+			assert.Equal(t, "thuis", results[0].Locations[0].Name)
+			assert.True(t, errors.Is(results[1].Err, ErrInvalidCredentials))
+			assert.Equal(t, "oma", results[1].Account.Name)
+			assert.Nil(t, results[2].Err)
+			assert.Equal(t, "zus", results[3].Locations[0].Name)
+		}
+	})
+
+	t.Run("FetchesAtMostConcurrencyAccountsAtTheSameTime", func(t *testing.T) {
+
+		var mutex sync.Mutex
+		running, maxRunning := 0, 0
+		fetch := func(ctx context.Context, a account) ([]LocationResponse, error) {
+			mutex.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mutex.Unlock()
+
+			time.Sleep(10 * time.Millisecond)
+
+			mutex.Lock()
+			running--
+			mutex.Unlock()
+			return nil, nil
+		}
+
+		// act
+		fetchAccounts(context.Background(), accounts, 2, fetch)
+
+		assert.Equal(t, 2, maxRunning)
+	})
+}
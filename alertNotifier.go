@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// AlertNotifier is the interface for delivering alert notifications
+type AlertNotifier interface {
+	Notify(ctx context.Context, notification alertNotification) error
+}
+
+type webhookAlertNotifierImpl struct {
+	webhookClient WebhookClient
+}
+
+// NewWebhookAlertNotifier returns an AlertNotifier that posts notifications as json to a webhook
+func NewWebhookAlertNotifier(webhookClient WebhookClient) AlertNotifier {
+	return &webhookAlertNotifierImpl{
+		webhookClient: webhookClient,
+	}
+}
+
+func (wn *webhookAlertNotifierImpl) Notify(ctx context.Context, notification alertNotification) error {
+	return wn.webhookClient.Post(ctx, notification)
+}
+
+type eventsAlertNotifierImpl struct {
+	bigqueryClient BigQueryClient
+	dataset        string
+	table          string
+}
+
+// NewEventsAlertNotifier returns an AlertNotifier that merges alerts into the events table, as an ongoing event while firing that ends when it resolves
+func NewEventsAlertNotifier(bigqueryClient BigQueryClient, dataset, table string) AlertNotifier {
+	return &eventsAlertNotifierImpl{
+		bigqueryClient: bigqueryClient,
+		dataset:        dataset,
+		table:          table,
+	}
+}
+
+func (en *eventsAlertNotifierImpl) Notify(ctx context.Context, notification alertNotification) error {
+	return en.bigqueryClient.MergeEvents(ctx, en.dataset, en.table, []BigQueryEvent{alertEvent(notification)})
+}
+
+// alertEvent maps the notification to an event keyed on its start, so the firing event gets updated when it resolves
+func alertEvent(notification alertNotification) BigQueryEvent {
+	return BigQueryEvent{
+		Account:    bigquery.NullString{StringVal: notification.Account, Valid: true},
+		Location:   notification.Location,
+		LocationID: notification.LocationID,
+		Zone:       notification.Zone,
+		Type:       "alert_" + notification.Type,
+		StartedAt:  notification.Since,
+		EndedAt:    notification.At,
+		Magnitude:  notification.Value,
+		Ongoing:    notification.Status == alertStatusFiring,
+		DetectedAt: notification.At,
+	}
+}
+
+// smtpTimeout limits how long mailing an alert can take
+const smtpTimeout = 10 * time.Second
+
+type smtpAlertNotifierImpl struct {
+	address string
+	from    string
+	to      []string
+}
+
+// NewSMTPAlertNotifier returns an AlertNotifier that mails notifications through an smtp server without authentication, like a local relay
+func NewSMTPAlertNotifier(address, from string, to []string) AlertNotifier {
+	return &smtpAlertNotifierImpl{
+		address: address,
+		from:    from,
+		to:      to,
+	}
+}
+
+func (sn *smtpAlertNotifierImpl) Notify(ctx context.Context, notification alertNotification) error {
+	if err := sn.send(ctx, alertMail(sn.from, sn.to, notification)); err != nil {
+		return fmt.Errorf("Sending alert mail through %v failed: %w", sn.address, err)
+	}
+
+	return nil
+}
+
+// send mails the message like smtp.SendMail, but with a deadline on the connection, so an unresponsive server doesn't hold up the run
+func (sn *smtpAlertNotifierImpl) send(ctx context.Context, message []byte) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", sn.address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	deadline, ok := ctx.Deadline()
+	if !ok || time.Until(deadline) > smtpTimeout {
+		deadline = time.Now().Add(smtpTimeout)
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+
+	host, _, err := net.SplitHostPort(sn.address)
+	if err != nil {
+		return err
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(sn.from); err != nil {
+		return err
+	}
+	for _, to := range sn.to {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(message); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// alertMail formats the notification as a plain text mail message
+func alertMail(from string, to []string, notification alertNotification) []byte {
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %v\r\n", from)
+	fmt.Fprintf(&message, "To: %v\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&message, "Subject: [%v] %v\r\n", strings.ToUpper(notification.Status), notification.Message)
+	fmt.Fprintf(&message, "Date: %v\r\n", notification.At.Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "Content-Type: text/plain; charset=UTF-8\r\n")
+	fmt.Fprintf(&message, "\r\n")
+	fmt.Fprintf(&message, "Alert %v is %v.\r\n\r\n", notification.Rule, notification.Status)
+	fmt.Fprintf(&message, "%v\r\n\r\n", notification.Message)
+	fmt.Fprintf(&message, "Since: %v\r\n", notification.Since.Format(time.RFC3339))
+
+	return message.Bytes()
+}
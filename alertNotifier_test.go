@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlertMail(t *testing.T) {
+
+	t.Run("FormatsNotificationAsPlainTextMail", func(t *testing.T) {
+
+		since := time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC)
+		notification := alertNotification{Status: alertStatusFiring, Rule: "cold", Message: "Zone Slaapkamer in Thuis is 14.5°, below 15°", Since: since, At: since.Add(30 * time.Minute)}
+
+		// act
+		message := string(alertMail("exporter@localhost", []string{"me@localhost", "you@localhost"}, notification))
+
+		assert.True(t, strings.HasPrefix(message, "From: exporter@localhost\r\nTo: me@localhost, you@localhost\r\nSubject: [FIRING] Zone Slaapkamer in Thuis is 14.5°, below 15°\r\n"))
+		assert.Contains(t, message, "\r\n\r\nAlert cold is firing.\r\n")
+		assert.Contains(t, message, "Since: 2020-11-01T12:00:00Z")
+	})
+}
+
+func TestSMTPAlertNotifier(t *testing.T) {
+
+	t.Run("GivesUpOnServerThatDoesNotRespondOnceContextIsDone", func(t *testing.T) {
+
+		// accept connections without ever sending a greeting
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+			}
+		}()
+
+		notifier := NewSMTPAlertNotifier(listener.Addr().String(), "exporter@localhost", []string{"me@localhost"})
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+
+		// act
+		err = notifier.Notify(ctx, alertNotification{Status: alertStatusFiring, Rule: "cold", At: start})
+
+		assert.NotNil(t, err)
+		assert.Less(t, time.Since(start), smtpTimeout)
+	})
+}
+
+func TestAlertEvent(t *testing.T) {
+
+	t.Run("KeepsStartOfAlertSoResolutionUpdatesFiringEvent", func(t *testing.T) {
+
+		since := time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC)
+		firing := alertNotification{Status: alertStatusFiring, Rule: "evohome-temp-lower-than-42", Type: alertRuleTypeZoneBelow, Account: "oma", Location: "Thuis", LocationID: 1234, Zone: "Slaapkamer", Value: 14, Since: since, At: since.Add(30 * time.Minute)}
+		resolved := firing
+		resolved.Status = alertStatusResolved
+		resolved.At = since.Add(time.Hour)
+
+		// act
+		firingEvent := alertEvent(firing)
+		resolvedEvent := alertEvent(resolved)
+
+		assert.Equal(t, eventKey(firingEvent), eventKey(resolvedEvent))
+		assert.Equal(t, "alert_zone_below", firingEvent.Type)
+		assert.Equal(t, "oma", firingEvent.Account.StringVal)
+		assert.True(t, firingEvent.Ongoing)
+		assert.False(t, resolvedEvent.Ongoing)
+		assert.Equal(t, since.Add(time.Hour), resolvedEvent.EndedAt)
+	})
+}
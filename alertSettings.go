@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+)
+
+// alertRulesFromSettings turns the alert settings configured per device in the evohome app into alert rules for that device, scoped by id so renaming the location or zone keeps them; fault and normal condition alerts aren't supported, the api doesn't report faults
+func alertRulesFromSettings(locations []LocationResponse) (rules []alertRule) {
+	rules = []alertRule{}
+	for _, l := range locations {
+		for _, d := range l.Devices {
+			settings := d.AlertSettings
+			rule := func(setting, ruleType string, threshold float64, forMinutes int) alertRule {
+				return alertRule{
+					Name:       fmt.Sprintf("evohome-%v-%v", setting, d.DeviceID),
+					Type:       ruleType,
+					LocationID: l.LocationID,
+					DeviceID:   d.DeviceID,
+					Threshold:  threshold,
+					ForMinutes: forMinutes,
+				}
+			}
+
+			if settings.TempHigherThanActive {
+				rules = append(rules, rule("temp-higher-than", alertRuleTypeZoneAbove, settings.TempHigherThan, settings.TempHigherThanMinutes))
+			}
+			if settings.TempLowerThanActive {
+				rules = append(rules, rule("temp-lower-than", alertRuleTypeZoneBelow, settings.TempLowerThan, settings.TempLowerThanMinutes))
+			}
+			if settings.CommunicationFailureActive {
+				rules = append(rules, rule("communication-failure", alertRuleTypeDeviceNotAlive, 0, settings.CommunicationFailureMinutes))
+			}
+			if settings.CommunicationLostActive {
+				rules = append(rules, rule("communication-lost", alertRuleTypeDeviceNotAlive, 0, settings.CommunicationLostHours*60))
+			}
+			if settings.DeviceLostActive {
+				rules = append(rules, rule("device-lost", alertRuleTypeDeviceNotAlive, 0, settings.DeviceLostHours*60))
+			}
+		}
+	}
+
+	return
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlertRulesFromSettings(t *testing.T) {
+
+	t.Run("ReturnsRulesForActiveSettings", func(t *testing.T) {
+
+		locations := []LocationResponse{{
+			Name:       "Thuis",
+			LocationID: 1234,
+			Devices: []DeviceResponse{{
+				DeviceID: 42,
+				Name:     "Slaapkamer",
+				AlertSettings: AlertSettingsResponse{
+					TempHigherThanActive:    true,
+					TempHigherThan:          30,
+					TempHigherThanMinutes:   15,
+					TempLowerThanActive:     true,
+					TempLowerThan:           5,
+					TempLowerThanMinutes:    30,
+					CommunicationLostActive: true,
+					CommunicationLostHours:  2,
+					DeviceLostActive:        false,
+					DeviceLostHours:         24,
+				},
+			}},
+		}}
+
+		// act
+		rules := alertRulesFromSettings(locations)
+
+		assert.Equal(t, []alertRule{
+			{Name: "evohome-temp-higher-than-42", Type: alertRuleTypeZoneAbove, LocationID: 1234, DeviceID: 42, Threshold: 30, ForMinutes: 15},
+			{Name: "evohome-temp-lower-than-42", Type: alertRuleTypeZoneBelow, LocationID: 1234, DeviceID: 42, Threshold: 5, ForMinutes: 30},
+			{Name: "evohome-communication-lost-42", Type: alertRuleTypeDeviceNotAlive, LocationID: 1234, DeviceID: 42, ForMinutes: 120},
+		}, rules)
+	})
+
+	t.Run("ReturnsNoRulesWithoutActiveSettings", func(t *testing.T) {
+
+		locations := []LocationResponse{{Name: "Thuis", Devices: []DeviceResponse{{DeviceID: 42, Name: "Slaapkamer"}}}}
+
+		// act
+		rules := alertRulesFromSettings(locations)
+
+		assert.Equal(t, 0, len(rules))
+	})
+}
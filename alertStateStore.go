@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// alertStateSecretKey is the key of the alert state in the session secret
+const alertStateSecretKey = "alerts.json"
+
+// AlertStateStore is the interface for keeping the alert state between runs
+type AlertStateStore interface {
+	Load(ctx context.Context) (state *alertState, err error)
+	Save(ctx context.Context, state *alertState) error
+}
+
+type fileAlertStateStoreImpl struct {
+	path string
+}
+
+// NewFileAlertStateStore returns an AlertStateStore that keeps the alert state in a local file, for example on a persistent volume
+func NewFileAlertStateStore(path string) AlertStateStore {
+	return &fileAlertStateStoreImpl{
+		path: path,
+	}
+}
+
+func (fs *fileAlertStateStoreImpl) Load(ctx context.Context) (state *alertState, err error) {
+	data, err := ioutil.ReadFile(fs.path)
+	if os.IsNotExist(err) {
+		return &alertState{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalAlertState(data)
+}
+
+func (fs *fileAlertStateStoreImpl) Save(ctx context.Context, state *alertState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first, so an interrupted run doesn't leave a truncated state behind
+	tempPath := filepath.Join(filepath.Dir(fs.path), "."+filepath.Base(fs.path)+".tmp")
+	if err := ioutil.WriteFile(tempPath, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tempPath, fs.path)
+}
+
+type secretAlertStateStoreImpl struct {
+	kubeClient KubernetesClient
+	namespace  string
+	secretName string
+}
+
+// NewSecretAlertStateStore returns an AlertStateStore that keeps the alert state in the session secret next to the session
+func NewSecretAlertStateStore(kubeClient KubernetesClient, namespace, secretName string) AlertStateStore {
+	return &secretAlertStateStoreImpl{
+		kubeClient: kubeClient,
+		namespace:  namespace,
+		secretName: secretName,
+	}
+}
+
+func (ss *secretAlertStateStoreImpl) Load(ctx context.Context) (state *alertState, err error) {
+	// read through the api instead of the mounted secret, which takes a while to reflect updates
+	secret, err := ss.kubeClient.GetSecret(ctx, ss.namespace, ss.secretName)
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := secret.Data[alertStateSecretKey]
+	if !ok {
+		return &alertState{}, nil
+	}
+
+	return unmarshalAlertState(data)
+}
+
+func (ss *secretAlertStateStoreImpl) Save(ctx context.Context, state *alertState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	// retrieve the secret again, the session may have been refreshed since loading the state
+	secret, err := ss.kubeClient.GetSecret(ctx, ss.namespace, ss.secretName)
+	if err != nil {
+		return err
+	}
+	if secret.Data == nil {
+		secret.Data = make(map[string][]byte)
+	}
+	secret.Data[alertStateSecretKey] = data
+
+	return ss.kubeClient.UpdateSecret(ctx, secret)
+}
+
+func unmarshalAlertState(data []byte) (state *alertState, err error) {
+	state = &alertState{}
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("Unmarshalling alert state failed: %w", err)
+	}
+
+	return state, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type kubernetesClientMock struct {
+	secret *KubernetesSecret
+}
+
+func (kc *kubernetesClientMock) GetSecret(ctx context.Context, namespace, name string) (*KubernetesSecret, error) {
+	return kc.secret, nil
+}
+
+func (kc *kubernetesClientMock) UpdateSecret(ctx context.Context, secret *KubernetesSecret) error {
+	kc.secret = secret
+	return nil
+}
+
+func TestFileAlertStateStore(t *testing.T) {
+
+	t.Run("ReturnsEmptyStateIfFileDoesNotExist", func(t *testing.T) {
+
+		store := NewFileAlertStateStore(filepath.Join(t.TempDir(), "alerts.json"))
+
+		// act
+		state, err := store.Load(context.Background())
+
+		assert.Nil(t, err)
+		assert.Equal(t, &alertState{}, state)
+	})
+
+	t.Run("LoadsSavedState", func(t *testing.T) {
+
+		store := NewFileAlertStateStore(filepath.Join(t.TempDir(), "alerts.json"))
+		exportedAt := time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC)
+		assert.Nil(t, store.Save(context.Background(), &alertState{LastSuccessfulExport: exportedAt, Alerts: map[string]*activeAlert{"cold/Thuis/Slaapkamer": {Rule: "cold", Since: exportedAt}}}))
+
+		// act
+		state, err := store.Load(context.Background())
+
+		assert.Nil(t, err)
+		assert.Equal(t, exportedAt, state.LastSuccessfulExport)
+		assert.Equal(t, "cold", state.Alerts["cold/Thuis/Slaapkamer"].Rule)
+	})
+}
+
+func TestSecretAlertStateStore(t *testing.T) {
+
+	t.Run("SavesStateNextToSession", func(t *testing.T) {
+
+		kubeClient := &kubernetesClientMock{secret: &KubernetesSecret{Data: map[string][]byte{"session.json": []byte(`{}`)}}}
+		store := NewSecretAlertStateStore(kubeClient, "heating", "evohome-bigquery-exporter")
+		exportedAt := time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC)
+
+		// act
+		err := store.Save(context.Background(), &alertState{LastSuccessfulExport: exportedAt})
+
+		assert.Nil(t, err)
+		assert.Equal(t, `{}`, string(kubeClient.secret.Data["session.json"]))
+		state, err := store.Load(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, exportedAt, state.LastSuccessfulExport)
+	})
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	alertRuleTypeZoneBelow                 = "zone_below"
+	alertRuleTypeZoneAbove                 = "zone_above"
+	alertRuleTypeDeviceNotAlive            = "device_not_alive"
+	alertRuleTypeOutdoorFreezingHeatingOff = "outdoor_freezing_heating_off"
+	alertRuleTypeExportStale               = "export_stale"
+
+	alertStatusFiring   = "firing"
+	alertStatusResolved = "resolved"
+
+	// heatingOffSetpoint is the setpoint evohome sets zones to when heating is switched off
+	heatingOffSetpoint = 5.0
+)
+
+// alertRule is a declarative threshold rule; the alert fires once its condition holds for ForMinutes and resolves as soon as it no longer holds
+type alertRule struct {
+	Name string `json:"name" yaml:"name"`
+	Type string `json:"type" yaml:"type"`
+
+	// LocationID and DeviceID limit the rule to a location or device by id, Location and Zone to a location or zone by name; empty matches all
+	LocationID int    `json:"locationId,omitempty" yaml:"locationId,omitempty"`
+	DeviceID   int    `json:"deviceId,omitempty" yaml:"deviceId,omitempty"`
+	Location   string `json:"location,omitempty" yaml:"location,omitempty"`
+	Zone       string `json:"zone,omitempty" yaml:"zone,omitempty"`
+
+	// Threshold is the temperature for zone_below, zone_above and outdoor_freezing_heating_off; export_stale uses ForMinutes only
+	Threshold  float64 `json:"threshold" yaml:"threshold"`
+	ForMinutes int     `json:"forMinutes" yaml:"forMinutes"`
+}
+
+// readAlertRules reads a json array of alert rules and checks them
+func readAlertRules(path string) (rules []alertRule, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("Unmarshalling alert rules from %v failed: %w", path, err)
+	}
+
+	return rules, validateAlertRules(rules)
+}
+
+func validateAlertRules(rules []alertRule) error {
+	names := map[string]bool{}
+	for i, r := range rules {
+		if r.Name == "" {
+			return fmt.Errorf("Alert rule %v has no name", i+1)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("Alert rule name %v is used more than once", r.Name)
+		}
+		names[r.Name] = true
+
+		switch r.Type {
+		case alertRuleTypeZoneBelow, alertRuleTypeZoneAbove, alertRuleTypeDeviceNotAlive, alertRuleTypeOutdoorFreezingHeatingOff:
+		case alertRuleTypeExportStale:
+			if r.ForMinutes <= 0 {
+				return fmt.Errorf("Alert rule %v of type %v needs forMinutes", r.Name, r.Type)
+			}
+		default:
+			return fmt.Errorf("Alert rule %v has unknown type %v", r.Name, r.Type)
+		}
+		if r.ForMinutes < 0 {
+			return fmt.Errorf("Alert rule %v has negative forMinutes", r.Name)
+		}
+	}
+
+	return nil
+}
+
+func (r alertRule) matches(locationID int, location string, deviceID int, zone string) bool {
+	return (r.LocationID == 0 || r.LocationID == locationID) && (r.DeviceID == 0 || r.DeviceID == deviceID) && (r.Location == "" || r.Location == location) && (r.Zone == "" || r.Zone == zone)
+}
+
+// deviceIDs returns the id of the device behind each zone of the locations, as zones are measured by their device's name
+func deviceIDs(locations []LocationResponse) map[zoneKey]int {
+	ids := map[zoneKey]int{}
+	for _, l := range locations {
+		for _, d := range l.Devices {
+			ids[zoneKey{location: locationKey{account: l.Account, locationID: l.LocationID}, zone: d.Name}] = d.DeviceID
+		}
+	}
+
+	return ids
+}
+
+// alertInput is what the alert rules are evaluated against
+type alertInput struct {
+	Locations       []LocationResponse
+	Measurements    []BigQueryMeasurement
+	OutdoorZoneName string
+
+	// Accounts are the accounts exported by the run, and FailedAccounts the ones whose locations couldn't be fetched; the alerts of failed accounts are left as they are
+	Accounts       []string
+	FailedAccounts []string
+
+	// ExportSucceeded is set when evaluating after the measurements of this run were inserted, for all accounts but the failed ones
+	ExportSucceeded bool
+	Now             time.Time
+}
+
+// failed tells whether the account's locations couldn't be fetched this run
+func (input alertInput) failed(account string) bool {
+	for _, a := range input.FailedAccounts {
+		if a == account {
+			return true
+		}
+	}
+
+	return false
+}
+
+// alertCondition is a rule's condition that currently holds for a location, zone or device
+type alertCondition struct {
+	Key        string
+	Rule       string
+	Type       string
+	Account    string
+	Location   string
+	LocationID int
+	Zone       string
+	Message    string
+	Value      float64
+
+	// Since is when the condition started holding, if known; otherwise it's the first evaluation that found it
+	Since time.Time
+}
+
+// evaluateAlertRules returns the conditions of the rules that hold at the moment, with the last successful export per account for export_stale
+func evaluateAlertRules(rules []alertRule, input alertInput, lastSuccessfulExports map[string]time.Time) (conditions []alertCondition) {
+	conditions = []alertCondition{}
+	devices := deviceIDs(input.Locations)
+	for _, r := range rules {
+		// the key tells the same location apart in other accounts and keeps a renamed location's alert
+		condition := func(account, location string, locationID int, zone, message string, value float64) alertCondition {
+			return alertCondition{Key: fmt.Sprintf("%v/%v/%v/%v", r.Name, account, locationID, zone), Rule: r.Name, Type: r.Type, Account: account, Location: location, LocationID: locationID, Zone: zone, Message: message, Value: value}
+		}
+
+		switch r.Type {
+		case alertRuleTypeZoneBelow, alertRuleTypeZoneAbove:
+			for _, m := range input.Measurements {
+				for _, z := range m.Zones {
+					deviceID := devices[zoneKey{location: locationKey{account: m.Account.StringVal, locationID: m.LocationID}, zone: z.Zone}]
+					if z.Zone == input.OutdoorZoneName || !r.matches(m.LocationID, m.Location, deviceID, z.Zone) || !z.TemperatureValue.Valid {
+						continue
+					}
+					temperature := z.TemperatureValue.Float64
+					if r.Type == alertRuleTypeZoneBelow && temperature < r.Threshold {
+						conditions = append(conditions, condition(m.Account.StringVal, m.Location, m.LocationID, z.Zone, fmt.Sprintf("Zone %v in %v is %v°, below %v°", z.Zone, m.Location, temperature, r.Threshold), temperature))
+					}
+					if r.Type == alertRuleTypeZoneAbove && temperature > r.Threshold {
+						conditions = append(conditions, condition(m.Account.StringVal, m.Location, m.LocationID, z.Zone, fmt.Sprintf("Zone %v in %v is %v°, above %v°", z.Zone, m.Location, temperature, r.Threshold), temperature))
+					}
+				}
+			}
+
+		case alertRuleTypeDeviceNotAlive:
+			for _, l := range input.Locations {
+				for _, d := range l.Devices {
+					if d.IsAlive || !r.matches(l.LocationID, l.Name, d.DeviceID, d.Name) {
+						continue
+					}
+					conditions = append(conditions, condition(l.Account, l.Name, l.LocationID, d.Name, fmt.Sprintf("Device %v in %v is not alive", d.Name, l.Name), 0))
+				}
+			}
+
+		case alertRuleTypeOutdoorFreezingHeatingOff:
+			for _, m := range input.Measurements {
+				if !r.matches(m.LocationID, m.Location, 0, "") {
+					continue
+				}
+				outdoor, heatingOff := findOutdoorAndHeatingOff(m, input.OutdoorZoneName)
+				if !outdoor.Valid || outdoor.Float64 >= r.Threshold || !heatingOff {
+					continue
+				}
+				conditions = append(conditions, condition(m.Account.StringVal, m.Location, m.LocationID, "", fmt.Sprintf("It's %v° outside %v while the heating is off", outdoor.Float64, m.Location), outdoor.Float64))
+			}
+
+		case alertRuleTypeExportStale:
+			accounts := make([]string, 0, len(lastSuccessfulExports))
+			for account := range lastSuccessfulExports {
+				accounts = append(accounts, account)
+			}
+			sort.Strings(accounts)
+			for _, account := range accounts {
+				lastSuccessfulExport := lastSuccessfulExports[account]
+				if (input.ExportSucceeded && !input.failed(account)) || lastSuccessfulExport.IsZero() {
+					continue
+				}
+				minutes := input.Now.Sub(lastSuccessfulExport).Minutes()
+				if minutes < float64(r.ForMinutes) {
+					continue
+				}
+				message := fmt.Sprintf("No successful export since %v", lastSuccessfulExport.Format(time.RFC3339))
+				if account != "" {
+					message = fmt.Sprintf("No successful export of account %v since %v", account, lastSuccessfulExport.Format(time.RFC3339))
+				}
+				stale := condition(account, "", 0, "", message, minutes)
+				stale.Since = lastSuccessfulExport
+				conditions = append(conditions, stale)
+			}
+		}
+	}
+
+	return
+}
+
+// findOutdoorAndHeatingOff returns the outdoor temperature of the measurement, if any, and whether all its zones are set to the heating off setpoint
+func findOutdoorAndHeatingOff(m BigQueryMeasurement, outdoorZoneName string) (outdoor bigquery.NullFloat64, heatingOff bool) {
+	for _, z := range m.Zones {
+		if z.Zone == outdoorZoneName {
+			outdoor = z.TemperatureValue
+			continue
+		}
+		if !z.HeatSetPointValue.Valid || z.HeatSetPointValue.Float64 > heatingOffSetpoint {
+			return outdoor, false
+		}
+		heatingOff = true
+	}
+
+	return
+}
+
+// alertState is kept between runs, so alerts fire once and resolve
+type alertState struct {
+	// LastSuccessfulExport is the last run that exported any account, LastSuccessfulExports the last per account; accounts without their own are assumed to be exported with the last run
+	LastSuccessfulExport  time.Time               `json:"lastSuccessfulExport"`
+	LastSuccessfulExports map[string]time.Time    `json:"lastSuccessfulExports,omitempty"`
+	Alerts                map[string]*activeAlert `json:"alerts"`
+}
+
+// exported records the successful export of the accounts that didn't fail
+func (s *alertState) exported(input alertInput) {
+	if s.LastSuccessfulExports == nil {
+		s.LastSuccessfulExports = map[string]time.Time{}
+	}
+	for _, a := range input.Accounts {
+		if !input.failed(a) {
+			s.LastSuccessfulExports[a] = input.Now
+			continue
+		}
+		// a failed account without its own is assumed to be exported with the last run, which it isn't part of anymore
+		if _, ok := s.LastSuccessfulExports[a]; !ok && !s.LastSuccessfulExport.IsZero() {
+			s.LastSuccessfulExports[a] = s.LastSuccessfulExport
+		}
+	}
+	s.LastSuccessfulExport = input.Now
+}
+
+// lastSuccessfulExports returns the last successful export of each of the accounts, or of the last run for a single account without a name
+func (s *alertState) lastSuccessfulExports(accounts []string) map[string]time.Time {
+	if len(accounts) == 0 {
+		return map[string]time.Time{"": s.LastSuccessfulExport}
+	}
+
+	exports := map[string]time.Time{}
+	for _, a := range accounts {
+		exported, ok := s.LastSuccessfulExports[a]
+		if !ok {
+			exported = s.LastSuccessfulExport
+		}
+		exports[a] = exported
+	}
+
+	return exports
+}
+
+// activeAlert is a condition that held in the previous runs; it's pending until it held for the rule's duration, then firing
+type activeAlert struct {
+	Rule       string    `json:"rule"`
+	Type       string    `json:"type"`
+	Account    string    `json:"account,omitempty"`
+	Location   string    `json:"location,omitempty"`
+	LocationID int       `json:"locationId,omitempty"`
+	Zone       string    `json:"zone,omitempty"`
+	Message    string    `json:"message"`
+	Value      float64   `json:"value"`
+	Since      time.Time `json:"since"`
+	Firing     bool      `json:"firing"`
+	FiredAt    time.Time `json:"firedAt,omitempty"`
+}
+
+// alertNotification is sent when an alert fires or resolves
+type alertNotification struct {
+	Status     string    `json:"status"`
+	Rule       string    `json:"rule"`
+	Type       string    `json:"type"`
+	Account    string    `json:"account,omitempty"`
+	Location   string    `json:"location,omitempty"`
+	LocationID int       `json:"locationId,omitempty"`
+	Zone       string    `json:"zone,omitempty"`
+	Message    string    `json:"message"`
+	Value      float64   `json:"value"`
+	Since      time.Time `json:"since"`
+	At         time.Time `json:"at"`
+}
+
+// update tracks the current conditions of the evaluated rules and returns notifications for the alerts that start firing or resolve; alerts of rules that weren't evaluated are left as they are, like those of failed accounts but for export_stale
+func (s *alertState) update(rules []alertRule, conditions []alertCondition, input alertInput) (notifications []alertNotification) {
+	now := input.Now
+	if s.Alerts == nil {
+		s.Alerts = map[string]*activeAlert{}
+	}
+	rulesByName := map[string]alertRule{}
+	for _, r := range rules {
+		rulesByName[r.Name] = r
+	}
+
+	holding := map[string]bool{}
+	for _, c := range conditions {
+		holding[c.Key] = true
+
+		alert, ok := s.Alerts[c.Key]
+		if !ok {
+			since := c.Since
+			if since.IsZero() {
+				since = now
+			}
+			alert = &activeAlert{Rule: c.Rule, Type: c.Type, Account: c.Account, Location: c.Location, LocationID: c.LocationID, Zone: c.Zone, Since: since}
+			s.Alerts[c.Key] = alert
+		}
+		alert.Message = c.Message
+		alert.Value = c.Value
+
+		if !alert.Firing && now.Sub(alert.Since) >= time.Duration(rulesByName[c.Rule].ForMinutes)*time.Minute {
+			alert.Firing = true
+			alert.FiredAt = now
+			notifications = append(notifications, alert.notification(alertStatusFiring, now))
+		}
+	}
+
+	keys := make([]string, 0, len(s.Alerts))
+	for key := range s.Alerts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		alert := s.Alerts[key]
+		if _, evaluated := rulesByName[alert.Rule]; !evaluated || holding[key] {
+			continue
+		}
+		if alert.Type != alertRuleTypeExportStale && input.failed(alert.Account) {
+			continue
+		}
+		if alert.Firing {
+			notifications = append(notifications, alert.notification(alertStatusResolved, now))
+		}
+		delete(s.Alerts, key)
+	}
+
+	return
+}
+
+// prune drops the alerts of rules that no longer exist, like those of alert settings switched off in the evohome app, resolving the firing ones; the alerts of failed accounts are kept, as their settings weren't fetched
+func (s *alertState) prune(rules []alertRule, input alertInput) (notifications []alertNotification) {
+	now := input.Now
+	ruleNames := map[string]bool{}
+	for _, r := range rules {
+		ruleNames[r.Name] = true
+	}
+
+	keys := make([]string, 0, len(s.Alerts))
+	for key := range s.Alerts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		alert := s.Alerts[key]
+		if ruleNames[alert.Rule] || input.failed(alert.Account) {
+			continue
+		}
+		if alert.Firing {
+			notifications = append(notifications, alert.notification(alertStatusResolved, now))
+		}
+		delete(s.Alerts, key)
+	}
+
+	return
+}
+
+func (a *activeAlert) notification(status string, now time.Time) alertNotification {
+	return alertNotification{
+		Status:     status,
+		Rule:       a.Rule,
+		Type:       a.Type,
+		Account:    a.Account,
+		Location:   a.Location,
+		LocationID: a.LocationID,
+		Zone:       a.Zone,
+		Message:    a.Message,
+		Value:      a.Value,
+		Since:      a.Since,
+		At:         now,
+	}
+}
+
+// alertManager evaluates the alert rules against each run, keeping their state in the store and sending notifications to all notifiers
+type alertManager struct {
+	rules     []alertRule
+	store     AlertStateStore
+	notifiers []AlertNotifier
+
+	// evohomeAlertSettings adds the rules for the alert settings configured in the evohome app
+	evohomeAlertSettings bool
+}
+
+// Evaluate evaluates the rules of the given types, or all rules if none are given, and sends the resulting notifications
+func (am *alertManager) Evaluate(ctx context.Context, input alertInput, types ...string) error {
+	allRules := am.rules
+	if am.evohomeAlertSettings {
+		allRules = append(append([]alertRule{}, am.rules...), alertRulesFromSettings(input.Locations)...)
+	}
+
+	rules := allRules
+	if len(types) > 0 {
+		rules = []alertRule{}
+		for _, r := range allRules {
+			for _, t := range types {
+				if r.Type == t {
+					rules = append(rules, r)
+				}
+			}
+		}
+	}
+
+	state, err := am.store.Load(ctx)
+	if err != nil {
+		return err
+	}
+	if input.ExportSucceeded {
+		state.exported(input)
+	}
+
+	conditions := evaluateAlertRules(rules, input, state.lastSuccessfulExports(input.Accounts))
+	notifications := state.update(rules, conditions, input)
+	if len(types) == 0 {
+		notifications = append(notifications, state.prune(rules, input)...)
+	}
+
+	for _, n := range notifications {
+		log.Info().Msgf("Alert %v is %v: %v", n.Rule, n.Status, n.Message)
+		for _, notifier := range am.notifiers {
+			// a failing notifier shouldn't keep the others from being notified
+			if err := notifier.Notify(ctx, n); err != nil {
+				log.Warn().Err(err).Msgf("Failed notifying that alert %v is %v", n.Rule, n.Status)
+			}
+		}
+	}
+
+	return am.store.Save(ctx, state)
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadAlertRules(t *testing.T) {
+
+	writeRules := func(t *testing.T, content string) string {
+		path := filepath.Join(t.TempDir(), "rules.json")
+		assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+		return path
+	}
+
+	t.Run("ReadsRules", func(t *testing.T) {
+
+		path := writeRules(t, `[{"name":"cold-bedroom","type":"zone_below","zone":"Slaapkamer","threshold":15,"forMinutes":30},{"name":"stale","type":"export_stale","forMinutes":30}]`)
+
+		// act
+		rules, err := readAlertRules(path)
+
+		assert.Nil(t, err)
+		assert.Equal(t, []alertRule{
+			{Name: "cold-bedroom", Type: alertRuleTypeZoneBelow, Zone: "Slaapkamer", Threshold: 15, ForMinutes: 30},
+			{Name: "stale", Type: alertRuleTypeExportStale, ForMinutes: 30},
+		}, rules)
+	})
+
+	t.Run("ReturnsErrorForUnknownType", func(t *testing.T) {
+
+		path := writeRules(t, `[{"name":"hot","type":"zone_warm","threshold":25}]`)
+
+		// act
+		_, err := readAlertRules(path)
+
+		assert.NotNil(t, err)
+	})
+
+	t.Run("ReturnsErrorForDuplicateName", func(t *testing.T) {
+
+		path := writeRules(t, `[{"name":"cold","type":"zone_below","threshold":15},{"name":"cold","type":"zone_below","threshold":10}]`)
+
+		// act
+		_, err := readAlertRules(path)
+
+		assert.NotNil(t, err)
+	})
+
+	t.Run("ReturnsErrorForExportStaleWithoutDuration", func(t *testing.T) {
+
+		path := writeRules(t, `[{"name":"stale","type":"export_stale"}]`)
+
+		// act
+		_, err := readAlertRules(path)
+
+		assert.NotNil(t, err)
+	})
+}
+
+func TestEvaluateAlertRules(t *testing.T) {
+
+	now := time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC)
+	zone := func(name string, temperature, setpoint float64) BigQueryZone {
+		return BigQueryZone{
+			Zone:              name,
+			TemperatureValue:  bigquery.NullFloat64{Float64: temperature, Valid: true},
+			HeatSetPointValue: bigquery.NullFloat64{Float64: setpoint, Valid: setpoint > 0},
+		}
+	}
+	measurement := func(zones ...BigQueryZone) []BigQueryMeasurement {
+		return []BigQueryMeasurement{{Location: "Thuis", LocationID: 1234, MeasuredAt: now, Zones: zones}}
+	}
+
+	t.Run("ReturnsZonesBelowThreshold", func(t *testing.T) {
+
+		rules := []alertRule{{Name: "cold", Type: alertRuleTypeZoneBelow, Threshold: 15}}
+		input := alertInput{Measurements: measurement(zone("Woonkamer", 19, 20), zone("Slaapkamer", 14.5, 15), zone("Outside", 2, 0)), OutdoorZoneName: "Outside", Now: now}
+
+		// act
+		conditions := evaluateAlertRules(rules, input, nil)
+
+		if assert.Equal(t, 1, len(conditions)) {
+			assert.Equal(t, "cold//1234/Slaapkamer", conditions[0].Key)
+			assert.Equal(t, "Slaapkamer", conditions[0].Zone)
+			assert.Equal(t, 14.5, conditions[0].Value)
+		}
+	})
+
+	t.Run("ReturnsZonesAboveThreshold", func(t *testing.T) {
+
+		rules := []alertRule{{Name: "hot", Type: alertRuleTypeZoneAbove, Threshold: 25}}
+		input := alertInput{Measurements: measurement(zone("Woonkamer", 26, 20), zone("Slaapkamer", 18, 15)), Now: now}
+
+		// act
+		conditions := evaluateAlertRules(rules, input, nil)
+
+		if assert.Equal(t, 1, len(conditions)) {
+			assert.Equal(t, "Woonkamer", conditions[0].Zone)
+			assert.Equal(t, 1234, conditions[0].LocationID)
+		}
+	})
+
+	t.Run("LimitsRuleToZone", func(t *testing.T) {
+
+		rules := []alertRule{{Name: "cold", Type: alertRuleTypeZoneBelow, Zone: "Woonkamer", Threshold: 15}}
+		input := alertInput{Measurements: measurement(zone("Woonkamer", 19, 20), zone("Slaapkamer", 14.5, 15)), Now: now}
+
+		// act
+		conditions := evaluateAlertRules(rules, input, nil)
+
+		assert.Equal(t, 0, len(conditions))
+	})
+
+	t.Run("LimitsRuleToLocationID", func(t *testing.T) {
+
+		rules := []alertRule{{Name: "cold", Type: alertRuleTypeZoneBelow, LocationID: 5678, Threshold: 15}}
+		input := alertInput{Measurements: append(measurement(zone("Slaapkamer", 14.5, 15)), BigQueryMeasurement{Location: "Thuis", LocationID: 5678, MeasuredAt: now, Zones: []BigQueryZone{zone("Slaapkamer", 14, 15)}}), Now: now}
+
+		// act
+		conditions := evaluateAlertRules(rules, input, nil)
+
+		if assert.Equal(t, 1, len(conditions)) {
+			assert.Equal(t, 5678, conditions[0].LocationID)
+		}
+	})
+
+	t.Run("LimitsRuleToZoneOfDeviceID", func(t *testing.T) {
+
+		rules := []alertRule{{Name: "cold", Type: alertRuleTypeZoneBelow, LocationID: 1234, DeviceID: 42, Threshold: 15}}
+		locations := []LocationResponse{
+			{Name: "Thuis", LocationID: 1234, Devices: []DeviceResponse{{DeviceID: 42, Name: "Slaapkamer"}, {DeviceID: 43, Name: "Woonkamer"}}},
+			{Name: "Thuis", LocationID: 5678, Devices: []DeviceResponse{{DeviceID: 44, Name: "Slaapkamer"}}},
+		}
+		measurements := append(measurement(zone("Slaapkamer", 14.5, 15), zone("Woonkamer", 14, 20)), BigQueryMeasurement{Location: "Thuis", LocationID: 5678, MeasuredAt: now, Zones: []BigQueryZone{zone("Slaapkamer", 14, 15)}})
+		input := alertInput{Locations: locations, Measurements: measurements, Now: now}
+
+		// act
+		conditions := evaluateAlertRules(rules, input, nil)
+
+		if assert.Equal(t, 1, len(conditions)) {
+			assert.Equal(t, "Slaapkamer", conditions[0].Zone)
+			assert.Equal(t, 1234, conditions[0].LocationID)
+		}
+	})
+
+	t.Run("TellsSameZoneInOtherAccountOrLocationApart", func(t *testing.T) {
+
+		rules := []alertRule{{Name: "cold", Type: alertRuleTypeZoneBelow, Threshold: 15}}
+		measurements := append(measurement(zone("Slaapkamer", 14.5, 15)), BigQueryMeasurement{Location: "Thuis", LocationID: 5678, MeasuredAt: now, Zones: []BigQueryZone{zone("Slaapkamer", 14, 15)}})
+		measurements = append(measurements, BigQueryMeasurement{Account: bigquery.NullString{StringVal: "oma", Valid: true}, Location: "Thuis", LocationID: 1234, MeasuredAt: now, Zones: []BigQueryZone{zone("Slaapkamer", 14, 15)}})
+		input := alertInput{Measurements: measurements, Now: now}
+
+		// act
+		conditions := evaluateAlertRules(rules, input, nil)
+
+		if assert.Equal(t, 3, len(conditions)) {
+			assert.Equal(t, "cold//1234/Slaapkamer", conditions[0].Key)
+			assert.Equal(t, "cold//5678/Slaapkamer", conditions[1].Key)
+			assert.Equal(t, "cold/oma/1234/Slaapkamer", conditions[2].Key)
+			assert.Equal(t, "oma", conditions[2].Account)
+		}
+	})
+
+	t.Run("ReturnsDevicesNotAlive", func(t *testing.T) {
+
+		rules := []alertRule{{Name: "dead", Type: alertRuleTypeDeviceNotAlive}}
+		input := alertInput{Locations: []LocationResponse{{Name: "Thuis", LocationID: 1234, Account: "oma", Devices: []DeviceResponse{{Name: "Woonkamer", IsAlive: true}, {Name: "Slaapkamer", IsAlive: false}}}}, Now: now}
+
+		// act
+		conditions := evaluateAlertRules(rules, input, nil)
+
+		if assert.Equal(t, 1, len(conditions)) {
+			assert.Equal(t, "Slaapkamer", conditions[0].Zone)
+			assert.Equal(t, "dead/oma/1234/Slaapkamer", conditions[0].Key)
+		}
+	})
+
+	t.Run("LimitsDeviceRuleToDeviceID", func(t *testing.T) {
+
+		rules := []alertRule{{Name: "dead", Type: alertRuleTypeDeviceNotAlive, DeviceID: 43}}
+		input := alertInput{Locations: []LocationResponse{{Name: "Thuis", LocationID: 1234, Devices: []DeviceResponse{{DeviceID: 42, Name: "Slaapkamer", IsAlive: false}, {DeviceID: 43, Name: "Slaapkamer 2", IsAlive: false}}}}, Now: now}
+
+		// act
+		conditions := evaluateAlertRules(rules, input, nil)
+
+		if assert.Equal(t, 1, len(conditions)) {
+			assert.Equal(t, "Slaapkamer 2", conditions[0].Zone)
+		}
+	})
+
+	t.Run("ReturnsOutdoorFreezingWhileHeatingOff", func(t *testing.T) {
+
+		rules := []alertRule{{Name: "freezing", Type: alertRuleTypeOutdoorFreezingHeatingOff, Threshold: 0}}
+		input := alertInput{Measurements: measurement(zone("Woonkamer", 12, 5), zone("Slaapkamer", 11, 5), zone("Outside", -3, 0)), OutdoorZoneName: "Outside", Now: now}
+
+		// act
+		conditions := evaluateAlertRules(rules, input, nil)
+
+		if assert.Equal(t, 1, len(conditions)) {
+			assert.Equal(t, "Thuis", conditions[0].Location)
+			assert.Equal(t, -3.0, conditions[0].Value)
+		}
+	})
+
+	t.Run("IgnoresOutdoorFreezingWhileAnyZoneHeats", func(t *testing.T) {
+
+		rules := []alertRule{{Name: "freezing", Type: alertRuleTypeOutdoorFreezingHeatingOff, Threshold: 0}}
+		input := alertInput{Measurements: measurement(zone("Woonkamer", 12, 20), zone("Slaapkamer", 11, 5), zone("Outside", -3, 0)), OutdoorZoneName: "Outside", Now: now}
+
+		// act
+		conditions := evaluateAlertRules(rules, input, nil)
+
+		assert.Equal(t, 0, len(conditions))
+	})
+
+	t.Run("ReturnsStaleExport", func(t *testing.T) {
+
+		rules := []alertRule{{Name: "stale", Type: alertRuleTypeExportStale, ForMinutes: 30}}
+
+		// act
+		conditions := evaluateAlertRules(rules, alertInput{Now: now}, map[string]time.Time{"": now.Add(-45 * time.Minute)})
+
+		if assert.Equal(t, 1, len(conditions)) {
+			assert.Equal(t, 45.0, conditions[0].Value)
+		}
+	})
+
+	t.Run("ReturnsStaleExportPerAccount", func(t *testing.T) {
+
+		rules := []alertRule{{Name: "stale", Type: alertRuleTypeExportStale, ForMinutes: 30}}
+		input := alertInput{Accounts: []string{"thuis", "oma"}, FailedAccounts: []string{"oma"}, ExportSucceeded: true, Now: now}
+
+		// act
+		conditions := evaluateAlertRules(rules, input, map[string]time.Time{"thuis": now, "oma": now.Add(-45 * time.Minute)})
+
+		if assert.Equal(t, 1, len(conditions)) {
+			assert.Equal(t, "oma", conditions[0].Account)
+			assert.Equal(t, "stale/oma/0/", conditions[0].Key)
+		}
+	})
+
+	t.Run("IgnoresStaleExportWithoutEarlierSuccessfulExport", func(t *testing.T) {
+
+		rules := []alertRule{{Name: "stale", Type: alertRuleTypeExportStale, ForMinutes: 30}}
+
+		// act
+		conditions := evaluateAlertRules(rules, alertInput{Now: now}, map[string]time.Time{"": {}})
+
+		assert.Equal(t, 0, len(conditions))
+	})
+}
+
+func TestAlertStateUpdate(t *testing.T) {
+
+	now := time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC)
+	rules := []alertRule{{Name: "cold", Type: alertRuleTypeZoneBelow, Threshold: 15, ForMinutes: 10}}
+	cold := alertCondition{Key: "cold//1234/Slaapkamer", Rule: "cold", Type: alertRuleTypeZoneBelow, Location: "Thuis", LocationID: 1234, Zone: "Slaapkamer", Message: "Zone Slaapkamer in Thuis is 14.5°, below 15°", Value: 14.5}
+
+	t.Run("FiresOnceAfterConditionHeldForDuration", func(t *testing.T) {
+
+		state := &alertState{}
+
+		// act
+		pending := state.update(rules, []alertCondition{cold}, alertInput{Now: now})
+		firing := state.update(rules, []alertCondition{cold}, alertInput{Now: now.Add(10 * time.Minute)})
+		again := state.update(rules, []alertCondition{cold}, alertInput{Now: now.Add(15 * time.Minute)})
+
+		assert.Equal(t, 0, len(pending))
+		if assert.Equal(t, 1, len(firing)) {
+			assert.Equal(t, alertStatusFiring, firing[0].Status)
+			assert.Equal(t, now, firing[0].Since)
+		}
+		assert.Equal(t, 0, len(again))
+	})
+
+	t.Run("ResolvesFiringAlert", func(t *testing.T) {
+
+		state := &alertState{}
+		state.update(rules, []alertCondition{cold}, alertInput{Now: now})
+		state.update(rules, []alertCondition{cold}, alertInput{Now: now.Add(10 * time.Minute)})
+
+		// act
+		notifications := state.update(rules, []alertCondition{}, alertInput{Now: now.Add(15 * time.Minute)})
+
+		if assert.Equal(t, 1, len(notifications)) {
+			assert.Equal(t, alertStatusResolved, notifications[0].Status)
+		}
+		assert.Equal(t, 0, len(state.Alerts))
+	})
+
+	t.Run("DropsPendingAlertSilently", func(t *testing.T) {
+
+		state := &alertState{}
+		state.update(rules, []alertCondition{cold}, alertInput{Now: now})
+
+		// act
+		notifications := state.update(rules, []alertCondition{}, alertInput{Now: now.Add(5 * time.Minute)})
+
+		assert.Equal(t, 0, len(notifications))
+		assert.Equal(t, 0, len(state.Alerts))
+	})
+
+	t.Run("KeepsAlertsOfRulesNotEvaluated", func(t *testing.T) {
+
+		state := &alertState{}
+		state.update(rules, []alertCondition{cold}, alertInput{Now: now})
+
+		// act
+		notifications := state.update([]alertRule{{Name: "stale", Type: alertRuleTypeExportStale, ForMinutes: 30}}, []alertCondition{}, alertInput{Now: now.Add(5 * time.Minute)})
+
+		assert.Equal(t, 0, len(notifications))
+		assert.Equal(t, 1, len(state.Alerts))
+	})
+
+	t.Run("KeepsAlertsOfFailedAccounts", func(t *testing.T) {
+
+		state := &alertState{}
+		oma := cold
+		oma.Key = "cold/oma/1234/Slaapkamer"
+		oma.Account = "oma"
+		state.update(rules, []alertCondition{oma}, alertInput{Now: now})
+		state.update(rules, []alertCondition{oma}, alertInput{Now: now.Add(10 * time.Minute)})
+
+		// act
+		notifications := state.update(rules, []alertCondition{}, alertInput{FailedAccounts: []string{"oma"}, Now: now.Add(15 * time.Minute)})
+
+		assert.Equal(t, 0, len(notifications))
+		if assert.Equal(t, 1, len(state.Alerts)) {
+			assert.True(t, state.Alerts["cold/oma/1234/Slaapkamer"].Firing)
+			assert.Equal(t, now, state.Alerts["cold/oma/1234/Slaapkamer"].Since)
+		}
+	})
+}
+
+func TestAlertStatePrune(t *testing.T) {
+
+	now := time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("ResolvesFiringAlertsOfRemovedRules", func(t *testing.T) {
+
+		state := &alertState{Alerts: map[string]*activeAlert{
+			"evohome-temp-lower-than-42//1234/Slaapkamer": {Rule: "evohome-temp-lower-than-42", Firing: true, Since: now.Add(-time.Hour)},
+			"cold//1234/Slaapkamer":                       {Rule: "cold", Firing: true, Since: now.Add(-time.Hour)},
+		}}
+
+		// act
+		notifications := state.prune([]alertRule{{Name: "cold", Type: alertRuleTypeZoneBelow}}, alertInput{Now: now})
+
+		if assert.Equal(t, 1, len(notifications)) {
+			assert.Equal(t, "evohome-temp-lower-than-42", notifications[0].Rule)
+			assert.Equal(t, alertStatusResolved, notifications[0].Status)
+		}
+		assert.Equal(t, 1, len(state.Alerts))
+	})
+
+	t.Run("KeepsAlertsOfFailedAccounts", func(t *testing.T) {
+
+		state := &alertState{Alerts: map[string]*activeAlert{
+			"evohome-temp-lower-than-42/oma/1234/Slaapkamer": {Rule: "evohome-temp-lower-than-42", Account: "oma", Firing: true, Since: now.Add(-time.Hour)},
+		}}
+
+		// act
+		notifications := state.prune([]alertRule{}, alertInput{FailedAccounts: []string{"oma"}, Now: now})
+
+		assert.Equal(t, 0, len(notifications))
+		assert.Equal(t, 1, len(state.Alerts))
+	})
+}
+
+type notifierMock struct {
+	notifications []alertNotification
+	err           error
+}
+
+func (nm *notifierMock) Notify(ctx context.Context, notification alertNotification) error {
+	nm.notifications = append(nm.notifications, notification)
+	return nm.err
+}
+
+func TestAlertManagerEvaluate(t *testing.T) {
+
+	now := time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("NotifiesAllNotifiersAndSavesState", func(t *testing.T) {
+
+		store := NewFileAlertStateStore(filepath.Join(t.TempDir(), "alerts.json"))
+		failing := &notifierMock{err: errors.New("unreachable")}
+		notifier := &notifierMock{}
+		manager := &alertManager{
+			rules:     []alertRule{{Name: "stale", Type: alertRuleTypeExportStale, ForMinutes: 30}},
+			store:     store,
+			notifiers: []AlertNotifier{failing, notifier},
+		}
+		assert.Nil(t, store.Save(context.Background(), &alertState{LastSuccessfulExport: now.Add(-time.Hour)}))
+
+		// act
+		err := manager.Evaluate(context.Background(), alertInput{Now: now}, alertRuleTypeExportStale)
+
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(failing.notifications))
+		if assert.Equal(t, 1, len(notifier.notifications)) {
+			assert.Equal(t, "stale", notifier.notifications[0].Rule)
+		}
+		state, err := store.Load(context.Background())
+		assert.Nil(t, err)
+		assert.True(t, state.Alerts["stale//0/"].Firing)
+	})
+
+	t.Run("EvaluatesEvohomeAlertSettings", func(t *testing.T) {
+
+		store := NewFileAlertStateStore(filepath.Join(t.TempDir(), "alerts.json"))
+		notifier := &notifierMock{}
+		manager := &alertManager{
+			store:                store,
+			notifiers:            []AlertNotifier{notifier},
+			evohomeAlertSettings: true,
+		}
+		locations := []LocationResponse{{Name: "Thuis", LocationID: 1234, Devices: []DeviceResponse{{DeviceID: 42, Name: "Slaapkamer", AlertSettings: AlertSettingsResponse{TempLowerThanActive: true, TempLowerThan: 15}}}}}
+		measurements := []BigQueryMeasurement{{Location: "Thuis", LocationID: 1234, MeasuredAt: now, Zones: []BigQueryZone{{Zone: "Slaapkamer", TemperatureValue: bigquery.NullFloat64{Float64: 14, Valid: true}}}}}
+
+		// act
+		err := manager.Evaluate(context.Background(), alertInput{Locations: locations, Measurements: measurements, ExportSucceeded: true, Now: now})
+
+		assert.Nil(t, err)
+		if assert.Equal(t, 1, len(notifier.notifications)) {
+			assert.Equal(t, "evohome-temp-lower-than-42", notifier.notifications[0].Rule)
+			assert.Equal(t, alertStatusFiring, notifier.notifications[0].Status)
+		}
+	})
+
+	t.Run("ResolvesStaleExportAfterSuccessfulExport", func(t *testing.T) {
+
+		store := NewFileAlertStateStore(filepath.Join(t.TempDir(), "alerts.json"))
+		notifier := &notifierMock{}
+		manager := &alertManager{
+			rules:     []alertRule{{Name: "stale", Type: alertRuleTypeExportStale, ForMinutes: 30}},
+			store:     store,
+			notifiers: []AlertNotifier{notifier},
+		}
+		assert.Nil(t, store.Save(context.Background(), &alertState{LastSuccessfulExport: now.Add(-time.Hour)}))
+		assert.Nil(t, manager.Evaluate(context.Background(), alertInput{Now: now}, alertRuleTypeExportStale))
+
+		// act
+		err := manager.Evaluate(context.Background(), alertInput{ExportSucceeded: true, Now: now.Add(time.Minute)})
+
+		assert.Nil(t, err)
+		if assert.Equal(t, 2, len(notifier.notifications)) {
+			assert.Equal(t, alertStatusResolved, notifier.notifications[1].Status)
+		}
+		state, _ := store.Load(context.Background())
+		assert.Equal(t, now.Add(time.Minute), state.LastSuccessfulExport)
+	})
+	t.Run("TracksLastSuccessfulExportPerAccount", func(t *testing.T) {
+
+		store := NewFileAlertStateStore(filepath.Join(t.TempDir(), "alerts.json"))
+		notifier := &notifierMock{}
+		manager := &alertManager{
+			rules:     []alertRule{{Name: "stale", Type: alertRuleTypeExportStale, ForMinutes: 30}},
+			store:     store,
+			notifiers: []AlertNotifier{notifier},
+		}
+		assert.Nil(t, store.Save(context.Background(), &alertState{LastSuccessfulExport: now.Add(-time.Hour)}))
+
+		// act
+		err := manager.Evaluate(context.Background(), alertInput{Accounts: []string{"thuis", "oma"}, FailedAccounts: []string{"oma"}, ExportSucceeded: true, Now: now})
+
+		assert.Nil(t, err)
+		if assert.Equal(t, 1, len(notifier.notifications)) {
+			assert.Equal(t, "oma", notifier.notifications[0].Account)
+			assert.Equal(t, alertStatusFiring, notifier.notifications[0].Status)
+		}
+		state, _ := store.Load(context.Background())
+		assert.Equal(t, map[string]time.Time{"thuis": now, "oma": now.Add(-time.Hour)}, state.LastSuccessfulExports)
+	})
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// backfillInput is a historical snapshot of the locations, with the hgi80 listener state of each location at that time if known
+type backfillInput struct {
+	MeasuredAt time.Time
+	Locations  []LocationResponse
+	States     map[backfillLocationKey]*State
+
+	// Account is the name of the account the snapshot was recorded with, empty for csv input and recordings without one
+	Account string
+
+	// Blanks holds the values csv rows left blank, which are stored as NULL instead of 0
+	Blanks map[backfillZoneKey]backfillBlanks
+}
+
+// backfillLocationKey identifies a location within a snapshot, the location id is optional in a csv
+type backfillLocationKey struct {
+	Name       string
+	LocationID int
+}
+
+// backfillZoneKey identifies a zone within a snapshot
+type backfillZoneKey struct {
+	Location backfillLocationKey
+	Zone     string
+}
+
+// backfillBlanks tells which values of a zone were left blank
+type backfillBlanks struct {
+	Temperature  bool
+	HeatSetpoint bool
+	Humidity     bool
+}
+
+// readRecordedBackfillInput reads all recordings in dir as written by a directory recorder, using the time each response was fetched at
+func readRecordedBackfillInput(ctx context.Context, dir string) (inputs []backfillInput, err error) {
+	replayClient, err := NewEvohomeReplayClient(dir)
+	if err != nil {
+		return
+	}
+
+	for replayClient.Next() {
+		locations, err := replayClient.GetLocations(ctx, "", 0)
+		if err != nil {
+			return nil, err
+		}
+		inputs = append(inputs, backfillInput{
+			MeasuredAt: replayClient.FetchedAt(),
+			Account:    replayClient.Account(),
+			Locations:  locations,
+		})
+	}
+
+	return
+}
+
+// readCSVBackfillInput reads csv rows with a header, laid out like the zone table: measured_at, location, location_id, zone, unit, temperature, heat_setpoint, heat_demand and humidity; only measured_at, location and zone are required, and the row for outdoorZoneName becomes the location's weather
+func readCSVBackfillInput(reader io.Reader, outdoorZoneName string) (inputs []backfillInput, err error) {
+	csvReader := csv.NewReader(reader)
+	csvReader.TrimLeadingSpace = true
+
+	header, err := csvReader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Reading csv header failed: %w", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"measured_at", "location", "zone"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("Csv header is missing required column %v", required)
+		}
+	}
+
+	inputsByTime := map[time.Time]*backfillInput{}
+	line := 1
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		line++
+		if err != nil {
+			return nil, fmt.Errorf("Reading csv line %v failed: %w", line, err)
+		}
+
+		row := csvRow{columns: columns, record: record}
+
+		measuredAt, err := time.Parse(time.RFC3339Nano, row.get("measured_at"))
+		if err != nil {
+			return nil, fmt.Errorf("Parsing measured_at on csv line %v failed: %w", line, err)
+		}
+		measuredAt = measuredAt.UTC()
+
+		temperature, hasTemperature, err := row.float("temperature")
+		if err != nil {
+			return nil, fmt.Errorf("Parsing temperature on csv line %v failed: %w", line, err)
+		}
+		heatSetpoint, hasHeatSetpoint, err := row.float("heat_setpoint")
+		if err != nil {
+			return nil, fmt.Errorf("Parsing heat_setpoint on csv line %v failed: %w", line, err)
+		}
+		humidity, hasHumidity, err := row.float("humidity")
+		if err != nil {
+			return nil, fmt.Errorf("Parsing humidity on csv line %v failed: %w", line, err)
+		}
+		locationID, err := row.int("location_id")
+		if err != nil {
+			return nil, fmt.Errorf("Parsing location_id on csv line %v failed: %w", line, err)
+		}
+
+		input, ok := inputsByTime[measuredAt]
+		if !ok {
+			input = &backfillInput{MeasuredAt: measuredAt}
+			inputsByTime[measuredAt] = input
+		}
+
+		location := findOrAddLocation(input, row.get("location"), locationID)
+		zone := row.get("zone")
+
+		if !hasTemperature || !hasHeatSetpoint || !hasHumidity {
+			if input.Blanks == nil {
+				input.Blanks = map[backfillZoneKey]backfillBlanks{}
+			}
+			input.Blanks[backfillZoneKey{Location: backfillLocationKey{Name: location.Name, LocationID: location.LocationID}, Zone: zone}] = backfillBlanks{
+				Temperature:  !hasTemperature,
+				HeatSetpoint: !hasHeatSetpoint,
+				Humidity:     !hasHumidity,
+			}
+		}
+
+		if zone == outdoorZoneName {
+			location.Weather = WeatherResponse{
+				Temperature: temperature,
+				Units:       row.get("unit"),
+				Humidity:    humidity,
+			}
+			continue
+		}
+
+		device := DeviceResponse{
+			Name:       zone,
+			LocationID: locationID,
+		}
+		device.Thermostat.Units = row.get("unit")
+		device.Thermostat.IndoorTemperature = temperature
+		device.Thermostat.ChangeableValues.HeatSetpoint.Value = heatSetpoint
+		location.Devices = append(location.Devices, device)
+
+		heatDemand, hasHeatDemand, err := row.float("heat_demand")
+		if err != nil {
+			return nil, fmt.Errorf("Parsing heat_demand on csv line %v failed: %w", line, err)
+		}
+		if hasHeatDemand {
+			// a listener hears a single controller, so every location gets its own state with the zone ids of a controller
+			key := backfillLocationKey{Name: location.Name, LocationID: location.LocationID}
+			if input.States == nil {
+				input.States = map[backfillLocationKey]*State{}
+			}
+			state, ok := input.States[key]
+			if !ok {
+				state = &State{ZoneInfoMap: map[int64]ZoneInfo{}, LastUpdated: measuredAt}
+				input.States[key] = state
+			}
+			id := int64(len(state.ZoneInfoMap))
+			if id >= maxControllerZones {
+				return nil, fmt.Errorf("Location %v has heat demand for more than %v zones at %v on csv line %v, more than a controller has", location.Name, maxControllerZones, measuredAt, line)
+			}
+			state.ZoneInfoMap[id] = ZoneInfo{ID: id, Name: zone, HeatDemand: heatDemand}
+		}
+	}
+
+	for _, input := range inputsByTime {
+		inputs = append(inputs, *input)
+	}
+	sort.Slice(inputs, func(i, j int) bool {
+		return inputs[i].MeasuredAt.Before(inputs[j].MeasuredAt)
+	})
+
+	return inputs, nil
+}
+
+func findOrAddLocation(input *backfillInput, name string, locationID int) *LocationResponse {
+	for i := range input.Locations {
+		if input.Locations[i].Name == name && input.Locations[i].LocationID == locationID {
+			return &input.Locations[i]
+		}
+	}
+
+	input.Locations = append(input.Locations, LocationResponse{Name: name, LocationID: locationID})
+	return &input.Locations[len(input.Locations)-1]
+}
+
+type csvRow struct {
+	columns map[string]int
+	record  []string
+}
+
+// get returns the trimmed value of the column, or an empty string if the csv doesn't have the column
+func (r csvRow) get(column string) string {
+	i, ok := r.columns[column]
+	if !ok || i >= len(r.record) {
+		return ""
+	}
+	return strings.TrimSpace(r.record[i])
+}
+
+// float returns the value of the column, or false if it's blank or the csv doesn't have the column
+func (r csvRow) float(column string) (value float64, ok bool, err error) {
+	if r.get(column) == "" {
+		return 0, false, nil
+	}
+	value, err = strconv.ParseFloat(r.get(column), 64)
+	return value, err == nil, err
+}
+
+func (r csvRow) int(column string) (int, error) {
+	if r.get(column) == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(r.get(column))
+}
+
+// mapBackfillInput maps every snapshot to validated measurements with its original time
+func mapBackfillInput(inputs []backfillInput, rules validationRules) (measurements []BigQueryMeasurement, report validationReport) {
+	measurements = []BigQueryMeasurement{}
+	report = newValidationReport()
+	for _, input := range inputs {
+		inputMeasurements := []BigQueryMeasurement{}
+		for _, l := range input.Locations {
+			key := backfillLocationKey{Name: l.Name, LocationID: l.LocationID}
+			l.Account = input.Account
+			locationMeasurements := mapLocationsToMeasurements([]LocationResponse{l}, rules.OutdoorZoneName, input.States[key], input.MeasuredAt)
+			for _, m := range locationMeasurements {
+				for i := range m.Zones {
+					blanks := input.Blanks[backfillZoneKey{Location: key, Zone: m.Zones[i].Zone}]
+					if blanks.Temperature {
+						m.Zones[i].TemperatureValue = bigquery.NullFloat64{}
+					}
+					if blanks.HeatSetpoint {
+						m.Zones[i].HeatSetPointValue = bigquery.NullFloat64{}
+					}
+					if blanks.Humidity {
+						m.Zones[i].HumidityValue = bigquery.NullFloat64{}
+					}
+				}
+			}
+			inputMeasurements = append(inputMeasurements, locationMeasurements...)
+		}
+		if input.Account != "" {
+			for i := range inputMeasurements {
+				inputMeasurements[i].Account = bigquery.NullString{StringVal: input.Account, Valid: true}
+			}
+		}
+		report.add(validateMeasurements(inputMeasurements, rules, setpointLimitsFromLocations(input.Locations)))
+		measurements = append(measurements, inputMeasurements...)
+	}
+
+	return
+}
+
+// skipExistingBuckets leaves out measurements whose location and time bucket, as used for their insert id, are already present in the table, as well as duplicates within the input itself
+func skipExistingBuckets(measurements []BigQueryMeasurement, existingBuckets map[string]bool) (missing []BigQueryMeasurement) {
+	missing = []BigQueryMeasurement{}
+	seen := map[string]bool{}
+	for _, m := range measurements {
+		id := m.InsertID()
+		if existingBuckets[id] || seen[id] {
+			continue
+		}
+		seen[id] = true
+		missing = append(missing, m)
+	}
+
+	return
+}
+
+// measuredAtRange returns the earliest and latest measured_at of the measurements
+func measuredAtRange(measurements []BigQueryMeasurement) (from, to time.Time) {
+	for i, m := range measurements {
+		if i == 0 || m.MeasuredAt.Before(from) {
+			from = m.MeasuredAt
+		}
+		if i == 0 || m.MeasuredAt.After(to) {
+			to = m.MeasuredAt
+		}
+	}
+
+	return
+}
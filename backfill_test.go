@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadCSVBackfillInput(t *testing.T) {
+
+	t.Run("GroupsRowsByMeasuredAtAndLocation", func(t *testing.T) {
+
+		csv := `measured_at,location,location_id,zone,unit,temperature,heat_setpoint,heat_demand,humidity
+2020-11-01T12:00:00Z,Thuis,1234,Woonkamer,Celsius,19.5,20,0.4,
+2020-11-01T12:00:00Z,Thuis,1234,Outside,Celsius,8.5,,,80
+2020-11-01T12:05:00Z,Thuis,1234,Woonkamer,Celsius,19.7,20,,
+`
+
+		// act
+		inputs, err := readCSVBackfillInput(strings.NewReader(csv), "Outside")
+
+		assert.Nil(t, err)
+		if assert.Equal(t, 2, len(inputs)) {
+			assert.Equal(t, time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC), inputs[0].MeasuredAt)
+			if assert.Equal(t, 1, len(inputs[0].Locations)) {
+				location := inputs[0].Locations[0]
+				assert.Equal(t, "Thuis", location.Name)
+				assert.Equal(t, 1234, location.LocationID)
+				assert.Equal(t, 8.5, location.Weather.Temperature)
+				assert.Equal(t, 80.0, location.Weather.Humidity)
+				if assert.Equal(t, 1, len(location.Devices)) {
+					assert.Equal(t, "Woonkamer", location.Devices[0].Name)
+					assert.Equal(t, 19.5, location.Devices[0].Thermostat.IndoorTemperature)
+					assert.Equal(t, 20.0, location.Devices[0].Thermostat.ChangeableValues.HeatSetpoint.Value)
+				}
+			}
+			if assert.NotNil(t, inputs[0].States[backfillLocationKey{Name: "Thuis", LocationID: 1234}]) {
+				assert.Equal(t, 0.4, inputs[0].States[backfillLocationKey{Name: "Thuis", LocationID: 1234}].ZoneInfoMap[0].HeatDemand)
+			}
+			assert.Nil(t, inputs[1].States)
+		}
+	})
+
+	t.Run("MapsWithOriginalTimestamps", func(t *testing.T) {
+
+		csv := `measured_at,location,zone,temperature,heat_setpoint,heat_demand
+2020-11-01T12:00:00Z,Thuis,Woonkamer,19.5,20,0.4
+`
+		inputs, _ := readCSVBackfillInput(strings.NewReader(csv), "Outside")
+
+		// act
+		measurements, _ := mapBackfillInput(inputs, validationRules{OutdoorZoneName: "Outside", IndoorTemperature: valueRange{Min: 1, Max: 40}, OutdoorTemperature: valueRange{Min: -40, Max: 50}, HeatSetpoint: valueRange{Min: 5, Max: 35}, Humidity: valueRange{Min: 0, Max: 100}})
+
+		if assert.Equal(t, 1, len(measurements)) {
+			assert.Equal(t, time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC), measurements[0].MeasuredAt)
+			if assert.Equal(t, 2, len(measurements[0].Zones)) {
+				assert.Equal(t, 0.4, measurements[0].Zones[0].HeatDemandValue.Float64)
+			}
+		}
+	})
+
+	t.Run("MapsBlankCellsToNull", func(t *testing.T) {
+
+		csv := `measured_at,location,zone,temperature,heat_setpoint,humidity
+2020-11-01T12:00:00Z,Thuis,Woonkamer,,20,
+2020-11-01T12:00:00Z,Thuis,Outside,8.5,,
+`
+		inputs, err := readCSVBackfillInput(strings.NewReader(csv), "Outside")
+		assert.Nil(t, err)
+
+		// act
+		measurements, report := mapBackfillInput(inputs, validationRules{OutdoorZoneName: "Outside", IndoorTemperature: valueRange{Min: 1, Max: 40}, OutdoorTemperature: valueRange{Min: -40, Max: 50}, HeatSetpoint: valueRange{Min: 5, Max: 35}, Humidity: valueRange{Min: 0, Max: 100}})
+
+		if assert.Equal(t, 1, len(measurements)) && assert.Equal(t, 2, len(measurements[0].Zones)) {
+			assert.Equal(t, bigquery.NullFloat64{}, measurements[0].Zones[0].TemperatureValue)
+			assert.Equal(t, bigquery.NullFloat64{Float64: 20, Valid: true}, measurements[0].Zones[0].HeatSetPointValue)
+			assert.Equal(t, bigquery.NullFloat64{Float64: 8.5, Valid: true}, measurements[0].Zones[1].TemperatureValue)
+			assert.Equal(t, bigquery.NullFloat64{}, measurements[0].Zones[1].HumidityValue)
+			assert.Empty(t, measurements[0].Zones[0].QualityFlags)
+			assert.Empty(t, measurements[0].Zones[1].QualityFlags)
+		}
+		assert.Empty(t, report.Rejected)
+	})
+
+	t.Run("MapsUnderAccountOfRecording", func(t *testing.T) {
+
+		inputs := []backfillInput{{MeasuredAt: time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC), Account: "oma", Locations: []LocationResponse{{LocationID: 1234, Name: "Thuis"}}}}
+
+		// act
+		measurements, _ := mapBackfillInput(inputs, validationRules{OutdoorZoneName: "Outside"})
+
+		if assert.Equal(t, 1, len(measurements)) {
+			assert.Equal(t, bigquery.NullString{StringVal: "oma", Valid: true}, measurements[0].Account)
+			assert.Equal(t, "oma/1234-1604232000", measurements[0].InsertID())
+		}
+	})
+
+	t.Run("KeepsZonesOfEveryLocationInItsOwnStateWithTwelveOrMoreZonesInTotal", func(t *testing.T) {
+
+		csv := "measured_at,location,location_id,zone,temperature,heat_setpoint,heat_demand\n"
+		for _, location := range []string{"Thuis,1234", "Oma,5678"} {
+			for i := 0; i < 7; i++ {
+				demand := "0.1"
+				if location == "Oma,5678" && i == 6 {
+					demand = "0.9"
+				}
+				csv += fmt.Sprintf("2020-11-01T12:00:00Z,%v,Zone %v,19.5,20,%v\n", location, i, demand)
+			}
+		}
+		inputs, err := readCSVBackfillInput(strings.NewReader(csv), "Outside")
+		assert.Nil(t, err)
+
+		// act
+		measurements, _ := mapBackfillInput(inputs, validationRules{OutdoorZoneName: "Outside", IndoorTemperature: valueRange{Min: 1, Max: 40}, OutdoorTemperature: valueRange{Min: -40, Max: 50}, HeatSetpoint: valueRange{Min: 5, Max: 35}, Humidity: valueRange{Min: 0, Max: 100}})
+
+		if assert.Equal(t, 2, len(measurements)) {
+			assert.Equal(t, "Thuis", measurements[0].Location)
+			assert.InDelta(t, 0.1, measurements[0].BoilerHeatDemand.Float64, 0.0001)
+			assert.Equal(t, "Oma", measurements[1].Location)
+			assert.InDelta(t, 0.9, measurements[1].BoilerHeatDemand.Float64, 0.0001)
+			for _, m := range measurements {
+				assert.Equal(t, 8, len(m.Zones))
+				for _, z := range m.Zones[:7] {
+					assert.True(t, z.HeatDemandValue.Valid)
+				}
+			}
+		}
+	})
+
+	t.Run("ReturnsErrorForMoreZonesThanAControllerHas", func(t *testing.T) {
+
+		csv := "measured_at,location,zone,temperature,heat_setpoint,heat_demand\n"
+		for i := 0; i < 13; i++ {
+			csv += fmt.Sprintf("2020-11-01T12:00:00Z,Thuis,Zone %v,19.5,20,0.1\n", i)
+		}
+
+		// act
+		_, err := readCSVBackfillInput(strings.NewReader(csv), "Outside")
+
+		assert.NotNil(t, err)
+	})
+
+	t.Run("ReturnsErrorForMissingRequiredColumn", func(t *testing.T) {
+
+		csv := `measured_at,zone,temperature
+2020-11-01T12:00:00Z,Woonkamer,19.5
+`
+
+		// act
+		_, err := readCSVBackfillInput(strings.NewReader(csv), "Outside")
+
+		assert.NotNil(t, err)
+	})
+
+	t.Run("ReturnsErrorForInvalidTimestamp", func(t *testing.T) {
+
+		csv := `measured_at,location,zone
+yesterday,Thuis,Woonkamer
+`
+
+		// act
+		_, err := readCSVBackfillInput(strings.NewReader(csv), "Outside")
+
+		assert.NotNil(t, err)
+	})
+}
+
+func TestSkipExistingBuckets(t *testing.T) {
+
+	t.Run("SkipsMeasurementsInPresentBucketsAndDuplicatesInInput", func(t *testing.T) {
+
+		measurements := []BigQueryMeasurement{
+			{LocationID: 1234, MeasuredAt: time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC)},
+			{LocationID: 1234, MeasuredAt: time.Date(2020, 11, 1, 12, 5, 0, 0, time.UTC)},
+			{LocationID: 1234, MeasuredAt: time.Date(2020, 11, 1, 12, 6, 0, 0, time.UTC)},
+		}
+		existing := map[string]bool{"1234-1604232000": true}
+
+		// act
+		missing := skipExistingBuckets(measurements, existing)
+
+		if assert.Equal(t, 1, len(missing)) {
+			assert.Equal(t, time.Date(2020, 11, 1, 12, 5, 0, 0, time.UTC), missing[0].MeasuredAt)
+		}
+	})
+}
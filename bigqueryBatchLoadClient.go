@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/api/option"
+)
+
+const (
+	batchBufferFileSuffix = ".ndjson"
+
+	// bigqueryJSONTimestampFormat is the most precise timestamp format bigquery accepts when loading json
+	bigqueryJSONTimestampFormat = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+type bigQueryBatchLoadClientImpl struct {
+	// table management and raw response inserts keep using the regular api
+	BigQueryClient
+
+	bufferDir    string
+	loadInterval time.Duration
+}
+
+// NewBigQueryBatchLoadClient returns a BigQueryClient that appends measurements to a local newline delimited json buffer per table and loads each buffer with a load job once it's older than loadInterval
+func NewBigQueryBatchLoadClient(ctx context.Context, projectID, bufferDir string, loadInterval time.Duration, opts ...option.ClientOption) (BigQueryClient, error) {
+	if err := os.MkdirAll(bufferDir, 0755); err != nil {
+		return nil, err
+	}
+
+	bigqueryClient, err := NewBigQueryClient(ctx, projectID, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &bigQueryBatchLoadClientImpl{
+		BigQueryClient: bigqueryClient,
+		bufferDir:      bufferDir,
+		loadInterval:   loadInterval,
+	}, nil
+}
+
+func (blc *bigQueryBatchLoadClientImpl) InsertMeasurements(ctx context.Context, dataset, table string, measurements []BigQueryMeasurement) error {
+	rows := make([]bigquery.ValueSaver, len(measurements))
+	for i, m := range measurements {
+		rows[i] = m
+	}
+
+	return blc.bufferAndLoad(ctx, dataset, table, rows)
+}
+
+func (blc *bigQueryBatchLoadClientImpl) InsertZoneMeasurements(ctx context.Context, dataset, table string, zoneMeasurements []BigQueryZoneMeasurement) error {
+	rows := make([]bigquery.ValueSaver, len(zoneMeasurements))
+	for i, z := range zoneMeasurements {
+		rows[i] = z
+	}
+
+	return blc.bufferAndLoad(ctx, dataset, table, rows)
+}
+
+// bufferAndLoad appends the rows to the table's current buffer and loads all buffers that are due; a buffer is removed only after its load job succeeded
+func (blc *bigQueryBatchLoadClientImpl) bufferAndLoad(ctx context.Context, dataset, table string, rows []bigquery.ValueSaver) error {
+	now := time.Now().UTC()
+
+	buffers, err := blc.listBuffers(table)
+	if err != nil {
+		return err
+	}
+
+	// append to the newest buffer unless it's due for loading, so a buffer doesn't change anymore once its load has been attempted
+	if len(rows) > 0 {
+		var current *batchBuffer
+		if len(buffers) > 0 && !buffers[len(buffers)-1].isDue(now, blc.loadInterval) {
+			current = &buffers[len(buffers)-1]
+		} else {
+			buffers = append(buffers, batchBuffer{
+				path:      filepath.Join(blc.bufferDir, fmt.Sprintf("%v-%v%v", table, now.Unix(), batchBufferFileSuffix)),
+				createdAt: now,
+			})
+			current = &buffers[len(buffers)-1]
+		}
+
+		if err := appendRowsToBuffer(current.path, rows); err != nil {
+			return err
+		}
+	}
+
+	for _, b := range buffers {
+		if !b.isDue(now, blc.loadInterval) {
+			continue
+		}
+
+		log.Info().Msgf("Loading buffer %v into table %v.%v...", b.path, dataset, table)
+
+		err := blc.LoadJSONFile(ctx, dataset, table, b.path, b.jobID())
+		if errors.Is(err, ErrLoadJobFailed) {
+			// nothing got loaded, so retry under a new job id on the next run
+			retryPath := strings.TrimSuffix(b.path, batchBufferFileSuffix) + fmt.Sprintf("-r%v%v", now.Unix(), batchBufferFileSuffix)
+			if renameErr := os.Rename(b.path, retryPath); renameErr != nil {
+				log.Warn().Err(renameErr).Msgf("Failed renaming buffer %v for retrying its load", b.path)
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := os.Remove(b.path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type batchBuffer struct {
+	path      string
+	createdAt time.Time
+}
+
+func (b batchBuffer) isDue(now time.Time, loadInterval time.Duration) bool {
+	return !now.Before(b.createdAt.Add(loadInterval))
+}
+
+// jobID is derived from the buffer's file name, so a load that got submitted before the pod was killed isn't submitted twice
+func (b batchBuffer) jobID() string {
+	return "evohome_bigquery_exporter_" + strings.Replace(strings.TrimSuffix(filepath.Base(b.path), batchBufferFileSuffix), "-", "_", -1)
+}
+
+// listBuffers returns the table's buffers, oldest first; their file names are <table>-<created unix time>[-r<retry unix time>].ndjson
+func (blc *bigQueryBatchLoadClientImpl) listBuffers(table string) (buffers []batchBuffer, err error) {
+	// the time has to follow the table name right away, so the buffers of a table named like <table>-zones aren't matched
+	paths, err := filepath.Glob(filepath.Join(blc.bufferDir, table+"-[0-9]*"+batchBufferFileSuffix))
+	if err != nil {
+		return
+	}
+
+	for _, p := range paths {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(p), table+"-"), batchBufferFileSuffix)
+		createdAtUnix, err := strconv.ParseInt(strings.Split(stamp, "-r")[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		buffers = append(buffers, batchBuffer{
+			path:      p,
+			createdAt: time.Unix(createdAtUnix, 0).UTC(),
+		})
+	}
+
+	sort.Slice(buffers, func(i, j int) bool {
+		return buffers[i].createdAt.Before(buffers[j].createdAt)
+	})
+
+	return
+}
+
+func appendRowsToBuffer(path string, rows []bigquery.ValueSaver) error {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for _, r := range rows {
+		row, _, err := r.Save()
+		if err != nil {
+			return err
+		}
+		line, err := json.Marshal(toJSONValue(row))
+		if err != nil {
+			return err
+		}
+		if _, err := file.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+
+	return file.Sync()
+}
+
+// toJSONValue prepares a value returned by a bigquery.ValueSaver for a json load job
+func toJSONValue(value bigquery.Value) interface{} {
+	switch v := value.(type) {
+	case map[string]bigquery.Value:
+		m := map[string]interface{}{}
+		for key, fieldValue := range v {
+			m[key] = toJSONValue(fieldValue)
+		}
+		return m
+	case []bigquery.Value:
+		s := make([]interface{}, len(v))
+		for i, elementValue := range v {
+			s[i] = toJSONValue(elementValue)
+		}
+		return s
+	case time.Time:
+		return v.UTC().Format(bigqueryJSONTimestampFormat)
+	case bigquery.NullTimestamp:
+		if !v.Valid {
+			return nil
+		}
+		return v.Timestamp.UTC().Format(bigqueryJSONTimestampFormat)
+	}
+
+	// null types marshal themselves to json
+	return value
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeLoadJSONFileClient struct {
+	BigQueryClient
+	jobIDs  []string
+	content []string
+	err     error
+}
+
+func (f *fakeLoadJSONFileClient) LoadJSONFile(ctx context.Context, dataset, table, path, jobID string) error {
+	data, _ := ioutil.ReadFile(path)
+	f.jobIDs = append(f.jobIDs, jobID)
+	f.content = append(f.content, string(data))
+	return f.err
+}
+
+func TestBigQueryBatchLoadClientInsertMeasurements(t *testing.T) {
+
+	t.Run("BuffersMeasurementsWithoutLoadingBeforeLoadInterval", func(t *testing.T) {
+
+		dir, _ := ioutil.TempDir("", "evohome-buffer")
+		defer os.RemoveAll(dir)
+		fake := &fakeLoadJSONFileClient{}
+		client := &bigQueryBatchLoadClientImpl{BigQueryClient: fake, bufferDir: dir, loadInterval: time.Hour}
+
+		// act
+		err := client.InsertMeasurements(context.Background(), "dataset", "measurements", []BigQueryMeasurement{BigQueryMeasurement{Location: "Thuis", MeasuredAt: time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC)}})
+
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(fake.jobIDs))
+		paths, _ := filepath.Glob(filepath.Join(dir, "measurements-*.ndjson"))
+		if assert.Equal(t, 1, len(paths)) {
+			data, _ := ioutil.ReadFile(paths[0])
+			assert.Contains(t, string(data), `"measured_at":"2020-11-01T12:00:00.000000Z"`)
+			assert.Contains(t, string(data), `"location":"Thuis"`)
+		}
+	})
+
+	t.Run("LoadsAndRemovesBufferOnceDue", func(t *testing.T) {
+
+		dir, _ := ioutil.TempDir("", "evohome-buffer")
+		defer os.RemoveAll(dir)
+		createdAt := time.Now().UTC().Add(-2 * time.Hour).Unix()
+		duePath := filepath.Join(dir, fmt.Sprintf("measurements-%v.ndjson", createdAt))
+		ioutil.WriteFile(duePath, []byte("{\"location\":\"Thuis\"}\n"), 0644)
+		fake := &fakeLoadJSONFileClient{}
+		client := &bigQueryBatchLoadClientImpl{BigQueryClient: fake, bufferDir: dir, loadInterval: time.Hour}
+
+		// act
+		err := client.InsertMeasurements(context.Background(), "dataset", "measurements", []BigQueryMeasurement{BigQueryMeasurement{Location: "Thuis"}})
+
+		assert.Nil(t, err)
+		assert.Equal(t, []string{fmt.Sprintf("evohome_bigquery_exporter_measurements_%v", createdAt)}, fake.jobIDs)
+		assert.Equal(t, []string{"{\"location\":\"Thuis\"}\n"}, fake.content)
+		_, statErr := os.Stat(duePath)
+		assert.True(t, os.IsNotExist(statErr))
+		paths, _ := filepath.Glob(filepath.Join(dir, "measurements-*.ndjson"))
+		assert.Equal(t, 1, len(paths))
+	})
+
+	t.Run("LeavesBuffersOfTablesWithLongerNamesAlone", func(t *testing.T) {
+
+		dir, _ := ioutil.TempDir("", "evohome-buffer")
+		defer os.RemoveAll(dir)
+		createdAt := time.Now().UTC().Add(-2 * time.Hour).Unix()
+		zonesPath := filepath.Join(dir, fmt.Sprintf("measurements-zones-%v.ndjson", createdAt))
+		ioutil.WriteFile(zonesPath, []byte("{\"zone\":\"Woonkamer\"}\n"), 0644)
+		fake := &fakeLoadJSONFileClient{}
+		client := &bigQueryBatchLoadClientImpl{BigQueryClient: fake, bufferDir: dir, loadInterval: time.Hour}
+
+		// act
+		err := client.InsertMeasurements(context.Background(), "dataset", "measurements", []BigQueryMeasurement{BigQueryMeasurement{Location: "Thuis"}})
+
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(fake.jobIDs))
+		_, statErr := os.Stat(zonesPath)
+		assert.Nil(t, statErr)
+	})
+
+	t.Run("RenamesBufferForRetryIfLoadJobFailed", func(t *testing.T) {
+
+		dir, _ := ioutil.TempDir("", "evohome-buffer")
+		defer os.RemoveAll(dir)
+		createdAt := time.Now().UTC().Add(-2 * time.Hour).Unix()
+		ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("measurements-%v.ndjson", createdAt)), []byte("{}\n"), 0644)
+		fake := &fakeLoadJSONFileClient{err: fmt.Errorf("%w: invalid row", ErrLoadJobFailed)}
+		client := &bigQueryBatchLoadClientImpl{BigQueryClient: fake, bufferDir: dir, loadInterval: time.Hour}
+
+		// act
+		err := client.InsertMeasurements(context.Background(), "dataset", "measurements", nil)
+
+		assert.NotNil(t, err)
+		paths, _ := filepath.Glob(filepath.Join(dir, "measurements-*.ndjson"))
+		if assert.Equal(t, 1, len(paths)) {
+			assert.True(t, strings.HasPrefix(filepath.Base(paths[0]), fmt.Sprintf("measurements-%v-r", createdAt)))
+		}
+	})
+}
+
+func TestToJSONValue(t *testing.T) {
+
+	t.Run("FormatsNestedTimestampsWithMicrosecondPrecision", func(t *testing.T) {
+
+		value := map[string]bigquery.Value{
+			"zones": []bigquery.Value{
+				map[string]bigquery.Value{"at": time.Date(2020, 11, 1, 12, 0, 0, 123456789, time.UTC)},
+			},
+		}
+
+		// act
+		jsonValue := toJSONValue(value)
+
+		assert.Equal(t, map[string]interface{}{"zones": []interface{}{map[string]interface{}{"at": "2020-11-01T12:00:00.123456Z"}}}, jsonValue)
+	})
+}
@@ -2,32 +2,74 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
 	"time"
 
 	"cloud.google.com/go/bigquery"
 	"github.com/rs/zerolog/log"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
 )
 
 // BigQueryClient is the interface for connecting to bigquery
 type BigQueryClient interface {
-	CheckIfDatasetExists(dataset string) bool
-	CheckIfTableExists(dataset, table string) bool
-	CreateTable(dataset, table string, typeForSchema interface{}, partitionField string, waitReady bool) error
-	UpdateTableSchema(dataset, table string, typeForSchema interface{}) error
-	DeleteTable(dataset, table string) error
-	InsertMeasurements(dataset, table string, measurements []BigQueryMeasurement) error
+	CheckIfDatasetExists(ctx context.Context, dataset string) bool
+	CheckIfTableExists(ctx context.Context, dataset, table string) bool
+	CreateDataset(ctx context.Context, dataset, location string) error
+	CreateTable(ctx context.Context, dataset, table string, typeForSchema interface{}, options TableOptions, waitReady bool) error
+	UpdateTableOptions(ctx context.Context, dataset, table string, options TableOptions) error
+	UpdateTableSchema(ctx context.Context, dataset, table string, typeForSchema interface{}) error
+	DeleteTable(ctx context.Context, dataset, table string) error
+	InsertMeasurements(ctx context.Context, dataset, table string, measurements []BigQueryMeasurement) error
+	GetMeasurementBuckets(ctx context.Context, dataset, table string, from, to time.Time, bucket time.Duration) (map[string]bool, error)
+	InsertZoneMeasurements(ctx context.Context, dataset, table string, zoneMeasurements []BigQueryZoneMeasurement) error
+	InsertRawResponses(ctx context.Context, dataset, table string, rawResponses []BigQueryRawResponse) error
+	CreateOrUpdateView(ctx context.Context, dataset, view, query string) error
+	GetLastModifiedTime(ctx context.Context, dataset, table string) (time.Time, error)
+	LoadJSONFile(ctx context.Context, dataset, table, path, jobID string) error
+	AddColumns(ctx context.Context, dataset, table string, fields bigquery.Schema) error
+	RunQuery(ctx context.Context, query string) error
+	CopyTable(ctx context.Context, dataset, source, destination string) error
+	GetSchemaMigrations(ctx context.Context, dataset, table string) ([]BigQuerySchemaMigration, error)
+	InsertSchemaMigration(ctx context.Context, dataset, table string, migration BigQuerySchemaMigration) error
+	GetOutdoorTemperatures(ctx context.Context, dataset, table, outdoorZoneName string, from, to time.Time) ([]BigQueryOutdoorTemperature, error)
+	MergeDegreeDays(ctx context.Context, dataset, table string, degreeDays []BigQueryDegreeDay) error
+	GetZoneSamples(ctx context.Context, dataset, table, outdoorZoneName string, from, to time.Time) ([]BigQueryZoneSample, error)
+	MergeThermalModels(ctx context.Context, dataset, table string, thermalModels []BigQueryThermalModel) error
+	MergeComfortSummaries(ctx context.Context, dataset, table string, summaries []BigQueryComfortSummary) error
+	GetBoilerSamples(ctx context.Context, dataset, table string, from, to time.Time) ([]BigQueryBoilerSample, error)
+	MergeBoilerRuntime(ctx context.Context, dataset, table string, runtimes []BigQueryBoilerRuntime) error
+	GetEvents(ctx context.Context, dataset, table string, since time.Time) ([]BigQueryEvent, error)
+	MergeEvents(ctx context.Context, dataset, table string, events []BigQueryEvent) error
+}
+
+var (
+	// ErrLoadJobFailed is returned if a load job ran but failed, meaning none of its rows were loaded
+	ErrLoadJobFailed = errors.New("The load job failed")
+)
+
+// TableOptions configures how a table is partitioned and clustered; a table without PartitionField isn't partitioned
+type TableOptions struct {
+	PartitionField         string
+	PartitionType          bigquery.TimePartitioningType
+	PartitionExpiration    time.Duration
+	RequirePartitionFilter bool
+	ClusteringFields       []string
 }
 
 type bigQueryClientImpl struct {
 	client *bigquery.Client
 }
 
-// NewBigQueryClient returns new BigQueryClient
-func NewBigQueryClient(projectID string) (BigQueryClient, error) {
-
-	ctx := context.Background()
+// NewBigQueryClient returns new BigQueryClient; opts can point it to another endpoint, like an emulator, or other credentials
+func NewBigQueryClient(ctx context.Context, projectID string, opts ...option.ClientOption) (BigQueryClient, error) {
 
-	bigqueryClient, err := bigquery.NewClient(ctx, projectID)
+	bigqueryClient, err := bigquery.NewClient(ctx, projectID, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -37,33 +79,46 @@ func NewBigQueryClient(projectID string) (BigQueryClient, error) {
 	}, nil
 }
 
-func (bqc *bigQueryClientImpl) CheckIfDatasetExists(dataset string) bool {
+func (bqc *bigQueryClientImpl) CheckIfDatasetExists(ctx context.Context, dataset string) bool {
 
 	ds := bqc.client.Dataset(dataset)
 
-	md, err := ds.Metadata(context.Background())
-
-	log.Error().Err(err).Msgf("Error retrieving metadata for dataset %v", dataset)
+	md, err := ds.Metadata(ctx)
+	if err != nil && !isNotFound(err) {
+		log.Error().Err(err).Msgf("Error retrieving metadata for dataset %v", dataset)
+	}
 
 	return md != nil
 }
 
-func (bqc *bigQueryClientImpl) CheckIfTableExists(dataset, table string) bool {
+func (bqc *bigQueryClientImpl) CheckIfTableExists(ctx context.Context, dataset, table string) bool {
 
 	tbl := bqc.client.Dataset(dataset).Table(table)
 
-	md, _ := tbl.Metadata(context.Background())
+	md, _ := tbl.Metadata(ctx)
 
 	// log.Error().Err(err).Msgf("Error retrieving metadata for table %v", table)
 
 	return md != nil
 }
 
-func (bqc *bigQueryClientImpl) CreateTable(dataset, table string, typeForSchema interface{}, partitionField string, waitReady bool) error {
+func (bqc *bigQueryClientImpl) CreateDataset(ctx context.Context, dataset, location string) error {
+	ds := bqc.client.Dataset(dataset)
+
+	err := ds.Create(ctx, &bigquery.DatasetMetadata{
+		Location: location,
+	})
+	if isAlreadyExists(err) {
+		return nil
+	}
+
+	return err
+}
+
+func (bqc *bigQueryClientImpl) CreateTable(ctx context.Context, dataset, table string, typeForSchema interface{}, options TableOptions, waitReady bool) error {
 	tbl := bqc.client.Dataset(dataset).Table(table)
 
-	// infer the schema of the type
-	schema, err := bigquery.InferSchema(typeForSchema)
+	schema, err := schemaFor(typeForSchema)
 	if err != nil {
 		return err
 	}
@@ -73,40 +128,51 @@ func (bqc *bigQueryClientImpl) CreateTable(dataset, table string, typeForSchema
 	}
 
 	// if partitionField is set use it for time partitioning
-	if partitionField != "" {
+	if options.PartitionField != "" {
 		tableMetadata.TimePartitioning = &bigquery.TimePartitioning{
-			Field: partitionField,
+			Field:      options.PartitionField,
+			Type:       options.PartitionType,
+			Expiration: options.PartitionExpiration,
+		}
+		tableMetadata.RequirePartitionFilter = options.RequirePartitionFilter
+	}
+	if len(options.ClusteringFields) > 0 {
+		tableMetadata.Clustering = &bigquery.Clustering{
+			Fields: options.ClusteringFields,
 		}
 	}
 
 	// create the table
-	err = tbl.Create(context.Background(), tableMetadata)
+	err = tbl.Create(ctx, tableMetadata)
 	if err != nil {
 		return err
 	}
 
 	if waitReady {
 		for {
-			if bqc.CheckIfTableExists(dataset, table) {
+			if bqc.CheckIfTableExists(ctx, dataset, table) {
 				break
 			}
-			time.Sleep(time.Second)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Second):
+			}
 		}
 	}
 
 	return nil
 }
 
-func (bqc *bigQueryClientImpl) UpdateTableSchema(dataset, table string, typeForSchema interface{}) error {
+func (bqc *bigQueryClientImpl) UpdateTableSchema(ctx context.Context, dataset, table string, typeForSchema interface{}) error {
 	tbl := bqc.client.Dataset(dataset).Table(table)
 
-	// infer the schema of the type
-	schema, err := bigquery.InferSchema(typeForSchema)
+	schema, err := schemaFor(typeForSchema)
 	if err != nil {
 		return err
 	}
 
-	meta, err := tbl.Metadata(context.Background())
+	meta, err := tbl.Metadata(ctx)
 	if err != nil {
 		return err
 	}
@@ -114,34 +180,671 @@ func (bqc *bigQueryClientImpl) UpdateTableSchema(dataset, table string, typeForS
 	update := bigquery.TableMetadataToUpdate{
 		Schema: schema,
 	}
-	if _, err := tbl.Update(context.Background(), update, meta.ETag); err != nil {
+	if _, err := tbl.Update(ctx, update, meta.ETag); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (bqc *bigQueryClientImpl) DeleteTable(dataset, table string) error {
+func (bqc *bigQueryClientImpl) UpdateTableOptions(ctx context.Context, dataset, table string, options TableOptions) error {
+	tbl := bqc.client.Dataset(dataset).Table(table)
+
+	meta, err := tbl.Metadata(ctx)
+	if err != nil {
+		return err
+	}
+
+	update, changed := tableOptionsUpdate(meta, options)
+	if !changed {
+		return nil
+	}
+
+	if _, err := tbl.Update(ctx, update, meta.ETag); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// tableOptionsUpdate returns the update to reconcile an existing table with the options; partitioning itself can't be changed without rewriting the table, so a mismatch is only logged
+func tableOptionsUpdate(meta *bigquery.TableMetadata, options TableOptions) (update bigquery.TableMetadataToUpdate, changed bool) {
+	partitioning := meta.TimePartitioning
+	if partitioning == nil {
+		if options.PartitionField != "" {
+			log.Warn().Msgf("Table %v isn't partitioned, it has to be rewritten to partition it by %v", meta.FullID, options.PartitionField)
+		}
+	} else {
+		partitionType := options.PartitionType
+		if partitionType == "" {
+			partitionType = bigquery.DayPartitioningType
+		}
+		if partitioning.Field != options.PartitionField || (partitioning.Type != "" && partitioning.Type != partitionType) {
+			log.Warn().Msgf("Table %v is partitioned by %v per %v, it has to be rewritten to partition it by %v per %v", meta.FullID, partitioning.Field, partitioning.Type, options.PartitionField, partitionType)
+		}
+
+		if partitioning.Expiration != options.PartitionExpiration {
+			// all mutable fields have to be set when updating partitioning; a zero expiration is sent as null, which removes it
+			update.TimePartitioning = &bigquery.TimePartitioning{
+				Field:      partitioning.Field,
+				Type:       partitioning.Type,
+				Expiration: options.PartitionExpiration,
+			}
+			changed = true
+		}
+
+		if meta.RequirePartitionFilter != options.RequirePartitionFilter {
+			update.RequirePartitionFilter = options.RequirePartitionFilter
+			changed = true
+		}
+	}
+
+	// clustering is only ever set or changed, never removed
+	if len(options.ClusteringFields) > 0 && (meta.Clustering == nil || !equalStrings(meta.Clustering.Fields, options.ClusteringFields)) {
+		update.Clustering = &bigquery.Clustering{
+			Fields: options.ClusteringFields,
+		}
+		changed = true
+	}
+
+	return
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (bqc *bigQueryClientImpl) DeleteTable(ctx context.Context, dataset, table string) error {
 	tbl := bqc.client.Dataset(dataset).Table(table)
 
 	// delete the table
-	err := tbl.Delete(context.Background())
+	err := tbl.Delete(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (bqc *bigQueryClientImpl) InsertMeasurements(ctx context.Context, dataset, table string, measurements []BigQueryMeasurement) error {
+	tbl := bqc.client.Dataset(dataset).Table(table)
+
+	u := tbl.Inserter()
+
+	if err := u.Put(ctx, measurements); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetMeasurementBuckets returns the account, location and time bucket of all measurements between from and to, formatted like BigQueryMeasurement.InsertID
+func (bqc *bigQueryClientImpl) GetMeasurementBuckets(ctx context.Context, dataset, table string, from, to time.Time, bucket time.Duration) (buckets map[string]bool, err error) {
+	bucketSeconds := int64(bucket / time.Second)
+	if bucketSeconds < 1 {
+		bucketSeconds = 1
+	}
+
+	query := bqc.client.Query(fmt.Sprintf(`SELECT DISTINCT
+  IFNULL(account, '') AS account,
+  IFNULL(location_id, 0) AS location_id,
+  IF(location_id IS NULL OR location_id = 0, location, '') AS location,
+  DIV(UNIX_SECONDS(measured_at), %v) * %v AS bucket
+FROM
+  `+"`%v.%v.%v`"+`
+WHERE
+  measured_at BETWEEN @from AND @to`, bucketSeconds, bucketSeconds, bqc.client.Project(), dataset, table))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "from", Value: from.UTC().Truncate(bucket)},
+		{Name: "to", Value: to.UTC()},
+	}
+
+	it, err := query.Read(ctx)
+	if err != nil {
+		return
+	}
 
+	buckets = map[string]bool{}
+	for {
+		var row struct {
+			Account    string `bigquery:"account"`
+			LocationID int    `bigquery:"location_id"`
+			Location   string `bigquery:"location"`
+			Bucket     int64  `bigquery:"bucket"`
+		}
+		err = it.Next(&row)
+		if err == iterator.Done {
+			return buckets, nil
+		}
+		if err != nil {
+			return
+		}
+		buckets[measurementIdentity(row.Account, row.LocationID, row.Location, row.Bucket)] = true
+	}
+}
+
+func (bqc *bigQueryClientImpl) InsertZoneMeasurements(ctx context.Context, dataset, table string, zoneMeasurements []BigQueryZoneMeasurement) error {
+	tbl := bqc.client.Dataset(dataset).Table(table)
+
+	u := tbl.Inserter()
+
+	if err := u.Put(ctx, zoneMeasurements); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (bqc *bigQueryClientImpl) InsertRawResponses(ctx context.Context, dataset, table string, rawResponses []BigQueryRawResponse) error {
+	tbl := bqc.client.Dataset(dataset).Table(table)
+
+	u := tbl.Inserter()
+
+	if err := u.Put(ctx, rawResponses); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (bqc *bigQueryClientImpl) CreateOrUpdateView(ctx context.Context, dataset, view, query string) error {
+	tbl := bqc.client.Dataset(dataset).Table(view)
+
+	meta, err := tbl.Metadata(ctx)
+	if isNotFound(err) {
+		return tbl.Create(ctx, &bigquery.TableMetadata{
+			ViewQuery: query,
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	if meta.ViewQuery == query {
+		return nil
+	}
+
+	update := bigquery.TableMetadataToUpdate{
+		ViewQuery: query,
+	}
+	if _, err := tbl.Update(ctx, update, meta.ETag); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (bqc *bigQueryClientImpl) GetLastModifiedTime(ctx context.Context, dataset, table string) (time.Time, error) {
+	tbl := bqc.client.Dataset(dataset).Table(table)
+
+	meta, err := tbl.Metadata(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return meta.LastModifiedTime, nil
+}
+
+func (bqc *bigQueryClientImpl) LoadJSONFile(ctx context.Context, dataset, table, path, jobID string) error {
+	tbl := bqc.client.Dataset(dataset).Table(table)
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	source := bigquery.NewReaderSource(file)
+	source.SourceFormat = bigquery.JSON
+
+	loader := tbl.LoaderFrom(source)
+	loader.JobID = jobID
+	loader.WriteDisposition = bigquery.WriteAppend
+
+	job, err := loader.Run(ctx)
+	if isAlreadyExists(err) {
+		// an earlier run already submitted this job, wait for it instead of loading the file twice
+		job, err = bqc.client.JobFromID(ctx, jobID)
+	}
 	if err != nil {
 		return err
 	}
 
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	if status.Err() != nil {
+		return fmt.Errorf("%w: %v", ErrLoadJobFailed, status.Err())
+	}
+
 	return nil
 }
 
-func (bqc *bigQueryClientImpl) InsertMeasurements(dataset, table string, measurements []BigQueryMeasurement) error {
+func (bqc *bigQueryClientImpl) AddColumns(ctx context.Context, dataset, table string, fields bigquery.Schema) error {
 	tbl := bqc.client.Dataset(dataset).Table(table)
 
-	u := tbl.Uploader()
+	meta, err := tbl.Metadata(ctx)
+	if err != nil {
+		return err
+	}
+
+	schema, changed := mergeFields(meta.Schema, fields)
+	if !changed {
+		return nil
+	}
 
-	if err := u.Put(context.Background(), measurements); err != nil {
+	update := bigquery.TableMetadataToUpdate{
+		Schema: schema,
+	}
+	if _, err := tbl.Update(ctx, update, meta.ETag); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+func (bqc *bigQueryClientImpl) RunQuery(ctx context.Context, query string) error {
+	job, err := bqc.client.Query(query).Run(ctx)
+	if err != nil {
+		return err
+	}
+
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return err
+	}
+
+	return status.Err()
+}
+
+func (bqc *bigQueryClientImpl) CopyTable(ctx context.Context, dataset, source, destination string) error {
+	ds := bqc.client.Dataset(dataset)
+
+	copier := ds.Table(destination).CopierFrom(ds.Table(source))
+	copier.WriteDisposition = bigquery.WriteTruncate
+
+	job, err := copier.Run(ctx)
+	if err != nil {
+		return err
+	}
+
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return err
+	}
+
+	return status.Err()
+}
+
+func (bqc *bigQueryClientImpl) GetSchemaMigrations(ctx context.Context, dataset, table string) (migrations []BigQuerySchemaMigration, err error) {
+	query := bqc.client.Query(fmt.Sprintf("SELECT version, description, applied_at FROM `%v.%v.%v` ORDER BY version", bqc.client.Project(), dataset, table))
+
+	it, err := query.Read(ctx)
+	if err != nil {
+		return
+	}
+
+	for {
+		var m BigQuerySchemaMigration
+		err = it.Next(&m)
+		if err == iterator.Done {
+			return migrations, nil
+		}
+		if err != nil {
+			return
+		}
+		migrations = append(migrations, m)
+	}
+}
+
+func (bqc *bigQueryClientImpl) InsertSchemaMigration(ctx context.Context, dataset, table string, migration BigQuerySchemaMigration) error {
+	// insert with dml instead of streaming, so the next run reads it back without waiting for the streaming buffer
+	query := bqc.client.Query(fmt.Sprintf("INSERT INTO `%v.%v.%v` (version, description, applied_at) VALUES (@version, @description, @applied_at)", bqc.client.Project(), dataset, table))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "version", Value: migration.Version},
+		{Name: "description", Value: migration.Description},
+		{Name: "applied_at", Value: migration.AppliedAt},
+	}
+
+	job, err := query.Run(ctx)
+	if err != nil {
+		return err
+	}
+
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return err
+	}
+
+	return status.Err()
+}
+
+func (bqc *bigQueryClientImpl) GetOutdoorTemperatures(ctx context.Context, dataset, table, outdoorZoneName string, from, to time.Time) (temperatures []BigQueryOutdoorTemperature, err error) {
+	query := bqc.client.Query(fmt.Sprintf(`SELECT
+  location,
+  location_id,
+  IFNULL(account, '') AS account,
+  measured_at,
+  zone.temperature AS temperature,
+  IFNULL(time_zone.id, '') AS time_zone_id,
+  IFNULL(time_zone.current_offset_minutes, 0) AS time_zone_offset_minutes
+FROM
+  `+"`%v.%v.%v`"+`,
+  UNNEST(zones) AS zone
+WHERE
+  measured_at BETWEEN @from AND @to
+  AND location_id IS NOT NULL
+  AND location_id != 0
+  AND zone.location = @outdoor_zone_name
+  AND zone.temperature IS NOT NULL
+ORDER BY
+  account,
+  location_id,
+  measured_at`, bqc.client.Project(), dataset, table))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "from", Value: from.UTC()},
+		{Name: "to", Value: to.UTC()},
+		{Name: "outdoor_zone_name", Value: outdoorZoneName},
+	}
+
+	it, err := query.Read(ctx)
+	if err != nil {
+		return
+	}
+
+	for {
+		var t BigQueryOutdoorTemperature
+		err = it.Next(&t)
+		if err == iterator.Done {
+			return temperatures, nil
+		}
+		if err != nil {
+			return
+		}
+		temperatures = append(temperatures, t)
+	}
+}
+
+func (bqc *bigQueryClientImpl) GetZoneSamples(ctx context.Context, dataset, table, outdoorZoneName string, from, to time.Time) (samples []BigQueryZoneSample, err error) {
+	query := bqc.client.Query(fmt.Sprintf(`SELECT
+  m.location,
+  m.location_id,
+  IFNULL(m.account, '') AS account,
+  zone.location AS zone,
+  m.measured_at,
+  zone.temperature,
+  zone.heat_setpoint,
+  zone.heat_demand,
+  (SELECT outdoor.temperature FROM UNNEST(m.zones) AS outdoor WHERE outdoor.location = @outdoor_zone_name LIMIT 1) AS outdoor_temperature,
+  IFNULL(m.time_zone.id, '') AS time_zone_id,
+  IFNULL(m.time_zone.current_offset_minutes, 0) AS time_zone_offset_minutes
+FROM
+  `+"`%v.%v.%v`"+` AS m,
+  UNNEST(m.zones) AS zone
+WHERE
+  m.measured_at BETWEEN @from AND @to
+  AND m.location_id IS NOT NULL
+  AND m.location_id != 0
+  AND zone.location != @outdoor_zone_name
+  AND zone.temperature IS NOT NULL
+ORDER BY
+  account,
+  location_id,
+  zone,
+  measured_at`, bqc.client.Project(), dataset, table))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "from", Value: from.UTC()},
+		{Name: "to", Value: to.UTC()},
+		{Name: "outdoor_zone_name", Value: outdoorZoneName},
+	}
+
+	it, err := query.Read(ctx)
+	if err != nil {
+		return
+	}
+
+	for {
+		var s BigQueryZoneSample
+		err = it.Next(&s)
+		if err == iterator.Done {
+			return samples, nil
+		}
+		if err != nil {
+			return
+		}
+		samples = append(samples, s)
+	}
+}
+
+func (bqc *bigQueryClientImpl) MergeDegreeDays(ctx context.Context, dataset, table string, degreeDays []BigQueryDegreeDay) error {
+	if len(degreeDays) == 0 {
+		return nil
+	}
+
+	return bqc.mergeRows(ctx, dataset, table, degreeDays, BigQueryDegreeDay{}, "account", "location_id", "day")
+}
+
+func (bqc *bigQueryClientImpl) MergeThermalModels(ctx context.Context, dataset, table string, thermalModels []BigQueryThermalModel) error {
+	if len(thermalModels) == 0 {
+		return nil
+	}
+
+	return bqc.mergeRows(ctx, dataset, table, thermalModels, BigQueryThermalModel{}, "account", "location_id", "zone", "week")
+}
+
+func (bqc *bigQueryClientImpl) MergeComfortSummaries(ctx context.Context, dataset, table string, summaries []BigQueryComfortSummary) error {
+	if len(summaries) == 0 {
+		return nil
+	}
+
+	return bqc.mergeRows(ctx, dataset, table, summaries, BigQueryComfortSummary{}, "account", "location_id", "zone", "day")
+}
+
+func (bqc *bigQueryClientImpl) GetBoilerSamples(ctx context.Context, dataset, table string, from, to time.Time) (samples []BigQueryBoilerSample, err error) {
+	query := bqc.client.Query(fmt.Sprintf(`SELECT
+  location,
+  location_id,
+  IFNULL(account, '') AS account,
+  measured_at,
+  boiler_heat_demand
+FROM
+  `+"`%v.%v.%v`"+`
+WHERE
+  measured_at BETWEEN @from AND @to
+  AND location_id IS NOT NULL
+  AND location_id != 0
+  AND boiler_heat_demand IS NOT NULL
+ORDER BY
+  account,
+  location_id,
+  measured_at`, bqc.client.Project(), dataset, table))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "from", Value: from.UTC()},
+		{Name: "to", Value: to.UTC()},
+	}
+
+	it, err := query.Read(ctx)
+	if err != nil {
+		return
+	}
+
+	for {
+		var s BigQueryBoilerSample
+		err = it.Next(&s)
+		if err == iterator.Done {
+			return samples, nil
+		}
+		if err != nil {
+			return
+		}
+		samples = append(samples, s)
+	}
+}
+
+func (bqc *bigQueryClientImpl) MergeBoilerRuntime(ctx context.Context, dataset, table string, runtimes []BigQueryBoilerRuntime) error {
+	if len(runtimes) == 0 {
+		return nil
+	}
+
+	return bqc.mergeRows(ctx, dataset, table, runtimes, BigQueryBoilerRuntime{}, "account", "location_id", "hour")
+}
+
+func (bqc *bigQueryClientImpl) GetEvents(ctx context.Context, dataset, table string, since time.Time) (events []BigQueryEvent, err error) {
+	query := bqc.client.Query(fmt.Sprintf("SELECT * FROM `%v.%v.%v` WHERE started_at >= @since ORDER BY started_at", bqc.client.Project(), dataset, table))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "since", Value: since.UTC()},
+	}
+
+	it, err := query.Read(ctx)
+	if err != nil {
+		return
+	}
+
+	for {
+		var e BigQueryEvent
+		err = it.Next(&e)
+		if err == iterator.Done {
+			return events, nil
+		}
+		if err != nil {
+			return
+		}
+		events = append(events, e)
+	}
+}
+
+func (bqc *bigQueryClientImpl) MergeEvents(ctx context.Context, dataset, table string, events []BigQueryEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	return bqc.mergeRows(ctx, dataset, table, events, BigQueryEvent{}, "account", "location_id", "zone", "type", "started_at")
+}
+
+// mergeRows updates the rows matching on keyColumns and inserts the others; it uses dml instead of streaming, so rows written earlier are updated in place, which isn't possible for rows in the streaming buffer
+func (bqc *bigQueryClientImpl) mergeRows(ctx context.Context, dataset, table string, rows interface{}, typeForSchema interface{}, keyColumns ...string) error {
+	schema, err := schemaFor(typeForSchema)
+	if err != nil {
+		return err
+	}
+
+	query := bqc.client.Query(mergeQuery(fmt.Sprintf("`%v.%v.%v`", bqc.client.Project(), dataset, table), schema, keyColumns))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "rows", Value: rows},
+	}
+
+	job, err := query.Run(ctx)
+	if err != nil {
+		return err
+	}
+
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return err
+	}
+
+	return status.Err()
+}
+
+// mergeQuery returns a merge statement of the @rows parameter into the table, matching rows on keyColumns and updating all other columns of the schema
+func mergeQuery(table string, schema bigquery.Schema, keyColumns []string) string {
+	isKey := map[string]bool{}
+	conditions := make([]string, len(keyColumns))
+	for i, c := range keyColumns {
+		isKey[c] = true
+		conditions[i] = fmt.Sprintf("t.%v = s.%v", c, c)
+	}
+
+	updates := []string{}
+	for _, f := range schema {
+		if !isKey[f.Name] {
+			updates = append(updates, fmt.Sprintf("  %v = s.%v", f.Name, f.Name))
+		}
+	}
+
+	merge := fmt.Sprintf(`MERGE %v AS t
+USING UNNEST(@rows) AS s
+ON %v
+WHEN MATCHED THEN UPDATE SET
+%v
+WHEN NOT MATCHED THEN INSERT ROW`, table, strings.Join(conditions, " AND "), strings.Join(updates, ",\n"))
+	if !isKey["account"] {
+		return merge
+	}
+
+	// rows written before the account was part of the key have none, they're replaced by the merged rows with the same other keys
+	legacyConditions := []string{}
+	for i, c := range keyColumns {
+		if c != "account" {
+			legacyConditions = append(legacyConditions, conditions[i])
+		}
+	}
+
+	return fmt.Sprintf(`DELETE FROM %v AS t
+WHERE t.account IS NULL AND EXISTS (SELECT 1 FROM UNNEST(@rows) AS s WHERE %v);
+%v`, table, strings.Join(legacyConditions, " AND "), merge)
+}
+
+// schemaFor returns typeForSchema itself if it's an explicit schema, otherwise the schema inferred from it
+func schemaFor(typeForSchema interface{}) (bigquery.Schema, error) {
+	if schema, ok := typeForSchema.(bigquery.Schema); ok {
+		return schema, nil
+	}
+
+	return bigquery.InferSchema(typeForSchema)
+}
+
+// mergeFields appends the fields that don't exist in schema yet, recursing into records that do exist, so adding columns can be retried safely
+func mergeFields(schema, fields bigquery.Schema) (merged bigquery.Schema, changed bool) {
+	merged = append(bigquery.Schema{}, schema...)
+	for _, f := range fields {
+		existing := findField(merged, f.Name)
+		if existing < 0 {
+			merged = append(merged, f)
+			changed = true
+			continue
+		}
+		if f.Type == bigquery.RecordFieldType && merged[existing].Type == bigquery.RecordFieldType {
+			nested, nestedChanged := mergeFields(merged[existing].Schema, f.Schema)
+			if nestedChanged {
+				record := *merged[existing]
+				record.Schema = nested
+				merged[existing] = &record
+				changed = true
+			}
+		}
+	}
+
+	return
+}
+
+func findField(schema bigquery.Schema, name string) int {
+	for i, f := range schema {
+		if f.Name == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func isAlreadyExists(err error) bool {
+	apiError, ok := err.(*googleapi.Error)
+	return ok && apiError.Code == http.StatusConflict
+}
+
+func isNotFound(err error) bool {
+	apiError, ok := err.(*googleapi.Error)
+	return ok && apiError.Code == http.StatusNotFound
+}
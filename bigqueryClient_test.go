@@ -1,103 +1,161 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"cloud.google.com/go/bigquery"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/option"
 )
 
 func TestCheckIfDatasetExists(t *testing.T) {
 
 	t.Run("ReturnsTrueIfDatasetExists", func(t *testing.T) {
 
-		if testing.Short() {
-			t.Skip("skipping test in short mode.")
-		}
-
-		client, _ := NewBigQueryClient(os.Getenv("BQ_PROJECT_ID"))
+		client, _ := newFakeBigQueryClient(t)
 
 		// act
-		exists := client.CheckIfDatasetExists(os.Getenv("BQ_DATASET"))
+		exists := client.CheckIfDatasetExists(context.Background(), "dataset")
 
 		assert.True(t, exists)
 	})
+
+	t.Run("ReturnsFalseIfDatasetDoesNotExist", func(t *testing.T) {
+
+		client, _ := newFakeBigQueryClient(t)
+
+		// act
+		exists := client.CheckIfDatasetExists(context.Background(), "other_dataset")
+
+		assert.False(t, exists)
+	})
 }
 
 func TestCheckIfTableExists(t *testing.T) {
 
 	t.Run("ReturnsFalseIfTableDoesNotExist", func(t *testing.T) {
 
-		if testing.Short() {
-			t.Skip("skipping test in short mode.")
-		}
-
-		client, _ := NewBigQueryClient(os.Getenv("BQ_PROJECT_ID"))
+		client, _ := newFakeBigQueryClient(t)
 
 		// act
-		exists := client.CheckIfTableExists(os.Getenv("BQ_DATASET"), "evohome_test")
+		exists := client.CheckIfTableExists(context.Background(), "dataset", "evohome_test")
 
 		assert.False(t, exists)
 	})
 
 	t.Run("ReturnsTrueIfTableExists", func(t *testing.T) {
 
-		if testing.Short() {
-			t.Skip("skipping test in short mode.")
-		}
-
-		client, _ := NewBigQueryClient(os.Getenv("BQ_PROJECT_ID"))
-		client.CreateTable(os.Getenv("BQ_DATASET"), "evohome_test", BigQueryMeasurement{}, "measured_at", true)
+		client, _ := newFakeBigQueryClient(t)
+		client.CreateTable(context.Background(), "dataset", "evohome_test", BigQueryMeasurement{}, TableOptions{PartitionField: "measured_at"}, true)
 
 		// act
-		exists := client.CheckIfTableExists(os.Getenv("BQ_DATASET"), "evohome_test")
+		exists := client.CheckIfTableExists(context.Background(), "dataset", "evohome_test")
 
 		assert.True(t, exists)
-
-		// cleanup
-		client.DeleteTable(os.Getenv("BQ_DATASET"), "evohome_test")
 	})
 }
 
-// export BQ_PROJECT_ID=...
-// export BQ_DATASET=...
 func TestCreateTable(t *testing.T) {
 
 	t.Run("CreatesTableIfTableDoesNotExistYet", func(t *testing.T) {
 
-		if testing.Short() {
-			t.Skip("skipping test in short mode.")
+		client, fake := newFakeBigQueryClient(t)
+
+		// act
+		err := client.CreateTable(context.Background(), "dataset", "evohome_test", BigQueryMeasurement{}, TableOptions{PartitionField: "measured_at", ClusteringFields: []string{"location"}}, false)
+
+		assert.Nil(t, err)
+		table := fake.table("evohome_test")
+		if assert.NotNil(t, table) {
+			assert.Equal(t, "measured_at", table.metadata.TimePartitioning.Field)
+			assert.Equal(t, []string{"location"}, table.metadata.Clustering.Fields)
+			assert.Equal(t, "location_id", table.metadata.Schema.Fields[1].Name)
 		}
+	})
 
-		client, _ := NewBigQueryClient(os.Getenv("BQ_PROJECT_ID"))
+	t.Run("ErrorsIfTableAlreadyExists", func(t *testing.T) {
+
+		client, _ := newFakeBigQueryClient(t)
+		client.CreateTable(context.Background(), "dataset", "evohome_test", BigQueryMeasurement{}, TableOptions{PartitionField: "measured_at"}, false)
 
 		// act
-		err := client.CreateTable(os.Getenv("BQ_DATASET"), "evohome_test", BigQueryMeasurement{}, "measured_at", false)
+		err := client.CreateTable(context.Background(), "dataset", "evohome_test", BigQueryMeasurement{}, TableOptions{PartitionField: "measured_at"}, false)
 
-		assert.Nil(t, err)
+		assert.NotNil(t, err)
+	})
+}
+
+func TestUpdateTableSchema(t *testing.T) {
+
+	t.Run("AddsNullableColumn", func(t *testing.T) {
+
+		client, fake := newFakeBigQueryClient(t)
+		client.CreateTable(context.Background(), "dataset", "evohome_test", measurementsSchemaV1, TableOptions{PartitionField: "measured_at"}, false)
+		schema := append(bigquery.Schema{}, measurementsSchemaV1...)
+		schema = append(schema, &bigquery.FieldSchema{Name: "location_id", Type: bigquery.IntegerFieldType})
 
-		// cleanup
-		client.DeleteTable(os.Getenv("BQ_DATASET"), "evohome_test")
+		// act
+		err := client.UpdateTableSchema(context.Background(), "dataset", "evohome_test", schema)
+
+		assert.Nil(t, err)
+		assert.Equal(t, len(measurementsSchemaV1)+1, len(fake.table("evohome_test").metadata.Schema.Fields))
 	})
 
-	t.Run("ErrorsIfTableAlreadyExists", func(t *testing.T) {
+	t.Run("ErrorsWhenAddingRequiredColumn", func(t *testing.T) {
 
-		if testing.Short() {
-			t.Skip("skipping test in short mode.")
-		}
+		client, _ := newFakeBigQueryClient(t)
+		client.CreateTable(context.Background(), "dataset", "evohome_test", measurementsSchemaV1, TableOptions{PartitionField: "measured_at"}, false)
+
+		// act
+		err := client.UpdateTableSchema(context.Background(), "dataset", "evohome_test", BigQueryMeasurement{})
 
-		client, _ := NewBigQueryClient(os.Getenv("BQ_PROJECT_ID"))
-		client.CreateTable(os.Getenv("BQ_DATASET"), "evohome_test", BigQueryMeasurement{}, "measured_at", false)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("ErrorsWhenRemovingColumn", func(t *testing.T) {
+
+		client, _ := newFakeBigQueryClient(t)
+		client.CreateTable(context.Background(), "dataset", "evohome_test", BigQueryMeasurement{}, TableOptions{PartitionField: "measured_at"}, false)
 
 		// act
-		err := client.CreateTable(os.Getenv("BQ_DATASET"), "evohome_test", BigQueryMeasurement{}, "measured_at", false)
+		err := client.UpdateTableSchema(context.Background(), "dataset", "evohome_test", measurementsSchemaV1)
 
 		assert.NotNil(t, err)
+	})
+}
+
+func TestDeleteTable(t *testing.T) {
+
+	t.Run("DeletesExistingTable", func(t *testing.T) {
 
-		// cleanup
-		client.DeleteTable(os.Getenv("BQ_DATASET"), "evohome_test")
+		client, fake := newFakeBigQueryClient(t)
+		client.CreateTable(context.Background(), "dataset", "evohome_test", BigQueryMeasurement{}, TableOptions{PartitionField: "measured_at"}, false)
+
+		// act
+		err := client.DeleteTable(context.Background(), "dataset", "evohome_test")
+
+		assert.Nil(t, err)
+		assert.Nil(t, fake.table("evohome_test"))
+	})
+
+	t.Run("ErrorsIfTableDoesNotExist", func(t *testing.T) {
+
+		client, _ := newFakeBigQueryClient(t)
+
+		// act
+		err := client.DeleteTable(context.Background(), "dataset", "evohome_test")
+
+		assert.NotNil(t, err)
 	})
 }
 
@@ -105,12 +163,8 @@ func TestInsertMeasurements(t *testing.T) {
 
 	t.Run("InsertMeasurementWithNullValuesForTemperatureAndHeatSetpointAndHumidityForAllZones", func(t *testing.T) {
 
-		if testing.Short() {
-			t.Skip("skipping test in short mode.")
-		}
-
-		client, _ := NewBigQueryClient(os.Getenv("BQ_PROJECT_ID"))
-		client.CreateTable(os.Getenv("BQ_DATASET"), "evohome_test", BigQueryMeasurement{}, "measured_at", true)
+		client, fake := newFakeBigQueryClient(t)
+		client.CreateTable(context.Background(), "dataset", "evohome_test", BigQueryMeasurement{}, TableOptions{PartitionField: "measured_at"}, true)
 		measurements := []BigQueryMeasurement{
 			BigQueryMeasurement{
 				Location:   "here",
@@ -143,22 +197,21 @@ func TestInsertMeasurements(t *testing.T) {
 		}
 
 		// act
-		err := client.InsertMeasurements(os.Getenv("BQ_DATASET"), "evohome_test", measurements)
+		err := client.InsertMeasurements(context.Background(), "dataset", "evohome_test", measurements)
 
 		assert.Nil(t, err)
-
-		// cleanup
-		client.DeleteTable(os.Getenv("BQ_DATASET"), "evohome_test")
+		rows := fake.table("evohome_test").rows
+		if assert.Equal(t, 1, len(rows)) {
+			zones := rows[0].JSON["zones"].([]interface{})
+			assert.Equal(t, 3, len(zones))
+			assert.Nil(t, zones[0].(map[string]interface{})["temperature"])
+		}
 	})
 
 	t.Run("InsertMeasurementWithValuesForTemperatureAndHeatSetpointAndHumidityForAllZones", func(t *testing.T) {
 
-		if testing.Short() {
-			t.Skip("skipping test in short mode.")
-		}
-
-		client, _ := NewBigQueryClient(os.Getenv("BQ_PROJECT_ID"))
-		client.CreateTable(os.Getenv("BQ_DATASET"), "evohome_test", BigQueryMeasurement{}, "measured_at", true)
+		client, fake := newFakeBigQueryClient(t)
+		client.CreateTable(context.Background(), "dataset", "evohome_test", BigQueryMeasurement{}, TableOptions{PartitionField: "measured_at"}, true)
 		measurements := []BigQueryMeasurement{
 			BigQueryMeasurement{
 				Location:   "here",
@@ -191,12 +244,29 @@ func TestInsertMeasurements(t *testing.T) {
 		}
 
 		// act
-		err := client.InsertMeasurements(os.Getenv("BQ_DATASET"), "evohome_test", measurements)
+		err := client.InsertMeasurements(context.Background(), "dataset", "evohome_test", measurements)
 
 		assert.Nil(t, err)
+		rows := fake.table("evohome_test").rows
+		if assert.Equal(t, 1, len(rows)) {
+			assert.Equal(t, measurements[0].InsertID(), rows[0].InsertID)
+			zones := rows[0].JSON["zones"].([]interface{})
+			assert.Equal(t, 19.6, zones[0].(map[string]interface{})["temperature"])
+		}
+	})
+
+	t.Run("ErrorsIfTableDoesNotHaveColumn", func(t *testing.T) {
+
+		client, _ := newFakeBigQueryClient(t)
+		client.CreateTable(context.Background(), "dataset", "evohome_test", measurementsSchemaV1, TableOptions{PartitionField: "measured_at"}, true)
+		measurements := []BigQueryMeasurement{
+			BigQueryMeasurement{Location: "here", LocationID: 1234, MeasuredAt: time.Now().UTC(), InsertedAt: time.Now().UTC()},
+		}
+
+		// act
+		err := client.InsertMeasurements(context.Background(), "dataset", "evohome_test", measurements)
 
-		// cleanup
-		client.DeleteTable(os.Getenv("BQ_DATASET"), "evohome_test")
+		assert.NotNil(t, err)
 	})
 }
 
@@ -208,22 +278,386 @@ func TestEndToEnd(t *testing.T) {
 			t.Skip("skipping test in short mode.")
 		}
 
-		bqClient, _ := NewBigQueryClient(os.Getenv("BQ_PROJECT_ID"))
-		bqClient.CreateTable(os.Getenv("BQ_DATASET"), "evohome_test", BigQueryMeasurement{}, "measured_at", true)
-		evoClient, _ := NewEvohomeClient()
+		bqClient, fake := newFakeBigQueryClient(t)
+		bqClient.CreateTable(context.Background(), "dataset", "evohome_test", BigQueryMeasurement{}, TableOptions{PartitionField: "measured_at"}, true)
+		evoClient, _ := NewEvohomeClient("", 10, time.Minute)
 
 		// act
-		sessionID, userID, _ := evoClient.GetSession(os.Getenv("EVOHOME_USERNAME"), os.Getenv("EVOHOME_PASSWORD"))
-		locations, _ := evoClient.GetLocations(sessionID, userID)
+		sessionID, userID, _ := evoClient.GetSession(context.Background(), os.Getenv("EVOHOME_USERNAME"), os.Getenv("EVOHOME_PASSWORD"))
+		locations, _ := evoClient.GetLocations(context.Background(), sessionID, userID)
 
-		measurements := mapLocationsToMeasurements(locations, "outside", nil)
+		measurements := mapLocationsToMeasurements(locations, "outside", nil, time.Now().UTC())
 
 		// act
-		err := bqClient.InsertMeasurements(os.Getenv("BQ_DATASET"), "evohome_test", measurements)
+		err := bqClient.InsertMeasurements(context.Background(), "dataset", "evohome_test", measurements)
 
 		assert.Nil(t, err)
+		assert.Equal(t, len(measurements), len(fake.table("evohome_test").rows))
+	})
+}
+
+func TestUpdateTableOptions(t *testing.T) {
+
+	t.Run("ClearsPartitionExpirationSetToZero", func(t *testing.T) {
+
+		client, fake := newFakeBigQueryClient(t)
+		client.CreateTable(context.Background(), "dataset", "evohome_test", BigQueryMeasurement{}, TableOptions{PartitionField: "measured_at", PartitionExpiration: 30 * 24 * time.Hour}, false)
+		assert.Equal(t, "2592000000", fake.table("evohome_test").metadata.TimePartitioning.ExpirationMs)
+
+		// act
+		err := client.UpdateTableOptions(context.Background(), "dataset", "evohome_test", TableOptions{PartitionField: "measured_at"})
+
+		assert.Nil(t, err)
+		if assert.NotNil(t, fake.table("evohome_test").metadata.TimePartitioning) {
+			assert.Equal(t, "measured_at", fake.table("evohome_test").metadata.TimePartitioning.Field)
+			assert.Equal(t, "", fake.table("evohome_test").metadata.TimePartitioning.ExpirationMs)
+		}
+	})
+}
+
+func TestTableOptionsUpdate(t *testing.T) {
+
+	t.Run("ReturnsNoChangeIfTableMatchesOptions", func(t *testing.T) {
+
+		meta := &bigquery.TableMetadata{
+			TimePartitioning: &bigquery.TimePartitioning{Field: "measured_at", Type: bigquery.DayPartitioningType},
+			Clustering:       &bigquery.Clustering{Fields: []string{"location"}},
+		}
+
+		// act
+		_, changed := tableOptionsUpdate(meta, TableOptions{PartitionField: "measured_at", PartitionType: bigquery.DayPartitioningType, ClusteringFields: []string{"location"}})
+
+		assert.False(t, changed)
+	})
+
+	t.Run("UpdatesExpirationAndKeepsPartitioning", func(t *testing.T) {
+
+		meta := &bigquery.TableMetadata{
+			TimePartitioning: &bigquery.TimePartitioning{Field: "measured_at", Type: bigquery.DayPartitioningType},
+		}
+
+		// act
+		update, changed := tableOptionsUpdate(meta, TableOptions{PartitionField: "measured_at", PartitionExpiration: 30 * 24 * time.Hour})
+
+		assert.True(t, changed)
+		if assert.NotNil(t, update.TimePartitioning) {
+			assert.Equal(t, "measured_at", update.TimePartitioning.Field)
+			assert.Equal(t, bigquery.DayPartitioningType, update.TimePartitioning.Type)
+			assert.Equal(t, 30*24*time.Hour, update.TimePartitioning.Expiration)
+		}
+		assert.Nil(t, update.RequirePartitionFilter)
+		assert.Nil(t, update.Clustering)
+	})
+
+	t.Run("UpdatesRequirePartitionFilterAndClustering", func(t *testing.T) {
+
+		meta := &bigquery.TableMetadata{
+			TimePartitioning: &bigquery.TimePartitioning{Field: "measured_at"},
+		}
+
+		// act
+		update, changed := tableOptionsUpdate(meta, TableOptions{PartitionField: "measured_at", RequirePartitionFilter: true, ClusteringFields: []string{"location"}})
+
+		assert.True(t, changed)
+		assert.Equal(t, true, update.RequirePartitionFilter)
+		if assert.NotNil(t, update.Clustering) {
+			assert.Equal(t, []string{"location"}, update.Clustering.Fields)
+		}
+	})
+
+	t.Run("KeepsExistingClusteringIfNoneIsConfigured", func(t *testing.T) {
+
+		meta := &bigquery.TableMetadata{
+			TimePartitioning: &bigquery.TimePartitioning{Field: "measured_at"},
+			Clustering:       &bigquery.Clustering{Fields: []string{"location"}},
+		}
+
+		// act
+		_, changed := tableOptionsUpdate(meta, TableOptions{PartitionField: "measured_at"})
+
+		assert.False(t, changed)
+	})
+}
+
+// fakeBigQueryServer implements the parts of the BigQuery REST api the client uses for managing tables and streaming inserts, so the client can be tested without a Google Cloud project
+type fakeBigQueryServer struct {
+	mu       sync.Mutex
+	datasets map[string]bool
+	tables   map[string]*fakeBigQueryTable
+}
+
+type fakeBigQueryTable struct {
+	metadata fakeBigQueryTableMetadata
+	etag     int
+	rows     []fakeBigQueryRow
+}
+
+type fakeBigQueryTableMetadata struct {
+	TableReference struct {
+		ProjectID string `json:"projectId"`
+		DatasetID string `json:"datasetId"`
+		TableID   string `json:"tableId"`
+	} `json:"tableReference"`
+	Schema struct {
+		Fields []fakeBigQueryField `json:"fields"`
+	} `json:"schema"`
+	TimePartitioning *struct {
+		Field        string `json:"field,omitempty"`
+		Type         string `json:"type,omitempty"`
+		ExpirationMs string `json:"expirationMs,omitempty"`
+	} `json:"timePartitioning,omitempty"`
+	Clustering *struct {
+		Fields []string `json:"fields"`
+	} `json:"clustering,omitempty"`
+	RequirePartitionFilter bool `json:"requirePartitionFilter,omitempty"`
+}
+
+type fakeBigQueryField struct {
+	Name   string              `json:"name"`
+	Type   string              `json:"type"`
+	Mode   string              `json:"mode,omitempty"`
+	Fields []fakeBigQueryField `json:"fields,omitempty"`
+}
+
+type fakeBigQueryRow struct {
+	InsertID string                 `json:"insertId"`
+	JSON     map[string]interface{} `json:"json"`
+}
+
+// newFakeBigQueryClient returns a client for a fake server with the project project and an empty dataset dataset; the server is stopped when the test ends, so no tables are left behind
+func newFakeBigQueryClient(t *testing.T) (BigQueryClient, *fakeBigQueryServer) {
+	fake := &fakeBigQueryServer{
+		datasets: map[string]bool{"dataset": true},
+		tables:   map[string]*fakeBigQueryTable{},
+	}
+
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	client, err := NewBigQueryClient(context.Background(), "project", option.WithEndpoint(server.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client, fake
+}
+
+func (f *fakeBigQueryServer) table(name string) *fakeBigQueryTable {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.tables["dataset."+name]
+}
+
+func (f *fakeBigQueryServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// paths look like /projects/<project>/datasets/<dataset>[/tables[/<table>[/insertAll]]]
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 4 || parts[0] != "projects" || parts[2] != "datasets" {
+		writeFakeBigQueryError(w, http.StatusNotImplemented, fmt.Sprintf("%v %v is not implemented", r.Method, r.URL.Path))
+		return
+	}
+	dataset := parts[3]
+	if !f.datasets[dataset] {
+		writeFakeBigQueryError(w, http.StatusNotFound, "Not found: Dataset "+dataset)
+		return
+	}
+
+	switch {
+	case len(parts) == 4 && r.Method == http.MethodGet:
+		writeFakeBigQueryJSON(w, map[string]interface{}{"datasetReference": map[string]string{"projectId": parts[1], "datasetId": dataset}})
+
+	case len(parts) == 5 && r.Method == http.MethodPost:
+		var metadata fakeBigQueryTableMetadata
+		json.NewDecoder(r.Body).Decode(&metadata)
+		key := dataset + "." + metadata.TableReference.TableID
+		if _, ok := f.tables[key]; ok {
+			writeFakeBigQueryError(w, http.StatusConflict, "Already Exists: Table "+key)
+			return
+		}
+		f.tables[key] = &fakeBigQueryTable{metadata: metadata, etag: 1}
+		f.tables[key].write(w)
+
+	case len(parts) >= 6:
+		key := dataset + "." + parts[5]
+		table, ok := f.tables[key]
+		if !ok {
+			writeFakeBigQueryError(w, http.StatusNotFound, "Not found: Table "+key)
+			return
+		}
+
+		switch {
+		case len(parts) == 6 && r.Method == http.MethodGet:
+			table.write(w)
+
+		case len(parts) == 6 && r.Method == http.MethodDelete:
+			delete(f.tables, key)
+			w.WriteHeader(http.StatusNoContent)
+
+		case len(parts) == 6 && r.Method == http.MethodPatch:
+			var update fakeBigQueryTableMetadata
+			body, _ := ioutil.ReadAll(r.Body)
+			json.Unmarshal(body, &update)
+			if strings.Contains(string(body), `"schema"`) {
+				if err := checkFakeBigQuerySchemaUpdate(table.metadata.Schema.Fields, update.Schema.Fields); err != nil {
+					writeFakeBigQueryError(w, http.StatusBadRequest, err.Error())
+					return
+				}
+				table.metadata.Schema = update.Schema
+			}
+			if update.TimePartitioning != nil {
+				// like BigQuery, an expiration missing from the update is kept, only a null one removes it
+				var fields struct {
+					TimePartitioning map[string]json.RawMessage `json:"timePartitioning"`
+				}
+				json.Unmarshal(body, &fields)
+				if _, ok := fields.TimePartitioning["expirationMs"]; !ok && table.metadata.TimePartitioning != nil {
+					update.TimePartitioning.ExpirationMs = table.metadata.TimePartitioning.ExpirationMs
+				}
+				table.metadata.TimePartitioning = update.TimePartitioning
+			}
+			if update.Clustering != nil {
+				table.metadata.Clustering = update.Clustering
+			}
+			table.etag++
+			table.write(w)
+
+		case len(parts) == 7 && parts[6] == "insertAll" && r.Method == http.MethodPost:
+			var request struct {
+				Rows []fakeBigQueryRow `json:"rows"`
+			}
+			json.NewDecoder(r.Body).Decode(&request)
+			insertErrors := []interface{}{}
+			for i, row := range request.Rows {
+				if err := checkFakeBigQueryRow(table.metadata.Schema.Fields, row.JSON); err != nil {
+					insertErrors = append(insertErrors, map[string]interface{}{"index": i, "errors": []map[string]string{{"reason": "invalid", "message": err.Error()}}})
+				}
+			}
+			if len(insertErrors) > 0 {
+				writeFakeBigQueryJSON(w, map[string]interface{}{"insertErrors": insertErrors})
+				return
+			}
+			table.rows = append(table.rows, request.Rows...)
+			writeFakeBigQueryJSON(w, map[string]interface{}{})
+
+		default:
+			writeFakeBigQueryError(w, http.StatusNotImplemented, fmt.Sprintf("%v %v is not implemented", r.Method, r.URL.Path))
+		}
+
+	default:
+		writeFakeBigQueryError(w, http.StatusNotImplemented, fmt.Sprintf("%v %v is not implemented", r.Method, r.URL.Path))
+	}
+}
+
+func (t *fakeBigQueryTable) write(w http.ResponseWriter) {
+	data, _ := json.Marshal(t.metadata)
+	response := map[string]interface{}{}
+	json.Unmarshal(data, &response)
+	response["etag"] = fmt.Sprint(t.etag)
+	response["type"] = "TABLE"
+	response["id"] = t.metadata.TableReference.ProjectID + ":" + t.metadata.TableReference.DatasetID + "." + t.metadata.TableReference.TableID
+	writeFakeBigQueryJSON(w, response)
+}
+
+// checkFakeBigQuerySchemaUpdate only allows adding nullable or repeated fields, like BigQuery itself
+func checkFakeBigQuerySchemaUpdate(current, updated []fakeBigQueryField) error {
+	updatedByName := map[string]fakeBigQueryField{}
+	for _, f := range updated {
+		updatedByName[f.Name] = f
+	}
+	currentByName := map[string]fakeBigQueryField{}
+	for _, f := range current {
+		currentByName[f.Name] = f
+		u, ok := updatedByName[f.Name]
+		if !ok {
+			return fmt.Errorf("Provided Schema does not match Table. Field %v is missing in new schema", f.Name)
+		}
+		if u.Type != f.Type {
+			return fmt.Errorf("Provided Schema does not match Table. Field %v has changed type from %v to %v", f.Name, f.Type, u.Type)
+		}
+		if err := checkFakeBigQuerySchemaUpdate(f.Fields, u.Fields); err != nil {
+			return err
+		}
+	}
+	for _, u := range updated {
+		if _, ok := currentByName[u.Name]; !ok && u.Mode == "REQUIRED" {
+			return fmt.Errorf("Provided Schema does not match Table. Cannot add required field %v", u.Name)
+		}
+	}
+
+	return nil
+}
+
+func checkFakeBigQueryRow(fields []fakeBigQueryField, row map[string]interface{}) error {
+	fieldsByName := map[string]fakeBigQueryField{}
+	for _, f := range fields {
+		fieldsByName[f.Name] = f
+		if _, ok := row[f.Name]; !ok && f.Mode == "REQUIRED" {
+			return fmt.Errorf("Missing required field: %v", f.Name)
+		}
+	}
+	for name, value := range row {
+		f, ok := fieldsByName[name]
+		if !ok {
+			return fmt.Errorf("no such field: %v", name)
+		}
+		if f.Type != "RECORD" {
+			continue
+		}
+		records, _ := value.([]interface{})
+		for _, record := range records {
+			if err := checkFakeBigQueryRow(f.Fields, record.(map[string]interface{})); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func writeFakeBigQueryJSON(w http.ResponseWriter, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func writeFakeBigQueryError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]interface{}{"code": code, "message": message}})
+}
+
+func TestMergeQuery(t *testing.T) {
+
+	t.Run("MatchesOnKeyColumnsAndUpdatesOthers", func(t *testing.T) {
+
+		schema := bigquery.Schema{
+			{Name: "location", Type: bigquery.StringFieldType},
+			{Name: "day", Type: bigquery.DateFieldType},
+			{Name: "degree_days", Type: bigquery.FloatFieldType},
+			{Name: "computed_at", Type: bigquery.TimestampFieldType},
+		}
+
+		// act
+		query := mergeQuery("`project.dataset.degree_days`", schema, []string{"location", "day"})
+
+		assert.Equal(t, "MERGE `project.dataset.degree_days` AS t\nUSING UNNEST(@rows) AS s\nON t.location = s.location AND t.day = s.day\nWHEN MATCHED THEN UPDATE SET\n  degree_days = s.degree_days,\n  computed_at = s.computed_at\nWHEN NOT MATCHED THEN INSERT ROW", query)
+	})
+
+	t.Run("ReplacesRowsWithoutAccountBeforeMergingOnAccount", func(t *testing.T) {
+
+		schema := bigquery.Schema{
+			{Name: "location", Type: bigquery.StringFieldType},
+			{Name: "location_id", Type: bigquery.IntegerFieldType},
+			{Name: "account", Type: bigquery.StringFieldType},
+			{Name: "day", Type: bigquery.DateFieldType},
+			{Name: "degree_days", Type: bigquery.FloatFieldType},
+		}
+
+		// act
+		query := mergeQuery("`project.dataset.degree_days`", schema, []string{"account", "location_id", "day"})
 
-		// cleanup
-		bqClient.DeleteTable(os.Getenv("BQ_DATASET"), "evohome_test")
+		assert.Equal(t, "DELETE FROM `project.dataset.degree_days` AS t\nWHERE t.account IS NULL AND EXISTS (SELECT 1 FROM UNNEST(@rows) AS s WHERE t.location_id = s.location_id AND t.day = s.day);\nMERGE `project.dataset.degree_days` AS t\nUSING UNNEST(@rows) AS s\nON t.account = s.account AND t.location_id = s.location_id AND t.day = s.day\nWHEN MATCHED THEN UPDATE SET\n  location = s.location,\n  degree_days = s.degree_days\nWHEN NOT MATCHED THEN INSERT ROW", query)
 	})
 }
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+type bigqueryRawArchiveImpl struct {
+	bigqueryClient BigQueryClient
+	dataset        string
+	table          string
+}
+
+// NewBigQueryRawArchive returns a ResponseRecorder that stores each gzipped response body in a bigquery table partitioned by fetch time
+func NewBigQueryRawArchive(bigqueryClient BigQueryClient, dataset, table string) ResponseRecorder {
+	return &bigqueryRawArchiveImpl{
+		bigqueryClient: bigqueryClient,
+		dataset:        dataset,
+		table:          table,
+	}
+}
+
+func (ra *bigqueryRawArchiveImpl) RecordLocationsResponse(ctx context.Context, account string, fetchedAt time.Time, body []byte) error {
+	compressedBody, err := gzipBytes(body)
+	if err != nil {
+		return err
+	}
+
+	return ra.bigqueryClient.InsertRawResponses(ctx, ra.dataset, ra.table, []BigQueryRawResponse{
+		BigQueryRawResponse{
+			FetchedAt:  fetchedAt,
+			Account:    bigquery.NullString{StringVal: account, Valid: account != ""},
+			Body:       compressedBody,
+			InsertedAt: time.Now().UTC(),
+		},
+	})
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/bigquery/storage/apiv1/storagepb"
+	"cloud.google.com/go/bigquery/storage/managedwriter"
+	"cloud.google.com/go/bigquery/storage/managedwriter/adapt"
+	"github.com/googleapis/gax-go/v2/apierror"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/api/option"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+type bigQueryStorageWriteClientImpl struct {
+	// table management and raw response inserts keep using the regular api
+	BigQueryClient
+
+	projectID  string
+	streams    storageWriteStreams
+	streamType storagepb.WriteStream_Type
+	stateStore StorageWriteStateStore
+}
+
+// NewBigQueryStorageWriteClient returns a BigQueryClient that inserts measurements via the Storage Write API, using a committed or pending stream per insert that's kept in the state store until its rows are known to be written
+func NewBigQueryStorageWriteClient(ctx context.Context, projectID, streamType string, stateStore StorageWriteStateStore, opts ...option.ClientOption) (BigQueryClient, error) {
+
+	var writeStreamType storagepb.WriteStream_Type
+	switch streamType {
+	case "committed":
+		writeStreamType = storagepb.WriteStream_COMMITTED
+	case "pending":
+		writeStreamType = storagepb.WriteStream_PENDING
+	default:
+		return nil, fmt.Errorf("Stream type %v is not supported, use committed or pending", streamType)
+	}
+
+	bigqueryClient, err := NewBigQueryClient(ctx, projectID, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	writeClient, err := managedwriter.NewClient(ctx, projectID, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &bigQueryStorageWriteClientImpl{
+		BigQueryClient: bigqueryClient,
+		projectID:      projectID,
+		streams:        &managedWriterStreamsImpl{writeClient: writeClient},
+		streamType:     writeStreamType,
+		stateStore:     stateStore,
+	}, nil
+}
+
+func (swc *bigQueryStorageWriteClientImpl) InsertMeasurements(ctx context.Context, dataset, table string, measurements []BigQueryMeasurement) error {
+	rows := make([]bigquery.ValueSaver, len(measurements))
+	for i, m := range measurements {
+		rows[i] = m
+	}
+
+	return swc.appendRows(ctx, dataset, table, BigQueryMeasurement{}, rows)
+}
+
+func (swc *bigQueryStorageWriteClientImpl) InsertZoneMeasurements(ctx context.Context, dataset, table string, zoneMeasurements []BigQueryZoneMeasurement) error {
+	rows := make([]bigquery.ValueSaver, len(zoneMeasurements))
+	for i, z := range zoneMeasurements {
+		rows[i] = z
+	}
+
+	return swc.appendRows(ctx, dataset, table, BigQueryZoneMeasurement{}, rows)
+}
+
+// appendRows writes the rows to a new stream in a single append at offset 0, after leaving out the rows the table's previous append already wrote; the stream is recorded before appending, so a retried run finds out whether an append of a failed run landed instead of appending its rows twice
+func (swc *bigQueryStorageWriteClientImpl) appendRows(ctx context.Context, dataset, table string, typeForSchema interface{}, rows []bigquery.ValueSaver) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	// derive a proto descriptor from the same schema the table is created with
+	schema, err := bigquery.InferSchema(typeForSchema)
+	if err != nil {
+		return err
+	}
+	tableSchema, err := adapt.BQSchemaToStorageTableSchema(schema)
+	if err != nil {
+		return err
+	}
+	descriptor, err := adapt.StorageSchemaToProto2Descriptor(tableSchema, "root")
+	if err != nil {
+		return err
+	}
+	messageDescriptor, ok := descriptor.(protoreflect.MessageDescriptor)
+	if !ok {
+		return errors.New("Converted schema descriptor is not a message descriptor")
+	}
+	descriptorProto, err := adapt.NormalizeDescriptor(messageDescriptor)
+	if err != nil {
+		return err
+	}
+
+	tableParent := managedwriter.TableParentFromParts(swc.projectID, dataset, table)
+
+	state, err := swc.stateStore.Load(ctx)
+	if err != nil {
+		return err
+	}
+	if state.Streams == nil {
+		state.Streams = map[string]*storageWriteStream{}
+	}
+
+	previous := state.Streams[tableParent]
+	if previous != nil && !previous.Landed {
+		previous.Landed, err = swc.landed(ctx, tableParent, previous.Name)
+		if err != nil {
+			return err
+		}
+	}
+	appended := map[string]bool{}
+	if previous != nil && previous.Landed {
+		for _, id := range previous.InsertIDs {
+			appended[id] = true
+		}
+	}
+
+	data := make([][]byte, 0, len(rows))
+	insertIDs := make([]string, 0, len(rows))
+	for _, r := range rows {
+		row, insertID, err := r.Save()
+		if err != nil {
+			return err
+		}
+		if appended[insertID] {
+			continue
+		}
+		message := dynamicpb.NewMessage(messageDescriptor)
+		if err := rowToMessage(row, message); err != nil {
+			return err
+		}
+		b, err := proto.Marshal(message)
+		if err != nil {
+			return err
+		}
+		data = append(data, b)
+		insertIDs = append(insertIDs, insertID)
+	}
+
+	if len(data) == 0 {
+		log.Info().Msgf("All %v rows for %v were already appended by a previous run, skipping append", len(rows), tableParent)
+		return swc.stateStore.Save(ctx, state)
+	}
+
+	streamName, err := swc.streams.Create(ctx, tableParent, swc.streamType)
+	if err != nil {
+		return err
+	}
+	state.Streams[tableParent] = &storageWriteStream{Name: streamName, InsertIDs: insertIDs}
+	if err := swc.stateStore.Save(ctx, state); err != nil {
+		return err
+	}
+
+	if err := swc.streams.Append(ctx, streamName, descriptorProto, data); err != nil {
+		return err
+	}
+	if _, err := swc.streams.Finalize(ctx, streamName); err != nil {
+		return err
+	}
+	if swc.streamType == storagepb.WriteStream_PENDING {
+		if err := swc.streams.Commit(ctx, tableParent, streamName); err != nil {
+			return err
+		}
+	}
+
+	state.Streams[tableParent].Landed = true
+
+	return swc.stateStore.Save(ctx, state)
+}
+
+// landed tells whether the append to a stream of a failed run was written; a pending stream whose rows were appended but not committed yet gets committed
+func (swc *bigQueryStorageWriteClientImpl) landed(ctx context.Context, tableParent, streamName string) (bool, error) {
+	committed, err := swc.streams.Committed(ctx, streamName)
+	if isStorageError(err, storagepb.StorageError_STREAM_NOT_FOUND) {
+		// an uncommitted pending stream gets cleaned up without writing its rows; a committed stream should have been finalized by then, leave possible duplicates to the deduplicated view
+		log.Warn().Msgf("Stream %v of a previous append to %v no longer exists, appending its rows again", streamName, tableParent)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if swc.streamType == storagepb.WriteStream_PENDING && committed {
+		return true, nil
+	}
+
+	// all rows go in a single append, so the stream has either all of them or none
+	rowCount, err := swc.streams.Finalize(ctx, streamName)
+	if err != nil {
+		return false, err
+	}
+	if rowCount == 0 {
+		return false, nil
+	}
+
+	if swc.streamType == storagepb.WriteStream_PENDING {
+		if err := swc.streams.Commit(ctx, tableParent, streamName); err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// storageWriteStreams is the part of the Storage Write API rows are appended with
+type storageWriteStreams interface {
+	Create(ctx context.Context, tableParent string, streamType storagepb.WriteStream_Type) (streamName string, err error)
+	Append(ctx context.Context, streamName string, descriptor *descriptorpb.DescriptorProto, data [][]byte) error
+	Finalize(ctx context.Context, streamName string) (rowCount int64, err error)
+	Committed(ctx context.Context, streamName string) (bool, error)
+	Commit(ctx context.Context, tableParent, streamName string) error
+}
+
+type managedWriterStreamsImpl struct {
+	writeClient *managedwriter.Client
+}
+
+func (mw *managedWriterStreamsImpl) Create(ctx context.Context, tableParent string, streamType storagepb.WriteStream_Type) (streamName string, err error) {
+	stream, err := mw.writeClient.CreateWriteStream(ctx, &storagepb.CreateWriteStreamRequest{
+		Parent:      tableParent,
+		WriteStream: &storagepb.WriteStream{Type: streamType},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return stream.GetName(), nil
+}
+
+// Append writes all rows at offset 0, so a retried append of rows that already landed fails with OFFSET_ALREADY_EXISTS instead of writing duplicates
+func (mw *managedWriterStreamsImpl) Append(ctx context.Context, streamName string, descriptor *descriptorpb.DescriptorProto, data [][]byte) error {
+	stream, err := mw.writeClient.NewManagedStream(ctx,
+		managedwriter.WithStreamName(streamName),
+		managedwriter.WithSchemaDescriptor(descriptor),
+		managedwriter.EnableWriteRetries(true),
+	)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	result, err := stream.AppendRows(ctx, data, managedwriter.WithOffset(0))
+	if err != nil {
+		return err
+	}
+	if _, err := result.GetResult(ctx); err != nil && !isStorageError(err, storagepb.StorageError_OFFSET_ALREADY_EXISTS) {
+		return err
+	}
+
+	return nil
+}
+
+func (mw *managedWriterStreamsImpl) Finalize(ctx context.Context, streamName string) (rowCount int64, err error) {
+	stream, err := mw.writeClient.NewManagedStream(ctx, managedwriter.WithStreamName(streamName))
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+
+	return stream.Finalize(ctx)
+}
+
+// Committed tells whether the stream's rows are committed; committed streams are from the start, pending streams once they're committed
+func (mw *managedWriterStreamsImpl) Committed(ctx context.Context, streamName string) (bool, error) {
+	stream, err := mw.writeClient.GetWriteStream(ctx, &storagepb.GetWriteStreamRequest{Name: streamName})
+	if err != nil {
+		return false, err
+	}
+
+	return stream.GetCommitTime() != nil, nil
+}
+
+func (mw *managedWriterStreamsImpl) Commit(ctx context.Context, tableParent, streamName string) error {
+	response, err := mw.writeClient.BatchCommitWriteStreams(ctx, &storagepb.BatchCommitWriteStreamsRequest{
+		Parent:       tableParent,
+		WriteStreams: []string{streamName},
+	})
+	if err != nil {
+		return err
+	}
+	if len(response.GetStreamErrors()) > 0 {
+		return fmt.Errorf("Committing stream %v failed: %v", streamName, response.GetStreamErrors()[0].GetErrorMessage())
+	}
+
+	return nil
+}
+
+func isStorageError(err error, code storagepb.StorageError_StorageErrorCode) bool {
+	apiError, ok := apierror.FromError(err)
+	if !ok {
+		return false
+	}
+
+	storageError := &storagepb.StorageError{}
+	if apiError.Details().ExtractProtoMessage(storageError) != nil {
+		return false
+	}
+
+	return storageError.GetCode() == code
+}
+
+// rowToMessage copies a row as returned by a bigquery.ValueSaver into a proto message derived from the same schema
+func rowToMessage(row map[string]bigquery.Value, message protoreflect.Message) error {
+	fields := message.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+
+		value, ok := row[string(field.Name())]
+		if !ok || value == nil {
+			continue
+		}
+
+		if field.IsList() {
+			values, ok := value.([]bigquery.Value)
+			if !ok {
+				return fmt.Errorf("Value for repeated field %v has type %T instead of a slice", field.Name(), value)
+			}
+			list := message.Mutable(field).List()
+			for _, v := range values {
+				protoValue, set, err := toProtoValue(field, v, list.NewElement)
+				if err != nil {
+					return err
+				}
+				if set {
+					list.Append(protoValue)
+				}
+			}
+			continue
+		}
+
+		protoValue, set, err := toProtoValue(field, value, func() protoreflect.Value { return message.NewField(field) })
+		if err != nil {
+			return err
+		}
+		if set {
+			message.Set(field, protoValue)
+		}
+	}
+
+	return nil
+}
+
+// toProtoValue converts a single bigquery value for the field; it returns false for null values, which are left unset
+func toProtoValue(field protoreflect.FieldDescriptor, value bigquery.Value, newMessage func() protoreflect.Value) (protoreflect.Value, bool, error) {
+	switch field.Kind() {
+	case protoreflect.MessageKind:
+		if row, ok := value.(map[string]bigquery.Value); ok {
+			message := newMessage()
+			return message, true, rowToMessage(row, message.Message())
+		}
+
+	case protoreflect.StringKind:
+		switch v := value.(type) {
+		case string:
+			return protoreflect.ValueOfString(v), true, nil
+		case bigquery.NullString:
+			return protoreflect.ValueOfString(v.StringVal), v.Valid, nil
+		}
+
+	case protoreflect.Int64Kind:
+		switch v := value.(type) {
+		case int:
+			return protoreflect.ValueOfInt64(int64(v)), true, nil
+		case int64:
+			return protoreflect.ValueOfInt64(v), true, nil
+		case bigquery.NullInt64:
+			return protoreflect.ValueOfInt64(v.Int64), v.Valid, nil
+		case time.Time:
+			// timestamps are sent as microseconds since epoch
+			return protoreflect.ValueOfInt64(v.UnixNano() / int64(time.Microsecond)), true, nil
+		case bigquery.NullTimestamp:
+			return protoreflect.ValueOfInt64(v.Timestamp.UnixNano() / int64(time.Microsecond)), v.Valid, nil
+		}
+
+	case protoreflect.DoubleKind:
+		switch v := value.(type) {
+		case float64:
+			return protoreflect.ValueOfFloat64(v), true, nil
+		case bigquery.NullFloat64:
+			return protoreflect.ValueOfFloat64(v.Float64), v.Valid, nil
+		}
+
+	case protoreflect.BoolKind:
+		switch v := value.(type) {
+		case bool:
+			return protoreflect.ValueOfBool(v), true, nil
+		case bigquery.NullBool:
+			return protoreflect.ValueOfBool(v.Bool), v.Valid, nil
+		}
+
+	case protoreflect.BytesKind:
+		if v, ok := value.([]byte); ok {
+			return protoreflect.ValueOfBytes(v), true, nil
+		}
+	}
+
+	return protoreflect.Value{}, false, fmt.Errorf("Value for field %v has unsupported type %T for proto kind %v", field.Name(), value, field.Kind())
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/bigquery/storage/apiv1/storagepb"
+	"cloud.google.com/go/bigquery/storage/managedwriter/adapt"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// storageWriteStreamsFake keeps the rows appended per stream in memory; the fail fields make the next call of that kind fail, an append without writing its rows and a finalize or commit after it took effect
+type storageWriteStreamsFake struct {
+	rows         map[string]int
+	committed    map[string]bool
+	appends      int
+	failAppend   bool
+	failFinalize bool
+	failCommit   bool
+}
+
+func (sf *storageWriteStreamsFake) Create(ctx context.Context, tableParent string, streamType storagepb.WriteStream_Type) (string, error) {
+	name := fmt.Sprintf("%v/streams/%v", tableParent, len(sf.rows))
+	sf.rows[name] = 0
+	sf.committed[name] = streamType == storagepb.WriteStream_COMMITTED
+	return name, nil
+}
+
+func (sf *storageWriteStreamsFake) Append(ctx context.Context, streamName string, descriptor *descriptorpb.DescriptorProto, data [][]byte) error {
+	sf.appends++
+	if sf.failAppend {
+		sf.failAppend = false
+		return errors.New("connection reset")
+	}
+	sf.rows[streamName] += len(data)
+	return nil
+}
+
+func (sf *storageWriteStreamsFake) Finalize(ctx context.Context, streamName string) (int64, error) {
+	if sf.failFinalize {
+		sf.failFinalize = false
+		return 0, errors.New("deadline exceeded")
+	}
+	return int64(sf.rows[streamName]), nil
+}
+
+func (sf *storageWriteStreamsFake) Committed(ctx context.Context, streamName string) (bool, error) {
+	return sf.committed[streamName], nil
+}
+
+func (sf *storageWriteStreamsFake) Commit(ctx context.Context, tableParent, streamName string) error {
+	sf.committed[streamName] = true
+	if sf.failCommit {
+		sf.failCommit = false
+		return errors.New("deadline exceeded")
+	}
+	return nil
+}
+
+// committedRows returns the number of rows written to the table
+func (sf *storageWriteStreamsFake) committedRows() (rows int) {
+	for name, n := range sf.rows {
+		if sf.committed[name] {
+			rows += n
+		}
+	}
+	return
+}
+
+func TestBigQueryStorageWriteClientInsertMeasurements(t *testing.T) {
+
+	measuredAt := time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC)
+	measurements := []BigQueryMeasurement{
+		{Location: "Thuis", LocationID: 1234, MeasuredAt: measuredAt, InsertedAt: measuredAt},
+		{Location: "Oma", LocationID: 5678, MeasuredAt: measuredAt, InsertedAt: measuredAt},
+	}
+	newClient := func(t *testing.T, streamType storagepb.WriteStream_Type) (*bigQueryStorageWriteClientImpl, *storageWriteStreamsFake) {
+		streams := &storageWriteStreamsFake{rows: map[string]int{}, committed: map[string]bool{}}
+		return &bigQueryStorageWriteClientImpl{
+			projectID:  "project",
+			streams:    streams,
+			streamType: streamType,
+			stateStore: NewFileStorageWriteStateStore(filepath.Join(t.TempDir(), "storage-write.json")),
+		}, streams
+	}
+
+	t.Run("DoesNotAppendRowsOfRetriedRunAgain", func(t *testing.T) {
+
+		client, streams := newClient(t, storagepb.WriteStream_COMMITTED)
+		assert.Nil(t, client.InsertMeasurements(context.Background(), "dataset", "measurements", measurements))
+
+		// act
+		err := client.InsertMeasurements(context.Background(), "dataset", "measurements", measurements)
+
+		assert.Nil(t, err)
+		assert.Equal(t, 1, streams.appends)
+		assert.Equal(t, 2, streams.committedRows())
+	})
+
+	t.Run("DoesNotAppendRowsAgainIfRunFailedAfterAppendLanded", func(t *testing.T) {
+
+		client, streams := newClient(t, storagepb.WriteStream_COMMITTED)
+		streams.failFinalize = true
+		assert.NotNil(t, client.InsertMeasurements(context.Background(), "dataset", "measurements", measurements))
+
+		// act
+		err := client.InsertMeasurements(context.Background(), "dataset", "measurements", measurements)
+
+		assert.Nil(t, err)
+		assert.Equal(t, 1, streams.appends)
+		assert.Equal(t, 2, streams.committedRows())
+	})
+
+	t.Run("AppendsRowsAgainIfAppendOfFailedRunDidNotLand", func(t *testing.T) {
+
+		client, streams := newClient(t, storagepb.WriteStream_COMMITTED)
+		streams.failAppend = true
+		assert.NotNil(t, client.InsertMeasurements(context.Background(), "dataset", "measurements", measurements))
+
+		// act
+		err := client.InsertMeasurements(context.Background(), "dataset", "measurements", measurements)
+
+		assert.Nil(t, err)
+		assert.Equal(t, 2, streams.appends)
+		assert.Equal(t, 2, streams.committedRows())
+	})
+
+	t.Run("AppendsOnlyRowsNotAppendedByPreviousRun", func(t *testing.T) {
+
+		client, streams := newClient(t, storagepb.WriteStream_COMMITTED)
+		assert.Nil(t, client.InsertMeasurements(context.Background(), "dataset", "measurements", measurements[:1]))
+
+		// act
+		err := client.InsertMeasurements(context.Background(), "dataset", "measurements", measurements)
+
+		assert.Nil(t, err)
+		assert.Equal(t, 2, streams.appends)
+		assert.Equal(t, 2, streams.committedRows())
+	})
+
+	t.Run("CommitsPendingStreamOfFailedRunInsteadOfAppendingAgain", func(t *testing.T) {
+
+		client, streams := newClient(t, storagepb.WriteStream_PENDING)
+		streams.failFinalize = true
+		assert.NotNil(t, client.InsertMeasurements(context.Background(), "dataset", "measurements", measurements))
+		assert.Equal(t, 0, streams.committedRows())
+
+		// act
+		err := client.InsertMeasurements(context.Background(), "dataset", "measurements", measurements)
+
+		assert.Nil(t, err)
+		assert.Equal(t, 1, streams.appends)
+		assert.Equal(t, 2, streams.committedRows())
+	})
+
+	t.Run("DoesNotAppendRowsAgainIfRunFailedAfterPendingStreamWasCommitted", func(t *testing.T) {
+
+		client, streams := newClient(t, storagepb.WriteStream_PENDING)
+		streams.failCommit = true
+		assert.NotNil(t, client.InsertMeasurements(context.Background(), "dataset", "measurements", measurements))
+
+		// act
+		err := client.InsertMeasurements(context.Background(), "dataset", "measurements", measurements)
+
+		assert.Nil(t, err)
+		assert.Equal(t, 1, streams.appends)
+		assert.Equal(t, 2, streams.committedRows())
+	})
+}
+
+func TestRowToMessage(t *testing.T) {
+
+	t.Run("ConvertsMeasurementWithNestedZonesAndLeavesNullValuesUnset", func(t *testing.T) {
+
+		schema, _ := bigquery.InferSchema(BigQueryMeasurement{})
+		tableSchema, _ := adapt.BQSchemaToStorageTableSchema(schema)
+		descriptor, _ := adapt.StorageSchemaToProto2Descriptor(tableSchema, "root")
+		messageDescriptor := descriptor.(protoreflect.MessageDescriptor)
+		measuredAt := time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC)
+		measurement := BigQueryMeasurement{
+			Location:   "Thuis",
+			LocationID: 1234,
+			MeasuredAt: measuredAt,
+			Zones: []BigQueryZone{
+				BigQueryZone{
+					Zone:             "Woonkamer",
+					TemperatureUnit:  "Celsius",
+					TemperatureValue: bigquery.NullFloat64{Float64: 20.5, Valid: true},
+				},
+			},
+			InsertedAt: measuredAt,
+		}
+		row, _, _ := measurement.Save()
+		message := dynamicpb.NewMessage(messageDescriptor)
+
+		// act
+		err := rowToMessage(row, message)
+
+		if assert.Nil(t, err) {
+			fields := messageDescriptor.Fields()
+			assert.Equal(t, "Thuis", message.Get(fields.ByName("location")).String())
+			assert.Equal(t, int64(1234), message.Get(fields.ByName("location_id")).Int())
+			assert.Equal(t, measuredAt.UnixNano()/1000, message.Get(fields.ByName("measured_at")).Int())
+
+			zones := message.Get(fields.ByName("zones")).List()
+			if assert.Equal(t, 1, zones.Len()) {
+				zone := zones.Get(0).Message()
+				zoneFields := zone.Descriptor().Fields()
+				assert.Equal(t, "Woonkamer", zone.Get(zoneFields.ByName("location")).String())
+				assert.Equal(t, 20.5, zone.Get(zoneFields.ByName("temperature")).Float())
+				assert.False(t, zone.Has(zoneFields.ByName("heat_setpoint")))
+			}
+		}
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// deduplicatedViewQuery selects the first inserted row per account, location and time bucket, the identity insert ids are derived from, hiding duplicates that were inserted outside bigquery's streaming dedup window
+func deduplicatedViewQuery(projectID, dataset, table string, bucket time.Duration) string {
+	bucketSeconds := int64(bucket / time.Second)
+	if bucketSeconds < 1 {
+		bucketSeconds = 1
+	}
+
+	return fmt.Sprintf(`SELECT
+  * EXCEPT(row_number)
+FROM (
+  SELECT
+    *,
+    ROW_NUMBER() OVER (PARTITION BY IFNULL(account, ''), IF(location_id IS NULL OR location_id = 0, location, CAST(location_id AS STRING)), TIMESTAMP_SECONDS(DIV(UNIX_SECONDS(measured_at), %v) * %v) ORDER BY inserted_at) AS row_number
+  FROM
+    `+"`%v.%v.%v`"+`
+)
+WHERE
+  row_number = 1`, bucketSeconds, bucketSeconds, projectID, dataset, table)
+}
+
+//go:embed sql/*.sql
+var viewTemplates embed.FS
+
+// managedView is a view over the measurements defined by the embedded sql template sql/<name>.sql; a released template is never changed, a new version is added instead so queries on the old view keep working
+type managedView struct {
+	Name string
+
+	// DateExpression is the date column or expression a rollup of the view is partitioned and refreshed by
+	DateExpression string
+}
+
+var managedViews = []managedView{
+	{Name: "zone_hourly_v1", DateExpression: "DATE(hour)"},
+	{Name: "zone_daily_v1", DateExpression: "day"},
+	{Name: "zone_hourly_v2", DateExpression: "DATE(hour)"},
+	{Name: "zone_daily_v2", DateExpression: "day"},
+}
+
+// viewName returns the name of the view for the measurement table
+func (v managedView) viewName(table string) string {
+	return table + "_" + v.Name
+}
+
+// rollupName returns the name of the table the view is materialised in for the measurement table
+func (v managedView) rollupName(table string) string {
+	return v.viewName(table) + "_rollup"
+}
+
+// query renders the view's sql template for the measurement table
+func (v managedView) query(projectID, dataset, table string) (string, error) {
+	tmpl, err := template.ParseFS(viewTemplates, "sql/"+v.Name+".sql")
+	if err != nil {
+		return "", err
+	}
+
+	var query strings.Builder
+	err = tmpl.Execute(&query, struct {
+		ProjectID string
+		Dataset   string
+		Table     string
+	}{projectID, dataset, table})
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(query.String()), nil
+}
+
+// rollupRefreshQuery creates the rollup table from the view if it doesn't exist and replaces its rows for the last refreshDays days in a single transaction
+func (v managedView) rollupRefreshQuery(projectID, dataset, table string, refreshDays int) string {
+	view := fmt.Sprintf("`%v.%v.%v`", projectID, dataset, v.viewName(table))
+	rollup := fmt.Sprintf("`%v.%v.%v`", projectID, dataset, v.rollupName(table))
+	filter := fmt.Sprintf("%v >= DATE_SUB(CURRENT_DATE(), INTERVAL %v DAY)", v.DateExpression, refreshDays)
+
+	return fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %v
+PARTITION BY %v AS
+SELECT * FROM %v;
+BEGIN TRANSACTION;
+DELETE FROM %v WHERE %v;
+INSERT INTO %v SELECT * FROM %v WHERE %v;
+COMMIT TRANSACTION;`, rollup, v.DateExpression, view, rollup, filter, rollup, view, filter)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeduplicatedViewQuery(t *testing.T) {
+
+	t.Run("PartitionsByAccountLocationIDAndTimeBucketLikeInsertIDs", func(t *testing.T) {
+
+		// act
+		query := deduplicatedViewQuery("project", "dataset", "measurements", 5*time.Minute)
+
+		assert.Contains(t, query, "PARTITION BY IFNULL(account, ''), IF(location_id IS NULL OR location_id = 0, location, CAST(location_id AS STRING)), TIMESTAMP_SECONDS(DIV(UNIX_SECONDS(measured_at), 300) * 300)")
+	})
+}
+
+func TestManagedViewQuery(t *testing.T) {
+
+	t.Run("RendersAllTemplatesForMeasurementTable", func(t *testing.T) {
+
+		for _, v := range managedViews {
+
+			// act
+			query, err := v.query("project", "dataset", "measurements")
+
+			assert.Nil(t, err, v.Name)
+			assert.Contains(t, query, "`project.dataset.measurements_deduplicated`", v.Name)
+			assert.NotContains(t, query, "{{", v.Name)
+		}
+	})
+
+	t.Run("GroupsVersion2ByAccountAndLocationID", func(t *testing.T) {
+
+		for _, v := range []managedView{{Name: "zone_hourly_v2"}, {Name: "zone_daily_v2"}} {
+
+			// act
+			query, err := v.query("project", "dataset", "measurements")
+
+			assert.Nil(t, err, v.Name)
+			assert.Contains(t, query, "GROUP BY\n", v.Name)
+			assert.Contains(t, query, "  IFNULL(account, ''),\n  location_id,\n  zone", v.Name)
+		}
+	})
+
+	t.Run("NamesViewAfterTableAndVersion", func(t *testing.T) {
+
+		v := managedView{Name: "zone_hourly_v1"}
+
+		// act
+		name := v.viewName("measurements")
+
+		assert.Equal(t, "measurements_zone_hourly_v1", name)
+	})
+}
+
+func TestManagedViewRollupRefreshQuery(t *testing.T) {
+
+	t.Run("ReplacesRecentDaysOfRollupInTransaction", func(t *testing.T) {
+
+		v := managedView{Name: "zone_daily_v1", DateExpression: "day"}
+
+		// act
+		query := v.rollupRefreshQuery("project", "dataset", "measurements", 2)
+
+		assert.Contains(t, query, "CREATE TABLE IF NOT EXISTS `project.dataset.measurements_zone_daily_v1_rollup`\nPARTITION BY day AS\nSELECT * FROM `project.dataset.measurements_zone_daily_v1`;")
+		assert.Contains(t, query, "DELETE FROM `project.dataset.measurements_zone_daily_v1_rollup` WHERE day >= DATE_SUB(CURRENT_DATE(), INTERVAL 2 DAY);")
+		assert.Contains(t, query, "INSERT INTO `project.dataset.measurements_zone_daily_v1_rollup` SELECT * FROM `project.dataset.measurements_zone_daily_v1` WHERE day >= DATE_SUB(CURRENT_DATE(), INTERVAL 2 DAY);")
+	})
+}
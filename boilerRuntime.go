@@ -0,0 +1,143 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+const (
+	// boilerRuntimeMaxSampleGap is the longest a boiler heat demand sample is assumed to last until the next one
+	boilerRuntimeMaxSampleGap = 15 * time.Minute
+
+	// boilerRuntimeRefreshWindow is how far back the hourly boiler runtime is recomputed
+	boilerRuntimeRefreshWindow = 24 * time.Hour
+)
+
+// boilerTariff describes the boiler and the gas it burns, to estimate energy use and cost from its runtime
+type boilerTariff struct {
+	// CapacityKW is the heat output of the boiler when running at full demand
+	CapacityKW float64
+	Efficiency float64
+
+	// CalorificValue is the energy in kWh per m³ of gas
+	CalorificValue float64
+
+	// GasPrice is the price per m³ of gas; the cost is left empty if it's 0
+	GasPrice float64
+}
+
+type boilerRuntimeKey struct {
+	location locationKey
+	hour     time.Time
+}
+
+type boilerRuntimeSums struct {
+	samples        int
+	coveredMinutes float64
+	onMinutes      float64
+}
+
+// computeBoilerRuntime estimates the boiler on-time per location per hour from the boiler heat demand, with the relay on for the demanded fraction of the time, and the energy, gas and cost that takes; each sample counts until the next one, for at most 15 minutes and not before from nor beyond computedAt, so a from within an hour only counts its remainder; locations are told apart by account and location id and named after their latest sample
+func computeBoilerRuntime(samples []BigQueryBoilerSample, tariff boilerTariff, from, computedAt time.Time) []BigQueryBoilerRuntime {
+	samplesPerLocation := map[locationKey][]BigQueryBoilerSample{}
+	for _, s := range samples {
+		key := locationKey{account: s.Account, locationID: s.LocationID}
+		samplesPerLocation[key] = append(samplesPerLocation[key], s)
+	}
+
+	sums := map[boilerRuntimeKey]*boilerRuntimeSums{}
+	hourSums := func(location locationKey, t time.Time) *boilerRuntimeSums {
+		key := boilerRuntimeKey{location: location, hour: t.UTC().Truncate(time.Hour)}
+		if _, ok := sums[key]; !ok {
+			sums[key] = &boilerRuntimeSums{}
+		}
+		return sums[key]
+	}
+
+	names := map[locationKey]string{}
+	for location, locationSamples := range samplesPerLocation {
+		sort.Slice(locationSamples, func(i, j int) bool {
+			return locationSamples[i].MeasuredAt.Before(locationSamples[j].MeasuredAt)
+		})
+		names[location] = locationSamples[len(locationSamples)-1].Location
+
+		for i, s := range locationSamples {
+			if !s.MeasuredAt.Before(from) {
+				hourSums(location, s.MeasuredAt).samples++
+			}
+
+			end := s.MeasuredAt.Add(boilerRuntimeMaxSampleGap)
+			if i+1 < len(locationSamples) && locationSamples[i+1].MeasuredAt.Before(end) {
+				end = locationSamples[i+1].MeasuredAt
+			}
+			if computedAt.Before(end) {
+				end = computedAt
+			}
+
+			start := s.MeasuredAt
+			if start.Before(from) {
+				start = from
+			}
+
+			// split the interval at the hour, so each part counts towards its own hour
+			for start.Before(end) {
+				partEnd := end
+				if nextHour := start.UTC().Truncate(time.Hour).Add(time.Hour); nextHour.Before(partEnd) {
+					partEnd = nextHour
+				}
+
+				minutes := partEnd.Sub(start).Minutes()
+				sums := hourSums(location, start)
+				sums.coveredMinutes += minutes
+				sums.onMinutes += s.BoilerHeatDemand * minutes
+
+				start = partEnd
+			}
+		}
+	}
+
+	runtimes := []BigQueryBoilerRuntime{}
+	for key, s := range sums {
+		if s.coveredMinutes == 0 {
+			continue
+		}
+
+		energyKWh := s.onMinutes / 60 * tariff.CapacityKW
+		gas := 0.0
+		if tariff.Efficiency > 0 && tariff.CalorificValue > 0 {
+			gas = energyKWh / tariff.Efficiency / tariff.CalorificValue
+		}
+		cost := bigquery.NullFloat64{}
+		if tariff.GasPrice > 0 {
+			cost = bigquery.NullFloat64{Float64: gas * tariff.GasPrice, Valid: true}
+		}
+
+		runtimes = append(runtimes, BigQueryBoilerRuntime{
+			Location:       names[key.location],
+			LocationID:     key.location.locationID,
+			Account:        bigquery.NullString{StringVal: key.location.account, Valid: true},
+			Hour:           key.hour,
+			Samples:        s.samples,
+			CoveredMinutes: s.coveredMinutes,
+			OnMinutes:      s.onMinutes,
+			EnergyKWh:      energyKWh,
+			GasM3:          gas,
+			Cost:           cost,
+			ComputedAt:     computedAt,
+		})
+	}
+
+	sort.Slice(runtimes, func(i, j int) bool {
+		if runtimes[i].Account != runtimes[j].Account {
+			return runtimes[i].Account.StringVal < runtimes[j].Account.StringVal
+		}
+		if runtimes[i].LocationID != runtimes[j].LocationID {
+			return runtimes[i].LocationID < runtimes[j].LocationID
+		}
+		return runtimes[i].Hour.Before(runtimes[j].Hour)
+	})
+
+	return runtimes
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// boilerRuntimeMetricsJob is the pushgateway job the boiler runtime metrics are grouped under
+const boilerRuntimeMetricsJob = "evohome-bigquery-exporter"
+
+// BoilerRuntimeMetricsPusher is the interface for exposing the boiler runtime as metrics
+type BoilerRuntimeMetricsPusher interface {
+	Push(runtimes []BigQueryBoilerRuntime) error
+}
+
+type boilerRuntimeMetricsPusherImpl struct {
+	url        string
+	job        string
+	httpClient *http.Client
+}
+
+// NewBoilerRuntimeMetricsPusher returns a BoilerRuntimeMetricsPusher that pushes gauges with the runtime per location to the prometheus pushgateway at url
+func NewBoilerRuntimeMetricsPusher(url, job string) BoilerRuntimeMetricsPusher {
+	return &boilerRuntimeMetricsPusherImpl{
+		url: url,
+		job: job,
+		httpClient: &http.Client{
+			Timeout: time.Second * 10,
+		},
+	}
+}
+
+// Push replaces the metrics of the job with the totals of the runtimes per location, so a location that's no longer exported doesn't keep its last values
+func (p *boilerRuntimeMetricsPusherImpl) Push(runtimes []BigQueryBoilerRuntime) error {
+	labels := []string{"account", "location", "location_id"}
+	onMinutes := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "evohome_boiler_on_minutes", Help: "Estimated minutes the boiler was on in the last 24 hours."}, labels)
+	energyKWh := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "evohome_boiler_energy_kwh", Help: "Estimated heat in kWh the boiler produced in the last 24 hours."}, labels)
+	gasM3 := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "evohome_boiler_gas_m3", Help: "Estimated m³ of gas the boiler used in the last 24 hours."}, labels)
+	cost := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "evohome_boiler_cost", Help: "Estimated cost of the gas the boiler used in the last 24 hours."}, labels)
+
+	for _, r := range runtimes {
+		values := []string{r.Account.StringVal, r.Location, strconv.Itoa(r.LocationID)}
+		onMinutes.WithLabelValues(values...).Add(r.OnMinutes)
+		energyKWh.WithLabelValues(values...).Add(r.EnergyKWh)
+		gasM3.WithLabelValues(values...).Add(r.GasM3)
+		if r.Cost.Valid {
+			cost.WithLabelValues(values...).Add(r.Cost.Float64)
+		}
+	}
+
+	return push.New(p.url, p.job).
+		Client(p.httpClient).
+		Collector(onMinutes).
+		Collector(energyKWh).
+		Collector(gasM3).
+		Collector(cost).
+		Push()
+}
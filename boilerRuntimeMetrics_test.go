@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBoilerRuntimeMetricsPusherPush(t *testing.T) {
+
+	t.Run("ReplacesJobMetricsWithTotalsPerLocation", func(t *testing.T) {
+
+		var path string
+		families := map[string]*dto.MetricFamily{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "PUT", r.Method)
+			path = r.URL.Path
+			decoder := expfmt.NewDecoder(r.Body, expfmt.ResponseFormat(r.Header))
+			for {
+				family := &dto.MetricFamily{}
+				if err := decoder.Decode(family); err != nil {
+					break
+				}
+				families[family.GetName()] = family
+			}
+			w.WriteHeader(http.StatusAccepted)
+		}))
+		defer server.Close()
+
+		pusher := NewBoilerRuntimeMetricsPusher(server.URL, "evohome")
+		runtimes := []BigQueryBoilerRuntime{
+			{Location: "Thuis", LocationID: 1234, OnMinutes: 30, EnergyKWh: 12, GasM3: 1.5, Cost: bigquery.NullFloat64{Float64: 1.2, Valid: true}},
+			{Location: "Thuis", LocationID: 1234, OnMinutes: 15, EnergyKWh: 6, GasM3: 0.75, Cost: bigquery.NullFloat64{Float64: 0.6, Valid: true}},
+			{Location: "Oma", LocationID: 5678, OnMinutes: 10, EnergyKWh: 4, GasM3: 0.5},
+		}
+
+		// act
+		err := pusher.Push(runtimes)
+
+		assert.Nil(t, err)
+		assert.Equal(t, "/metrics/job/evohome", path)
+		if assert.Contains(t, families, "evohome_boiler_on_minutes") {
+			metrics := families["evohome_boiler_on_minutes"].GetMetric()
+			if assert.Equal(t, 2, len(metrics)) {
+				values := map[string]float64{}
+				for _, m := range metrics {
+					for _, l := range m.GetLabel() {
+						if l.GetName() == "location_id" {
+							values[l.GetValue()] = m.GetGauge().GetValue()
+						}
+					}
+				}
+				assert.Equal(t, map[string]float64{"1234": 45, "5678": 10}, values)
+			}
+		}
+		if assert.Contains(t, families, "evohome_boiler_cost") {
+			assert.Equal(t, 1, len(families["evohome_boiler_cost"].GetMetric()))
+			assert.InDelta(t, 1.8, families["evohome_boiler_cost"].GetMetric()[0].GetGauge().GetValue(), 0.0001)
+		}
+	})
+
+	t.Run("ReturnsErrorForUnsuccessfulStatusCode", func(t *testing.T) {
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+		defer server.Close()
+
+		pusher := NewBoilerRuntimeMetricsPusher(server.URL, "evohome")
+
+		// act
+		err := pusher.Push([]BigQueryBoilerRuntime{{Location: "Thuis", LocationID: 1234, OnMinutes: 30}})
+
+		assert.NotNil(t, err)
+	})
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComputeBoilerRuntime(t *testing.T) {
+
+	from := time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC)
+	computedAt := time.Date(2020, 11, 1, 14, 0, 0, 0, time.UTC)
+	tariff := boilerTariff{CapacityKW: 24, Efficiency: 0.9, CalorificValue: 10, GasPrice: 1.5}
+
+	samplesEvery5Minutes := func(start time.Time, demands ...float64) (samples []BigQueryBoilerSample) {
+		for i, demand := range demands {
+			samples = append(samples, BigQueryBoilerSample{Location: "Thuis", LocationID: 1234, MeasuredAt: start.Add(time.Duration(i) * 5 * time.Minute), BoilerHeatDemand: demand})
+		}
+		return
+	}
+
+	t.Run("EstimatesOnTimeEnergyGasAndCostPerHour", func(t *testing.T) {
+
+		demands := make([]float64, 12)
+		for i := range demands {
+			demands[i] = 0.5
+		}
+		samples := samplesEvery5Minutes(from, demands...)
+
+		// act
+		runtimes := computeBoilerRuntime(samples, tariff, from, computedAt)
+
+		// the last sample lasts 15 minutes, into the next hour
+		if assert.Equal(t, 2, len(runtimes)) {
+			assert.Equal(t, from, runtimes[0].Hour)
+			assert.Equal(t, 1234, runtimes[0].LocationID)
+			assert.Equal(t, 12, runtimes[0].Samples)
+			assert.InDelta(t, 60.0, runtimes[0].CoveredMinutes, 0.0001)
+			assert.InDelta(t, 30.0, runtimes[0].OnMinutes, 0.0001)
+			assert.InDelta(t, 12.0, runtimes[0].EnergyKWh, 0.0001)
+			assert.InDelta(t, 12.0/0.9/10, runtimes[0].GasM3, 0.0001)
+			assert.InDelta(t, 12.0/0.9/10*1.5, runtimes[0].Cost.Float64, 0.0001)
+			assert.Equal(t, computedAt, runtimes[0].ComputedAt)
+			assert.InDelta(t, 10.0, runtimes[1].CoveredMinutes, 0.0001)
+		}
+	})
+
+	t.Run("SplitsSamplesAtTheHourAndSkipsHoursBeforeFrom", func(t *testing.T) {
+
+		samples := samplesEvery5Minutes(from.Add(-5*time.Minute), 1)
+
+		// act
+		runtimes := computeBoilerRuntime(samples, tariff, from, computedAt)
+
+		if assert.Equal(t, 1, len(runtimes)) {
+			assert.Equal(t, from, runtimes[0].Hour)
+			// the sample lasts 15 minutes, of which 10 in the hour from
+			assert.InDelta(t, 10.0, runtimes[0].OnMinutes, 0.0001)
+			assert.InDelta(t, 10.0, runtimes[0].CoveredMinutes, 0.0001)
+		}
+	})
+
+	t.Run("CountsOnlyTimeFromFromWithinAnHour", func(t *testing.T) {
+
+		samples := samplesEvery5Minutes(from, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1)
+
+		// act
+		runtimes := computeBoilerRuntime(samples, tariff, from.Add(30*time.Minute), computedAt)
+
+		// the last sample lasts 15 minutes, into the next hour
+		if assert.Equal(t, 2, len(runtimes)) {
+			assert.Equal(t, from, runtimes[0].Hour)
+			assert.Equal(t, 6, runtimes[0].Samples)
+			assert.InDelta(t, 30.0, runtimes[0].OnMinutes, 0.0001)
+			assert.InDelta(t, 10.0, runtimes[1].OnMinutes, 0.0001)
+		}
+	})
+
+	t.Run("KeysOnAccountAndLocationIDNamedAfterLatestSample", func(t *testing.T) {
+
+		samples := samplesEvery5Minutes(from, 1, 1)
+		samples[1].Location = "Huis"
+		other := samplesEvery5Minutes(from, 0.5)
+		other[0].Account = "oma"
+		samples = append(samples, other...)
+
+		// act
+		runtimes := computeBoilerRuntime(samples, tariff, from, computedAt)
+
+		if assert.Equal(t, 2, len(runtimes)) {
+			assert.Equal(t, bigquery.NullString{StringVal: "", Valid: true}, runtimes[0].Account)
+			assert.Equal(t, "Huis", runtimes[0].Location)
+			assert.Equal(t, 2, runtimes[0].Samples)
+			assert.Equal(t, bigquery.NullString{StringVal: "oma", Valid: true}, runtimes[1].Account)
+			assert.Equal(t, "Thuis", runtimes[1].Location)
+			assert.Equal(t, 1234, runtimes[1].LocationID)
+			assert.InDelta(t, 7.5, runtimes[1].OnMinutes, 0.0001)
+		}
+	})
+
+	t.Run("LeavesCostEmptyWithoutGasPrice", func(t *testing.T) {
+
+		samples := samplesEvery5Minutes(from, 1)
+
+		// act
+		runtimes := computeBoilerRuntime(samples, boilerTariff{CapacityKW: 24, Efficiency: 0.9, CalorificValue: 10}, from, from.Add(5*time.Minute))
+
+		if assert.Equal(t, 1, len(runtimes)) {
+			// the sample doesn't last beyond the time of computing
+			assert.InDelta(t, 5.0, runtimes[0].OnMinutes, 0.0001)
+			assert.False(t, runtimes[0].Cost.Valid)
+		}
+	})
+}
+
+func TestBoilerHeatDemand(t *testing.T) {
+
+	t.Run("ReturnsRelayDemandIfReported", func(t *testing.T) {
+
+		zoneInfoMap := map[int64]ZoneInfo{
+			0:   {ID: 0, Name: "Woonkamer", HeatDemand: 0.8},
+			252: {ID: 252, HeatDemand: 0.4},
+		}
+
+		// act
+		demand := boilerHeatDemand(zoneInfoMap, []string{"Woonkamer"})
+
+		assert.Equal(t, bigquery.NullFloat64{Float64: 0.4, Valid: true}, demand)
+	})
+
+	t.Run("IgnoresDemandOfValves", func(t *testing.T) {
+
+		zoneInfoMap := map[int64]ZoneInfo{
+			0:    {ID: 0, Name: "Woonkamer", HeatDemand: 0.3},
+			0xF9: {ID: 0xF9, HeatDemand: 1},
+			0xFA: {ID: 0xFA, HeatDemand: 1},
+		}
+
+		// act
+		demand := boilerHeatDemand(zoneInfoMap, []string{"Woonkamer"})
+
+		assert.Equal(t, bigquery.NullFloat64{Float64: 0.3, Valid: true}, demand)
+	})
+
+	t.Run("ReturnsHighestZoneDemandWithoutRelay", func(t *testing.T) {
+
+		zoneInfoMap := map[int64]ZoneInfo{
+			0: {ID: 0, Name: "Woonkamer", HeatDemand: 0.8},
+			1: {ID: 1, Name: "Badkamer", HeatDemand: 0.3},
+		}
+
+		// act
+		demand := boilerHeatDemand(zoneInfoMap, []string{"Woonkamer", "Badkamer"})
+
+		assert.Equal(t, bigquery.NullFloat64{Float64: 0.8, Valid: true}, demand)
+	})
+
+	t.Run("ReturnsHighestDemandOfLocationZonesOnly", func(t *testing.T) {
+
+		zoneInfoMap := map[int64]ZoneInfo{
+			0: {ID: 0, Name: "Woonkamer", HeatDemand: 0.8},
+			1: {ID: 1, Name: "Badkamer", HeatDemand: 0.3},
+		}
+
+		// act
+		demand := boilerHeatDemand(zoneInfoMap, []string{"Badkamer", "Keuken"})
+
+		assert.Equal(t, bigquery.NullFloat64{Float64: 0.3, Valid: true}, demand)
+	})
+
+	t.Run("ReturnsNullIfNoLocationZoneIsInState", func(t *testing.T) {
+
+		zoneInfoMap := map[int64]ZoneInfo{
+			0:   {ID: 0, Name: "Woonkamer", HeatDemand: 0.8},
+			252: {ID: 252, HeatDemand: 0.4},
+		}
+
+		// act
+		demand := boilerHeatDemand(zoneInfoMap, []string{"Zolder"})
+
+		assert.False(t, demand.Valid)
+	})
+
+	t.Run("ReturnsNullWithoutState", func(t *testing.T) {
+
+		// act
+		demand := boilerHeatDemand(map[int64]ZoneInfo{}, []string{"Woonkamer"})
+
+		assert.False(t, demand.Valid)
+	})
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+)
+
+const (
+	// comfortMaxSampleGap is the longest gap between two zone samples that still counts as covered time
+	comfortMaxSampleGap = 15 * time.Minute
+
+	// comfortMinSetpointStep is the least setpoint increase that counts as a schedule step
+	comfortMinSetpointStep = 0.5
+)
+
+type comfortSummaryKey struct {
+	zone zoneKey
+	day  civil.Date
+}
+
+type comfortSummarySums struct {
+	samples              int
+	coveredMinutes       float64
+	minutesBelowSetpoint float64
+	overshoot            float64
+	overshootSamples     int
+	setpointSteps        int
+	setpointStepsReached int
+	minutesToSetpoint    float64
+}
+
+// setpointStep is a schedule step that raised the setpoint, waiting for the zone to reach it
+type setpointStep struct {
+	at       time.Time
+	setpoint float64
+	sums     *comfortSummarySums
+}
+
+// summarizeComfort summarizes per zone, told apart by account and location id, per day in the location's time zone how well the zone kept up with its setpoint: the minutes it was more than belowSetpointDelta below it, how far it went over it on average, how long it took to come within belowSetpointDelta of the setpoint after the setpoint was raised, and a comfort score being the percentage of covered time it wasn't too far below the setpoint
+func summarizeComfort(samples []BigQueryZoneSample, belowSetpointDelta float64, computedAt time.Time) []BigQueryComfortSummary {
+	samplesPerZone := map[zoneKey][]BigQueryZoneSample{}
+	for _, s := range samples {
+		samplesPerZone[s.zoneKey()] = append(samplesPerZone[s.zoneKey()], s)
+	}
+	names := locationNames(samples)
+
+	// days are split at the location's midnight like the degree-days, so both can be joined
+	timeZones := recordedTimeZones{}
+	localDay := func(s BigQueryZoneSample) civil.Date {
+		return civil.DateOf(s.MeasuredAt.In(timeZones.get(s.TimeZoneID, s.TimeZoneOffsetMinutes)))
+	}
+
+	sums := map[comfortSummaryKey]*comfortSummarySums{}
+	daySums := func(s BigQueryZoneSample) *comfortSummarySums {
+		key := comfortSummaryKey{zone: s.zoneKey(), day: localDay(s)}
+		if _, ok := sums[key]; !ok {
+			sums[key] = &comfortSummarySums{}
+		}
+		return sums[key]
+	}
+
+	for _, zoneSamples := range samplesPerZone {
+		sort.Slice(zoneSamples, func(i, j int) bool {
+			return zoneSamples[i].MeasuredAt.Before(zoneSamples[j].MeasuredAt)
+		})
+
+		var step *setpointStep
+		for i, s := range zoneSamples {
+			if !s.HeatSetpoint.Valid {
+				step = nil
+				continue
+			}
+
+			current := daySums(s)
+			current.samples++
+			setpoint := s.HeatSetpoint.Float64
+			if s.Temperature > setpoint {
+				current.overshoot += s.Temperature - setpoint
+				current.overshootSamples++
+			}
+
+			if i > 0 {
+				previous := zoneSamples[i-1]
+				gap := s.MeasuredAt.Sub(previous.MeasuredAt)
+				if gap <= 0 || gap > comfortMaxSampleGap || !previous.HeatSetpoint.Valid {
+					step = nil
+				} else {
+					// the interval counts towards the day it starts in
+					previousSums := daySums(previous)
+					previousSums.coveredMinutes += gap.Minutes()
+					if previous.Temperature < previous.HeatSetpoint.Float64-belowSetpointDelta {
+						previousSums.minutesBelowSetpoint += gap.Minutes()
+					}
+
+					if setpoint >= previous.HeatSetpoint.Float64+comfortMinSetpointStep {
+						step = &setpointStep{at: s.MeasuredAt, setpoint: setpoint, sums: current}
+						current.setpointSteps++
+					}
+				}
+			}
+
+			if step == nil {
+				continue
+			}
+			if setpoint < step.setpoint {
+				// lowered again before it was reached
+				step = nil
+				continue
+			}
+			if s.Temperature >= step.setpoint-belowSetpointDelta {
+				step.sums.setpointStepsReached++
+				step.sums.minutesToSetpoint += s.MeasuredAt.Sub(step.at).Minutes()
+				step = nil
+			}
+		}
+	}
+
+	summaries := []BigQueryComfortSummary{}
+	for key, s := range sums {
+		if s.coveredMinutes == 0 {
+			continue
+		}
+
+		avgOvershoot := bigquery.NullFloat64{}
+		if s.overshootSamples > 0 {
+			avgOvershoot = bigquery.NullFloat64{Float64: s.overshoot / float64(s.overshootSamples), Valid: true}
+		}
+		avgMinutesToSetpoint := bigquery.NullFloat64{}
+		if s.setpointStepsReached > 0 {
+			avgMinutesToSetpoint = bigquery.NullFloat64{Float64: s.minutesToSetpoint / float64(s.setpointStepsReached), Valid: true}
+		}
+
+		summaries = append(summaries, BigQueryComfortSummary{
+			Location:             names[key.zone.location],
+			LocationID:           key.zone.location.locationID,
+			Account:              bigquery.NullString{StringVal: key.zone.location.account, Valid: true},
+			Zone:                 key.zone.zone,
+			Day:                  key.day,
+			BelowSetpointDelta:   belowSetpointDelta,
+			Samples:              s.samples,
+			CoveredMinutes:       s.coveredMinutes,
+			MinutesBelowSetpoint: s.minutesBelowSetpoint,
+			AvgOvershoot:         avgOvershoot,
+			SetpointSteps:        s.setpointSteps,
+			SetpointStepsReached: s.setpointStepsReached,
+			AvgMinutesToSetpoint: avgMinutesToSetpoint,
+			ComfortScore:         100 * (1 - s.minutesBelowSetpoint/s.coveredMinutes),
+			ComputedAt:           computedAt,
+		})
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Account != summaries[j].Account {
+			return summaries[i].Account.StringVal < summaries[j].Account.StringVal
+		}
+		if summaries[i].LocationID != summaries[j].LocationID {
+			return summaries[i].LocationID < summaries[j].LocationID
+		}
+		if summaries[i].Zone != summaries[j].Zone {
+			return summaries[i].Zone < summaries[j].Zone
+		}
+		return summaries[i].Day.Before(summaries[j].Day)
+	})
+
+	return summaries
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSummarizeComfort(t *testing.T) {
+
+	start := time.Date(2020, 11, 1, 6, 0, 0, 0, time.UTC)
+	computedAt := time.Date(2020, 11, 2, 0, 0, 0, 0, time.UTC)
+
+	// zoneSamples returns samples 5 minutes apart from pairs of temperature and setpoint
+	zoneSamples := func(values ...[2]float64) (samples []BigQueryZoneSample) {
+		for i, v := range values {
+			samples = append(samples, BigQueryZoneSample{
+				Location:     "Thuis",
+				LocationID:   1234,
+				Zone:         "Woonkamer",
+				MeasuredAt:   start.Add(time.Duration(i) * 5 * time.Minute),
+				Temperature:  v[0],
+				HeatSetpoint: bigquery.NullFloat64{Float64: v[1], Valid: true},
+			})
+		}
+		return
+	}
+
+	t.Run("SummarizesSetpointStepUntilReached", func(t *testing.T) {
+
+		// the setpoint is raised from 16 to 20 in the second sample, which is reached 15 minutes later and then overshot, like the first sample overshot the lower setpoint
+		samples := zoneSamples([2]float64{17, 16}, [2]float64{17, 20}, [2]float64{18, 20}, [2]float64{19, 20}, [2]float64{19.6, 20}, [2]float64{20.4, 20}, [2]float64{20.2, 20})
+
+		// act
+		summaries := summarizeComfort(samples, 0.5, computedAt)
+
+		if assert.Equal(t, 1, len(summaries)) {
+			s := summaries[0]
+			assert.Equal(t, civil.Date{Year: 2020, Month: 11, Day: 1}, s.Day)
+			assert.Equal(t, 1234, s.LocationID)
+			assert.Equal(t, 7, s.Samples)
+			assert.Equal(t, 30.0, s.CoveredMinutes)
+			assert.Equal(t, 15.0, s.MinutesBelowSetpoint)
+			assert.InDelta(t, (1+0.4+0.2)/3, s.AvgOvershoot.Float64, 0.0001)
+			assert.Equal(t, 1, s.SetpointSteps)
+			assert.Equal(t, 1, s.SetpointStepsReached)
+			assert.Equal(t, 15.0, s.AvgMinutesToSetpoint.Float64)
+			assert.InDelta(t, 50.0, s.ComfortScore, 0.0001)
+			assert.Equal(t, 0.5, s.BelowSetpointDelta)
+			assert.Equal(t, computedAt, s.ComputedAt)
+		}
+	})
+
+	t.Run("DoesNotCountStepLoweredBeforeReached", func(t *testing.T) {
+
+		samples := zoneSamples([2]float64{17, 16}, [2]float64{17, 20}, [2]float64{17.5, 20}, [2]float64{17.5, 16}, [2]float64{17.5, 16})
+
+		// act
+		summaries := summarizeComfort(samples, 0.5, computedAt)
+
+		if assert.Equal(t, 1, len(summaries)) {
+			assert.Equal(t, 1, summaries[0].SetpointSteps)
+			assert.Equal(t, 0, summaries[0].SetpointStepsReached)
+			assert.False(t, summaries[0].AvgMinutesToSetpoint.Valid)
+		}
+	})
+
+	t.Run("DoesNotCoverGapsBetweenSamples", func(t *testing.T) {
+
+		samples := zoneSamples([2]float64{20, 20}, [2]float64{20, 20})
+		samples[1].MeasuredAt = start.Add(time.Hour)
+
+		// act
+		summaries := summarizeComfort(samples, 0.5, computedAt)
+
+		assert.Equal(t, 0, len(summaries))
+	})
+
+	t.Run("SplitsDaysAtMidnightInLocationTimeZone", func(t *testing.T) {
+
+		samples := zoneSamples([2]float64{20, 20}, [2]float64{20, 20}, [2]float64{20, 20}, [2]float64{20, 20}, [2]float64{20, 20})
+		for i := range samples {
+			// 22:50 to 23:10 utc is 23:50 to 00:10 in amsterdam
+			samples[i].MeasuredAt = time.Date(2020, 11, 1, 22, 50, 0, 0, time.UTC).Add(time.Duration(i) * 5 * time.Minute)
+			samples[i].TimeZoneID = "W. Europe Standard Time"
+			samples[i].TimeZoneOffsetMinutes = 60
+		}
+
+		// act
+		summaries := summarizeComfort(samples, 0.5, computedAt)
+
+		if assert.Equal(t, 2, len(summaries)) {
+			assert.Equal(t, civil.Date{Year: 2020, Month: 11, Day: 1}, summaries[0].Day)
+			assert.Equal(t, 10.0, summaries[0].CoveredMinutes)
+			assert.Equal(t, civil.Date{Year: 2020, Month: 11, Day: 2}, summaries[1].Day)
+			assert.Equal(t, 10.0, summaries[1].CoveredMinutes)
+		}
+	})
+	t.Run("KeysOnAccountAndLocationIDNamedAfterLatestSample", func(t *testing.T) {
+
+		samples := zoneSamples([2]float64{20, 20}, [2]float64{20, 20}, [2]float64{20, 20})
+		samples[2].Location = "Huis"
+		other := zoneSamples([2]float64{20, 20}, [2]float64{20, 20})
+		for i := range other {
+			other[i].Account = "oma"
+		}
+
+		// act
+		summaries := summarizeComfort(append(samples, other...), 0.5, computedAt)
+
+		if assert.Equal(t, 2, len(summaries)) {
+			assert.Equal(t, "", summaries[0].Account.StringVal)
+			assert.Equal(t, "Huis", summaries[0].Location)
+			assert.Equal(t, 10.0, summaries[0].CoveredMinutes)
+			assert.Equal(t, "oma", summaries[1].Account.StringVal)
+			assert.Equal(t, "Thuis", summaries[1].Location)
+			assert.Equal(t, 1234, summaries[1].LocationID)
+			assert.Equal(t, 5.0, summaries[1].CoveredMinutes)
+		}
+	})
+}
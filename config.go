@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/kingpin"
+	"gopkg.in/yaml.v3"
+)
+
+// redactedValue replaces the values of secrets when printing the config
+const redactedValue = "REDACTED"
+
+// config is the typed configuration; every field with a flag tag can be set in the --config yaml file, with flags and environment variables overriding it
+type config struct {
+	Evohome       evohomeConfig       `yaml:"evohome"`
+	Kubernetes    kubernetesConfig    `yaml:"kubernetes"`
+	HGI80         hgi80Config         `yaml:"hgi80"`
+	Recording     recordingConfig     `yaml:"recording"`
+	BigQuery      bigqueryConfig      `yaml:"bigquery"`
+	DegreeDays    degreeDaysConfig    `yaml:"degreeDays"`
+	BoilerRuntime boilerRuntimeConfig `yaml:"boilerRuntime"`
+	Events        eventsConfig        `yaml:"events"`
+	Alerts        alertsConfig        `yaml:"alerts"`
+	Validation    validationConfig    `yaml:"validation"`
+
+	RunTimeoutSeconds int `yaml:"runTimeoutSeconds" flag:"run-timeout-seconds"`
+}
+
+type evohomeConfig struct {
+	Username     string `yaml:"username" flag:"username"`
+	Password     string `yaml:"password" flag:"password"`
+	AccountsPath string `yaml:"accountsPath" flag:"accounts-path"`
+
+	// Accounts can be given inline instead of in the file at AccountsPath
+	Accounts []account `yaml:"accounts,omitempty"`
+
+	AccountConcurrency     int      `yaml:"accountConcurrency" flag:"account-concurrency"`
+	SessionTimeoutMinutes  int      `yaml:"sessionTimeoutMinutes" flag:"session-timeout-minutes"`
+	RateLimitRequests      int      `yaml:"rateLimitRequests" flag:"rate-limit-requests"`
+	RateLimitWindowSeconds int      `yaml:"rateLimitWindowSeconds" flag:"rate-limit-window-seconds"`
+	OutdoorZoneName        string   `yaml:"outdoorZoneName" flag:"outdoor-zone-name"`
+	IncludeLocations       []string `yaml:"includeLocations" flag:"include-location"`
+	ExcludeLocations       []string `yaml:"excludeLocations" flag:"exclude-location"`
+	OwnedLocationsOnly     bool     `yaml:"ownedLocationsOnly" flag:"owned-locations-only"`
+}
+
+type kubernetesConfig struct {
+	Namespace         string `yaml:"namespace" flag:"namespace"`
+	SessionSecretName string `yaml:"sessionSecretName" flag:"session-secret-name"`
+	SessionSecretPath string `yaml:"sessionSecretPath" flag:"session-secret-path"`
+}
+
+type hgi80Config struct {
+	StateFilePath string `yaml:"stateFilePath" flag:"state-file-path"`
+}
+
+type recordingConfig struct {
+	RecordDir       string `yaml:"recordDir" flag:"record-dir"`
+	ReplayDir       string `yaml:"replayDir" flag:"replay-dir"`
+	RawArchiveTable string `yaml:"rawArchiveTable" flag:"raw-archive-table"`
+	RawArchiveDir   string `yaml:"rawArchiveDir" flag:"raw-archive-dir"`
+}
+
+type bigqueryConfig struct {
+	ProjectID                string `yaml:"projectID" flag:"bigquery-project-id"`
+	Dataset                  string `yaml:"dataset" flag:"bigquery-dataset"`
+	Table                    string `yaml:"table" flag:"bigquery-table"`
+	Endpoint                 string `yaml:"endpoint" flag:"bigquery-endpoint"`
+	CredentialsFile          string `yaml:"credentialsFile" flag:"bigquery-credentials-file"`
+	Location                 string `yaml:"location" flag:"bigquery-location"`
+	CreateDataset            bool   `yaml:"createDataset" flag:"create-dataset"`
+	ZoneTable                string `yaml:"zoneTable" flag:"zone-table"`
+	WriteMethod              string `yaml:"writeMethod" flag:"bigquery-write-method"`
+	StreamType               string `yaml:"streamType" flag:"bigquery-stream-type"`
+	StreamStatePath          string `yaml:"streamStatePath" flag:"bigquery-stream-state-path"`
+	BatchBufferDir           string `yaml:"batchBufferDir" flag:"batch-buffer-dir"`
+	BatchLoadIntervalMinutes int    `yaml:"batchLoadIntervalMinutes" flag:"batch-load-interval-minutes"`
+	InsertIDBucketSeconds    int    `yaml:"insertIDBucketSeconds" flag:"insert-id-bucket-seconds"`
+	PartitionType            string `yaml:"partitionType" flag:"partition-type"`
+	PartitionExpirationDays  int    `yaml:"partitionExpirationDays" flag:"partition-expiration-days"`
+	RequirePartitionFilter   bool   `yaml:"requirePartitionFilter" flag:"require-partition-filter"`
+	ClusterByLocation        bool   `yaml:"clusterByLocation" flag:"cluster-by-location"`
+	Rollups                  bool   `yaml:"rollups" flag:"rollups"`
+	RollupRefreshMinutes     int    `yaml:"rollupRefreshMinutes" flag:"rollup-refresh-minutes"`
+	RollupRefreshDays        int    `yaml:"rollupRefreshDays" flag:"rollup-refresh-days"`
+}
+
+type degreeDaysConfig struct {
+	Table           string  `yaml:"table" flag:"degree-days-table"`
+	BaseTemperature float64 `yaml:"baseTemperature" flag:"degree-days-base-temperature"`
+	RefreshMinutes  int     `yaml:"refreshMinutes" flag:"degree-days-refresh-minutes"`
+	RefreshDays     int     `yaml:"refreshDays" flag:"degree-days-refresh-days"`
+}
+
+type boilerRuntimeConfig struct {
+	Table                 string  `yaml:"table" flag:"boiler-runtime-table"`
+	RefreshMinutes        int     `yaml:"refreshMinutes" flag:"boiler-runtime-refresh-minutes"`
+	CapacityKW            float64 `yaml:"capacityKW" flag:"boiler-capacity-kw"`
+	Efficiency            float64 `yaml:"efficiency" flag:"boiler-efficiency"`
+	GasCalorificValue     float64 `yaml:"gasCalorificValue" flag:"gas-calorific-value"`
+	GasPrice              float64 `yaml:"gasPrice" flag:"gas-price"`
+	MetricsPushgatewayURL string  `yaml:"metricsPushgatewayURL" flag:"metrics-pushgateway-url"`
+}
+
+type eventsConfig struct {
+	Table                   string  `yaml:"table" flag:"events-table"`
+	WebhookURL              string  `yaml:"webhookURL" flag:"events-webhook-url"`
+	OpenWindowDrop          float64 `yaml:"openWindowDrop" flag:"open-window-drop"`
+	OpenWindowMinutes       int     `yaml:"openWindowMinutes" flag:"open-window-minutes"`
+	OpenWindowMinHeatDemand float64 `yaml:"openWindowMinHeatDemand" flag:"open-window-min-heat-demand"`
+}
+
+type alertsConfig struct {
+	RulesPath string `yaml:"rulesPath" flag:"alert-rules-path"`
+
+	// Rules can be given inline instead of in the file at RulesPath
+	Rules []alertRule `yaml:"rules,omitempty"`
+
+	EvohomeSettings bool     `yaml:"evohomeSettings" flag:"alert-evohome-settings"`
+	StatePath       string   `yaml:"statePath" flag:"alert-state-path"`
+	WebhookURLs     []string `yaml:"webhookURLs" flag:"alert-webhook-url"`
+	SMTPAddress     string   `yaml:"smtpAddress" flag:"alert-smtp-address"`
+	SMTPFrom        string   `yaml:"smtpFrom" flag:"alert-smtp-from"`
+	SMTPTo          []string `yaml:"smtpTo" flag:"alert-smtp-to"`
+}
+
+type validationConfig struct {
+	MinIndoorTemperature  float64 `yaml:"minIndoorTemperature" flag:"min-indoor-temperature"`
+	MaxIndoorTemperature  float64 `yaml:"maxIndoorTemperature" flag:"max-indoor-temperature"`
+	MinOutdoorTemperature float64 `yaml:"minOutdoorTemperature" flag:"min-outdoor-temperature"`
+	MaxOutdoorTemperature float64 `yaml:"maxOutdoorTemperature" flag:"max-outdoor-temperature"`
+	MinHeatSetpoint       float64 `yaml:"minHeatSetpoint" flag:"min-heat-setpoint"`
+	MaxHeatSetpoint       float64 `yaml:"maxHeatSetpoint" flag:"max-heat-setpoint"`
+	MinHumidity           float64 `yaml:"minHumidity" flag:"min-humidity"`
+	MaxHumidity           float64 `yaml:"maxHumidity" flag:"max-humidity"`
+	InvalidValueAction    string  `yaml:"invalidValueAction" flag:"invalid-value-action"`
+}
+
+// readConfigFile reads the yaml config file, rejecting unknown keys and values of the wrong type
+func readConfigFile(path string) (c config, present map[string]interface{}, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, nil, err
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err = decoder.Decode(&c); err != nil && !errors.Is(err, io.EOF) {
+		return c, nil, fmt.Errorf("Unmarshalling config from %v failed: %w", path, err)
+	}
+
+	// the typed config can't tell a key set to its zero value from a missing key, so flags are only set for the keys in the file
+	present = map[string]interface{}{}
+	if err = yaml.Unmarshal(data, &present); err != nil {
+		return c, nil, fmt.Errorf("Unmarshalling config from %v failed: %w", path, err)
+	}
+
+	return c, present, nil
+}
+
+// applyConfigFile sets the flags for the keys in the config file that weren't given on the command line or in their environment variable, and returns the config file's values
+func applyConfigFile(app *kingpin.Application, args []string, path string) (config, error) {
+	c, present, err := readConfigFile(path)
+	if err != nil {
+		return c, err
+	}
+
+	context, err := app.ParseContext(args)
+	if err != nil {
+		return c, err
+	}
+	onCommandLine := map[string]bool{}
+	for _, e := range context.Elements {
+		if f, ok := e.Clause.(*kingpin.FlagClause); ok {
+			onCommandLine[f.Model().Name] = true
+		}
+	}
+
+	err = visitConfigFlags(reflect.ValueOf(c), present, "", func(key, name string, value reflect.Value) error {
+		flag := app.GetFlag(name)
+		if flag == nil {
+			return fmt.Errorf("Config key %v sets unknown flag --%v", key, name)
+		}
+		if onCommandLine[name] || flag.HasEnvarValue() {
+			return nil
+		}
+
+		values := []string{fmt.Sprint(value.Interface())}
+		if value.Kind() == reflect.Slice {
+			values = value.Interface().([]string)
+		}
+		for _, v := range values {
+			if err := flag.Model().Value.Set(v); err != nil {
+				return fmt.Errorf("Config key %v has invalid value %q: %w", key, v, err)
+			}
+		}
+
+		return nil
+	})
+
+	return c, err
+}
+
+// visitConfigFlags calls visit for every field with a flag whose key is present in the config file
+func visitConfigFlags(v reflect.Value, present map[string]interface{}, prefix string, visit func(key, flag string, value reflect.Value) error) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if value, ok := present[name]; !ok || value == nil {
+			continue
+		}
+
+		if field.Type.Kind() == reflect.Struct {
+			nested, _ := present[name].(map[string]interface{})
+			if err := visitConfigFlags(v.Field(i), nested, prefix+name+".", visit); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if flag := field.Tag.Get("flag"); flag != "" {
+			if err := visit(prefix+name, flag, v.Field(i)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// configKeyFlags returns the flag of every config key
+func configKeyFlags(t reflect.Type, prefix string) map[string]string {
+	flags := map[string]string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if field.Type.Kind() == reflect.Struct {
+			for key, flag := range configKeyFlags(field.Type, prefix+name+".") {
+				flags[key] = flag
+			}
+			continue
+		}
+		if flag := field.Tag.Get("flag"); flag != "" {
+			flags[prefix+name] = flag
+		}
+	}
+
+	return flags
+}
+
+// describeConfigKey names the config key together with its flag, so errors tell both ways of setting it
+func describeConfigKey(key string) string {
+	if flag, ok := configKeyFlags(reflect.TypeOf(config{}), "")[key]; ok {
+		return fmt.Sprintf("%v (--%v)", key, flag)
+	}
+
+	return key
+}
+
+// validate checks the effective config and returns all problems at once; credentials are only required for exporting from the evohome api
+func (c config) validate(requireCredentials bool) error {
+	errs := []error{}
+	fail := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+
+	for key, value := range map[string]string{
+		"bigquery.projectID": c.BigQuery.ProjectID,
+		"bigquery.dataset":   c.BigQuery.Dataset,
+		"bigquery.table":     c.BigQuery.Table,
+	} {
+		if value == "" {
+			fail("%v is required", describeConfigKey(key))
+		}
+	}
+
+	if (c.Evohome.Username == "") != (c.Evohome.Password == "") {
+		fail("%v and %v have to be set together", describeConfigKey("evohome.username"), describeConfigKey("evohome.password"))
+	}
+	if c.Evohome.AccountsPath != "" && len(c.Evohome.Accounts) > 0 {
+		fail("%v and evohome.accounts can't both be set", describeConfigKey("evohome.accountsPath"))
+	}
+	if c.Evohome.AccountsPath != "" {
+		if _, err := readAccounts(c.Evohome.AccountsPath); err != nil {
+			fail("%v is invalid: %w", describeConfigKey("evohome.accountsPath"), err)
+		}
+	}
+	if len(c.Evohome.Accounts) > 0 {
+		if err := validateAccounts(c.Evohome.Accounts); err != nil {
+			fail("evohome.accounts is invalid: %w", err)
+		}
+	}
+	if requireCredentials {
+		if c.Evohome.Username == "" && c.Evohome.AccountsPath == "" && len(c.Evohome.Accounts) == 0 {
+			fail("%v and %v, %v or evohome.accounts are required", describeConfigKey("evohome.username"), describeConfigKey("evohome.password"), describeConfigKey("evohome.accountsPath"))
+		}
+		if c.Kubernetes.Namespace == "" {
+			fail("%v is required", describeConfigKey("kubernetes.namespace"))
+		}
+	}
+
+	if c.Alerts.RulesPath != "" && len(c.Alerts.Rules) > 0 {
+		fail("%v and alerts.rules can't both be set", describeConfigKey("alerts.rulesPath"))
+	}
+	if c.Alerts.RulesPath != "" {
+		if _, err := readAlertRules(c.Alerts.RulesPath); err != nil {
+			fail("%v is invalid: %w", describeConfigKey("alerts.rulesPath"), err)
+		}
+	}
+	if len(c.Alerts.Rules) > 0 {
+		if err := validateAlertRules(c.Alerts.Rules); err != nil {
+			fail("alerts.rules is invalid: %w", err)
+		}
+	}
+	if c.Alerts.SMTPAddress != "" && len(c.Alerts.SMTPTo) == 0 {
+		fail("%v is required for mailing alert notifications", describeConfigKey("alerts.smtpTo"))
+	}
+
+	// the derived tables read the deduplicated view, whose window function keeps a filter on measured_at from reaching the table
+	if c.BigQuery.RequirePartitionFilter {
+		for key, enabled := range map[string]bool{
+			"bigquery.rollups":    c.BigQuery.Rollups,
+			"degreeDays.table":    c.DegreeDays.Table != "",
+			"boilerRuntime.table": c.BoilerRuntime.Table != "",
+			"events.table":        c.Events.Table != "",
+		} {
+			if enabled {
+				fail("%v can't be combined with %v, it reads the deduplicated view which can't pass on a partition filter", describeConfigKey(key), describeConfigKey("bigquery.requirePartitionFilter"))
+			}
+		}
+	}
+
+	for key, value := range map[string]int{
+		"evohome.accountConcurrency":        c.Evohome.AccountConcurrency,
+		"evohome.sessionTimeoutMinutes":     c.Evohome.SessionTimeoutMinutes,
+		"evohome.rateLimitRequests":         c.Evohome.RateLimitRequests,
+		"evohome.rateLimitWindowSeconds":    c.Evohome.RateLimitWindowSeconds,
+		"bigquery.batchLoadIntervalMinutes": c.BigQuery.BatchLoadIntervalMinutes,
+		"bigquery.insertIDBucketSeconds":    c.BigQuery.InsertIDBucketSeconds,
+		"bigquery.rollupRefreshDays":        c.BigQuery.RollupRefreshDays,
+		"degreeDays.refreshDays":            c.DegreeDays.RefreshDays,
+		"events.openWindowMinutes":          c.Events.OpenWindowMinutes,
+		"runTimeoutSeconds":                 c.RunTimeoutSeconds,
+	} {
+		if value <= 0 {
+			fail("%v has to be positive, not %v", describeConfigKey(key), value)
+		}
+	}
+	for key, value := range map[string]int{
+		"bigquery.partitionExpirationDays": c.BigQuery.PartitionExpirationDays,
+		"bigquery.rollupRefreshMinutes":    c.BigQuery.RollupRefreshMinutes,
+		"degreeDays.refreshMinutes":        c.DegreeDays.RefreshMinutes,
+		"boilerRuntime.refreshMinutes":     c.BoilerRuntime.RefreshMinutes,
+	} {
+		if value < 0 {
+			fail("%v can't be negative, not %v", describeConfigKey(key), value)
+		}
+	}
+	for key, value := range map[string]float64{
+		"boilerRuntime.capacityKW":        c.BoilerRuntime.CapacityKW,
+		"boilerRuntime.gasCalorificValue": c.BoilerRuntime.GasCalorificValue,
+		"boilerRuntime.gasPrice":          c.BoilerRuntime.GasPrice,
+		"events.openWindowDrop":           c.Events.OpenWindowDrop,
+		"events.openWindowMinHeatDemand":  c.Events.OpenWindowMinHeatDemand,
+	} {
+		if value < 0 {
+			fail("%v can't be negative, not %v", describeConfigKey(key), value)
+		}
+	}
+	if c.BoilerRuntime.Efficiency <= 0 || c.BoilerRuntime.Efficiency > 1 {
+		fail("%v has to be a fraction above 0 and at most 1, not %v", describeConfigKey("boilerRuntime.efficiency"), c.BoilerRuntime.Efficiency)
+	}
+
+	for _, r := range []struct {
+		minKey, maxKey string
+		min, max       float64
+	}{
+		{"validation.minIndoorTemperature", "validation.maxIndoorTemperature", c.Validation.MinIndoorTemperature, c.Validation.MaxIndoorTemperature},
+		{"validation.minOutdoorTemperature", "validation.maxOutdoorTemperature", c.Validation.MinOutdoorTemperature, c.Validation.MaxOutdoorTemperature},
+		{"validation.minHeatSetpoint", "validation.maxHeatSetpoint", c.Validation.MinHeatSetpoint, c.Validation.MaxHeatSetpoint},
+		{"validation.minHumidity", "validation.maxHumidity", c.Validation.MinHumidity, c.Validation.MaxHumidity},
+	} {
+		if r.min > r.max {
+			fail("%v %v is above %v %v", describeConfigKey(r.minKey), r.min, describeConfigKey(r.maxKey), r.max)
+		}
+	}
+
+	// map iteration order is random, sort so the same config always gives the same errors
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+
+	return errors.Join(errs...)
+}
+
+// redacted returns a copy of the config with passwords and webhook urls, which usually contain a token, replaced
+func (c config) redacted() config {
+	redact := func(value string) string {
+		if value == "" {
+			return ""
+		}
+		return redactedValue
+	}
+
+	c.Evohome.Password = redact(c.Evohome.Password)
+	if c.Evohome.Accounts != nil {
+		accounts := make([]account, len(c.Evohome.Accounts))
+		for i, a := range c.Evohome.Accounts {
+			a.Password = redact(a.Password)
+			accounts[i] = a
+		}
+		c.Evohome.Accounts = accounts
+	}
+
+	c.Events.WebhookURL = redact(c.Events.WebhookURL)
+	if c.Alerts.WebhookURLs != nil {
+		urls := make([]string, len(c.Alerts.WebhookURLs))
+		for i, url := range c.Alerts.WebhookURLs {
+			urls[i] = redact(url)
+		}
+		c.Alerts.WebhookURLs = urls
+	}
+
+	return c
+}
+
+// redactedYAML returns the config as yaml with its secrets redacted, for printing it
+func (c config) redactedYAML() ([]byte, error) {
+	return yaml.Marshal(c.redacted())
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/kingpin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyConfigFile(t *testing.T) {
+
+	writeConfig := func(t *testing.T, content string) string {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+		return path
+	}
+
+	// parse registers a few of the flags in the config on a fresh application, so the tests don't change the global flags
+	type testFlags struct {
+		projectID          *string
+		rateLimitRequests  *int
+		writeMethod        *string
+		includeLocations   *[]string
+		ownedLocationsOnly *bool
+	}
+	parse := func(t *testing.T, path string, args ...string) (testFlags, config, error) {
+		app := kingpin.New("test", "")
+		flags := testFlags{
+			projectID:          app.Flag("bigquery-project-id", "").Envar("TEST_BQ_PROJECT_ID").String(),
+			rateLimitRequests:  app.Flag("rate-limit-requests", "").Default("10").Int(),
+			writeMethod:        app.Flag("bigquery-write-method", "").Default("streaming").Enum("streaming", "batch"),
+			includeLocations:   app.Flag("include-location", "").Strings(),
+			ownedLocationsOnly: app.Flag("owned-locations-only", "").Default("false").Bool(),
+		}
+		_, err := app.Parse(args)
+		assert.Nil(t, err)
+
+		c, err := applyConfigFile(app, args, path)
+		return flags, c, err
+	}
+
+	t.Run("SetsFlagsForKeysInFile", func(t *testing.T) {
+
+		path := writeConfig(t, "evohome:\n  rateLimitRequests: 5\n  includeLocations: [Thuis, \"1234\"]\n  ownedLocationsOnly: true\nbigquery:\n  projectID: my-project\n")
+
+		// act
+		flags, c, err := parse(t, path)
+
+		assert.Nil(t, err)
+		assert.Equal(t, "my-project", *flags.projectID)
+		assert.Equal(t, 5, *flags.rateLimitRequests)
+		assert.Equal(t, []string{"Thuis", "1234"}, *flags.includeLocations)
+		assert.True(t, *flags.ownedLocationsOnly)
+		assert.Equal(t, "my-project", c.BigQuery.ProjectID)
+	})
+
+	t.Run("KeepsDefaultsForKeysNotInFile", func(t *testing.T) {
+
+		path := writeConfig(t, "bigquery:\n  projectID: my-project\n")
+
+		// act
+		flags, _, err := parse(t, path)
+
+		assert.Nil(t, err)
+		assert.Equal(t, 10, *flags.rateLimitRequests)
+		assert.Equal(t, "streaming", *flags.writeMethod)
+	})
+
+	t.Run("SetsFlagToZeroValueInFile", func(t *testing.T) {
+
+		path := writeConfig(t, "evohome:\n  rateLimitRequests: 0\n")
+
+		// act
+		flags, _, err := parse(t, path)
+
+		assert.Nil(t, err)
+		assert.Equal(t, 0, *flags.rateLimitRequests)
+	})
+
+	t.Run("KeepsFlagsGivenOnCommandLine", func(t *testing.T) {
+
+		path := writeConfig(t, "evohome:\n  rateLimitRequests: 5\n  includeLocations: [Thuis]\n")
+
+		// act
+		flags, _, err := parse(t, path, "--rate-limit-requests", "20", "--include-location", "Oma")
+
+		assert.Nil(t, err)
+		assert.Equal(t, 20, *flags.rateLimitRequests)
+		assert.Equal(t, []string{"Oma"}, *flags.includeLocations)
+	})
+
+	t.Run("KeepsFlagsGivenInEnvironmentVariable", func(t *testing.T) {
+
+		t.Setenv("TEST_BQ_PROJECT_ID", "env-project")
+		path := writeConfig(t, "bigquery:\n  projectID: my-project\n")
+
+		// act
+		flags, _, err := parse(t, path)
+
+		assert.Nil(t, err)
+		assert.Equal(t, "env-project", *flags.projectID)
+	})
+
+	t.Run("ReturnsErrorWithLineForUnknownKey", func(t *testing.T) {
+
+		path := writeConfig(t, "bigquery:\n  projectId: my-project\n")
+
+		// act
+		_, _, err := parse(t, path)
+
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "line 2: field projectId not found")
+		}
+	})
+
+	t.Run("ReturnsErrorWithLineForValueOfWrongType", func(t *testing.T) {
+
+		path := writeConfig(t, "evohome:\n  rateLimitRequests: many\n")
+
+		// act
+		_, _, err := parse(t, path)
+
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "line 2: cannot unmarshal")
+		}
+	})
+
+	t.Run("ReturnsErrorWithKeyForInvalidEnumValue", func(t *testing.T) {
+
+		path := writeConfig(t, "bigquery:\n  writeMethod: fast\n")
+
+		// act
+		_, _, err := parse(t, path)
+
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "bigquery.writeMethod")
+		}
+	})
+
+	t.Run("ReturnsInlineAccountsAndAlertRules", func(t *testing.T) {
+
+		path := writeConfig(t, "evohome:\n  accounts:\n    - name: thuis\n      username: me@example.com\n      password: secret\nalerts:\n  rules:\n    - name: cold\n      type: zone_below\n      threshold: 15\n      forMinutes: 30\n")
+
+		// act
+		_, c, err := parse(t, path)
+
+		assert.Nil(t, err)
+		assert.Equal(t, []account{{Name: "thuis", Username: "me@example.com", Password: "secret"}}, c.Evohome.Accounts)
+		assert.Equal(t, []alertRule{{Name: "cold", Type: alertRuleTypeZoneBelow, Threshold: 15, ForMinutes: 30}}, c.Alerts.Rules)
+	})
+}
+
+func TestConfigKeyFlags(t *testing.T) {
+
+	keyFlags := configKeyFlags(reflect.TypeOf(config{}), "")
+
+	t.Run("EveryKeySetsAnExistingFlag", func(t *testing.T) {
+
+		for key, flag := range keyFlags {
+			// act
+			clause := kingpin.CommandLine.GetFlag(flag)
+
+			assert.NotNil(t, clause, "config key %v sets unknown flag --%v", key, flag)
+		}
+	})
+
+	t.Run("EveryFlagHasAKey", func(t *testing.T) {
+
+		flags := map[string]bool{}
+		for _, flag := range keyFlags {
+			flags[flag] = true
+		}
+
+		// act
+		model := kingpin.CommandLine.Model()
+
+		for _, f := range model.Flags {
+			if f.Hidden || f.Name == "help" || f.Name == "config" {
+				continue
+			}
+			assert.True(t, flags[f.Name], "flag --%v has no config key", f.Name)
+		}
+	})
+}
+
+func TestConfigValidate(t *testing.T) {
+
+	validConfig := func() config {
+		return config{
+			Evohome:           evohomeConfig{Username: "me@example.com", Password: "secret", AccountConcurrency: 2, SessionTimeoutMinutes: 30, RateLimitRequests: 10, RateLimitWindowSeconds: 60},
+			Kubernetes:        kubernetesConfig{Namespace: "evohome"},
+			BigQuery:          bigqueryConfig{ProjectID: "my-project", Dataset: "evohome", Table: "measurements", BatchLoadIntervalMinutes: 60, InsertIDBucketSeconds: 300, RollupRefreshDays: 2},
+			DegreeDays:        degreeDaysConfig{RefreshDays: 2},
+			BoilerRuntime:     boilerRuntimeConfig{CapacityKW: 24, Efficiency: 0.9, GasCalorificValue: 9.77},
+			Events:            eventsConfig{OpenWindowMinutes: 15},
+			Validation:        validationConfig{MinIndoorTemperature: 1, MaxIndoorTemperature: 40, MinOutdoorTemperature: -40, MaxOutdoorTemperature: 50, MinHeatSetpoint: 5, MaxHeatSetpoint: 35, MinHumidity: 0, MaxHumidity: 100},
+			RunTimeoutSeconds: 210,
+		}
+	}
+
+	t.Run("ReturnsNilForValidConfig", func(t *testing.T) {
+
+		c := validConfig()
+
+		// act
+		err := c.validate(true)
+
+		assert.Nil(t, err)
+	})
+
+	t.Run("ReturnsAllProblemsNamingKeyAndFlag", func(t *testing.T) {
+
+		c := validConfig()
+		c.BigQuery.ProjectID = ""
+		c.Validation.MinHumidity = 50
+		c.Validation.MaxHumidity = 10
+		c.Alerts.SMTPAddress = "localhost:25"
+
+		// act
+		err := c.validate(true)
+
+		if assert.NotNil(t, err) {
+			assert.Equal(t, []string{
+				"alerts.smtpTo (--alert-smtp-to) is required for mailing alert notifications",
+				"bigquery.projectID (--bigquery-project-id) is required",
+				"validation.minHumidity (--min-humidity) 50 is above validation.maxHumidity (--max-humidity) 10",
+			}, strings.Split(err.Error(), "\n"))
+		}
+	})
+
+	t.Run("RequiresCredentialsOnlyWhenAsked", func(t *testing.T) {
+
+		c := validConfig()
+		c.Evohome.Username = ""
+		c.Evohome.Password = ""
+		c.Kubernetes.Namespace = ""
+
+		// act
+		err := c.validate(false)
+
+		assert.Nil(t, err)
+	})
+
+	t.Run("AcceptsInlineAccountsAsCredentials", func(t *testing.T) {
+
+		c := validConfig()
+		c.Evohome.Username = ""
+		c.Evohome.Password = ""
+		c.Evohome.Accounts = []account{{Name: "thuis", Username: "me@example.com", Password: "secret"}}
+
+		// act
+		err := c.validate(true)
+
+		assert.Nil(t, err)
+	})
+
+	t.Run("ReturnsErrorForInvalidInlineAlertRules", func(t *testing.T) {
+
+		c := validConfig()
+		c.Alerts.Rules = []alertRule{{Name: "cold", Type: "zone_warm"}}
+
+		// act
+		err := c.validate(true)
+
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "alerts.rules is invalid")
+		}
+	})
+
+	t.Run("ReturnsErrorForDerivedTablesWithRequiredPartitionFilter", func(t *testing.T) {
+
+		c := validConfig()
+		c.BigQuery.RequirePartitionFilter = true
+		c.BigQuery.Rollups = true
+		c.BoilerRuntime.Table = "boiler_runtime"
+
+		// act
+		err := c.validate(true)
+
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "bigquery.rollups (--rollups) can't be combined with bigquery.requirePartitionFilter (--require-partition-filter)")
+			assert.Contains(t, err.Error(), "boilerRuntime.table (--boiler-runtime-table) can't be combined with bigquery.requirePartitionFilter (--require-partition-filter)")
+			assert.NotContains(t, err.Error(), "degreeDays.table")
+		}
+	})
+
+	t.Run("ReturnsErrorForAlertRulesInFileAndInline", func(t *testing.T) {
+
+		c := validConfig()
+		c.Alerts.RulesPath = "/alerts/alert-rules.json"
+		c.Alerts.Rules = []alertRule{{Name: "cold", Type: alertRuleTypeZoneBelow}}
+
+		// act
+		err := c.validate(true)
+
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "alerts.rulesPath (--alert-rules-path) and alerts.rules can't both be set")
+		}
+	})
+}
+
+func TestConfigRedacted(t *testing.T) {
+
+	t.Run("ReplacesPasswordsAndWebhookURLsWithoutChangingConfig", func(t *testing.T) {
+
+		c := config{
+			Evohome: evohomeConfig{Username: "me@example.com", Password: "secret", Accounts: []account{{Name: "oma", Username: "oma@example.com", Password: "secret"}}},
+			Events:  eventsConfig{WebhookURL: "https://hooks.example.com/token"},
+			Alerts:  alertsConfig{WebhookURLs: []string{"https://hooks.example.com/token"}},
+		}
+
+		// act
+		redacted := c.redacted()
+
+		assert.Equal(t, "me@example.com", redacted.Evohome.Username)
+		assert.Equal(t, redactedValue, redacted.Evohome.Password)
+		assert.Equal(t, redactedValue, redacted.Evohome.Accounts[0].Password)
+		assert.Equal(t, redactedValue, redacted.Events.WebhookURL)
+		assert.Equal(t, []string{redactedValue}, redacted.Alerts.WebhookURLs)
+		assert.Equal(t, "secret", c.Evohome.Accounts[0].Password)
+		assert.Equal(t, "https://hooks.example.com/token", c.Alerts.WebhookURLs[0])
+	})
+}
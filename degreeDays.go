@@ -0,0 +1,140 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+)
+
+// degreeDaysMaxSampleGap is the longest gap between two outdoor samples that is still interpolated; longer gaps count as not covered
+const degreeDaysMaxSampleGap = time.Hour
+
+type degreeDayAccumulator struct {
+	deficitSeconds     float64
+	temperatureSeconds float64
+	coveredSeconds     float64
+	samples            int
+}
+
+// computeDegreeDays integrates how far the outdoor temperature stays below baseTemperature over each day in the location's time zone, interpolating linearly between samples; locations are told apart by account and location id and named after their latest sample, only days from the day containing from onwards are returned; days are in the time zone recorded with the latest sample, like the comfort summaries
+func computeDegreeDays(samples []BigQueryOutdoorTemperature, baseTemperature float64, from, computedAt time.Time) []BigQueryDegreeDay {
+	samplesPerLocation := map[locationKey][]BigQueryOutdoorTemperature{}
+	for _, s := range samples {
+		key := locationKey{account: s.Account, locationID: s.LocationID}
+		samplesPerLocation[key] = append(samplesPerLocation[key], s)
+	}
+
+	degreeDays := []BigQueryDegreeDay{}
+	timeZones := recordedTimeZones{}
+	for key, locationSamples := range samplesPerLocation {
+		sort.Slice(locationSamples, func(i, j int) bool {
+			return locationSamples[i].MeasuredAt.Before(locationSamples[j].MeasuredAt)
+		})
+		latest := locationSamples[len(locationSamples)-1]
+		timeZone := timeZones.get(latest.TimeZoneID, latest.TimeZoneOffsetMinutes)
+
+		days := map[civil.Date]*degreeDayAccumulator{}
+		day := func(t time.Time) *degreeDayAccumulator {
+			date := civil.DateOf(t.In(timeZone))
+			if _, ok := days[date]; !ok {
+				days[date] = &degreeDayAccumulator{}
+			}
+			return days[date]
+		}
+
+		for i, s := range locationSamples {
+			day(s.MeasuredAt).samples++
+			if i == 0 {
+				continue
+			}
+
+			previous := locationSamples[i-1]
+			gap := s.MeasuredAt.Sub(previous.MeasuredAt)
+			if gap <= 0 || gap > degreeDaysMaxSampleGap {
+				continue
+			}
+
+			temperatureAt := func(t time.Time) float64 {
+				return previous.Temperature + (s.Temperature-previous.Temperature)*t.Sub(previous.MeasuredAt).Seconds()/gap.Seconds()
+			}
+
+			// split the interval at midnight, so each part counts towards its own day
+			for start := previous.MeasuredAt; start.Before(s.MeasuredAt); {
+				end := s.MeasuredAt
+				if midnight := nextMidnight(start, timeZone); midnight.Before(end) {
+					end = midnight
+				}
+
+				seconds := end.Sub(start).Seconds()
+				startTemperature, endTemperature := temperatureAt(start), temperatureAt(end)
+
+				accumulator := day(start)
+				accumulator.deficitSeconds += deficitIntegral(baseTemperature-startTemperature, baseTemperature-endTemperature, seconds)
+				accumulator.temperatureSeconds += (startTemperature + endTemperature) / 2 * seconds
+				accumulator.coveredSeconds += seconds
+
+				start = end
+			}
+		}
+
+		firstDay := civil.DateOf(from.In(timeZone))
+		for date, accumulator := range days {
+			if date.Before(firstDay) || accumulator.coveredSeconds == 0 {
+				continue
+			}
+
+			midnight := date.In(timeZone)
+			dayLength := nextMidnight(midnight, timeZone).Sub(midnight).Seconds()
+
+			degreeDays = append(degreeDays, BigQueryDegreeDay{
+				Location:              latest.Location,
+				LocationID:            key.locationID,
+				Account:               bigquery.NullString{StringVal: key.account, Valid: true},
+				Day:                   date,
+				BaseTemperature:       baseTemperature,
+				DegreeDays:            accumulator.deficitSeconds / accumulator.coveredSeconds,
+				AvgOutdoorTemperature: accumulator.temperatureSeconds / accumulator.coveredSeconds,
+				Coverage:              accumulator.coveredSeconds / dayLength,
+				Samples:               accumulator.samples,
+				ComputedAt:            computedAt,
+			})
+		}
+	}
+
+	sort.Slice(degreeDays, func(i, j int) bool {
+		if degreeDays[i].Account != degreeDays[j].Account {
+			return degreeDays[i].Account.StringVal < degreeDays[j].Account.StringVal
+		}
+		if degreeDays[i].LocationID != degreeDays[j].LocationID {
+			return degreeDays[i].LocationID < degreeDays[j].LocationID
+		}
+		return degreeDays[i].Day.Before(degreeDays[j].Day)
+	})
+
+	return degreeDays
+}
+
+// nextMidnight returns the start of the day after t in the time zone
+func nextMidnight(t time.Time, timeZone *time.Location) time.Time {
+	local := t.In(timeZone)
+	return time.Date(local.Year(), local.Month(), local.Day()+1, 0, 0, 0, 0, timeZone)
+}
+
+// deficitIntegral integrates the positive part of a deficit that changes linearly from startDeficit to endDeficit over seconds
+func deficitIntegral(startDeficit, endDeficit, seconds float64) float64 {
+	switch {
+	case startDeficit >= 0 && endDeficit >= 0:
+		return (startDeficit + endDeficit) / 2 * seconds
+	case startDeficit <= 0 && endDeficit <= 0:
+		return 0
+	}
+
+	// the deficit crosses zero, only the triangle above zero counts
+	positive, negative := startDeficit, endDeficit
+	if positive < negative {
+		positive, negative = negative, positive
+	}
+	return positive / 2 * seconds * positive / (positive - negative)
+}
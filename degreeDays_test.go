@@ -0,0 +1,157 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/civil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComputeDegreeDays(t *testing.T) {
+
+	from := time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+	computedAt := time.Date(2020, 11, 3, 0, 0, 0, 0, time.UTC)
+
+	hourlySamples := func(location string, start time.Time, temperatures ...float64) (samples []BigQueryOutdoorTemperature) {
+		for i, temperature := range temperatures {
+			samples = append(samples, BigQueryOutdoorTemperature{Location: location, LocationID: 1234, MeasuredAt: start.Add(time.Duration(i) * time.Hour), Temperature: temperature})
+		}
+		return
+	}
+
+	t.Run("IntegratesDeficitBelowBaseTemperatureOverTheDay", func(t *testing.T) {
+
+		temperatures := make([]float64, 25)
+		for i := range temperatures {
+			temperatures[i] = 8
+		}
+		samples := hourlySamples("Thuis", from, temperatures...)
+
+		// act
+		degreeDays := computeDegreeDays(samples, 18, from, computedAt)
+
+		// the sample at midnight starts the next day without covering any of it, so that day is left out
+		if assert.Equal(t, 1, len(degreeDays)) {
+			assert.Equal(t, civil.Date{Year: 2020, Month: 11, Day: 1}, degreeDays[0].Day)
+			assert.Equal(t, 1234, degreeDays[0].LocationID)
+			assert.InDelta(t, 10.0, degreeDays[0].DegreeDays, 0.0001)
+			assert.InDelta(t, 8.0, degreeDays[0].AvgOutdoorTemperature, 0.0001)
+			assert.InDelta(t, 1.0, degreeDays[0].Coverage, 0.0001)
+			assert.Equal(t, 24, degreeDays[0].Samples)
+			assert.Equal(t, 18.0, degreeDays[0].BaseTemperature)
+			assert.Equal(t, computedAt, degreeDays[0].ComputedAt)
+		}
+	})
+
+	t.Run("OnlyCountsTimeBelowBaseTemperature", func(t *testing.T) {
+
+		// from 14 to 22 degrees in an hour crosses the base temperature of 18 halfway
+		samples := hourlySamples("Thuis", from, 14, 22)
+
+		// act
+		degreeDays := computeDegreeDays(samples, 18, from, computedAt)
+
+		if assert.Equal(t, 1, len(degreeDays)) {
+			// a triangle of 4 degrees over half an hour, averaged over the covered hour
+			assert.InDelta(t, 1.0, degreeDays[0].DegreeDays, 0.0001)
+			assert.InDelta(t, 18.0, degreeDays[0].AvgOutdoorTemperature, 0.0001)
+			assert.InDelta(t, 1.0/24, degreeDays[0].Coverage, 0.0001)
+		}
+	})
+
+	t.Run("SplitsDaysAtMidnightInLocationTimeZone", func(t *testing.T) {
+
+		// 22:30 to 23:30 utc is 23:30 to 00:30 local time
+		samples := hourlySamples("Thuis", from.Add(22*time.Hour+30*time.Minute), 10, 10)
+		for i := range samples {
+			samples[i].TimeZoneID, samples[i].TimeZoneOffsetMinutes = "WEurope", 60
+		}
+
+		// act
+		degreeDays := computeDegreeDays(samples, 18, from, computedAt)
+
+		if assert.Equal(t, 2, len(degreeDays)) {
+			assert.Equal(t, civil.Date{Year: 2020, Month: 11, Day: 1}, degreeDays[0].Day)
+			assert.InDelta(t, 0.5/24, degreeDays[0].Coverage, 0.0001)
+			assert.Equal(t, 1, degreeDays[0].Samples)
+			assert.Equal(t, civil.Date{Year: 2020, Month: 11, Day: 2}, degreeDays[1].Day)
+			assert.InDelta(t, 0.5/24, degreeDays[1].Coverage, 0.0001)
+			assert.InDelta(t, 8.0, degreeDays[1].DegreeDays, 0.0001)
+		}
+	})
+
+	t.Run("CoversWholeDayAcrossDaylightSavingTimeChange", func(t *testing.T) {
+
+		// 25 october 2020 lasts 25 hours in amsterdam, from 22:00 utc the day before to 23:00 utc
+		temperatures := make([]float64, 26)
+		for i := range temperatures {
+			temperatures[i] = 8
+		}
+		samples := hourlySamples("Thuis", time.Date(2020, 10, 24, 22, 0, 0, 0, time.UTC), temperatures...)
+		for i := range samples {
+			samples[i].TimeZoneID, samples[i].TimeZoneOffsetMinutes = "W. Europe Standard Time", 60
+		}
+
+		// act
+		degreeDays := computeDegreeDays(samples, 18, time.Date(2020, 10, 24, 22, 0, 0, 0, time.UTC), computedAt)
+
+		if assert.Equal(t, 1, len(degreeDays)) {
+			assert.Equal(t, civil.Date{Year: 2020, Month: 10, Day: 25}, degreeDays[0].Day)
+			assert.InDelta(t, 1.0, degreeDays[0].Coverage, 0.0001)
+			assert.InDelta(t, 10.0, degreeDays[0].DegreeDays, 0.0001)
+		}
+	})
+
+	t.Run("DoesNotInterpolateOverLongGaps", func(t *testing.T) {
+
+		samples := []BigQueryOutdoorTemperature{
+			{Location: "Thuis", MeasuredAt: from, Temperature: 10},
+			{Location: "Thuis", MeasuredAt: from.Add(30 * time.Minute), Temperature: 10},
+			{Location: "Thuis", MeasuredAt: from.Add(5 * time.Hour), Temperature: 0},
+		}
+
+		// act
+		degreeDays := computeDegreeDays(samples, 18, from, computedAt)
+
+		if assert.Equal(t, 1, len(degreeDays)) {
+			assert.InDelta(t, 8.0, degreeDays[0].DegreeDays, 0.0001)
+			assert.InDelta(t, 0.5/24, degreeDays[0].Coverage, 0.0001)
+			assert.Equal(t, 3, degreeDays[0].Samples)
+		}
+	})
+
+	t.Run("KeysOnAccountAndLocationIDNamedAfterLatestSample", func(t *testing.T) {
+
+		samples := append(hourlySamples("Thuis", from, 10, 10), hourlySamples("Huis", from.Add(2*time.Hour), 10, 10)...)
+		samples = append(samples, hourlySamples("Thuis", from, 10, 10)...)
+		for i := 4; i < len(samples); i++ {
+			samples[i].Account = "oma"
+		}
+
+		// act
+		degreeDays := computeDegreeDays(samples, 18, from, computedAt)
+
+		if assert.Equal(t, 2, len(degreeDays)) {
+			assert.Equal(t, "", degreeDays[0].Account.StringVal)
+			assert.Equal(t, "Huis", degreeDays[0].Location)
+			assert.Equal(t, 1234, degreeDays[0].LocationID)
+			assert.Equal(t, 4, degreeDays[0].Samples)
+			assert.Equal(t, "oma", degreeDays[1].Account.StringVal)
+			assert.Equal(t, "Thuis", degreeDays[1].Location)
+			assert.Equal(t, 2, degreeDays[1].Samples)
+		}
+	})
+
+	t.Run("SkipsDaysBeforeFrom", func(t *testing.T) {
+
+		samples := hourlySamples("Thuis", from.Add(-2*time.Hour), 10, 10, 10, 10)
+
+		// act
+		degreeDays := computeDegreeDays(samples, 18, from, computedAt)
+
+		if assert.Equal(t, 1, len(degreeDays)) {
+			assert.Equal(t, civil.Date{Year: 2020, Month: 11, Day: 1}, degreeDays[0].Day)
+		}
+	})
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"strconv"
 	"time"
 
 	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
 )
 
 // SessionRequest represents the json request body for POST https://tccna.honeywell.com/WebAPI/api/Session
@@ -62,6 +66,9 @@ type LocationResponse struct {
 	LocationOwnerName         string                   `json:"locationOwnerName"`
 	LocationOwnerUserName     string                   `json:"locationOwnerUserName"`
 	CanSearchForContractors   bool                     `json:"canSearchForContractors"`
+
+	// Account is the name of the account the location was fetched with; it's set by the exporter, not evohome
+	Account string `json:"-"`
 }
 
 // DeviceResponse contains additional information about the evohome device
@@ -167,6 +174,15 @@ type TimeZoneResponse struct {
 	UsingDaylightSavingTime bool   `json:"usingDaylightSavingTime"`
 }
 
+// KubernetesSecret is the subset of a kubernetes secret needed to update its data; metadata is passed through untouched so the update keeps its resourceVersion and labels
+type KubernetesSecret struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   json.RawMessage   `json:"metadata"`
+	Type       string            `json:"type,omitempty"`
+	Data       map[string][]byte `json:"data,omitempty"`
+}
+
 type SessionSecret struct {
 	SessionID   string
 	UserID      int
@@ -175,18 +191,292 @@ type SessionSecret struct {
 
 type BigQueryMeasurement struct {
 	Location   string         `bigquery:"location"`
+	LocationID int            `bigquery:"location_id"`
 	MeasuredAt time.Time      `bigquery:"measured_at"`
 	Zones      []BigQueryZone `bigquery:"zones"`
-	InsertedAt time.Time      `bigquery:"inserted_at"`
+	// BoilerHeatDemand is the heat demand the controller sends to the boiler relay, from the hgi80 listener state
+	BoilerHeatDemand bigquery.NullFloat64 `bigquery:"boiler_heat_demand"`
+	// Account is the name of the evohome account the location was fetched with; it's empty for replayed measurements and for backfilled ones unless the backfill is given an account
+	Account       bigquery.NullString   `bigquery:"account"`
+	LocationOwner BigQueryLocationOwner `bigquery:"location_owner"`
+	TimeZone      BigQueryTimeZone      `bigquery:"time_zone"`
+	InsertedAt    time.Time             `bigquery:"inserted_at"`
+}
+
+// BigQueryLocationOwner tells who owns the location, as locations can be shared with other accounts; it's empty for csv backfills
+type BigQueryLocationOwner struct {
+	IsOwner bigquery.NullBool   `bigquery:"is_owner"`
+	ID      bigquery.NullInt64  `bigquery:"id"`
+	Name    bigquery.NullString `bigquery:"name"`
+}
+
+// BigQueryTimeZone is the time zone evohome reports for the location, for splitting days at the location's midnight without calling evohome; it's empty for csv backfills
+type BigQueryTimeZone struct {
+	ID                   bigquery.NullString `bigquery:"id"`
+	CurrentOffsetMinutes bigquery.NullInt64  `bigquery:"current_offset_minutes"`
+}
+
+// insertIDBucket is the time bucket measured_at is truncated to when deriving insert ids; it should match the cronjob schedule, so a retried run deduplicates while consecutive runs don't
+var insertIDBucket = 5 * time.Minute
+
+// Save implements bigquery.ValueSaver, so streaming inserts of the same location and time bucket get deduplicated by bigquery within its dedup window
+func (m BigQueryMeasurement) Save() (row map[string]bigquery.Value, insertID string, err error) {
+	schema, err := bigquery.InferSchema(m)
+	if err != nil {
+		return nil, "", err
+	}
+
+	row, _, err = (&bigquery.StructSaver{Schema: schema, Struct: m}).Save()
+	if err != nil {
+		return nil, "", err
+	}
+
+	return row, m.InsertID(), nil
+}
+
+// InsertID derives a deterministic id from the measurement's identity: the account, the location and the time bucket of measured_at
+func (m BigQueryMeasurement) InsertID() string {
+	bucket := m.MeasuredAt.UTC()
+	if insertIDBucket > 0 {
+		bucket = bucket.Truncate(insertIDBucket)
+	}
+
+	return measurementIdentity(m.Account.StringVal, m.LocationID, m.Location, bucket.Unix())
+}
+
+// measurementIdentity formats the account, location and time bucket a measurement is unique by, the same way the deduplicated view partitions; the location is its id, or its name for measurements without one
+func measurementIdentity(account string, locationID int, location string, bucket int64) string {
+	if locationID != 0 {
+		location = fmt.Sprint(locationID)
+	}
+	if account == "" {
+		return fmt.Sprintf("%v-%v", location, bucket)
+	}
+
+	return fmt.Sprintf("%v/%v-%v", account, location, bucket)
+}
+
+// locationKey identifies a location in the derived tables by its evohome id within the account it was exported with, so renaming it doesn't split its rows
+type locationKey struct {
+	account    string
+	locationID int
+}
+
+// zoneKey identifies a zone of a location in the derived tables
+type zoneKey struct {
+	location locationKey
+	zone     string
+}
+
+// BigQueryZoneMeasurement is a single zone of a measurement as one flat row, so it can be queried without unnesting zones
+type BigQueryZoneMeasurement struct {
+	Location          string               `bigquery:"location"`
+	LocationID        int                  `bigquery:"location_id"`
+	Zone              string               `bigquery:"zone"`
+	ZoneID            bigquery.NullInt64   `bigquery:"zone_id"`
+	MeasuredAt        time.Time            `bigquery:"measured_at"`
+	TemperatureUnit   string               `bigquery:"unit"`
+	TemperatureValue  bigquery.NullFloat64 `bigquery:"temperature"`
+	HeatSetPointValue bigquery.NullFloat64 `bigquery:"heat_setpoint"`
+	HeatDemandValue   bigquery.NullFloat64 `bigquery:"heat_demand"`
+	HumidityValue     bigquery.NullFloat64 `bigquery:"humidity"`
+	QualityFlags      []string             `bigquery:"quality_flags"`
+	Account           bigquery.NullString  `bigquery:"account"`
+	InsertedAt        time.Time            `bigquery:"inserted_at"`
+}
+
+// Save implements bigquery.ValueSaver with an insert id per zone, derived from the identity of the measurement the zone belongs to and the zone's id
+func (z BigQueryZoneMeasurement) Save() (row map[string]bigquery.Value, insertID string, err error) {
+	schema, err := bigquery.InferSchema(z)
+	if err != nil {
+		return nil, "", err
+	}
+
+	row, _, err = (&bigquery.StructSaver{Schema: schema, Struct: z}).Save()
+	if err != nil {
+		return nil, "", err
+	}
+
+	// zones are told apart by id, as two zones can share a name; the outdoor zone has no id, but only one per location
+	measurement := BigQueryMeasurement{Account: z.Account, Location: z.Location, LocationID: z.LocationID, MeasuredAt: z.MeasuredAt}
+	zone := z.Zone
+	if z.ZoneID.Valid {
+		zone = strconv.FormatInt(z.ZoneID.Int64, 10)
+	}
+
+	return row, measurement.InsertID() + "-" + zone, nil
+}
+
+// BigQueryRawResponse stores the gzipped raw body of a locations response, to derive new columns from it retroactively
+type BigQueryRawResponse struct {
+	FetchedAt  time.Time           `bigquery:"fetched_at"`
+	Account    bigquery.NullString `bigquery:"account"`
+	Body       []byte              `bigquery:"body_gzip"`
+	InsertedAt time.Time           `bigquery:"inserted_at"`
+}
+
+// BigQueryOutdoorTemperature is a single outdoor temperature reading of a location, as read back for computing degree-days
+type BigQueryOutdoorTemperature struct {
+	Location    string    `bigquery:"location"`
+	LocationID  int       `bigquery:"location_id"`
+	Account     string    `bigquery:"account"`
+	MeasuredAt  time.Time `bigquery:"measured_at"`
+	Temperature float64   `bigquery:"temperature"`
+	// TimeZoneID and TimeZoneOffsetMinutes are the location's time zone; empty for measurements from before it was recorded
+	TimeZoneID            string `bigquery:"time_zone_id"`
+	TimeZoneOffsetMinutes int    `bigquery:"time_zone_offset_minutes"`
+}
+
+// BigQueryDegreeDay holds the heating degree-days of a location for a day in the location's time zone
+type BigQueryDegreeDay struct {
+	Location              string              `bigquery:"location"`
+	LocationID            int                 `bigquery:"location_id"`
+	Account               bigquery.NullString `bigquery:"account"`
+	Day                   civil.Date          `bigquery:"day"`
+	BaseTemperature       float64             `bigquery:"base_temperature"`
+	DegreeDays            float64             `bigquery:"degree_days"`
+	AvgOutdoorTemperature float64             `bigquery:"avg_outdoor_temperature"`
+	// Coverage is the fraction of the day covered by samples; degree-days of a partially covered day are extrapolated from the covered part
+	Coverage   float64   `bigquery:"coverage"`
+	Samples    int       `bigquery:"samples"`
+	ComputedAt time.Time `bigquery:"computed_at"`
+}
+
+// BigQueryZoneSample is a single zone reading together with the outdoor temperature at that time, as read back for fitting thermal models
+type BigQueryZoneSample struct {
+	Location           string               `bigquery:"location"`
+	LocationID         int                  `bigquery:"location_id"`
+	Account            string               `bigquery:"account"`
+	Zone               string               `bigquery:"zone"`
+	MeasuredAt         time.Time            `bigquery:"measured_at"`
+	Temperature        float64              `bigquery:"temperature"`
+	HeatSetpoint       bigquery.NullFloat64 `bigquery:"heat_setpoint"`
+	HeatDemand         bigquery.NullFloat64 `bigquery:"heat_demand"`
+	OutdoorTemperature bigquery.NullFloat64 `bigquery:"outdoor_temperature"`
+	// TimeZoneID and TimeZoneOffsetMinutes are the location's time zone; empty for measurements from before it was recorded
+	TimeZoneID            string `bigquery:"time_zone_id"`
+	TimeZoneOffsetMinutes int    `bigquery:"time_zone_offset_minutes"`
+}
+
+func (s BigQueryZoneSample) zoneKey() zoneKey {
+	return zoneKey{location: locationKey{account: s.Account, locationID: s.LocationID}, zone: s.Zone}
+}
+
+// locationNames returns the name of every location in its latest sample, so the rows of a renamed location get its current name
+func locationNames(samples []BigQueryZoneSample) map[locationKey]string {
+	names := map[locationKey]string{}
+	latest := map[locationKey]time.Time{}
+	for _, s := range samples {
+		key := s.zoneKey().location
+		if !s.MeasuredAt.Before(latest[key]) {
+			names[key] = s.Location
+			latest[key] = s.MeasuredAt
+		}
+	}
+
+	return names
+}
+
+// BigQueryThermalModel holds the parameters of a first-order thermal model of a zone, fitted over the week starting on monday Week
+type BigQueryThermalModel struct {
+	Location   string              `bigquery:"location"`
+	LocationID int                 `bigquery:"location_id"`
+	Account    bigquery.NullString `bigquery:"account"`
+	Zone       string              `bigquery:"zone"`
+	Week       civil.Date          `bigquery:"week"`
+	// HeatLossCoefficient is the fraction of the indoor to outdoor temperature difference lost per hour
+	HeatLossCoefficient float64 `bigquery:"heat_loss_coefficient"`
+	// HeatingRate is the temperature rise per hour at a heat demand of 1 without any heat loss
+	HeatingRate float64 `bigquery:"heating_rate"`
+	// TimeConstantHours is the inverse of the heat loss coefficient, null if no heat loss could be fitted
+	TimeConstantHours     bigquery.NullFloat64 `bigquery:"time_constant_hours"`
+	RSquared              float64              `bigquery:"r_squared"`
+	Samples               int                  `bigquery:"samples"`
+	AvgIndoorTemperature  float64              `bigquery:"avg_indoor_temperature"`
+	AvgOutdoorTemperature float64              `bigquery:"avg_outdoor_temperature"`
+	ComputedAt            time.Time            `bigquery:"computed_at"`
+}
+
+// BigQueryComfortSummary summarizes how well a zone kept up with its setpoint during a day
+type BigQueryComfortSummary struct {
+	Location           string              `bigquery:"location"`
+	LocationID         int                 `bigquery:"location_id"`
+	Account            bigquery.NullString `bigquery:"account"`
+	Zone               string              `bigquery:"zone"`
+	Day                civil.Date          `bigquery:"day"`
+	BelowSetpointDelta float64             `bigquery:"below_setpoint_delta"`
+	Samples            int                 `bigquery:"samples"`
+	// CoveredMinutes is the part of the day with samples at most 15 minutes apart
+	CoveredMinutes       float64              `bigquery:"covered_minutes"`
+	MinutesBelowSetpoint float64              `bigquery:"minutes_below_setpoint"`
+	AvgOvershoot         bigquery.NullFloat64 `bigquery:"avg_overshoot"`
+	SetpointSteps        int                  `bigquery:"setpoint_steps"`
+	SetpointStepsReached int                  `bigquery:"setpoint_steps_reached"`
+	AvgMinutesToSetpoint bigquery.NullFloat64 `bigquery:"avg_minutes_to_setpoint"`
+	// ComfortScore is the percentage of covered time the zone wasn't more than the delta below its setpoint
+	ComfortScore float64   `bigquery:"comfort_score"`
+	ComputedAt   time.Time `bigquery:"computed_at"`
+}
+
+// BigQueryBoilerSample is a single boiler heat demand reading of a location, as read back for estimating the boiler runtime
+type BigQueryBoilerSample struct {
+	Location         string    `bigquery:"location"`
+	LocationID       int       `bigquery:"location_id"`
+	Account          string    `bigquery:"account"`
+	MeasuredAt       time.Time `bigquery:"measured_at"`
+	BoilerHeatDemand float64   `bigquery:"boiler_heat_demand"`
+}
+
+// BigQueryBoilerRuntime holds the estimated boiler on-time of a location during an hour and the energy, gas and cost that took
+type BigQueryBoilerRuntime struct {
+	Location       string              `bigquery:"location"`
+	LocationID     int                 `bigquery:"location_id"`
+	Account        bigquery.NullString `bigquery:"account"`
+	Hour           time.Time           `bigquery:"hour"`
+	Samples        int                 `bigquery:"samples"`
+	CoveredMinutes float64             `bigquery:"covered_minutes"`
+	OnMinutes      float64             `bigquery:"on_minutes"`
+	EnergyKWh      float64             `bigquery:"energy_kwh"`
+	GasM3          float64             `bigquery:"gas_m3"`
+	// Cost is empty if no gas price is configured
+	Cost       bigquery.NullFloat64 `bigquery:"cost"`
+	ComputedAt time.Time            `bigquery:"computed_at"`
+}
+
+// BigQueryEvent is something detected in the zone samples over a period of time, like a likely open window; it's also the payload posted to the events webhook
+type BigQueryEvent struct {
+	Location   string              `bigquery:"location" json:"location"`
+	LocationID int                 `bigquery:"location_id" json:"locationId"`
+	Account    bigquery.NullString `bigquery:"account" json:"account"`
+	Zone       string              `bigquery:"zone" json:"zone"`
+	Type       string              `bigquery:"type" json:"type"`
+	StartedAt  time.Time           `bigquery:"started_at" json:"startedAt"`
+	EndedAt    time.Time           `bigquery:"ended_at" json:"endedAt"`
+	// Magnitude is the size of the event, for an open window the temperature drop in degrees
+	Magnitude        float64   `bigquery:"magnitude" json:"magnitude"`
+	StartTemperature float64   `bigquery:"start_temperature" json:"startTemperature"`
+	EndTemperature   float64   `bigquery:"end_temperature" json:"endTemperature"`
+	Ongoing          bool      `bigquery:"ongoing" json:"ongoing"`
+	DetectedAt       time.Time `bigquery:"detected_at" json:"detectedAt"`
+}
+
+// BigQuerySchemaMigration records a migration that has been applied to a table
+type BigQuerySchemaMigration struct {
+	Version     int       `bigquery:"version"`
+	Description string    `bigquery:"description"`
+	AppliedAt   time.Time `bigquery:"applied_at"`
 }
 
 type BigQueryZone struct {
+	// ZoneID is the id of the zone's device, which isn't stored in the zones column but only in the flat zone rows; the outdoor zone has none
+	ZoneID            bigquery.NullInt64   `bigquery:"-"`
 	Zone              string               `bigquery:"location"`
 	TemperatureUnit   string               `bigquery:"unit"`
 	TemperatureValue  bigquery.NullFloat64 `bigquery:"temperature"`
 	HeatSetPointValue bigquery.NullFloat64 `bigquery:"heat_setpoint"`
 	HeatDemandValue   bigquery.NullFloat64 `bigquery:"heat_demand"`
 	HumidityValue     bigquery.NullFloat64 `bigquery:"humidity"`
+	QualityFlags      []string             `bigquery:"quality_flags"`
 }
 
 // State from evohome-hgi80-listener
@@ -205,6 +495,46 @@ type ZoneInfo struct {
 	HeatDemand     float64
 }
 
+// maxControllerZones is the number of zones a controller has, the listener reports the boiler relay and other devices with higher ids
+const maxControllerZones = 12
+
+// boilerRelayDomainID is the id the listener reports the boiler relay under, its ramses domain; the heating and hot water valves have their own, 0xF9 and 0xFA
+const boilerRelayDomainID = 0xFC
+
 func (z ZoneInfo) IsActualZone() bool {
-	return z.ID < 12 && z.Name != ""
+	return z.ID < maxControllerZones && z.Name != ""
+}
+
+// IsBoilerRelay tells whether the entry is the boiler relay rather than a zone or another device like a valve
+func (z ZoneInfo) IsBoilerRelay() bool {
+	return z.ID == boilerRelayDomainID
+}
+
+// boilerHeatDemand returns the heat demand of the boiler relay, or if the listener didn't report any the highest heat demand of the location's zones, like the controller derives it; it's null if none of the location's zones are in the state, since the state belongs to a single controller
+func boilerHeatDemand(zoneInfoMap map[int64]ZoneInfo, zoneNames []string) bigquery.NullFloat64 {
+	locationZones := map[string]bool{}
+	for _, name := range zoneNames {
+		locationZones[name] = true
+	}
+
+	relayDemand, zoneDemand := bigquery.NullFloat64{}, bigquery.NullFloat64{}
+	for _, z := range zoneInfoMap {
+		demand := &zoneDemand
+		if z.IsBoilerRelay() {
+			demand = &relayDemand
+		} else if !z.IsActualZone() || !locationZones[z.Name] {
+			continue
+		}
+		if !demand.Valid || z.HeatDemand > demand.Float64 {
+			*demand = bigquery.NullFloat64{Float64: z.HeatDemand, Valid: true}
+		}
+	}
+
+	if !zoneDemand.Valid {
+		return bigquery.NullFloat64{}
+	}
+	if relayDemand.Valid {
+		return relayDemand
+	}
+	return zoneDemand
 }
@@ -6,21 +6,29 @@ import (
 	"cloud.google.com/go/bigquery"
 )
 
-func mapLocationsToMeasurements(locations []LocationResponse, outdoorZoneName string, state *State) (measurements []BigQueryMeasurement) {
+func mapLocationsToMeasurements(locations []LocationResponse, outdoorZoneName string, state *State, measuredAt time.Time) (measurements []BigQueryMeasurement) {
 	measurements = []BigQueryMeasurement{}
 
 	for _, l := range locations {
 		measurement := BigQueryMeasurement{
-			Location:   l.Name,
-			MeasuredAt: time.Now().UTC(),
-			Zones:      []BigQueryZone{},
-			InsertedAt: time.Now().UTC(),
+			Location:      l.Name,
+			LocationID:    l.LocationID,
+			MeasuredAt:    measuredAt,
+			Zones:         []BigQueryZone{},
+			LocationOwner: mapLocationOwner(l),
+			TimeZone:      mapTimeZone(l.TimeZone),
+			InsertedAt:    time.Now().UTC(),
 		}
 
 		zoneInfoMap := map[int64]ZoneInfo{}
-		if state != nil && time.Since(state.LastUpdated).Minutes() < 10 {
+		if state != nil && measuredAt.Sub(state.LastUpdated).Minutes() < 10 {
 			zoneInfoMap = state.ZoneInfoMap
 		}
+		zoneNames := []string{}
+		for _, d := range l.Devices {
+			zoneNames = append(zoneNames, d.Name)
+		}
+		measurement.BoilerHeatDemand = boilerHeatDemand(zoneInfoMap, zoneNames)
 
 		// loop devices
 		for _, d := range l.Devices {
@@ -32,6 +40,7 @@ func mapLocationsToMeasurements(locations []LocationResponse, outdoorZoneName st
 			}
 
 			zone := BigQueryZone{
+				ZoneID:            bigquery.NullInt64{Int64: int64(d.DeviceID), Valid: d.DeviceID != 0},
 				Zone:              d.Name,
 				TemperatureUnit:   d.Thermostat.Units,
 				TemperatureValue:  bigquery.NullFloat64{Float64: d.Thermostat.IndoorTemperature, Valid: true},
@@ -55,6 +64,58 @@ func mapLocationsToMeasurements(locations []LocationResponse, outdoorZoneName st
 	return
 }
 
+// mapLocationOwner returns who owns the location, or an empty owner if it's unknown, as for locations read from a csv backfill
+func mapLocationOwner(l LocationResponse) BigQueryLocationOwner {
+	if l.LocationOwnerID == 0 {
+		return BigQueryLocationOwner{}
+	}
+
+	return BigQueryLocationOwner{
+		IsOwner: bigquery.NullBool{Bool: l.IsLocationOwner, Valid: true},
+		ID:      bigquery.NullInt64{Int64: int64(l.LocationOwnerID), Valid: true},
+		Name:    bigquery.NullString{StringVal: l.LocationOwnerName, Valid: l.LocationOwnerName != ""},
+	}
+}
+
+// mapTimeZone returns the location's time zone, or an empty one if it's unknown, as for locations read from a csv backfill
+func mapTimeZone(tz TimeZoneResponse) BigQueryTimeZone {
+	if tz.ID == "" {
+		return BigQueryTimeZone{}
+	}
+
+	return BigQueryTimeZone{
+		ID:                   bigquery.NullString{StringVal: tz.ID, Valid: true},
+		CurrentOffsetMinutes: bigquery.NullInt64{Int64: int64(tz.CurrentOffsetMinutes), Valid: true},
+	}
+}
+
+// flattenMeasurements returns a row per zone per measurement
+func flattenMeasurements(measurements []BigQueryMeasurement) (zoneMeasurements []BigQueryZoneMeasurement) {
+	zoneMeasurements = []BigQueryZoneMeasurement{}
+
+	for _, m := range measurements {
+		for _, z := range m.Zones {
+			zoneMeasurements = append(zoneMeasurements, BigQueryZoneMeasurement{
+				Location:          m.Location,
+				LocationID:        m.LocationID,
+				Zone:              z.Zone,
+				ZoneID:            z.ZoneID,
+				MeasuredAt:        m.MeasuredAt,
+				TemperatureUnit:   z.TemperatureUnit,
+				TemperatureValue:  z.TemperatureValue,
+				HeatSetPointValue: z.HeatSetPointValue,
+				HeatDemandValue:   z.HeatDemandValue,
+				HumidityValue:     z.HumidityValue,
+				QualityFlags:      z.QualityFlags,
+				Account:           m.Account,
+				InsertedAt:        m.InsertedAt,
+			})
+		}
+	}
+
+	return
+}
+
 func getZoneInfoFromMapByName(zoneInfoMap map[int64]ZoneInfo, zoneName string) *ZoneInfo {
 	for _, v := range zoneInfoMap {
 		if v.Name == zoneName {
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMapLocationsToMeasurements(t *testing.T) {
+
+	t.Run("SetsBoilerHeatDemandOnlyForLocationWithZonesInState", func(t *testing.T) {
+
+		measuredAt := time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC)
+		locations := []LocationResponse{
+			{LocationID: 1234, Name: "Thuis", Devices: []DeviceResponse{{Name: "Woonkamer"}, {Name: "Badkamer"}}},
+			{LocationID: 5678, Name: "Oma", Devices: []DeviceResponse{{Name: "Zitkamer"}}},
+		}
+		state := &State{
+			LastUpdated: measuredAt.Add(-2 * time.Minute),
+			ZoneInfoMap: map[int64]ZoneInfo{
+				0: {ID: 0, Name: "Woonkamer", HeatDemand: 0.3},
+				1: {ID: 1, Name: "Badkamer", HeatDemand: 0.6},
+			},
+		}
+
+		// act
+		measurements := mapLocationsToMeasurements(locations, "Outside", state, measuredAt)
+
+		if assert.Equal(t, 2, len(measurements)) {
+			assert.Equal(t, bigquery.NullFloat64{Float64: 0.6, Valid: true}, measurements[0].BoilerHeatDemand)
+			assert.False(t, measurements[1].BoilerHeatDemand.Valid)
+		}
+	})
+}
+
+func TestFlattenMeasurements(t *testing.T) {
+
+	t.Run("ReturnsRowPerZoneWithMeasurementColumns", func(t *testing.T) {
+
+		measuredAt := time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC)
+		measurements := []BigQueryMeasurement{
+			{
+				Location:   "Thuis",
+				LocationID: 1234,
+				MeasuredAt: measuredAt,
+				Zones: []BigQueryZone{
+					{ZoneID: bigquery.NullInt64{Int64: 42, Valid: true}, Zone: "Woonkamer", TemperatureUnit: "Celsius", TemperatureValue: bigquery.NullFloat64{Float64: 19.5, Valid: true}, HeatSetPointValue: bigquery.NullFloat64{Float64: 20, Valid: true}},
+					{Zone: "Outside", TemperatureUnit: "Celsius", TemperatureValue: bigquery.NullFloat64{Float64: 8.5, Valid: true}, HumidityValue: bigquery.NullFloat64{Float64: 80, Valid: true}},
+				},
+			},
+		}
+
+		// act
+		zoneMeasurements := flattenMeasurements(measurements)
+
+		if assert.Equal(t, 2, len(zoneMeasurements)) {
+			assert.Equal(t, "Thuis", zoneMeasurements[0].Location)
+			assert.Equal(t, 1234, zoneMeasurements[0].LocationID)
+			assert.Equal(t, "Woonkamer", zoneMeasurements[0].Zone)
+			assert.Equal(t, int64(42), zoneMeasurements[0].ZoneID.Int64)
+			assert.Equal(t, measuredAt, zoneMeasurements[0].MeasuredAt)
+			assert.Equal(t, 20.0, zoneMeasurements[0].HeatSetPointValue.Float64)
+			assert.Equal(t, "Outside", zoneMeasurements[1].Zone)
+			assert.Equal(t, 80.0, zoneMeasurements[1].HumidityValue.Float64)
+			assert.False(t, zoneMeasurements[1].HeatSetPointValue.Valid)
+		}
+	})
+}
+
+func TestMapLocationOwner(t *testing.T) {
+
+	t.Run("ReturnsOwnerOfSharedLocation", func(t *testing.T) {
+
+		location := LocationResponse{LocationID: 5678, Name: "Oma", IsLocationOwner: false, LocationOwnerID: 42, LocationOwnerName: "Oma de Vries"}
+
+		// act
+		owner := mapLocationOwner(location)
+
+		assert.Equal(t, bigquery.NullBool{Bool: false, Valid: true}, owner.IsOwner)
+		assert.Equal(t, bigquery.NullInt64{Int64: 42, Valid: true}, owner.ID)
+		assert.Equal(t, bigquery.NullString{StringVal: "Oma de Vries", Valid: true}, owner.Name)
+	})
+
+	t.Run("ReturnsEmptyOwnerIfUnknown", func(t *testing.T) {
+
+		location := LocationResponse{LocationID: 1234, Name: "Thuis"}
+
+		// act
+		owner := mapLocationOwner(location)
+
+		assert.Equal(t, BigQueryLocationOwner{}, owner)
+	})
+}
+
+func TestMapTimeZone(t *testing.T) {
+
+	t.Run("ReturnsTimeZoneOfLocation", func(t *testing.T) {
+
+		// act
+		timeZone := mapTimeZone(TimeZoneResponse{ID: "W. Europe Standard Time", CurrentOffsetMinutes: 60})
+
+		assert.Equal(t, bigquery.NullString{StringVal: "W. Europe Standard Time", Valid: true}, timeZone.ID)
+		assert.Equal(t, bigquery.NullInt64{Int64: 60, Valid: true}, timeZone.CurrentOffsetMinutes)
+	})
+
+	t.Run("ReturnsEmptyTimeZoneIfUnknown", func(t *testing.T) {
+
+		// act
+		timeZone := mapTimeZone(TimeZoneResponse{})
+
+		assert.Equal(t, BigQueryTimeZone{}, timeZone)
+	})
+}
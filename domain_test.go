@@ -0,0 +1,128 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBigQueryMeasurementSave(t *testing.T) {
+
+	t.Run("ReturnsSameInsertIDForMeasurementsInSameTimeBucket", func(t *testing.T) {
+
+		first := BigQueryMeasurement{LocationID: 1234, MeasuredAt: time.Date(2020, 11, 1, 12, 0, 10, 0, time.UTC)}
+		retry := BigQueryMeasurement{LocationID: 1234, MeasuredAt: time.Date(2020, 11, 1, 12, 3, 50, 0, time.UTC)}
+
+		// act
+		_, firstInsertID, err := first.Save()
+		_, retryInsertID, _ := retry.Save()
+
+		assert.Nil(t, err)
+		assert.Equal(t, "1234-1604232000", firstInsertID)
+		assert.Equal(t, firstInsertID, retryInsertID)
+	})
+
+	t.Run("ReturnsDifferentInsertIDsForDifferentLocations", func(t *testing.T) {
+
+		measuredAt := time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC)
+		first := BigQueryMeasurement{LocationID: 1234, MeasuredAt: measuredAt}
+		second := BigQueryMeasurement{LocationID: 5678, MeasuredAt: measuredAt}
+
+		// act
+		_, firstInsertID, _ := first.Save()
+		_, secondInsertID, _ := second.Save()
+
+		assert.NotEqual(t, firstInsertID, secondInsertID)
+	})
+
+	t.Run("ReturnsDifferentInsertIDsForSameLocationInDifferentAccounts", func(t *testing.T) {
+
+		measuredAt := time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC)
+		first := BigQueryMeasurement{LocationID: 1234, MeasuredAt: measuredAt, Account: bigquery.NullString{StringVal: "default", Valid: true}}
+		second := BigQueryMeasurement{LocationID: 1234, MeasuredAt: measuredAt, Account: bigquery.NullString{StringVal: "oma", Valid: true}}
+
+		// act
+		_, firstInsertID, _ := first.Save()
+		_, secondInsertID, _ := second.Save()
+
+		assert.Equal(t, "default/1234-1604232000", firstInsertID)
+		assert.Equal(t, "oma/1234-1604232000", secondInsertID)
+	})
+
+	t.Run("ReturnsSameInsertIDForRenamedLocation", func(t *testing.T) {
+
+		measuredAt := time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC)
+		first := BigQueryMeasurement{Location: "Thuis", LocationID: 1234, MeasuredAt: measuredAt}
+		renamed := BigQueryMeasurement{Location: "Huis", LocationID: 1234, MeasuredAt: measuredAt}
+
+		// act
+		_, firstInsertID, _ := first.Save()
+		_, renamedInsertID, _ := renamed.Save()
+
+		assert.Equal(t, firstInsertID, renamedInsertID)
+	})
+
+	t.Run("ReturnsRowWithAllColumns", func(t *testing.T) {
+
+		measurement := BigQueryMeasurement{Location: "Thuis", LocationID: 1234, MeasuredAt: time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC), Zones: []BigQueryZone{BigQueryZone{Zone: "Woonkamer"}}}
+
+		// act
+		row, _, err := measurement.Save()
+
+		if assert.Nil(t, err) {
+			assert.Equal(t, "Thuis", row["location"])
+			assert.Equal(t, 1234, row["location_id"])
+			assert.Equal(t, 1, len(row["zones"].([]bigquery.Value)))
+		}
+	})
+}
+
+func TestBigQueryZoneMeasurementSave(t *testing.T) {
+
+	t.Run("ReturnsInsertIDPerZone", func(t *testing.T) {
+
+		measuredAt := time.Date(2020, 11, 1, 12, 1, 0, 0, time.UTC)
+		first := BigQueryZoneMeasurement{LocationID: 1234, Zone: "Woonkamer", MeasuredAt: measuredAt}
+		second := BigQueryZoneMeasurement{LocationID: 1234, Zone: "Keuken", MeasuredAt: measuredAt}
+
+		// act
+		row, firstInsertID, err := first.Save()
+		_, secondInsertID, _ := second.Save()
+
+		assert.Nil(t, err)
+		assert.Equal(t, "1234-1604232000-Woonkamer", firstInsertID)
+		assert.NotEqual(t, firstInsertID, secondInsertID)
+		assert.Equal(t, "Woonkamer", row["zone"])
+	})
+
+	t.Run("ReturnsDifferentInsertIDsForSameZoneInDifferentAccounts", func(t *testing.T) {
+
+		measuredAt := time.Date(2020, 11, 1, 12, 1, 0, 0, time.UTC)
+		first := BigQueryZoneMeasurement{Account: bigquery.NullString{StringVal: "thuis", Valid: true}, LocationID: 1234, Zone: "Woonkamer", ZoneID: bigquery.NullInt64{Int64: 42, Valid: true}, MeasuredAt: measuredAt}
+		second := first
+		second.Account = bigquery.NullString{StringVal: "oma", Valid: true}
+
+		// act
+		_, firstInsertID, _ := first.Save()
+		_, secondInsertID, _ := second.Save()
+
+		assert.Equal(t, "thuis/1234-1604232000-42", firstInsertID)
+		assert.Equal(t, "oma/1234-1604232000-42", secondInsertID)
+	})
+
+	t.Run("ReturnsDifferentInsertIDsForZonesWithTheSameName", func(t *testing.T) {
+
+		measuredAt := time.Date(2020, 11, 1, 12, 1, 0, 0, time.UTC)
+		first := BigQueryZoneMeasurement{LocationID: 1234, Zone: "Slaapkamer", ZoneID: bigquery.NullInt64{Int64: 42, Valid: true}, MeasuredAt: measuredAt}
+		second := first
+		second.ZoneID = bigquery.NullInt64{Int64: 43, Valid: true}
+
+		// act
+		_, firstInsertID, _ := first.Save()
+		_, secondInsertID, _ := second.Save()
+
+		assert.NotEqual(t, firstInsertID, secondInsertID)
+	})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+const (
+	eventTypeOpenWindow = "open_window"
+
+	// eventsLookback is how far back zone samples are read for detecting events, so the start of a long lasting event stays the same between runs
+	eventsLookback = 3 * time.Hour
+)
+
+// openWindowRules configure when a temperature drop counts as a likely open window
+type openWindowRules struct {
+	// Drop is the least drop in degrees within Window
+	Drop   float64
+	Window time.Duration
+
+	// MinHeatDemand is the heat demand at which the zone counts as heating; zones without heat demand count as heating while below their setpoint
+	MinHeatDemand float64
+}
+
+// heating returns whether the zone is calling for heat at the time of the sample
+func (r openWindowRules) heating(s BigQueryZoneSample) bool {
+	if s.HeatDemand.Valid {
+		return s.HeatDemand.Float64 >= r.MinHeatDemand
+	}
+
+	return s.HeatSetpoint.Valid && s.Temperature < s.HeatSetpoint.Float64
+}
+
+// detectOpenWindows flags a likely open window when a zone's temperature drops by at least the rules' drop within its window while the zone is heating; the event lasts from the highest temperature before the drop until the temperature stops dropping
+func detectOpenWindows(samples []BigQueryZoneSample, rules openWindowRules, detectedAt time.Time) []BigQueryEvent {
+	samplesPerZone := map[zoneKey][]BigQueryZoneSample{}
+	for _, s := range samples {
+		samplesPerZone[s.zoneKey()] = append(samplesPerZone[s.zoneKey()], s)
+	}
+
+	events := []BigQueryEvent{}
+	for _, zoneSamples := range samplesPerZone {
+		sort.Slice(zoneSamples, func(i, j int) bool {
+			return zoneSamples[i].MeasuredAt.Before(zoneSamples[j].MeasuredAt)
+		})
+
+		var current *BigQueryEvent
+		// samples up to the end of the previous event can't start a new one
+		first := 0
+		for i, s := range zoneSamples {
+			if current != nil {
+				previous := zoneSamples[i-1]
+				if s.Temperature < previous.Temperature && s.MeasuredAt.Sub(previous.MeasuredAt) <= rules.Window {
+					current.EndedAt = s.MeasuredAt
+					current.EndTemperature = s.Temperature
+					current.Magnitude = current.StartTemperature - s.Temperature
+					continue
+				}
+
+				current.Ongoing = false
+				events = append(events, *current)
+				current = nil
+				first = i - 1
+			}
+
+			if !rules.heating(s) {
+				continue
+			}
+
+			peak := -1
+			for j := i - 1; j >= first && s.MeasuredAt.Sub(zoneSamples[j].MeasuredAt) <= rules.Window; j-- {
+				if peak < 0 || zoneSamples[j].Temperature >= zoneSamples[peak].Temperature {
+					peak = j
+				}
+			}
+			if peak < 0 || zoneSamples[peak].Temperature-s.Temperature < rules.Drop {
+				continue
+			}
+
+			current = &BigQueryEvent{
+				Location:         s.Location,
+				LocationID:       s.LocationID,
+				Account:          bigquery.NullString{StringVal: s.Account, Valid: true},
+				Zone:             s.Zone,
+				Type:             eventTypeOpenWindow,
+				StartedAt:        zoneSamples[peak].MeasuredAt,
+				EndedAt:          s.MeasuredAt,
+				Magnitude:        zoneSamples[peak].Temperature - s.Temperature,
+				StartTemperature: zoneSamples[peak].Temperature,
+				EndTemperature:   s.Temperature,
+				Ongoing:          true,
+				DetectedAt:       detectedAt,
+			}
+		}
+
+		if current != nil {
+			events = append(events, *current)
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].StartedAt.Before(events[j].StartedAt)
+	})
+
+	return events
+}
+
+// eventKey identifies an event the same way the events table is merged on
+func eventKey(e BigQueryEvent) string {
+	return fmt.Sprintf("%v/%v/%v/%v/%v", e.Account.StringVal, e.LocationID, e.Zone, e.Type, e.StartedAt.Unix())
+}
+
+// newEvents returns the events that aren't among the existing events yet
+func newEvents(events, existing []BigQueryEvent) []BigQueryEvent {
+	existingKeys := map[string]bool{}
+	for _, e := range existing {
+		existingKeys[eventKey(e)] = true
+	}
+
+	added := []BigQueryEvent{}
+	for _, e := range events {
+		if !existingKeys[eventKey(e)] {
+			added = append(added, e)
+		}
+	}
+
+	return added
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectOpenWindows(t *testing.T) {
+
+	start := time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC)
+	detectedAt := start.Add(time.Hour)
+	rules := openWindowRules{Drop: 1, Window: 15 * time.Minute, MinHeatDemand: 0.5}
+
+	zoneSamples := func(heatDemand float64, temperatures ...float64) (samples []BigQueryZoneSample) {
+		for i, temperature := range temperatures {
+			samples = append(samples, BigQueryZoneSample{
+				Location:    "Thuis",
+				LocationID:  1234,
+				Zone:        "Slaapkamer",
+				MeasuredAt:  start.Add(time.Duration(i) * 5 * time.Minute),
+				Temperature: temperature,
+				HeatDemand:  bigquery.NullFloat64{Float64: heatDemand, Valid: true},
+			})
+		}
+		return
+	}
+
+	t.Run("FlagsSharpDropWhileHeating", func(t *testing.T) {
+
+		samples := zoneSamples(1, 19.5, 20, 19.6, 19.2, 18.8, 18.5, 18.7)
+
+		// act
+		events := detectOpenWindows(samples, rules, detectedAt)
+
+		if assert.Equal(t, 1, len(events)) {
+			assert.Equal(t, eventTypeOpenWindow, events[0].Type)
+			assert.Equal(t, "Slaapkamer", events[0].Zone)
+			assert.Equal(t, start.Add(5*time.Minute), events[0].StartedAt)
+			assert.Equal(t, start.Add(25*time.Minute), events[0].EndedAt)
+			assert.InDelta(t, 1.5, events[0].Magnitude, 0.0001)
+			assert.Equal(t, 20.0, events[0].StartTemperature)
+			assert.Equal(t, 18.5, events[0].EndTemperature)
+			assert.False(t, events[0].Ongoing)
+			assert.Equal(t, detectedAt, events[0].DetectedAt)
+		}
+	})
+
+	t.Run("MarksEventOngoingWhileTemperatureKeepsDropping", func(t *testing.T) {
+
+		samples := zoneSamples(1, 20, 19.6, 19.2, 18.8)
+
+		// act
+		events := detectOpenWindows(samples, rules, detectedAt)
+
+		if assert.Equal(t, 1, len(events)) {
+			assert.True(t, events[0].Ongoing)
+			assert.Equal(t, start.Add(15*time.Minute), events[0].EndedAt)
+		}
+	})
+
+	t.Run("IgnoresDropWithoutHeatDemand", func(t *testing.T) {
+
+		samples := zoneSamples(0, 20, 19.6, 19.2, 18.8, 18.5)
+
+		// act
+		events := detectOpenWindows(samples, rules, detectedAt)
+
+		assert.Equal(t, 0, len(events))
+	})
+
+	t.Run("IgnoresSlowDrop", func(t *testing.T) {
+
+		samples := zoneSamples(1, 20, 19.8, 19.6, 19.4, 19.2, 19.0, 18.8)
+
+		// act
+		events := detectOpenWindows(samples, rules, detectedAt)
+
+		assert.Equal(t, 0, len(events))
+	})
+
+	t.Run("UsesSetpointForZonesWithoutHeatDemand", func(t *testing.T) {
+
+		samples := zoneSamples(0, 20, 19.6, 19.2, 18.8, 18.9)
+		for i := range samples {
+			samples[i].HeatDemand = bigquery.NullFloat64{}
+			samples[i].HeatSetpoint = bigquery.NullFloat64{Float64: 20, Valid: true}
+		}
+
+		// act
+		events := detectOpenWindows(samples, rules, detectedAt)
+
+		assert.Equal(t, 1, len(events))
+	})
+
+	t.Run("DoesNotDetectSameDropTwice", func(t *testing.T) {
+
+		samples := zoneSamples(1, 20, 19.4, 18.8, 18.9, 18.85, 18.9)
+
+		// act
+		events := detectOpenWindows(samples, rules, detectedAt)
+
+		assert.Equal(t, 1, len(events))
+	})
+}
+
+func TestNewEvents(t *testing.T) {
+
+	t.Run("ReturnsEventsNotStoredBefore", func(t *testing.T) {
+
+		startedAt := time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC)
+		existing := []BigQueryEvent{{Location: "Thuis", Zone: "Slaapkamer", Type: eventTypeOpenWindow, StartedAt: startedAt, Ongoing: true}}
+		events := []BigQueryEvent{
+			{Location: "Thuis", Zone: "Slaapkamer", Type: eventTypeOpenWindow, StartedAt: startedAt},
+			{Location: "Thuis", Zone: "Badkamer", Type: eventTypeOpenWindow, StartedAt: startedAt},
+		}
+
+		// act
+		added := newEvents(events, existing)
+
+		if assert.Equal(t, 1, len(added)) {
+			assert.Equal(t, "Badkamer", added[0].Zone)
+		}
+	})
+	t.Run("TellsSameZoneInOtherAccountOrLocationApart", func(t *testing.T) {
+
+		startedAt := time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC)
+		existing := []BigQueryEvent{{Location: "Thuis", LocationID: 1234, Account: bigquery.NullString{StringVal: "default", Valid: true}, Zone: "Slaapkamer", Type: eventTypeOpenWindow, StartedAt: startedAt}}
+		events := []BigQueryEvent{
+			{Location: "Huis", LocationID: 1234, Account: bigquery.NullString{StringVal: "default", Valid: true}, Zone: "Slaapkamer", Type: eventTypeOpenWindow, StartedAt: startedAt},
+			{Location: "Thuis", LocationID: 1234, Account: bigquery.NullString{StringVal: "oma", Valid: true}, Zone: "Slaapkamer", Type: eventTypeOpenWindow, StartedAt: startedAt},
+			{Location: "Thuis", LocationID: 5678, Account: bigquery.NullString{StringVal: "default", Valid: true}, Zone: "Slaapkamer", Type: eventTypeOpenWindow, StartedAt: startedAt},
+		}
+
+		// act
+		added := newEvents(events, existing)
+
+		if assert.Equal(t, 2, len(added)) {
+			assert.Equal(t, "oma", added[0].Account.StringVal)
+			assert.Equal(t, 5678, added[1].LocationID)
+		}
+	})
+}
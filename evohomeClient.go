@@ -2,8 +2,8 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -13,29 +13,41 @@ import (
 	"github.com/sethgrid/pester"
 )
 
-var (
-	// ErrRequestNotAuthorized is returned if a query for a user returns no results
-	ErrRequestNotAuthorized = errors.New("The request is not authorized")
+const (
+	// maxRateLimitedAttempts is the number of times a request is sent while the api answers with 429 Too Many Requests
+	maxRateLimitedAttempts = 3
+
+	// maxFailedAttempts is the number of times a request is sent while its connection fails or the api answers with a 5xx status code
+	maxFailedAttempts = 3
+
+	// defaultRetryAfter is used to back off when a 429 Too Many Requests response lacks a usable Retry-After header
+	defaultRetryAfter = 30 * time.Second
 )
 
 // EvohomeClient is the interface for connecting to the evohome api
 type EvohomeClient interface {
-	GetSession(username, password string) (sessionID string, userID int, err error)
-	GetLocations(sessionID string, userID int) (locations []LocationResponse, err error)
+	GetSession(ctx context.Context, username, password string) (sessionID string, userID int, err error)
+	GetLocations(ctx context.Context, sessionID string, userID int) (locations []LocationResponse, err error)
 }
 
 type evohomeClientImpl struct {
-	baseURL string
+	account     string
+	baseURL     string
+	rateLimiter *rateLimiter
+	recorders   []ResponseRecorder
 }
 
-// NewEvohomeClient returns new EvohomeClient
-func NewEvohomeClient() (EvohomeClient, error) {
+// NewEvohomeClient returns new EvohomeClient that sends at most rateLimitRequests requests per rateLimitWindow and passes raw GetLocations responses to the recorders under the account's name
+func NewEvohomeClient(account string, rateLimitRequests int, rateLimitWindow time.Duration, recorders ...ResponseRecorder) (EvohomeClient, error) {
 	return &evohomeClientImpl{
-		baseURL: "https://tccna.honeywell.com",
+		account:     account,
+		baseURL:     "https://tccna.honeywell.com",
+		rateLimiter: newRateLimiter(rateLimitRequests, rateLimitWindow),
+		recorders:   recorders,
 	}, nil
 }
 
-func (ec *evohomeClientImpl) GetSession(username, password string) (sessionID string, userID int, err error) {
+func (ec *evohomeClientImpl) GetSession(ctx context.Context, username, password string) (sessionID string, userID int, err error) {
 	// https://tccna.honeywell.com/WebAPI/api/Session
 
 	// using this approach can suffer from rate limiting, see https://github.com/watchforstock/evohome-client/issues/57
@@ -52,35 +64,28 @@ func (ec *evohomeClientImpl) GetSession(username, password string) (sessionID st
 		return
 	}
 
-	// create client, in order to add headers
-	client := pester.New()
-	client.MaxRetries = 3
-	client.Backoff = pester.ExponentialJitterBackoff
-	client.KeepLog = true
-	client.Timeout = time.Second * 10
-	request, err := http.NewRequest("POST", requestURL, bytes.NewBuffer(sessionRequestJSONBytes))
-	if err != nil {
-		return
-	}
-
-	// add headers
-	request.Header.Add("Content-Type", "application/json")
-
-	// perform actual request
-	response, err := client.Do(request)
-	if err != nil {
-		return
-	}
+	statusCode, body, err := ec.doRequest(ctx, func() (*http.Request, error) {
+		request, err := http.NewRequestWithContext(ctx, "POST", requestURL, bytes.NewBuffer(sessionRequestJSONBytes))
+		if err != nil {
+			return nil, err
+		}
 
-	defer response.Body.Close()
+		// add headers
+		request.Header.Add("Content-Type", "application/json")
 
-	body, err := ioutil.ReadAll(response.Body)
+		return request, nil
+	})
 	if err != nil {
 		return
 	}
 
-	if response.StatusCode != http.StatusOK {
-		return "", 0, fmt.Errorf("Request to %v failed with status code %v: %v", requestURL, response.StatusCode, string(body))
+	if statusCode != http.StatusOK {
+		apiError := newAPIError(requestURL, statusCode, body)
+		if apiError.Kind == ErrRequestNotAuthorized {
+			// without a session any 401 means the credentials were rejected
+			apiError.Kind = ErrInvalidCredentials
+		}
+		return "", 0, apiError
 	}
 
 	// log.Debug().Interface("body", string(body)).Msg("Session response before unmarshalling")
@@ -89,7 +94,7 @@ func (ec *evohomeClientImpl) GetSession(username, password string) (sessionID st
 	var sessionResponse SessionResponse
 	err = json.Unmarshal(body, &sessionResponse)
 	if err != nil {
-		return
+		return "", 0, newDecodeError(requestURL, statusCode, err)
 	}
 
 	sessionID = sessionResponse.SessionID
@@ -98,53 +103,120 @@ func (ec *evohomeClientImpl) GetSession(username, password string) (sessionID st
 	return
 }
 
-func (ec *evohomeClientImpl) GetLocations(sessionID string, userID int) (locations []LocationResponse, err error) {
+func (ec *evohomeClientImpl) GetLocations(ctx context.Context, sessionID string, userID int) (locations []LocationResponse, err error) {
 	// https://tccna.honeywell.com/WebAPI/api/locations?userId=%v&allData=True
 
 	requestURL := ec.baseURL + fmt.Sprintf("/WebAPI/api/locations?userId=%v&allData=True", userID)
 
-	// create client, in order to add headers
-	client := pester.New()
-	client.MaxRetries = 3
-	client.Backoff = pester.ExponentialJitterBackoff
-	client.KeepLog = true
-	client.Timeout = time.Second * 10
-	request, err := http.NewRequest("GET", requestURL, nil)
-	if err != nil {
-		return
-	}
+	statusCode, body, err := ec.doRequest(ctx, func() (*http.Request, error) {
+		request, err := http.NewRequestWithContext(ctx, "GET", requestURL, nil)
+		if err != nil {
+			return nil, err
+		}
 
-	// add headers
-	request.Header.Add("sessionID", sessionID)
+		// add headers
+		request.Header.Add("sessionID", sessionID)
 
-	// perform actual request
-	response, err := client.Do(request)
+		return request, nil
+	})
 	if err != nil {
 		return
 	}
 
-	defer response.Body.Close()
-
-	body, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return
+	if statusCode != http.StatusOK {
+		return locations, newAPIError(requestURL, statusCode, body)
 	}
 
-	if response.StatusCode == http.StatusUnauthorized {
-		return locations, ErrRequestNotAuthorized
-	}
+	log.Debug().Interface("body", string(body)).Msg("Location response before unmarshalling")
 
-	if response.StatusCode != http.StatusOK {
-		return locations, fmt.Errorf("Request to %v failed with status code %v: %v", requestURL, response.StatusCode, string(body))
+	// record the raw body before unmarshalling, so responses that fail to decode can be replayed as well
+	if err := recordResponse(ctx, ec.recorders, ec.account, time.Now().UTC(), body); err != nil {
+		log.Warn().Err(err).Msg("Failed recording location response")
 	}
 
-	log.Debug().Interface("body", string(body)).Msg("Location response before unmarshalling")
-
 	// unmarshal json body
 	err = json.Unmarshal(body, &locations)
 	if err != nil {
-		return
+		return nil, newDecodeError(requestURL, statusCode, err)
 	}
 
 	return
 }
+
+// doRequest sends the request created by newRequest within the rate limiter's budget; failed connections and 5xx responses are retried with a backoff and 429 responses after the Retry-After period, every attempt taking its turn in the rate limiter
+func (ec *evohomeClientImpl) doRequest(ctx context.Context, newRequest func() (*http.Request, error)) (statusCode int, body []byte, err error) {
+
+	var retryAfter time.Duration
+	var requestURL string
+	failedAttempts, rateLimitedAttempts := 0, 0
+	for {
+		err = ec.rateLimiter.Wait(ctx)
+		if err != nil {
+			return
+		}
+
+		request, err := newRequest()
+		if err != nil {
+			return 0, nil, err
+		}
+		requestURL = request.URL.String()
+
+		// create client, in order to add headers; retries happen below, so they count against the rate limit
+		client := pester.New()
+		client.MaxRetries = 1
+		client.KeepLog = true
+		client.Timeout = time.Second * 10
+
+		// perform actual request
+		statusCode, body, err = 0, nil, nil
+		response, err := client.Do(request)
+		if err == nil {
+			body, err = ioutil.ReadAll(response.Body)
+			response.Body.Close()
+			statusCode = response.StatusCode
+		}
+
+		if (err != nil && ctx.Err() == nil) || statusCode >= http.StatusInternalServerError {
+			failedAttempts++
+			if failedAttempts >= maxFailedAttempts {
+				return statusCode, body, err
+			}
+
+			backoff := pester.ExponentialJitterBackoff(failedAttempts)
+			log.Warn().Err(err).Msgf("Request to %v failed with status code %v, retrying after %v (attempt %v of %v)", request.URL.Path, statusCode, backoff, failedAttempts, maxFailedAttempts)
+
+			select {
+			case <-ctx.Done():
+				return 0, nil, ctx.Err()
+			case <-time.After(backoff):
+			}
+			continue
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if statusCode != http.StatusTooManyRequests {
+			return statusCode, body, nil
+		}
+
+		var ok bool
+		retryAfter, ok = parseRetryAfter(response.Header.Get("Retry-After"), time.Now().UTC())
+		if !ok {
+			retryAfter = defaultRetryAfter
+		}
+		ec.rateLimiter.BlockUntil(time.Now().UTC().Add(retryAfter))
+
+		rateLimitedAttempts++
+		if rateLimitedAttempts >= maxRateLimitedAttempts {
+			break
+		}
+
+		log.Warn().Msgf("Request to %v is rate limited, retrying after %v (attempt %v of %v)", request.URL.Path, retryAfter, rateLimitedAttempts, maxRateLimitedAttempts)
+	}
+
+	apiError := newAPIError(requestURL, http.StatusTooManyRequests, body)
+	apiError.RetryAfter = retryAfter
+
+	return http.StatusTooManyRequests, body, apiError
+}
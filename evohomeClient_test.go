@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -18,12 +23,12 @@ func TestGetSession(t *testing.T) {
 			t.Skip("skipping test in short mode.")
 		}
 
-		client, _ := NewEvohomeClient()
+		client, _ := NewEvohomeClient("", 10, time.Minute)
 		username := os.Getenv("EVOHOME_USERNAME")
 		password := os.Getenv("EVOHOME_PASSWORD")
 
 		// act
-		sessionID, userID, err := client.GetSession(username, password)
+		sessionID, userID, err := client.GetSession(context.Background(), username, password)
 
 		if assert.Nil(t, err) {
 			assert.NotEqual(t, "", sessionID)
@@ -40,13 +45,13 @@ func TestGetLocations(t *testing.T) {
 			t.Skip("skipping test in short mode.")
 		}
 
-		client, _ := NewEvohomeClient()
+		client, _ := NewEvohomeClient("", 10, time.Minute)
 		username := os.Getenv("EVOHOME_USERNAME")
 		password := os.Getenv("EVOHOME_PASSWORD")
-		sessionID, userID, _ := client.GetSession(username, password)
+		sessionID, userID, _ := client.GetSession(context.Background(), username, password)
 
 		// act
-		locations, err := client.GetLocations(sessionID, userID)
+		locations, err := client.GetLocations(context.Background(), sessionID, userID)
 
 		if assert.Nil(t, err) {
 			log.Printf("%v", locations)
@@ -66,3 +71,107 @@ func TestGetLocations(t *testing.T) {
 		}
 	})
 }
+
+func TestGetLocationsRateLimiting(t *testing.T) {
+
+	t.Run("RetriesAfterRetryAfterPeriodWhenRateLimited", func(t *testing.T) {
+
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if requests == 1 {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.Write([]byte(`[{"locationID":1,"name":"Thuis"}]`))
+		}))
+		defer server.Close()
+
+		client := &evohomeClientImpl{baseURL: server.URL, rateLimiter: newRateLimiter(10, time.Minute)}
+
+		// act
+		locations, err := client.GetLocations(context.Background(), "session", 1)
+
+		if assert.Nil(t, err) {
+			assert.Equal(t, 2, requests)
+			assert.Equal(t, 1, len(locations))
+		}
+	})
+
+	t.Run("CountsRetriesOfServerErrorsAgainstRateLimit", func(t *testing.T) {
+
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		client := &evohomeClientImpl{baseURL: server.URL, rateLimiter: newRateLimiter(1, time.Minute)}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		// act
+		_, err := client.GetLocations(ctx, "session", 1)
+
+		assert.True(t, errors.Is(err, ErrRateLimited))
+		assert.Equal(t, 1, requests)
+	})
+
+	t.Run("ReturnsErrRateLimitedIfRetryAfterExceedsDeadline", func(t *testing.T) {
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "120")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}))
+		defer server.Close()
+
+		client := &evohomeClientImpl{baseURL: server.URL, rateLimiter: newRateLimiter(10, time.Minute)}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		// act
+		_, err := client.GetLocations(ctx, "session", 1)
+
+		assert.True(t, errors.Is(err, ErrRateLimited))
+	})
+}
+
+func TestGetSessionErrors(t *testing.T) {
+
+	t.Run("ReturnsErrInvalidCredentialsIfPasswordIsIncorrect", func(t *testing.T) {
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`[{"code":"EmailOrPasswordIncorrect","message":"The email or password provided is incorrect."}]`))
+		}))
+		defer server.Close()
+
+		client := &evohomeClientImpl{baseURL: server.URL, rateLimiter: newRateLimiter(10, time.Minute)}
+
+		// act
+		_, _, err := client.GetSession(context.Background(), "username", "password")
+
+		assert.True(t, errors.Is(err, ErrInvalidCredentials))
+		var apiError *APIError
+		if assert.True(t, errors.As(err, &apiError)) {
+			assert.Equal(t, "EmailOrPasswordIncorrect", apiError.Code)
+		}
+	})
+
+	t.Run("ReturnsErrDecodeFailedIfResponseIsNotJSON", func(t *testing.T) {
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`<html>maintenance</html>`))
+		}))
+		defer server.Close()
+
+		client := &evohomeClientImpl{baseURL: server.URL, rateLimiter: newRateLimiter(10, time.Minute)}
+
+		// act
+		_, _, err := client.GetSession(context.Background(), "username", "password")
+
+		assert.True(t, errors.Is(err, ErrDecodeFailed))
+	})
+}
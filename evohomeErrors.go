@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrRequestNotAuthorized is returned if the session is no longer valid
+	ErrRequestNotAuthorized = errors.New("The request is not authorized")
+
+	// ErrInvalidCredentials is returned if the username or password is rejected when creating a session
+	ErrInvalidCredentials = errors.New("The username or password is incorrect")
+
+	// ErrAccountLocked is returned if the account has been locked, usually after too many failed logins
+	ErrAccountLocked = errors.New("The account is locked")
+
+	// ErrRateLimited is returned if the api keeps answering with 429 Too Many Requests or the request budget doesn't allow another request before the deadline
+	ErrRateLimited = errors.New("The request is rate limited")
+
+	// ErrServerError is returned if the api fails with a 5xx status code after retries
+	ErrServerError = errors.New("The api failed with a server error")
+
+	// ErrDecodeFailed is returned if a response body can't be unmarshalled
+	ErrDecodeFailed = errors.New("The response could not be decoded")
+
+	// ErrRequestFailed is returned for any other unexpected status code
+	ErrRequestFailed = errors.New("The request failed")
+)
+
+// APIError describes a failed request to the evohome api; use errors.Is with one of the sentinel errors above to check its kind, or errors.As to inspect the details
+type APIError struct {
+	Kind       error
+	URL        string
+	StatusCode int
+	Code       string
+	Message    string
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *APIError) Error() string {
+	description := e.Message
+	if description == "" && e.Err != nil {
+		description = e.Err.Error()
+	}
+	if e.Code != "" {
+		description = fmt.Sprintf("%v (%v)", description, e.Code)
+	}
+
+	return fmt.Sprintf("%v: request to %v returned status code %v: %v", e.Kind, e.URL, e.StatusCode, description)
+}
+
+// Is makes errors.Is match the error against its kind
+func (e *APIError) Is(target error) bool {
+	return e.Kind == target
+}
+
+// Unwrap gives access to the underlying error, if any
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// honeywellErrorResponse is the error payload returned by the evohome api, either as a single object or as an array of them
+type honeywellErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// newAPIError classifies a non-ok response from the evohome api by its status code and the error code in its body
+func newAPIError(requestURL string, statusCode int, body []byte) *APIError {
+	apiError := &APIError{
+		Kind:       ErrRequestFailed,
+		URL:        requestURL,
+		StatusCode: statusCode,
+	}
+
+	apiError.Code, apiError.Message = parseErrorResponse(body)
+	if apiError.Code == "" && apiError.Message == "" {
+		apiError.Message = string(body)
+	}
+
+	code := strings.ToLower(apiError.Code)
+
+	switch {
+	case statusCode == http.StatusTooManyRequests || code == "toomanyrequests":
+		apiError.Kind = ErrRateLimited
+	case strings.Contains(code, "locked"):
+		apiError.Kind = ErrAccountLocked
+	case code == "emailorpasswordincorrect" || code == "invalidcredentials" || code == "invalid_grant":
+		apiError.Kind = ErrInvalidCredentials
+	case statusCode == http.StatusUnauthorized:
+		apiError.Kind = ErrRequestNotAuthorized
+	case statusCode >= 500:
+		apiError.Kind = ErrServerError
+	}
+
+	return apiError
+}
+
+// newDecodeError wraps an unmarshalling failure of an otherwise successful response
+func newDecodeError(requestURL string, statusCode int, err error) *APIError {
+	return &APIError{
+		Kind:       ErrDecodeFailed,
+		URL:        requestURL,
+		StatusCode: statusCode,
+		Err:        err,
+	}
+}
+
+func parseErrorResponse(body []byte) (code, message string) {
+	var errorResponses []honeywellErrorResponse
+	if err := json.Unmarshal(body, &errorResponses); err == nil && len(errorResponses) > 0 {
+		return errorResponses[0].Code, errorResponses[0].Message
+	}
+
+	var errorResponse honeywellErrorResponse
+	if err := json.Unmarshal(body, &errorResponse); err == nil {
+		return errorResponse.Code, errorResponse.Message
+	}
+
+	return "", ""
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewAPIError(t *testing.T) {
+
+	t.Run("ReturnsErrAccountLockedForLockedAccountCode", func(t *testing.T) {
+
+		// act
+		err := newAPIError("https://tccna.honeywell.com/WebAPI/api/Session", http.StatusUnauthorized, []byte(`[{"code":"AccountIsLocked","message":"Account is locked"}]`))
+
+		assert.True(t, errors.Is(err, ErrAccountLocked))
+		assert.Equal(t, "Account is locked", err.Message)
+	})
+
+	t.Run("ReturnsErrRequestNotAuthorizedForUnauthorizedStatusCode", func(t *testing.T) {
+
+		// act
+		err := newAPIError("https://tccna.honeywell.com/WebAPI/api/locations", http.StatusUnauthorized, []byte(`{"code":"Unauthorized","message":"Unauthorized"}`))
+
+		assert.True(t, errors.Is(err, ErrRequestNotAuthorized))
+	})
+
+	t.Run("ReturnsErrServerErrorFor5xxStatusCode", func(t *testing.T) {
+
+		// act
+		err := newAPIError("https://tccna.honeywell.com/WebAPI/api/locations", http.StatusBadGateway, []byte(`Bad Gateway`))
+
+		assert.True(t, errors.Is(err, ErrServerError))
+		assert.Equal(t, "Bad Gateway", err.Message)
+	})
+
+	t.Run("ReturnsErrRateLimitedForTooManyRequestsCode", func(t *testing.T) {
+
+		// act
+		err := newAPIError("https://tccna.honeywell.com/WebAPI/api/Session", http.StatusBadRequest, []byte(`[{"code":"TooManyRequests","message":"Request count limitation exceeded, please try again later."}]`))
+
+		assert.True(t, errors.Is(err, ErrRateLimited))
+	})
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// recordingTimeFormat is used in recording file names; it sorts chronologically and avoids colons for filesystems that don't allow them
+	recordingTimeFormat = "20060102T150405.000000000Z"
+
+	recordingFilePrefix           = "locations-"
+	recordingFileSuffix           = ".json"
+	compressedRecordingFileSuffix = ".json.gz"
+)
+
+// ResponseRecorder receives the raw body of every successful GetLocations response, with the name of the account it was fetched with
+type ResponseRecorder interface {
+	RecordLocationsResponse(ctx context.Context, account string, fetchedAt time.Time, body []byte) error
+}
+
+type directoryRecorderImpl struct {
+	dir      string
+	compress bool
+}
+
+// NewDirectoryRecorder returns a ResponseRecorder that writes each response body to a file named after its account and time in dir, gzipped if compress is set; dir can be a mounted object storage bucket
+func NewDirectoryRecorder(dir string, compress bool) (ResponseRecorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &directoryRecorderImpl{
+		dir:      dir,
+		compress: compress,
+	}, nil
+}
+
+func (dr *directoryRecorderImpl) RecordLocationsResponse(ctx context.Context, account string, fetchedAt time.Time, body []byte) error {
+	path := filepath.Join(dr.dir, recordingFileName(account, fetchedAt, dr.compress))
+
+	if dr.compress {
+		var err error
+		body, err = gzipBytes(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	// write to a temporary file first so a replay never picks up a half written recording
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, body, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// recordingFileName returns locations-<account>-<time>.json, or locations-<time>.json without an account as recorded before accounts were
+func recordingFileName(account string, fetchedAt time.Time, compressed bool) string {
+	name := recordingFilePrefix
+	if account != "" {
+		name += account + "-"
+	}
+	name += fetchedAt.UTC().Format(recordingTimeFormat)
+
+	if compressed {
+		return name + compressedRecordingFileSuffix
+	}
+	return name + recordingFileSuffix
+}
+
+// parseRecordingFileName returns the account and time a recording was fetched with and whether it's compressed, or false if the file name isn't a recording
+func parseRecordingFileName(name string) (account string, fetchedAt time.Time, compressed bool, ok bool) {
+	if !strings.HasPrefix(name, recordingFilePrefix) {
+		return
+	}
+
+	var suffix string
+	switch {
+	case strings.HasSuffix(name, compressedRecordingFileSuffix):
+		suffix = compressedRecordingFileSuffix
+		compressed = true
+	case strings.HasSuffix(name, recordingFileSuffix):
+		suffix = recordingFileSuffix
+	default:
+		return
+	}
+
+	// the time has a fixed length, account names can contain dashes themselves
+	rest := strings.TrimSuffix(strings.TrimPrefix(name, recordingFilePrefix), suffix)
+	if len(rest) > len(recordingTimeFormat)+1 && rest[len(rest)-len(recordingTimeFormat)-1] == '-' {
+		account = rest[:len(rest)-len(recordingTimeFormat)-1]
+		rest = rest[len(rest)-len(recordingTimeFormat):]
+	}
+
+	fetchedAt, err := time.Parse(recordingTimeFormat, rest)
+	if err != nil {
+		return
+	}
+
+	return account, fetchedAt, compressed, true
+}
+
+// recordResponse passes the body to all recorders, so one failing recorder doesn't keep the others from recording
+func recordResponse(ctx context.Context, recorders []ResponseRecorder, account string, fetchedAt time.Time, body []byte) (err error) {
+	for _, r := range recorders {
+		if recordErr := r.RecordLocationsResponse(ctx, account, fetchedAt, body); recordErr != nil && err == nil {
+			err = fmt.Errorf("Recording locations response fetched at %v failed: %w", fetchedAt, recordErr)
+		}
+	}
+
+	return
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func gunzipBytes(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+var (
+	// ErrNoMoreRecordings is returned by a replay client once all recordings have been served
+	ErrNoMoreRecordings = errors.New("All recordings have been replayed")
+)
+
+// EvohomeReplayClient serves recorded GetLocations responses in chronological order instead of calling the evohome api
+type EvohomeReplayClient interface {
+	EvohomeClient
+
+	// Next advances to the next recording and returns false once all recordings have been served
+	Next() bool
+
+	// FetchedAt returns the time the current recording was originally fetched at
+	FetchedAt() time.Time
+
+	// Account returns the name of the account the current recording was fetched with, or an empty string for recordings without one
+	Account() string
+}
+
+type recording struct {
+	path       string
+	account    string
+	fetchedAt  time.Time
+	compressed bool
+}
+
+type evohomeReplayClientImpl struct {
+	recordings []recording
+	current    int
+}
+
+// NewEvohomeReplayClient returns an EvohomeReplayClient for the recordings in replayDir, as written by a directory recorder with or without compression
+func NewEvohomeReplayClient(replayDir string) (EvohomeReplayClient, error) {
+	files, err := ioutil.ReadDir(replayDir)
+	if err != nil {
+		return nil, err
+	}
+
+	recordings := []recording{}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		account, fetchedAt, compressed, ok := parseRecordingFileName(f.Name())
+		if !ok {
+			continue
+		}
+		recordings = append(recordings, recording{
+			path:       filepath.Join(replayDir, f.Name()),
+			account:    account,
+			fetchedAt:  fetchedAt,
+			compressed: compressed,
+		})
+	}
+
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].fetchedAt.Before(recordings[j].fetchedAt)
+	})
+
+	return &evohomeReplayClientImpl{
+		recordings: recordings,
+		current:    -1,
+	}, nil
+}
+
+func (rc *evohomeReplayClientImpl) GetSession(ctx context.Context, username, password string) (sessionID string, userID int, err error) {
+	// recordings don't need a session
+	return "replay", 0, nil
+}
+
+func (rc *evohomeReplayClientImpl) GetLocations(ctx context.Context, sessionID string, userID int) (locations []LocationResponse, err error) {
+	if rc.current < 0 || rc.current >= len(rc.recordings) {
+		return nil, ErrNoMoreRecordings
+	}
+
+	r := rc.recordings[rc.current]
+
+	body, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		return
+	}
+
+	if r.compressed {
+		body, err = gunzipBytes(body)
+		if err != nil {
+			return nil, newDecodeError(r.path, 0, err)
+		}
+	}
+
+	err = json.Unmarshal(body, &locations)
+	if err != nil {
+		return nil, newDecodeError(r.path, 0, err)
+	}
+
+	return
+}
+
+func (rc *evohomeReplayClientImpl) Next() bool {
+	if rc.current < len(rc.recordings) {
+		rc.current++
+	}
+
+	return rc.current < len(rc.recordings)
+}
+
+func (rc *evohomeReplayClientImpl) FetchedAt() time.Time {
+	if rc.current < 0 || rc.current >= len(rc.recordings) {
+		return time.Time{}
+	}
+
+	return rc.recordings[rc.current].fetchedAt
+}
+
+func (rc *evohomeReplayClientImpl) Account() string {
+	if rc.current < 0 || rc.current >= len(rc.recordings) {
+		return ""
+	}
+
+	return rc.recordings[rc.current].account
+}
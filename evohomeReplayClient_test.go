@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvohomeReplayClient(t *testing.T) {
+
+	t.Run("ReplaysRecordingsInChronologicalOrder", func(t *testing.T) {
+
+		dir, _ := ioutil.TempDir("", "evohome-recordings")
+		defer os.RemoveAll(dir)
+
+		recorder, _ := NewDirectoryRecorder(dir, false)
+		later := time.Date(2020, 11, 1, 12, 5, 0, 0, time.UTC)
+		earlier := time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC)
+		recorder.RecordLocationsResponse(context.Background(), "", later, []byte(`[{"locationID":1,"name":"Later"}]`))
+		recorder.RecordLocationsResponse(context.Background(), "", earlier, []byte(`[{"locationID":1,"name":"Earlier"}]`))
+
+		client, err := NewEvohomeReplayClient(dir)
+		assert.Nil(t, err)
+
+		// act
+		names := []string{}
+		fetchedAts := []time.Time{}
+		for client.Next() {
+			locations, err := client.GetLocations(context.Background(), "", 0)
+			if assert.Nil(t, err) {
+				names = append(names, locations[0].Name)
+				fetchedAts = append(fetchedAts, client.FetchedAt())
+			}
+		}
+
+		assert.Equal(t, []string{"Earlier", "Later"}, names)
+		assert.Equal(t, []time.Time{earlier, later}, fetchedAts)
+	})
+
+	t.Run("ReplaysCompressedRecordings", func(t *testing.T) {
+
+		dir, _ := ioutil.TempDir("", "evohome-recordings")
+		defer os.RemoveAll(dir)
+
+		recorder, _ := NewDirectoryRecorder(dir, true)
+		recorder.RecordLocationsResponse(context.Background(), "", time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC), []byte(`[{"locationID":1,"name":"Thuis"}]`))
+
+		client, _ := NewEvohomeReplayClient(dir)
+		client.Next()
+
+		// act
+		locations, err := client.GetLocations(context.Background(), "", 0)
+
+		if assert.Nil(t, err) {
+			assert.Equal(t, "Thuis", locations[0].Name)
+		}
+	})
+
+	t.Run("ReturnsAccountFromRecordingFileName", func(t *testing.T) {
+
+		dir, _ := ioutil.TempDir("", "evohome-recordings")
+		defer os.RemoveAll(dir)
+
+		recorder, _ := NewDirectoryRecorder(dir, true)
+		recorder.RecordLocationsResponse(context.Background(), "oma-2", time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC), []byte(`[{"locationID":1,"name":"Oma"}]`))
+		recorder.RecordLocationsResponse(context.Background(), "", time.Date(2020, 11, 1, 12, 5, 0, 0, time.UTC), []byte(`[{"locationID":1,"name":"Thuis"}]`))
+
+		client, _ := NewEvohomeReplayClient(dir)
+
+		// act
+		accounts := []string{}
+		fetchedAts := []time.Time{}
+		for client.Next() {
+			accounts = append(accounts, client.Account())
+			fetchedAts = append(fetchedAts, client.FetchedAt())
+		}
+
+		assert.Equal(t, []string{"oma-2", ""}, accounts)
+		assert.Equal(t, []time.Time{time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC), time.Date(2020, 11, 1, 12, 5, 0, 0, time.UTC)}, fetchedAts)
+	})
+
+	t.Run("ReturnsErrNoMoreRecordingsAfterLastRecording", func(t *testing.T) {
+
+		dir, _ := ioutil.TempDir("", "evohome-recordings")
+		defer os.RemoveAll(dir)
+
+		client, _ := NewEvohomeReplayClient(dir)
+		client.Next()
+
+		// act
+		_, err := client.GetLocations(context.Background(), "", 0)
+
+		assert.Equal(t, ErrNoMoreRecordings, err)
+	})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	serviceAccountTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	serviceAccountCAPath    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// KubernetesClient is the interface for reading and updating secrets via the kubernetes api
+type KubernetesClient interface {
+	GetSecret(ctx context.Context, namespace, name string) (secret *KubernetesSecret, err error)
+	UpdateSecret(ctx context.Context, secret *KubernetesSecret) error
+}
+
+type kubernetesClientImpl struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+// NewInClusterKubernetesClient returns a KubernetesClient authenticated with the pod's service account
+func NewInClusterKubernetesClient() (KubernetesClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("Not running inside a kubernetes cluster, KUBERNETES_SERVICE_HOST or KUBERNETES_SERVICE_PORT is not set")
+	}
+
+	token, err := ioutil.ReadFile(serviceAccountTokenPath)
+	if err != nil {
+		return nil, err
+	}
+
+	caCert, err := ioutil.ReadFile(serviceAccountCAPath)
+	if err != nil {
+		return nil, err
+	}
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("No certificates found in %v", serviceAccountCAPath)
+	}
+
+	return &kubernetesClientImpl{
+		baseURL: "https://" + net.JoinHostPort(host, port),
+		token:   string(bytes.TrimSpace(token)),
+		httpClient: &http.Client{
+			Timeout: time.Second * 10,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: rootCAs},
+			},
+		},
+	}, nil
+}
+
+func (kc *kubernetesClientImpl) GetSecret(ctx context.Context, namespace, name string) (secret *KubernetesSecret, err error) {
+	requestURL := kc.baseURL + fmt.Sprintf("/api/v1/namespaces/%v/secrets/%v", namespace, name)
+
+	body, err := kc.doRequest(ctx, "GET", requestURL, nil)
+	if err != nil {
+		return
+	}
+
+	// unmarshal json body
+	err = json.Unmarshal(body, &secret)
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+func (kc *kubernetesClientImpl) UpdateSecret(ctx context.Context, secret *KubernetesSecret) error {
+	var metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	}
+	if err := json.Unmarshal(secret.Metadata, &metadata); err != nil {
+		return err
+	}
+
+	requestURL := kc.baseURL + fmt.Sprintf("/api/v1/namespaces/%v/secrets/%v", metadata.Namespace, metadata.Name)
+
+	secretJSONBytes, err := json.Marshal(secret)
+	if err != nil {
+		return err
+	}
+
+	_, err = kc.doRequest(ctx, "PUT", requestURL, secretJSONBytes)
+
+	return err
+}
+
+func (kc *kubernetesClientImpl) doRequest(ctx context.Context, method, requestURL string, requestBody []byte) (body []byte, err error) {
+	request, err := http.NewRequestWithContext(ctx, method, requestURL, bytes.NewReader(requestBody))
+	if err != nil {
+		return
+	}
+
+	// add headers
+	request.Header.Add("Authorization", "Bearer "+kc.token)
+	request.Header.Add("Accept", "application/json")
+	if requestBody != nil {
+		request.Header.Add("Content-Type", "application/json")
+	}
+
+	// perform actual request
+	response, err := kc.httpClient.Do(request)
+	if err != nil {
+		return
+	}
+
+	defer response.Body.Close()
+
+	body, err = ioutil.ReadAll(response.Body)
+	if err != nil {
+		return
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Request to %v failed with status code %v: %v", requestURL, response.StatusCode, string(body))
+	}
+
+	return
+}
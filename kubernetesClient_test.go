@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKubernetesClientUpdateSecret(t *testing.T) {
+
+	t.Run("KeepsMetadataWhenUpdatingSecretData", func(t *testing.T) {
+
+		var updatedSecret map[string]interface{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/api/v1/namespaces/heating/secrets/evohome-bigquery-exporter", r.URL.Path)
+			assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+			switch r.Method {
+			case "GET":
+				w.Write([]byte(`{"apiVersion":"v1","kind":"Secret","metadata":{"name":"evohome-bigquery-exporter","namespace":"heating","resourceVersion":"42","labels":{"app":"evohome"}},"type":"Opaque","data":{"username":"dXNlcg=="}}`))
+			case "PUT":
+				body, _ := ioutil.ReadAll(r.Body)
+				json.Unmarshal(body, &updatedSecret)
+				w.Write(body)
+			}
+		}))
+		defer server.Close()
+
+		client := &kubernetesClientImpl{baseURL: server.URL, token: "token", httpClient: server.Client()}
+		secret, err := client.GetSecret(context.Background(), "heating", "evohome-bigquery-exporter")
+		assert.Nil(t, err)
+		secret.Data["session.json"] = []byte(`{}`)
+
+		// act
+		err = client.UpdateSecret(context.Background(), secret)
+
+		if assert.Nil(t, err) {
+			metadata := updatedSecret["metadata"].(map[string]interface{})
+			assert.Equal(t, "42", metadata["resourceVersion"])
+			assert.Equal(t, map[string]interface{}{"app": "evohome"}, metadata["labels"])
+			data := updatedSecret["data"].(map[string]interface{})
+			assert.Equal(t, "dXNlcg==", data["username"])
+			assert.Equal(t, "e30=", data["session.json"])
+		}
+	})
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+)
+
+// locationFilter selects the locations to export; include and exclude match a location by id or name
+type locationFilter struct {
+	Include []string
+	Exclude []string
+
+	// OwnedOnly skips the locations that are shared with the account by their owner
+	OwnedOnly bool
+}
+
+// apply returns the locations that pass the filter, and the names of the ones that don't
+func (f locationFilter) apply(locations []LocationResponse) (kept []LocationResponse, skipped []string) {
+	kept = []LocationResponse{}
+	skipped = []string{}
+	for _, l := range locations {
+		if (len(f.Include) > 0 && !matchesLocation(l, f.Include)) || matchesLocation(l, f.Exclude) || (f.OwnedOnly && !l.IsLocationOwner) {
+			skipped = append(skipped, l.Name)
+			continue
+		}
+		kept = append(kept, l)
+	}
+
+	return
+}
+
+func matchesLocation(l LocationResponse, idsOrNames []string) bool {
+	for _, v := range idsOrNames {
+		if v == l.Name || v == fmt.Sprint(l.LocationID) {
+			return true
+		}
+	}
+
+	return false
+}
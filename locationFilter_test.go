@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocationFilterApply(t *testing.T) {
+
+	locations := []LocationResponse{
+		{LocationID: 1234, Name: "Thuis", IsLocationOwner: true},
+		{LocationID: 5678, Name: "Oma", IsLocationOwner: false},
+		{LocationID: 9012, Name: "Vakantiehuis", IsLocationOwner: true},
+	}
+
+	t.Run("KeepsAllLocationsWithoutFilter", func(t *testing.T) {
+
+		// act
+		kept, skipped := locationFilter{}.apply(locations)
+
+		assert.Equal(t, 3, len(kept))
+		assert.Equal(t, 0, len(skipped))
+	})
+
+	t.Run("KeepsIncludedLocationsByIDOrName", func(t *testing.T) {
+
+		filter := locationFilter{Include: []string{"1234", "Oma"}}
+
+		// act
+		kept, skipped := filter.apply(locations)
+
+		if assert.Equal(t, 2, len(kept)) {
+			assert.Equal(t, "Thuis", kept[0].Name)
+			assert.Equal(t, "Oma", kept[1].Name)
+		}
+		assert.Equal(t, []string{"Vakantiehuis"}, skipped)
+	})
+
+	t.Run("SkipsExcludedLocations", func(t *testing.T) {
+
+		filter := locationFilter{Exclude: []string{"9012"}}
+
+		// act
+		kept, _ := filter.apply(locations)
+
+		assert.Equal(t, 2, len(kept))
+	})
+
+	t.Run("SkipsSharedLocationsIfOwnedOnly", func(t *testing.T) {
+
+		filter := locationFilter{OwnedOnly: true}
+
+		// act
+		kept, skipped := filter.apply(locations)
+
+		assert.Equal(t, 2, len(kept))
+		assert.Equal(t, []string{"Oma"}, skipped)
+	})
+}
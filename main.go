@@ -3,16 +3,24 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
 	"github.com/alecthomas/kingpin"
-	"github.com/ericchiang/k8s"
-	corev1 "github.com/ericchiang/k8s/apis/core/v1"
 	foundation "github.com/estafette/estafette-foundation"
 	"github.com/rs/zerolog/log"
+	"google.golang.org/api/option"
 )
 
 var (
@@ -25,96 +33,1048 @@ var (
 	buildDate string
 	goVersion = runtime.Version()
 
+	// commands
+	exportCommand     = kingpin.Command("export", "Export evohome measurements to BigQuery, applying pending schema migrations first.").Default()
+	migrateCommand    = kingpin.Command("migrate", "Apply pending schema migrations to the BigQuery tables.")
+	migrateDryRun     = migrateCommand.Flag("dry-run", "Only log the pending migrations and their steps without applying them.").Bool()
+	backfillCommand   = kingpin.Command("backfill", "Insert historical measurements from recorded locations responses or a csv export, skipping time buckets that are already present; raise --run-timeout-seconds for large inputs.")
+	backfillInputPath = backfillCommand.Flag("input", "Directory with recorded locations responses, or a csv file with a header laid out like the zone table.").Required().String()
+	backfillFormat    = backfillCommand.Flag("format", "Format of the input.").Default("json").Enum("json", "csv")
+	backfillBatchSize = backfillCommand.Flag("batch-size", "Number of measurements to insert per batch.").Default("500").Int()
+	backfillAccount   = backfillCommand.Flag("account", "Name of the evohome account to record the measurements without one under, like csv input and recordings made before their file names included the account, so time buckets the exporter already inserted for that account are skipped; empty for none.").String()
+	analyzeCommand    = kingpin.Command("analyze", "Fit a first-order thermal model per zone per week over a period from the collected measurements and store its parameters; zones need heat demand from the hgi80 listener.")
+	analyzeFrom       = analyzeCommand.Flag("from", "First day of the period, for example 2020-11-02; rounded down to the monday of its week.").Required().String()
+	analyzeTo         = analyzeCommand.Flag("to", "Last day of the period, for example 2020-11-29; defaults to today.").String()
+	analyzeTable      = analyzeCommand.Flag("thermal-model-table", "Name of the BigQuery table to store the thermal model parameters in.").Default("thermal_models").Envar("BQ_THERMAL_MODEL_TABLE").String()
+	summarizeCommand  = kingpin.Command("summarize", "Summarize per zone per day how well it kept up with its setpoint over a period and store it with a comfort score.")
+	summarizeFrom     = summarizeCommand.Flag("from", "First day of the period, for example 2020-11-02.").Required().String()
+	summarizeTo       = summarizeCommand.Flag("to", "Last day of the period, for example 2020-11-29; defaults to today.").String()
+	summarizeTable    = summarizeCommand.Flag("comfort-summary-table", "Name of the BigQuery table to store the comfort summaries in.").Default("comfort_summaries").Envar("BQ_COMFORT_SUMMARY_TABLE").String()
+	summarizeDelta    = summarizeCommand.Flag("below-setpoint-delta", "Number of degrees a zone can be below its setpoint before it counts as too cold.").Default("0.5").Float64()
+	configCommand     = kingpin.Command("config", "Inspect the configuration.")
+	configValidate    = configCommand.Command("validate", "Validate the configuration merged from the config file, environment variables and flags, and print it with secrets redacted.")
+
 	// application specific config
-	username              = kingpin.Flag("username", "Evohome username.").Envar("EVOHOME_USERNAME").Required().String()
-	password              = kingpin.Flag("password", "Evohome password.").Envar("EVOHOME_PASSWORD").Required().String()
-	sessionSecretPath     = kingpin.Flag("session-secret-path", "Path to session secret.").Default("/secrets/session.json").OverrideDefaultFromEnvar("SESSION_SECRET_PATH").String()
-	sessionSecretName     = kingpin.Flag("session-secret-name", "Name of the session secret.").Default("evohome-bigquery-exporter").OverrideDefaultFromEnvar("SESSION_SECRET_NAME").String()
-	sessionTimeoutMinutes = kingpin.Flag("session-timeout-minutes", "Number of minutes before a session has to be refreshed.").Default("30").OverrideDefaultFromEnvar("SESSION_TIMEOUT_MINUTES").Int()
-	stateFilePath         = kingpin.Flag("state-file-path", "Path to file with state from evohome-hgi80-listener.").Default("/state/state.json").OverrideDefaultFromEnvar("STATE_FILE_PATH").String()
-	namespace             = kingpin.Flag("namespace", "Namespace the pod runs in.").Envar("NAMESPACE").Required().String()
-	bigqueryProjectID     = kingpin.Flag("bigquery-project-id", "Google Cloud project id that contains the BigQuery dataset").Envar("BQ_PROJECT_ID").Required().String()
-	bigqueryDataset       = kingpin.Flag("bigquery-dataset", "Name of the BigQuery dataset").Envar("BQ_DATASET").Required().String()
-	bigqueryTable         = kingpin.Flag("bigquery-table", "Name of the BigQuery table").Envar("BQ_TABLE").Required().String()
-	outdoorZoneName       = kingpin.Flag("outdoor-zone-name", "Name of the zone representing the outdoor temperature and humidity").Default("Outside").OverrideDefaultFromEnvar("OUTDOOR_ZONE_NAME").String()
+	configPath               = kingpin.Flag("config", "Path to a yaml file with the configuration; flags and environment variables override its values.").Envar("CONFIG_PATH").String()
+	username                 = kingpin.Flag("username", "Evohome username.").Envar("EVOHOME_USERNAME").String()
+	password                 = kingpin.Flag("password", "Evohome password.").Envar("EVOHOME_PASSWORD").String()
+	accountsPath             = kingpin.Flag("accounts-path", "Path to a json file with the name, username and password of each evohome account to export, instead of --username and --password.").Envar("ACCOUNTS_PATH").String()
+	accountConcurrency       = kingpin.Flag("account-concurrency", "Maximum number of accounts to fetch at the same time.").Default("2").OverrideDefaultFromEnvar("ACCOUNT_CONCURRENCY").Int()
+	sessionSecretPath        = kingpin.Flag("session-secret-path", "Path to the session secret of the default account; the sessions of the other accounts are read from session-<name>.json next to it.").Default("/secrets/session.json").OverrideDefaultFromEnvar("SESSION_SECRET_PATH").String()
+	sessionSecretName        = kingpin.Flag("session-secret-name", "Name of the session secret.").Default("evohome-bigquery-exporter").OverrideDefaultFromEnvar("SESSION_SECRET_NAME").String()
+	sessionTimeoutMinutes    = kingpin.Flag("session-timeout-minutes", "Number of minutes before a session has to be refreshed.").Default("30").OverrideDefaultFromEnvar("SESSION_TIMEOUT_MINUTES").Int()
+	stateFilePath            = kingpin.Flag("state-file-path", "Path to file with state from evohome-hgi80-listener.").Default("/state/state.json").OverrideDefaultFromEnvar("STATE_FILE_PATH").String()
+	namespace                = kingpin.Flag("namespace", "Namespace the pod runs in.").Envar("NAMESPACE").String()
+	bigqueryProjectID        = kingpin.Flag("bigquery-project-id", "Google Cloud project id that contains the BigQuery dataset").Envar("BQ_PROJECT_ID").String()
+	bigqueryDataset          = kingpin.Flag("bigquery-dataset", "Name of the BigQuery dataset").Envar("BQ_DATASET").String()
+	bigqueryTable            = kingpin.Flag("bigquery-table", "Name of the BigQuery table").Envar("BQ_TABLE").String()
+	bigqueryEndpoint         = kingpin.Flag("bigquery-endpoint", "Endpoint of the BigQuery api, for example of a local BigQuery emulator; uses the Google Cloud endpoint if empty.").Envar("BQ_ENDPOINT").String()
+	bigqueryCredentialsFile  = kingpin.Flag("bigquery-credentials-file", "Path to a service account key file for BigQuery; uses application default credentials if empty, or no credentials if an endpoint is set.").Envar("BQ_CREDENTIALS_FILE").String()
+	outdoorZoneName          = kingpin.Flag("outdoor-zone-name", "Name of the zone representing the outdoor temperature and humidity").Default("Outside").OverrideDefaultFromEnvar("OUTDOOR_ZONE_NAME").String()
+	rateLimitRequests        = kingpin.Flag("rate-limit-requests", "Maximum number of requests to the evohome api per rate limit window.").Default("10").OverrideDefaultFromEnvar("RATE_LIMIT_REQUESTS").Int()
+	rateLimitWindowSeconds   = kingpin.Flag("rate-limit-window-seconds", "Length in seconds of the rate limit window for requests to the evohome api.").Default("60").OverrideDefaultFromEnvar("RATE_LIMIT_WINDOW_SECONDS").Int()
+	recordDir                = kingpin.Flag("record-dir", "Directory to save every raw locations response to, for replaying it later on.").Envar("RECORD_DIR").String()
+	replayDir                = kingpin.Flag("replay-dir", "Directory with recorded locations responses to map and insert instead of calling the evohome api.").Envar("REPLAY_DIR").String()
+	includeLocations         = kingpin.Flag("include-location", "Id or name of a location to export, leaving out all others; repeatable, or one per line in the environment variable.").Envar("INCLUDE_LOCATIONS").Strings()
+	excludeLocations         = kingpin.Flag("exclude-location", "Id or name of a location not to export; repeatable, or one per line in the environment variable.").Envar("EXCLUDE_LOCATIONS").Strings()
+	ownedLocationsOnly       = kingpin.Flag("owned-locations-only", "Only export locations owned by the account, not the ones shared with it.").Default("false").OverrideDefaultFromEnvar("OWNED_LOCATIONS_ONLY").Bool()
+	zoneTable                = kingpin.Flag("zone-table", "Name of the BigQuery table to also insert a flat row per zone per measurement in, for example zone_measurements; disabled if empty.").Envar("BQ_ZONE_TABLE").String()
+	rawArchiveTable          = kingpin.Flag("raw-archive-table", "Name of the BigQuery table to archive gzipped raw locations responses in, for example raw_responses; disabled if empty.").Envar("BQ_RAW_ARCHIVE_TABLE").String()
+	rawArchiveDir            = kingpin.Flag("raw-archive-dir", "Directory, for example a mounted object storage bucket, to archive gzipped raw locations responses in; disabled if empty.").Envar("RAW_ARCHIVE_DIR").String()
+	bigqueryWriteMethod      = kingpin.Flag("bigquery-write-method", "Method for inserting measurements: streaming for legacy streaming inserts, storage-write for the Storage Write API or batch for periodic load jobs from a local buffer.").Default("streaming").OverrideDefaultFromEnvar("BQ_WRITE_METHOD").Enum("streaming", "storage-write", "batch")
+	bigqueryStreamType       = kingpin.Flag("bigquery-stream-type", "Storage Write API stream type: committed makes rows visible on append, pending commits all rows of a run atomically.").Default("committed").OverrideDefaultFromEnvar("BQ_STREAM_TYPE").Enum("committed", "pending")
+	bigqueryStreamStatePath  = kingpin.Flag("bigquery-stream-state-path", "Path to a file on a persistent volume to keep the Storage Write API streams in between runs, so a retried run doesn't append rows twice; kept in the session secret if empty.").Envar("BQ_STREAM_STATE_PATH").String()
+	batchBufferDir           = kingpin.Flag("batch-buffer-dir", "Directory on a persistent volume to buffer measurements in between load jobs when using the batch write method.").Default("/buffer").OverrideDefaultFromEnvar("BATCH_BUFFER_DIR").String()
+	batchLoadIntervalMinutes = kingpin.Flag("batch-load-interval-minutes", "Number of minutes measurements are buffered before they're loaded with a load job when using the batch write method.").Default("60").OverrideDefaultFromEnvar("BATCH_LOAD_INTERVAL_MINUTES").Int()
+	insertIDBucketSeconds    = kingpin.Flag("insert-id-bucket-seconds", "Number of seconds measured_at is bucketed by to derive insert ids for deduplication; should match the cronjob schedule.").Default("300").OverrideDefaultFromEnvar("INSERT_ID_BUCKET_SECONDS").Int()
+	createDataset            = kingpin.Flag("create-dataset", "Create the BigQuery dataset if it doesn't exist.").Default("false").OverrideDefaultFromEnvar("BQ_CREATE_DATASET").Bool()
+	bigqueryLocation         = kingpin.Flag("bigquery-location", "Location to create the BigQuery dataset in, for example EU or europe-west4.").Default("US").OverrideDefaultFromEnvar("BQ_LOCATION").String()
+	partitionType            = kingpin.Flag("partition-type", "Granularity of the time partitioning of new tables.").Default("DAY").OverrideDefaultFromEnvar("BQ_PARTITION_TYPE").Enum("HOUR", "DAY", "MONTH", "YEAR")
+	partitionExpirationDays  = kingpin.Flag("partition-expiration-days", "Number of days before partitions are deleted; partitions never expire if 0, which also removes the expiration of existing tables.").Default("0").OverrideDefaultFromEnvar("BQ_PARTITION_EXPIRATION_DAYS").Int()
+	requirePartitionFilter   = kingpin.Flag("require-partition-filter", "Require queries on the tables to filter on the partition column; can't be combined with rollups, degree-days, boiler runtime or events, nor with the analyze and summarize commands, which read the deduplicated view.").Default("false").OverrideDefaultFromEnvar("BQ_REQUIRE_PARTITION_FILTER").Bool()
+	clusterByLocation        = kingpin.Flag("cluster-by-location", "Cluster the measurement tables on location.").Default("false").OverrideDefaultFromEnvar("BQ_CLUSTER_BY_LOCATION").Bool()
+	rollups                  = kingpin.Flag("rollups", "Materialise the managed views in rollup tables, refreshed by the export runs.").Default("false").OverrideDefaultFromEnvar("BQ_ROLLUPS").Bool()
+	rollupRefreshMinutes     = kingpin.Flag("rollup-refresh-minutes", "Number of minutes between refreshes of the rollup tables.").Default("60").OverrideDefaultFromEnvar("BQ_ROLLUP_REFRESH_MINUTES").Int()
+	rollupRefreshDays        = kingpin.Flag("rollup-refresh-days", "Number of most recent days recomputed when refreshing the rollup tables.").Default("2").OverrideDefaultFromEnvar("BQ_ROLLUP_REFRESH_DAYS").Int()
+	degreeDaysTable          = kingpin.Flag("degree-days-table", "Name of the BigQuery table to maintain daily heating degree-days per location in, computed from the outdoor zone; disabled if empty.").Envar("BQ_DEGREE_DAYS_TABLE").String()
+	degreeDaysBaseTemp       = kingpin.Flag("degree-days-base-temperature", "Outdoor temperature below which the difference counts towards the heating degree-days.").Default("18").OverrideDefaultFromEnvar("DEGREE_DAYS_BASE_TEMPERATURE").Float64()
+	degreeDaysRefreshMinutes = kingpin.Flag("degree-days-refresh-minutes", "Number of minutes between recomputing the degree-days.").Default("60").OverrideDefaultFromEnvar("DEGREE_DAYS_REFRESH_MINUTES").Int()
+	degreeDaysRefreshDays    = kingpin.Flag("degree-days-refresh-days", "Number of most recent days recomputed when refreshing the degree-days.").Default("2").OverrideDefaultFromEnvar("DEGREE_DAYS_REFRESH_DAYS").Int()
+	boilerRuntimeTable       = kingpin.Flag("boiler-runtime-table", "Name of the BigQuery table to maintain the estimated hourly boiler runtime, energy and gas cost per location in, computed from the boiler heat demand; disabled if empty.").Envar("BQ_BOILER_RUNTIME_TABLE").String()
+	boilerRuntimeRefreshMins = kingpin.Flag("boiler-runtime-refresh-minutes", "Number of minutes between recomputing the boiler runtime of the last 24 hours.").Default("60").OverrideDefaultFromEnvar("BOILER_RUNTIME_REFRESH_MINUTES").Int()
+	boilerCapacityKW         = kingpin.Flag("boiler-capacity-kw", "Heat output of the boiler in kW when running at full demand.").Default("24").OverrideDefaultFromEnvar("BOILER_CAPACITY_KW").Float64()
+	boilerEfficiency         = kingpin.Flag("boiler-efficiency", "Fraction of the gas energy the boiler turns into heat.").Default("0.9").OverrideDefaultFromEnvar("BOILER_EFFICIENCY").Float64()
+	gasCalorificValue        = kingpin.Flag("gas-calorific-value", "Energy in kWh per m³ of gas.").Default("9.77").OverrideDefaultFromEnvar("GAS_CALORIFIC_VALUE").Float64()
+	gasPrice                 = kingpin.Flag("gas-price", "Price per m³ of gas to estimate the cost with; no cost is estimated if 0.").Default("0").OverrideDefaultFromEnvar("GAS_PRICE").Float64()
+	metricsPushgatewayURL    = kingpin.Flag("metrics-pushgateway-url", "Url of the prometheus pushgateway to push the boiler runtime of the last 24 hours to as metrics each time it's recomputed; disabled if empty.").Envar("METRICS_PUSHGATEWAY_URL").String()
+	eventsTable              = kingpin.Flag("events-table", "Name of the BigQuery table to write detected events like likely open windows to; disabled if empty.").Envar("BQ_EVENTS_TABLE").String()
+	eventsWebhookURL         = kingpin.Flag("events-webhook-url", "Url to post newly detected events to as json; disabled if empty.").Envar("EVENTS_WEBHOOK_URL").String()
+	openWindowDrop           = kingpin.Flag("open-window-drop", "Least temperature drop in degrees within the open window minutes to flag a likely open window.").Default("1").OverrideDefaultFromEnvar("OPEN_WINDOW_DROP").Float64()
+	openWindowMinutes        = kingpin.Flag("open-window-minutes", "Number of minutes within which the temperature has to drop to flag a likely open window.").Default("15").OverrideDefaultFromEnvar("OPEN_WINDOW_MINUTES").Int()
+	openWindowMinHeatDemand  = kingpin.Flag("open-window-min-heat-demand", "Least heat demand of the zone while the temperature drops to flag a likely open window.").Default("0.5").OverrideDefaultFromEnvar("OPEN_WINDOW_MIN_HEAT_DEMAND").Float64()
+	alertRulesPath           = kingpin.Flag("alert-rules-path", "Path to a json file with alert rules evaluated after each export run; alerting is disabled if empty, unless --alert-evohome-settings is set.").Envar("ALERT_RULES_PATH").String()
+	alertEvohomeSettings     = kingpin.Flag("alert-evohome-settings", "Also alert on the alert settings configured per device in the evohome app.").Default("false").OverrideDefaultFromEnvar("ALERT_EVOHOME_SETTINGS").Bool()
+	alertStatePath           = kingpin.Flag("alert-state-path", "Path to a file on a persistent volume to keep the alert state in between runs; kept in the session secret if empty.").Envar("ALERT_STATE_PATH").String()
+	alertWebhookURLs         = kingpin.Flag("alert-webhook-url", "Url to post alert notifications to as json; repeatable, or one per line in the environment variable.").Envar("ALERT_WEBHOOK_URLS").Strings()
+	alertSMTPAddress         = kingpin.Flag("alert-smtp-address", "Host and port of an smtp server accepting mail without authentication, like a local relay, to mail alert notifications through; disabled if empty.").Envar("ALERT_SMTP_ADDRESS").String()
+	alertSMTPFrom            = kingpin.Flag("alert-smtp-from", "Sender address of alert mails.").Default("evohome-bigquery-exporter@localhost").OverrideDefaultFromEnvar("ALERT_SMTP_FROM").String()
+	alertSMTPTo              = kingpin.Flag("alert-smtp-to", "Recipient address of alert mails; repeatable, or one per line in the environment variable.").Envar("ALERT_SMTP_TO").Strings()
+	minIndoorTemperature     = kingpin.Flag("min-indoor-temperature", "Lowest plausible zone temperature; thermostats with flat batteries report 0.").Default("1").OverrideDefaultFromEnvar("MIN_INDOOR_TEMPERATURE").Float64()
+	maxIndoorTemperature     = kingpin.Flag("max-indoor-temperature", "Highest plausible zone temperature; thermostats with flat batteries report 128.").Default("40").OverrideDefaultFromEnvar("MAX_INDOOR_TEMPERATURE").Float64()
+	minOutdoorTemperature    = kingpin.Flag("min-outdoor-temperature", "Lowest plausible outdoor temperature.").Default("-40").OverrideDefaultFromEnvar("MIN_OUTDOOR_TEMPERATURE").Float64()
+	maxOutdoorTemperature    = kingpin.Flag("max-outdoor-temperature", "Highest plausible outdoor temperature.").Default("50").OverrideDefaultFromEnvar("MAX_OUTDOOR_TEMPERATURE").Float64()
+	minHeatSetpoint          = kingpin.Flag("min-heat-setpoint", "Lowest plausible heat setpoint for thermostats that don't report their own limits.").Default("5").OverrideDefaultFromEnvar("MIN_HEAT_SETPOINT").Float64()
+	maxHeatSetpoint          = kingpin.Flag("max-heat-setpoint", "Highest plausible heat setpoint for thermostats that don't report their own limits.").Default("35").OverrideDefaultFromEnvar("MAX_HEAT_SETPOINT").Float64()
+	minHumidity              = kingpin.Flag("min-humidity", "Lowest plausible humidity.").Default("0").OverrideDefaultFromEnvar("MIN_HUMIDITY").Float64()
+	maxHumidity              = kingpin.Flag("max-humidity", "Highest plausible humidity.").Default("100").OverrideDefaultFromEnvar("MAX_HUMIDITY").Float64()
+	invalidValueAction       = kingpin.Flag("invalid-value-action", "What to do with values outside their plausible range: null them out and flag them in quality_flags, or only flag them.").Default("null").OverrideDefaultFromEnvar("INVALID_VALUE_ACTION").Enum("null", "flag")
+	runTimeoutSeconds        = kingpin.Flag("run-timeout-seconds", "Number of seconds before a run is aborted; keep it below the cronjob's activeDeadlineSeconds.").Default("210").OverrideDefaultFromEnvar("RUN_TIMEOUT_SECONDS").Int()
+
+	// fileConfig holds the config file's values, for the settings that can only be given there, like inline accounts and alert rules
+	fileConfig config
 )
 
 func main() {
 
 	// parse command line parameters
-	kingpin.Parse()
+	command := kingpin.Parse()
+	if *configPath != "" {
+		var err error
+		fileConfig, err = applyConfigFile(kingpin.CommandLine, os.Args[1:], *configPath)
+		if err != nil {
+			kingpin.Fatalf("%v", err)
+		}
+	}
+
+	// validate the export's configuration, so it can be checked before deploying it
+	effectiveConfig := configFromFlags()
+	requireCredentials := (command == exportCommand.FullCommand() || command == configValidate.FullCommand()) && *replayDir == ""
+	if err := effectiveConfig.validate(requireCredentials); err != nil {
+		kingpin.Fatalf("invalid configuration, try --help:\n%v", err)
+	}
+
+	if command == configValidate.FullCommand() {
+		out, err := effectiveConfig.redactedYAML()
+		if err != nil {
+			kingpin.Fatalf("%v", err)
+		}
+		fmt.Print(string(out))
+		return
+	}
 
 	// init log format from envvar ESTAFETTE_LOG_FORMAT
 	foundation.InitLoggingFromEnv(foundation.NewApplicationInfo(appgroup, app, version, branch, revision, buildDate))
 
-	evoClient, err := NewEvohomeClient()
+	// bound the entire run by a deadline and cancel it on SIGINT/SIGTERM
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*runTimeoutSeconds)*time.Second)
+	defer cancel()
+	go cancelOnSignal(ctx, cancel)
+
+	if command == migrateCommand.FullCommand() {
+		bigqueryClient, err := NewBigQueryClient(ctx, *bigqueryProjectID, bigqueryClientOptions()...)
+		if err != nil {
+			exitOnStepError(ctx, err, "creating bigquery client")
+		}
+		initBigqueryDataset(ctx, bigqueryClient, *migrateDryRun)
+		migrateBigqueryTables(ctx, bigqueryClient, *migrateDryRun)
+		return
+	}
+
+	var bigqueryClient BigQueryClient
+	var err error
+	switch *bigqueryWriteMethod {
+	case "storage-write":
+		bigqueryClient, err = NewBigQueryStorageWriteClient(ctx, *bigqueryProjectID, *bigqueryStreamType, storageWriteStateStore(), bigqueryClientOptions()...)
+	case "batch":
+		bigqueryClient, err = NewBigQueryBatchLoadClient(ctx, *bigqueryProjectID, *batchBufferDir, time.Duration(*batchLoadIntervalMinutes)*time.Minute, bigqueryClientOptions()...)
+	default:
+		bigqueryClient, err = NewBigQueryClient(ctx, *bigqueryProjectID, bigqueryClientOptions()...)
+	}
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed creating evohome client")
+		exitOnStepError(ctx, err, "creating bigquery client")
+	}
+	insertIDBucket = time.Duration(*insertIDBucketSeconds) * time.Second
+	initBigqueryDataset(ctx, bigqueryClient, false)
+	migrateBigqueryTables(ctx, bigqueryClient, false)
+
+	deduplicatedView := *bigqueryTable + "_deduplicated"
+	log.Debug().Msgf("Creating or updating view %v.%v.%v...", *bigqueryProjectID, *bigqueryDataset, deduplicatedView)
+	err = bigqueryClient.CreateOrUpdateView(ctx, *bigqueryDataset, deduplicatedView, deduplicatedViewQuery(*bigqueryProjectID, *bigqueryDataset, *bigqueryTable, insertIDBucket))
+	if err != nil {
+		exitOnStepError(ctx, err, fmt.Sprintf("creating or updating view %v", deduplicatedView))
+	}
+
+	initManagedViews(ctx, bigqueryClient)
+
+	if *zoneTable != "" {
+		initBigqueryTable(ctx, bigqueryClient, *zoneTable, BigQueryZoneMeasurement{}, tableOptions("measured_at", "location", "zone"))
+	}
+
+	if *degreeDaysTable != "" {
+		// a row per location per day is too little to partition by day
+		initBigqueryTable(ctx, bigqueryClient, *degreeDaysTable, BigQueryDegreeDay{}, TableOptions{PartitionField: "day", PartitionType: bigquery.MonthPartitioningType, ClusteringFields: []string{"location"}})
+	}
+
+	if *boilerRuntimeTable != "" {
+		initBigqueryTable(ctx, bigqueryClient, *boilerRuntimeTable, BigQueryBoilerRuntime{}, tableOptions("hour", "location"))
+	}
+
+	if *eventsTable != "" {
+		initBigqueryTable(ctx, bigqueryClient, *eventsTable, BigQueryEvent{}, tableOptions("started_at", "location", "zone"))
+	}
+
+	if command == analyzeCommand.FullCommand() {
+		analyzeThermalModels(ctx, bigqueryClient)
+		return
+	}
+
+	if command == summarizeCommand.FullCommand() {
+		summarizeComfortOfZones(ctx, bigqueryClient)
+		return
+	}
+
+	if command == backfillCommand.FullCommand() {
+		backfillMeasurements(ctx, bigqueryClient)
+		return
+	}
+
+	if *replayDir != "" {
+		replayRecordings(ctx, bigqueryClient)
+		refreshRollups(ctx, bigqueryClient)
+		return
+	}
+
+	recorders := []ResponseRecorder{}
+	if *recordDir != "" {
+		directoryRecorder, err := NewDirectoryRecorder(*recordDir, false)
+		if err != nil {
+			log.Fatal().Err(err).Msgf("Failed creating recorder for directory %v", *recordDir)
+		}
+		recorders = append(recorders, directoryRecorder)
+	}
+	if *rawArchiveDir != "" {
+		directoryArchive, err := NewDirectoryRecorder(*rawArchiveDir, true)
+		if err != nil {
+			log.Fatal().Err(err).Msgf("Failed creating raw archive for directory %v", *rawArchiveDir)
+		}
+		recorders = append(recorders, directoryArchive)
+	}
+	if *rawArchiveTable != "" {
+		initBigqueryTable(ctx, bigqueryClient, *rawArchiveTable, BigQueryRawResponse{}, tableOptions("fetched_at"))
+		recorders = append(recorders, NewBigQueryRawArchive(bigqueryClient, *bigqueryDataset, *rawArchiveTable))
 	}
 
+	accounts := accountsFromFlags()
+
+	alerts := newAlertManagerFromFlags(bigqueryClient)
+
+	// a stale export can only be noticed at the start of a run, the previous ones didn't get to the end
+	evaluateAlerts(ctx, alerts, alertInput{Accounts: accountNames(accounts), Now: time.Now().UTC()}, alertRuleTypeExportStale)
+
 	state := readStateFromStateFile()
 
-	bigqueryClient, err := NewBigQueryClient(*bigqueryProjectID)
+	results := fetchAccounts(ctx, accounts, *accountConcurrency, func(ctx context.Context, a account) ([]LocationResponse, error) {
+		return fetchLocations(ctx, a, recorders)
+	})
+
+	log.Debug().Msg("Mapping locations to measurements")
+	locations, measurements, failedAccounts := mapAccountResults(ctx, results, state, time.Now().UTC())
+
+	log.Debug().Msg("Validating measurements")
+	report := validateMeasurements(measurements, validationRulesFromFlags(), setpointLimitsFromLocations(locations))
+
+	insertMeasurements(ctx, bigqueryClient, measurements, "measurements")
+
+	refreshRollups(ctx, bigqueryClient)
+
+	refreshDegreeDays(ctx, bigqueryClient)
+
+	refreshBoilerRuntime(ctx, bigqueryClient)
+
+	detectEvents(ctx, bigqueryClient)
+
+	evaluateAlerts(ctx, alerts, alertInput{
+		Locations:       locations,
+		Measurements:    measurements,
+		OutdoorZoneName: *outdoorZoneName,
+		Accounts:        accountNames(accounts),
+		FailedAccounts:  failedAccounts,
+		ExportSucceeded: true,
+		Now:             time.Now().UTC(),
+	})
+
+	// done
+	logValidationReport(report)
+	log.Info().Msg("Finished exporting metrics")
+}
+
+// replayRecordings maps and inserts every recorded locations response with its original fetch time, to re-run the mapping over historical raw data
+func replayRecordings(ctx context.Context, bigqueryClient BigQueryClient) {
+	replayClient, err := NewEvohomeReplayClient(*replayDir)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed creating bigquery client")
+		log.Fatal().Err(err).Msgf("Failed reading recordings from directory %v", *replayDir)
 	}
-	initBigqueryTable(bigqueryClient)
 
-	validSessionSecret, sessionSecret := readSessionSecretFromFile()
+	replayed := 0
+	report := newValidationReport()
+	for replayClient.Next() {
+		fetchedAt := replayClient.FetchedAt()
 
-	if !validSessionSecret {
-		sessionSecret = refreshSessionSecret(evoClient)
+		locations, err := replayClient.GetLocations(ctx, "", 0)
+		if err != nil {
+			exitOnStepError(ctx, err, fmt.Sprintf("replaying locations fetched at %v", fetchedAt))
+		}
+		locations = filterLocations(locations)
+		account := replayClient.Account()
+		for i := range locations {
+			locations[i].Account = account
+		}
+
+		// the hgi80 listener state reflects the present, so it's not used for historical data
+		measurements := mapLocationsToMeasurements(locations, *outdoorZoneName, nil, fetchedAt)
+		if account != "" {
+			for i := range measurements {
+				measurements[i].Account = bigquery.NullString{StringVal: account, Valid: true}
+			}
+		}
+		report.add(validateMeasurements(measurements, validationRulesFromFlags(), setpointLimitsFromLocations(locations)))
+
+		insertMeasurements(ctx, bigqueryClient, measurements, fmt.Sprintf("replayed measurements fetched at %v", fetchedAt))
+		replayed++
+	}
+
+	logValidationReport(report)
+	log.Info().Msgf("Finished replaying %v recordings from directory %v", replayed, *replayDir)
+}
+
+// backfillMeasurements maps the historical input with its original timestamps and inserts the measurements whose time bucket isn't present yet in batches
+func backfillMeasurements(ctx context.Context, bigqueryClient BigQueryClient) {
+	var inputs []backfillInput
+	var err error
+	switch *backfillFormat {
+	case "csv":
+		file, err := os.Open(*backfillInputPath)
+		if err != nil {
+			log.Fatal().Err(err).Msgf("Failed opening csv file %v", *backfillInputPath)
+		}
+		defer file.Close()
+		inputs, err = readCSVBackfillInput(file, *outdoorZoneName)
+		if err != nil {
+			log.Fatal().Err(err).Msgf("Failed reading csv file %v", *backfillInputPath)
+		}
+	default:
+		inputs, err = readRecordedBackfillInput(ctx, *backfillInputPath)
+		if err != nil {
+			log.Fatal().Err(err).Msgf("Failed reading recordings from directory %v", *backfillInputPath)
+		}
+		// csv input doesn't tell who owns a location, so it isn't filtered
+		for i := range inputs {
+			inputs[i].Locations = filterLocations(inputs[i].Locations)
+		}
+	}
+
+	measurements, report := mapBackfillInput(inputs, validationRulesFromFlags())
+	logValidationReport(report)
+	if *backfillAccount != "" {
+		// recordings named after their account keep it
+		for i := range measurements {
+			if !measurements[i].Account.Valid {
+				measurements[i].Account = bigquery.NullString{StringVal: *backfillAccount, Valid: true}
+			}
+		}
+	}
+	if len(measurements) == 0 {
+		log.Info().Msgf("No measurements found in %v", *backfillInputPath)
+		return
+	}
+
+	from, to := measuredAtRange(measurements)
+	log.Debug().Msgf("Retrieving time buckets between %v and %v already present in table %v.%v.%v...", from, to, *bigqueryProjectID, *bigqueryDataset, *bigqueryTable)
+	existingBuckets, err := bigqueryClient.GetMeasurementBuckets(ctx, *bigqueryDataset, *bigqueryTable, from, to, insertIDBucket)
+	if err != nil {
+		exitOnStepError(ctx, err, "retrieving time buckets already present in bigquery table")
+	}
+
+	missing := skipExistingBuckets(measurements, existingBuckets)
+	log.Info().Msgf("Backfilling %v of %v measurements between %v and %v, the others are already present", len(missing), len(measurements), from, to)
+
+	batchSize := *backfillBatchSize
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	for start := 0; start < len(missing); start += batchSize {
+		end := start + batchSize
+		if end > len(missing) {
+			end = len(missing)
+		}
+		insertMeasurements(ctx, bigqueryClient, missing[start:end], fmt.Sprintf("backfilled measurements %v to %v", start+1, end))
+	}
+
+	if *degreeDaysTable != "" && len(missing) > 0 {
+		updateDegreeDays(ctx, bigqueryClient, from, to)
+	}
+
+	log.Info().Msgf("Finished backfilling %v measurements from %v", len(missing), *backfillInputPath)
+}
+
+// analyzeThermalModels fits the thermal models of all zones for every week in the analyzed period and merges them into the thermal model table
+func analyzeThermalModels(ctx context.Context, bigqueryClient BigQueryClient) {
+	fromDate, toDate := parsePeriod(*analyzeFrom, *analyzeTo)
+	from := weekStart(fromDate.In(time.UTC)).In(time.UTC)
+	to := toDate.AddDays(1).In(time.UTC)
+
+	initBigqueryTable(ctx, bigqueryClient, *analyzeTable, BigQueryThermalModel{}, TableOptions{PartitionField: "week", PartitionType: bigquery.MonthPartitioningType, ClusteringFields: []string{"location", "zone"}})
+
+	log.Info().Msgf("Retrieving zone samples between %v and %v...", from, to)
+	samples, err := bigqueryClient.GetZoneSamples(ctx, *bigqueryDataset, *bigqueryTable+"_deduplicated", *outdoorZoneName, from, to)
+	if err != nil {
+		exitOnStepError(ctx, err, "retrieving zone samples")
+	}
+
+	models := fitThermalModels(samples, time.Now().UTC())
+	log.Info().Msgf("Fitted %v thermal models from %v zone samples", len(models), len(samples))
+
+	err = bigqueryClient.MergeThermalModels(ctx, *bigqueryDataset, *analyzeTable, models)
+	if err != nil {
+		exitOnStepError(ctx, err, fmt.Sprintf("merging thermal models into table %v", *analyzeTable))
+	}
+
+	log.Info().Msgf("Finished analyzing thermal models between %v and %v", from, to)
+}
+
+// refreshBoilerRuntime recomputes the boiler runtime of the last 24 hours once every refresh interval
+func refreshBoilerRuntime(ctx context.Context, bigqueryClient BigQueryClient) {
+	if *boilerRuntimeTable == "" {
+		return
+	}
+
+	lastModified, err := bigqueryClient.GetLastModifiedTime(ctx, *bigqueryDataset, *boilerRuntimeTable)
+	if err != nil {
+		exitOnStepError(ctx, err, fmt.Sprintf("retrieving last modified time of boiler runtime table %v", *boilerRuntimeTable))
+	}
+	if time.Since(lastModified) < time.Duration(*boilerRuntimeRefreshMins)*time.Minute {
+		return
+	}
+
+	now := time.Now().UTC()
+	// whole hours only, a partially read hour would overwrite its earlier complete estimate
+	from := now.Add(-boilerRuntimeRefreshWindow).Truncate(time.Hour)
+	log.Info().Msgf("Updating boiler runtime in table %v.%v.%v since %v...", *bigqueryProjectID, *bigqueryDataset, *boilerRuntimeTable, from)
+
+	// start early, so the first hour includes the sample before it
+	samples, err := bigqueryClient.GetBoilerSamples(ctx, *bigqueryDataset, *bigqueryTable+"_deduplicated", from.Add(-boilerRuntimeMaxSampleGap), now)
+	if err != nil {
+		exitOnStepError(ctx, err, "retrieving boiler heat demand")
+	}
+
+	tariff := boilerTariff{
+		CapacityKW:     *boilerCapacityKW,
+		Efficiency:     *boilerEfficiency,
+		CalorificValue: *gasCalorificValue,
+		GasPrice:       *gasPrice,
+	}
+	runtimes := computeBoilerRuntime(samples, tariff, from, now)
+
+	err = bigqueryClient.MergeBoilerRuntime(ctx, *bigqueryDataset, *boilerRuntimeTable, runtimes)
+	if err != nil {
+		exitOnStepError(ctx, err, fmt.Sprintf("merging boiler runtime into table %v", *boilerRuntimeTable))
+	}
+
+	if *metricsPushgatewayURL == "" {
+		return
+	}
+	// the metrics cover exactly the last 24 hours instead of the whole hours stored; failing to push them shouldn't fail the export, the runtime is stored anyway
+	lastDay := computeBoilerRuntime(samples, tariff, now.Add(-boilerRuntimeRefreshWindow), now)
+	if err := NewBoilerRuntimeMetricsPusher(*metricsPushgatewayURL, boilerRuntimeMetricsJob).Push(lastDay); err != nil {
+		log.Warn().Err(err).Msgf("Failed pushing boiler runtime metrics to %v", *metricsPushgatewayURL)
+	}
+}
+
+// detectEvents detects likely open windows in the recent zone samples, merges them into the events table and posts the ones that weren't detected before to the webhook
+func detectEvents(ctx context.Context, bigqueryClient BigQueryClient) {
+	if *eventsTable == "" {
+		return
+	}
+
+	now := time.Now().UTC()
+	samples, err := bigqueryClient.GetZoneSamples(ctx, *bigqueryDataset, *bigqueryTable+"_deduplicated", *outdoorZoneName, now.Add(-eventsLookback), now)
+	if err != nil {
+		exitOnStepError(ctx, err, "retrieving zone samples for detecting events")
+	}
+
+	events := detectOpenWindows(samples, openWindowRules{
+		Drop:          *openWindowDrop,
+		Window:        time.Duration(*openWindowMinutes) * time.Minute,
+		MinHeatDemand: *openWindowMinHeatDemand,
+	}, now)
+	if len(events) == 0 {
+		return
+	}
+
+	existing, err := bigqueryClient.GetEvents(ctx, *bigqueryDataset, *eventsTable, now.Add(-eventsLookback))
+	if err != nil {
+		exitOnStepError(ctx, err, fmt.Sprintf("retrieving events from table %v", *eventsTable))
+	}
+	added := newEvents(events, existing)
+
+	log.Info().Msgf("Detected %v events of which %v are new, merging them into table %v.%v.%v...", len(events), len(added), *bigqueryProjectID, *bigqueryDataset, *eventsTable)
+	err = bigqueryClient.MergeEvents(ctx, *bigqueryDataset, *eventsTable, events)
+	if err != nil {
+		exitOnStepError(ctx, err, fmt.Sprintf("merging events into table %v", *eventsTable))
+	}
+
+	if *eventsWebhookURL == "" {
+		return
+	}
+	webhookClient := NewWebhookClient(*eventsWebhookURL)
+	for _, e := range added {
+		// a failing webhook shouldn't fail the export, the event is stored anyway
+		if err := webhookClient.Post(ctx, e); err != nil {
+			log.Warn().Err(err).Msgf("Failed posting %v event of zone %v to webhook", e.Type, e.Zone)
+		}
+	}
+}
+
+// storageWriteStateStore returns where the Storage Write API streams are kept between runs
+func storageWriteStateStore() StorageWriteStateStore {
+	if *bigqueryStreamStatePath != "" {
+		return NewFileStorageWriteStateStore(*bigqueryStreamStatePath)
+	}
+
+	kubeClient, err := NewInClusterKubernetesClient()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed creating Kubernetes API client for keeping the storage write state, set --bigquery-stream-state-path outside kubernetes")
+	}
+
+	return NewSecretStorageWriteStateStore(kubeClient, *namespace, *sessionSecretName)
+}
+
+// newAlertManagerFromFlags returns an alert manager for the configured alert rules, or nil if alerting is disabled
+func newAlertManagerFromFlags(bigqueryClient BigQueryClient) *alertManager {
+	if *alertRulesPath == "" && len(fileConfig.Alerts.Rules) == 0 && !*alertEvohomeSettings {
+		return nil
+	}
+
+	rules := fileConfig.Alerts.Rules
+	if rules == nil {
+		rules = []alertRule{}
+	}
+	if *alertRulesPath != "" {
+		var err error
+		rules, err = readAlertRules(*alertRulesPath)
+		if err != nil {
+			log.Fatal().Err(err).Msgf("Failed reading alert rules from %v", *alertRulesPath)
+		}
+		log.Info().Msgf("Loaded %v alert rules from %v", len(rules), *alertRulesPath)
+	}
+
+	var store AlertStateStore
+	if *alertStatePath != "" {
+		store = NewFileAlertStateStore(*alertStatePath)
+	} else {
+		kubeClient, err := NewInClusterKubernetesClient()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed creating Kubernetes API client for keeping the alert state, set --alert-state-path outside kubernetes")
+		}
+		store = NewSecretAlertStateStore(kubeClient, *namespace, *sessionSecretName)
+	}
+
+	notifiers := []AlertNotifier{}
+	for _, url := range *alertWebhookURLs {
+		notifiers = append(notifiers, NewWebhookAlertNotifier(NewWebhookClient(url)))
+	}
+	if *alertSMTPAddress != "" {
+		notifiers = append(notifiers, NewSMTPAlertNotifier(*alertSMTPAddress, *alertSMTPFrom, *alertSMTPTo))
+	}
+	if *eventsTable != "" {
+		notifiers = append(notifiers, NewEventsAlertNotifier(bigqueryClient, *bigqueryDataset, *eventsTable))
+	}
+	if len(notifiers) == 0 {
+		log.Warn().Msg("No alert webhook, smtp server or events table configured, alerts are only logged")
+	}
+
+	return &alertManager{
+		rules:                rules,
+		store:                store,
+		notifiers:            notifiers,
+		evohomeAlertSettings: *alertEvohomeSettings,
+	}
+}
+
+// evaluateAlerts evaluates the alert rules of the given types, or all of them, if alerting is enabled
+func evaluateAlerts(ctx context.Context, alerts *alertManager, input alertInput, types ...string) {
+	if alerts == nil {
+		return
+	}
+
+	// failing alerting shouldn't fail the export
+	if err := alerts.Evaluate(ctx, input, types...); err != nil {
+		log.Warn().Err(err).Msg("Failed evaluating alert rules")
+	}
+}
+
+// summarizeComfortOfZones summarizes the comfort of all zones for every day in the summarized period and merges the summaries into the comfort summary table
+func summarizeComfortOfZones(ctx context.Context, bigqueryClient BigQueryClient) {
+	fromDate, toDate := parsePeriod(*summarizeFrom, *summarizeTo)
+	// days are in the location's time zone, so read a day extra on both sides and drop the partial days afterwards
+	from := fromDate.AddDays(-1).In(time.UTC)
+	to := toDate.AddDays(2).In(time.UTC)
+
+	initBigqueryTable(ctx, bigqueryClient, *summarizeTable, BigQueryComfortSummary{}, TableOptions{PartitionField: "day", PartitionType: bigquery.MonthPartitioningType, ClusteringFields: []string{"location", "zone"}})
+
+	log.Info().Msgf("Retrieving zone samples between %v and %v...", from, to)
+	samples, err := bigqueryClient.GetZoneSamples(ctx, *bigqueryDataset, *bigqueryTable+"_deduplicated", *outdoorZoneName, from, to)
+	if err != nil {
+		exitOnStepError(ctx, err, "retrieving zone samples")
 	}
 
-	log.Info().Msgf("Retrieving locations for user with id %v...", sessionSecret.UserID)
+	summaries := []BigQueryComfortSummary{}
+	for _, s := range summarizeComfort(samples, *summarizeDelta, time.Now().UTC()) {
+		if !s.Day.Before(fromDate) && !s.Day.After(toDate) {
+			summaries = append(summaries, s)
+		}
+	}
+	log.Info().Msgf("Summarized %v zone days from %v zone samples", len(summaries), len(samples))
 
-	locations, err := evoClient.GetLocations(sessionSecret.SessionID, sessionSecret.UserID)
+	err = bigqueryClient.MergeComfortSummaries(ctx, *bigqueryDataset, *summarizeTable, summaries)
 	if err != nil {
-		if err == ErrRequestNotAuthorized {
-			// refresh session
-			sessionSecret = refreshSessionSecret(evoClient)
-			locations, err = evoClient.GetLocations(sessionSecret.SessionID, sessionSecret.UserID)
+		exitOnStepError(ctx, err, fmt.Sprintf("merging comfort summaries into table %v", *summarizeTable))
+	}
+
+	log.Info().Msgf("Finished summarizing comfort between %v and %v", fromDate, toDate)
+}
+
+// parsePeriod parses the first and last day of a period given as yyyy-mm-dd, with the last day defaulting to today
+func parsePeriod(fromFlag, toFlag string) (from, to civil.Date) {
+	from, err := civil.ParseDate(fromFlag)
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Failed parsing --from %v", fromFlag)
+	}
+	to = civil.DateOf(time.Now().UTC())
+	if toFlag != "" {
+		to, err = civil.ParseDate(toFlag)
+		if err != nil {
+			log.Fatal().Err(err).Msgf("Failed parsing --to %v", toFlag)
+		}
+	}
+
+	return
+}
+
+// configFromFlags returns the effective config, after merging the config file into the flags
+func configFromFlags() config {
+	return config{
+		Evohome: evohomeConfig{
+			Username:               *username,
+			Password:               *password,
+			AccountsPath:           *accountsPath,
+			Accounts:               fileConfig.Evohome.Accounts,
+			AccountConcurrency:     *accountConcurrency,
+			SessionTimeoutMinutes:  *sessionTimeoutMinutes,
+			RateLimitRequests:      *rateLimitRequests,
+			RateLimitWindowSeconds: *rateLimitWindowSeconds,
+			OutdoorZoneName:        *outdoorZoneName,
+			IncludeLocations:       *includeLocations,
+			ExcludeLocations:       *excludeLocations,
+			OwnedLocationsOnly:     *ownedLocationsOnly,
+		},
+		Kubernetes: kubernetesConfig{
+			Namespace:         *namespace,
+			SessionSecretName: *sessionSecretName,
+			SessionSecretPath: *sessionSecretPath,
+		},
+		HGI80: hgi80Config{
+			StateFilePath: *stateFilePath,
+		},
+		Recording: recordingConfig{
+			RecordDir:       *recordDir,
+			ReplayDir:       *replayDir,
+			RawArchiveTable: *rawArchiveTable,
+			RawArchiveDir:   *rawArchiveDir,
+		},
+		BigQuery: bigqueryConfig{
+			ProjectID:                *bigqueryProjectID,
+			Dataset:                  *bigqueryDataset,
+			Table:                    *bigqueryTable,
+			Endpoint:                 *bigqueryEndpoint,
+			CredentialsFile:          *bigqueryCredentialsFile,
+			Location:                 *bigqueryLocation,
+			CreateDataset:            *createDataset,
+			ZoneTable:                *zoneTable,
+			WriteMethod:              *bigqueryWriteMethod,
+			StreamType:               *bigqueryStreamType,
+			StreamStatePath:          *bigqueryStreamStatePath,
+			BatchBufferDir:           *batchBufferDir,
+			BatchLoadIntervalMinutes: *batchLoadIntervalMinutes,
+			InsertIDBucketSeconds:    *insertIDBucketSeconds,
+			PartitionType:            *partitionType,
+			PartitionExpirationDays:  *partitionExpirationDays,
+			RequirePartitionFilter:   *requirePartitionFilter,
+			ClusterByLocation:        *clusterByLocation,
+			Rollups:                  *rollups,
+			RollupRefreshMinutes:     *rollupRefreshMinutes,
+			RollupRefreshDays:        *rollupRefreshDays,
+		},
+		DegreeDays: degreeDaysConfig{
+			Table:           *degreeDaysTable,
+			BaseTemperature: *degreeDaysBaseTemp,
+			RefreshMinutes:  *degreeDaysRefreshMinutes,
+			RefreshDays:     *degreeDaysRefreshDays,
+		},
+		BoilerRuntime: boilerRuntimeConfig{
+			Table:                 *boilerRuntimeTable,
+			RefreshMinutes:        *boilerRuntimeRefreshMins,
+			CapacityKW:            *boilerCapacityKW,
+			Efficiency:            *boilerEfficiency,
+			GasCalorificValue:     *gasCalorificValue,
+			GasPrice:              *gasPrice,
+			MetricsPushgatewayURL: *metricsPushgatewayURL,
+		},
+		Events: eventsConfig{
+			Table:                   *eventsTable,
+			WebhookURL:              *eventsWebhookURL,
+			OpenWindowDrop:          *openWindowDrop,
+			OpenWindowMinutes:       *openWindowMinutes,
+			OpenWindowMinHeatDemand: *openWindowMinHeatDemand,
+		},
+		Alerts: alertsConfig{
+			RulesPath:       *alertRulesPath,
+			Rules:           fileConfig.Alerts.Rules,
+			EvohomeSettings: *alertEvohomeSettings,
+			StatePath:       *alertStatePath,
+			WebhookURLs:     *alertWebhookURLs,
+			SMTPAddress:     *alertSMTPAddress,
+			SMTPFrom:        *alertSMTPFrom,
+			SMTPTo:          *alertSMTPTo,
+		},
+		Validation: validationConfig{
+			MinIndoorTemperature:  *minIndoorTemperature,
+			MaxIndoorTemperature:  *maxIndoorTemperature,
+			MinOutdoorTemperature: *minOutdoorTemperature,
+			MaxOutdoorTemperature: *maxOutdoorTemperature,
+			MinHeatSetpoint:       *minHeatSetpoint,
+			MaxHeatSetpoint:       *maxHeatSetpoint,
+			MinHumidity:           *minHumidity,
+			MaxHumidity:           *maxHumidity,
+			InvalidValueAction:    *invalidValueAction,
+		},
+		RunTimeoutSeconds: *runTimeoutSeconds,
+	}
+}
+
+// validationRulesFromFlags returns the configured plausibility ranges
+func validationRulesFromFlags() validationRules {
+	return validationRules{
+		IndoorTemperature:  valueRange{Min: *minIndoorTemperature, Max: *maxIndoorTemperature},
+		OutdoorTemperature: valueRange{Min: *minOutdoorTemperature, Max: *maxOutdoorTemperature},
+		Humidity:           valueRange{Min: *minHumidity, Max: *maxHumidity},
+		HeatSetpoint:       valueRange{Min: *minHeatSetpoint, Max: *maxHeatSetpoint},
+		NullInvalidValues:  *invalidValueAction == "null",
+		OutdoorZoneName:    *outdoorZoneName,
+	}
+}
+
+// logValidationReport logs how many zone values were rejected, warning if any were
+func logValidationReport(report validationReport) {
+	if report.RejectedTotal() == 0 {
+		log.Info().Msgf("Validated %v zones, no values rejected", report.Zones)
+		return
+	}
+
+	log.Warn().Interface("rejected", report.Rejected).Msgf("Validated %v zones, rejected %v values (%v)", report.Zones, report.RejectedTotal(), report)
+}
+
+// insertMeasurements inserts the measurements into the measurement table and, if configured, a row per zone into the zone table
+func insertMeasurements(ctx context.Context, bigqueryClient BigQueryClient, measurements []BigQueryMeasurement, description string) {
+	log.Debug().Msgf("Inserting %v into table %v.%v.%v...", description, *bigqueryProjectID, *bigqueryDataset, *bigqueryTable)
+	err := bigqueryClient.InsertMeasurements(ctx, *bigqueryDataset, *bigqueryTable, measurements)
+	if err != nil {
+		exitOnStepError(ctx, err, fmt.Sprintf("inserting %v into bigquery table", description))
+	}
+
+	if *zoneTable == "" {
+		return
+	}
+
+	log.Debug().Msgf("Inserting %v per zone into table %v.%v.%v...", description, *bigqueryProjectID, *bigqueryDataset, *zoneTable)
+	err = bigqueryClient.InsertZoneMeasurements(ctx, *bigqueryDataset, *zoneTable, flattenMeasurements(measurements))
+	if err != nil {
+		exitOnStepError(ctx, err, fmt.Sprintf("inserting %v into bigquery zone table", description))
+	}
+}
+
+// initManagedViews creates or updates the views defined by the embedded sql templates
+func initManagedViews(ctx context.Context, bigqueryClient BigQueryClient) {
+	for _, v := range managedViews {
+		query, err := v.query(*bigqueryProjectID, *bigqueryDataset, *bigqueryTable)
+		if err != nil {
+			log.Fatal().Err(err).Msgf("Failed rendering sql template for view %v", v.Name)
+		}
+
+		log.Debug().Msgf("Creating or updating view %v.%v.%v...", *bigqueryProjectID, *bigqueryDataset, v.viewName(*bigqueryTable))
+		err = bigqueryClient.CreateOrUpdateView(ctx, *bigqueryDataset, v.viewName(*bigqueryTable), query)
+		if err != nil {
+			exitOnStepError(ctx, err, fmt.Sprintf("creating or updating view %v", v.viewName(*bigqueryTable)))
+		}
+	}
+}
+
+// refreshRollups recomputes the most recent days of each rollup table that hasn't been refreshed within the refresh interval
+func refreshRollups(ctx context.Context, bigqueryClient BigQueryClient) {
+	if !*rollups {
+		return
+	}
+
+	for _, v := range managedViews {
+		rollup := v.rollupName(*bigqueryTable)
+
+		if bigqueryClient.CheckIfTableExists(ctx, *bigqueryDataset, rollup) {
+			lastModified, err := bigqueryClient.GetLastModifiedTime(ctx, *bigqueryDataset, rollup)
 			if err != nil {
-				log.Fatal().Err(err).Msgf("Failed retrieving locations for userid %v after session refresh", sessionSecret.UserID)
+				exitOnStepError(ctx, err, fmt.Sprintf("retrieving last modified time of rollup table %v", rollup))
+			}
+			if time.Since(lastModified) < time.Duration(*rollupRefreshMinutes)*time.Minute {
+				continue
 			}
-		} else {
-			log.Fatal().Err(err).Msgf("Failed retrieving locations for userid %v", sessionSecret.UserID)
 		}
+
+		log.Info().Msgf("Refreshing rollup table %v.%v.%v...", *bigqueryProjectID, *bigqueryDataset, rollup)
+		err := bigqueryClient.RunQuery(ctx, v.rollupRefreshQuery(*bigqueryProjectID, *bigqueryDataset, *bigqueryTable, *rollupRefreshDays))
+		if err != nil {
+			exitOnStepError(ctx, err, fmt.Sprintf("refreshing rollup table %v", rollup))
+		}
+	}
+}
+
+// refreshDegreeDays recomputes the degree-days of the most recent days once every refresh interval
+func refreshDegreeDays(ctx context.Context, bigqueryClient BigQueryClient) {
+	if *degreeDaysTable == "" {
+		return
 	}
 
-	log.Debug().Interface("locations", locations).Msgf("Retrieved %v locations: ", len(locations))
+	lastModified, err := bigqueryClient.GetLastModifiedTime(ctx, *bigqueryDataset, *degreeDaysTable)
+	if err != nil {
+		exitOnStepError(ctx, err, fmt.Sprintf("retrieving last modified time of degree-days table %v", *degreeDaysTable))
+	}
+	if time.Since(lastModified) < time.Duration(*degreeDaysRefreshMinutes)*time.Minute {
+		return
+	}
 
-	log.Debug().Msg("Mapping locations to measurements")
-	measurements := mapLocationsToMeasurements(locations, *outdoorZoneName, state)
+	now := time.Now().UTC()
+	updateDegreeDays(ctx, bigqueryClient, now.AddDate(0, 0, -*degreeDaysRefreshDays), now)
+}
+
+// updateDegreeDays computes the degree-days for the days between from and to from the deduplicated outdoor temperatures and merges them into the degree-days table
+func updateDegreeDays(ctx context.Context, bigqueryClient BigQueryClient, from, to time.Time) {
+	log.Info().Msgf("Updating degree-days in table %v.%v.%v between %v and %v...", *bigqueryProjectID, *bigqueryDataset, *degreeDaysTable, from, to)
 
-	log.Debug().Msgf("Inserting measurements into table %v.%v.%v...", *bigqueryProjectID, *bigqueryDataset, *bigqueryTable)
-	err = bigqueryClient.InsertMeasurements(*bigqueryDataset, *bigqueryTable, measurements)
+	// start a day early, so the first day starts at midnight in any time zone and can be interpolated from the sample before it
+	temperatures, err := bigqueryClient.GetOutdoorTemperatures(ctx, *bigqueryDataset, *bigqueryTable+"_deduplicated", *outdoorZoneName, from.AddDate(0, 0, -1), to)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed inserting measurements into bigquery table")
+		exitOnStepError(ctx, err, "retrieving outdoor temperatures")
 	}
 
-	// done
-	log.Info().Msg("Finished exporting metrics")
+	degreeDays := computeDegreeDays(temperatures, *degreeDaysBaseTemp, from, time.Now().UTC())
+
+	err = bigqueryClient.MergeDegreeDays(ctx, *bigqueryDataset, *degreeDaysTable, degreeDays)
+	if err != nil {
+		exitOnStepError(ctx, err, fmt.Sprintf("merging degree-days into table %v", *degreeDaysTable))
+	}
+}
+
+// cancelOnSignal cancels the run when the pod receives SIGINT or SIGTERM, so in-flight calls are aborted instead of being killed halfway
+func cancelOnSignal(ctx context.Context, cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case sig := <-signals:
+		log.Warn().Msgf("Received signal %v, cancelling run...", sig)
+		cancel()
+	case <-ctx.Done():
+	}
+}
+
+// exitOnEvohomeError ends the run in a way that fits the kind of evohome api failure; transient problems skip this run without failing the job, so the next scheduled run can simply try again
+func exitOnEvohomeError(ctx context.Context, err error, step string) {
+	switch {
+	case errors.Is(err, ErrRateLimited):
+		log.Warn().Err(err).Msgf("Evohome api is rate limiting requests while %v, skipping this run", step)
+		os.Exit(0)
+	case errors.Is(err, ErrServerError):
+		log.Warn().Err(err).Msgf("Evohome api failed with a server error while %v, skipping this run", step)
+		os.Exit(0)
+	case errors.Is(err, ErrInvalidCredentials):
+		log.Fatal().Err(err).Msgf("Evohome api rejected the username or password while %v, check the configured credentials", step)
+	case errors.Is(err, ErrAccountLocked):
+		log.Fatal().Err(err).Msgf("Evohome account is locked while %v, unlock it via the Total Connect Comfort website before the next run", step)
+	case errors.Is(err, ErrDecodeFailed):
+		log.Fatal().Err(err).Msgf("Failed decoding evohome api response while %v, the api may have changed", step)
+	}
+
+	exitOnStepError(ctx, err, step)
+}
+
+// exitOnStepError logs a fatal error for the failed step, making clear whether the step was cut short by the run deadline or a termination signal
+func exitOnStepError(ctx context.Context, err error, step string) {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		log.Fatal().Err(err).Msgf("Timed out after %v seconds while %v", *runTimeoutSeconds, step)
+	case context.Canceled:
+		log.Fatal().Err(err).Msgf("Cancelled while %v", step)
+	default:
+		log.Fatal().Err(err).Msgf("Failed %v", step)
+	}
 }
 
-func readSessionSecretFromFile() (validSessionSecret bool, sessionSecret SessionSecret) {
+// accountsFromFlags returns the accounts from the accounts file, or the default account given by the username and password flags
+func accountsFromFlags() []account {
+	if len(fileConfig.Evohome.Accounts) > 0 {
+		return fileConfig.Evohome.Accounts
+	}
+	if *accountsPath == "" {
+		return []account{{Name: defaultAccountName, Username: *username, Password: *password}}
+	}
+
+	accounts, err := readAccounts(*accountsPath)
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Failed reading accounts from %v", *accountsPath)
+	}
+
+	return accounts
+}
+
+// fetchLocations retrieves the locations of the account, refreshing its session if it's no longer valid
+func fetchLocations(ctx context.Context, a account, recorders []ResponseRecorder) ([]LocationResponse, error) {
+	// every account gets its own client, so each has its own rate limit budget
+	evoClient, err := NewEvohomeClient(a.Name, *rateLimitRequests, time.Duration(*rateLimitWindowSeconds)*time.Second, recorders...)
+	if err != nil {
+		return nil, err
+	}
+
+	validSessionSecret, sessionSecret, err := readSessionSecretFromFile(a)
+	if err != nil {
+		return nil, err
+	}
+
+	if !validSessionSecret {
+		sessionSecret, err = refreshSessionSecret(ctx, evoClient, a)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	log.Info().Msgf("Retrieving locations of account %v for user with id %v...", a.Name, sessionSecret.UserID)
+
+	locations, err := evoClient.GetLocations(ctx, sessionSecret.SessionID, sessionSecret.UserID)
+	if errors.Is(err, ErrRequestNotAuthorized) {
+		// refresh session
+		sessionSecret, err = refreshSessionSecret(ctx, evoClient, a)
+		if err != nil {
+			return nil, err
+		}
+		locations, err = evoClient.GetLocations(ctx, sessionSecret.SessionID, sessionSecret.UserID)
+		if err != nil {
+			return nil, fmt.Errorf("Retrieving locations for userid %v after session refresh failed: %w", sessionSecret.UserID, err)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Retrieving locations for userid %v failed: %w", sessionSecret.UserID, err)
+	}
+
+	log.Debug().Interface("locations", locations).Msgf("Retrieved %v locations of account %v", len(locations), a.Name)
+
+	return locations, nil
+}
+
+// mapAccountResults maps the locations of the accounts that were fetched to measurements; failed accounts are logged, skipped and returned, unless all of them failed
+func mapAccountResults(ctx context.Context, results []accountResult, state *State, measuredAt time.Time) (locations []LocationResponse, measurements []BigQueryMeasurement, failedAccounts []string) {
+	locations = []LocationResponse{}
+	measurements = []BigQueryMeasurement{}
+	failedAccounts = []string{}
+
+	failed := []accountResult{}
+	for _, r := range results {
+		if r.Err != nil {
+			failed = append(failed, r)
+			continue
+		}
+
+		accountLocations := filterLocations(r.Locations)
+		for i := range accountLocations {
+			accountLocations[i].Account = r.Account.Name
+		}
+		accountMeasurements := mapLocationsToMeasurements(accountLocations, *outdoorZoneName, state, measuredAt)
+		for i := range accountMeasurements {
+			accountMeasurements[i].Account = bigquery.NullString{StringVal: r.Account.Name, Valid: true}
+		}
+
+		locations = append(locations, accountLocations...)
+		measurements = append(measurements, accountMeasurements...)
+	}
+
+	if len(failed) == len(results) {
+		// nothing to export, so fail the run like a single account would
+		exitOnEvohomeError(ctx, failed[0].Err, fmt.Sprintf("fetching locations of account %v", failed[0].Account.Name))
+	}
+	for _, r := range failed {
+		failedAccounts = append(failedAccounts, r.Account.Name)
+		if errors.Is(r.Err, ErrRateLimited) || errors.Is(r.Err, ErrServerError) {
+			log.Warn().Err(r.Err).Msgf("Skipping account %v this run, the evohome api is unavailable", r.Account.Name)
+			continue
+		}
+		log.Error().Err(r.Err).Msgf("Failed fetching locations of account %v, exporting the other accounts", r.Account.Name)
+	}
+
+	return
+}
+
+// filterLocations leaves out the locations the location flags exclude
+func filterLocations(locations []LocationResponse) []LocationResponse {
+	filter := locationFilter{
+		Include:   *includeLocations,
+		Exclude:   *excludeLocations,
+		OwnedOnly: *ownedLocationsOnly,
+	}
+
+	kept, skipped := filter.apply(locations)
+	if len(skipped) > 0 {
+		log.Debug().Msgf("Skipping locations %v", strings.Join(skipped, ", "))
+	}
+
+	return kept
+}
+
+// sessionSecretPathFor returns the path the account's session is mounted at
+func sessionSecretPathFor(a account) string {
+	if a.Name == defaultAccountName {
+		return *sessionSecretPath
+	}
+
+	return filepath.Join(filepath.Dir(*sessionSecretPath), a.sessionSecretKey())
+}
+
+func readSessionSecretFromFile(a account) (validSessionSecret bool, sessionSecret SessionSecret, err error) {
+	path := sessionSecretPathFor(a)
+
 	// check if session key exists in secret
 	validSessionSecret = false
-	if _, err := os.Stat(*sessionSecretPath); !os.IsNotExist(err) {
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
 
-		log.Info().Msgf("File %v exists, reading contents...", *sessionSecretPath)
+		log.Info().Msgf("File %v exists, reading contents...", path)
 
 		// read secret
-		data, err := ioutil.ReadFile(*sessionSecretPath)
+		data, err := ioutil.ReadFile(path)
 		if err != nil {
-			log.Fatal().Err(err).Msgf("Failed reading file from path %v", *sessionSecretPath)
+			return false, sessionSecret, fmt.Errorf("Reading session secret from path %v failed: %w", path, err)
 		}
 
-		log.Info().Msgf("Unmarshalling file %v contents...", *sessionSecretPath)
+		log.Info().Msgf("Unmarshalling file %v contents...", path)
 
 		// unmarshal secret
 		if err := json.Unmarshal(data, &sessionSecret); err != nil {
-			log.Fatal().Err(err).Interface("data", data).Msg("Failed unmarshalling session secret")
+			return false, sessionSecret, fmt.Errorf("Unmarshalling session secret from path %v failed: %w", path, err)
 		}
 
 		log.Info().Interface("RetrievedAt", sessionSecret.RetrievedAt).Msgf("Unmarshalled session secret, checking age...")
@@ -128,70 +1088,171 @@ func readSessionSecretFromFile() (validSessionSecret bool, sessionSecret Session
 	return
 }
 
-func refreshSessionSecret(evoClient EvohomeClient) SessionSecret {
-	log.Info().Msg("No valid session secret, retrieving new session id...")
+// sessionSecretMutex serializes updates of the session secret by accounts refreshing their session at the same time, which would otherwise conflict
+var sessionSecretMutex sync.Mutex
+
+func refreshSessionSecret(ctx context.Context, evoClient EvohomeClient, a account) (sessionSecret SessionSecret, err error) {
+	log.Info().Msgf("No valid session secret for account %v, retrieving new session id...", a.Name)
 
-	sessionID, userID, err := evoClient.GetSession(*username, *password)
+	sessionID, userID, err := evoClient.GetSession(ctx, a.Username, a.Password)
 	if err != nil {
-		log.Fatal().Err(err).Msgf("Failed retrieving session id for username %v", *username)
+		return sessionSecret, fmt.Errorf("Retrieving session id for username %v failed: %w", a.Username, err)
 	}
 
-	sessionSecret := SessionSecret{
+	sessionSecret = SessionSecret{
 		SessionID:   sessionID,
 		UserID:      userID,
 		RetrievedAt: time.Now().UTC(),
 	}
 
 	// create kubernetes api client
-	kubeClient, err := k8s.NewInClusterClient()
+	kubeClient, err := NewInClusterKubernetesClient()
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed creating Kubernetes API client")
+		return sessionSecret, fmt.Errorf("Creating Kubernetes API client failed: %w", err)
 	}
 
 	log.Info().Msg("Retrieved new session id, storing it in secret for using it in the next scheduled pod...")
 
+	sessionSecretMutex.Lock()
+	defer sessionSecretMutex.Unlock()
+
 	// retrieve secret
-	var secret corev1.Secret
-	err = kubeClient.Get(context.Background(), *namespace, *sessionSecretName, &secret)
+	secret, err := kubeClient.GetSecret(ctx, *namespace, *sessionSecretName)
 	if err != nil {
-		log.Fatal().Err(err).Msgf("Failed retrieving secret %v", *sessionSecretName)
+		return sessionSecret, fmt.Errorf("Retrieving secret %v failed: %w", *sessionSecretName, err)
 	}
 
 	// marshal session secret to json
 	sessionSecretData, err := json.Marshal(sessionSecret)
+	if err != nil {
+		return sessionSecret, err
+	}
 
 	if secret.Data == nil {
 		secret.Data = make(map[string][]byte)
 	}
 
-	secret.Data["session.json"] = sessionSecretData
+	secret.Data[a.sessionSecretKey()] = sessionSecretData
 
 	// update secret to have session information available when the application runs the next time
-	err = kubeClient.Update(context.Background(), &secret)
+	err = kubeClient.UpdateSecret(ctx, secret)
+	if err != nil {
+		return sessionSecret, fmt.Errorf("Updating secret %v failed: %w", *sessionSecretName, err)
+	}
+
+	log.Info().Msgf("Stored session secret of account %v in secret %v...", a.Name, *sessionSecretName)
+
+	return sessionSecret, nil
+}
+
+// migrateBigqueryTables applies the pending schema migrations to the measurements table, or only logs them for a dry run
+func migrateBigqueryTables(ctx context.Context, bigqueryClient BigQueryClient, dryRun bool) {
+	target := migrationTarget{
+		ProjectID: *bigqueryProjectID,
+		Dataset:   *bigqueryDataset,
+		Table:     *bigqueryTable,
+		Options:   tableOptions("measured_at", "location"),
+	}
+
+	log.Debug().Msgf("Checking pending migrations for table %v.%v.%v...", *bigqueryProjectID, *bigqueryDataset, *bigqueryTable)
+	pending, err := applyMigrations(ctx, bigqueryClient, target, measurementsMigrations(target), dryRun)
+	if err != nil {
+		exitOnStepError(ctx, err, fmt.Sprintf("migrating bigquery table %v", *bigqueryTable))
+	}
+
+	if !dryRun {
+		log.Debug().Msgf("Reconciling table %v.%v.%v partitioning and clustering...", *bigqueryProjectID, *bigqueryDataset, *bigqueryTable)
+		err = bigqueryClient.UpdateTableOptions(ctx, *bigqueryDataset, *bigqueryTable, target.Options)
+		if err != nil {
+			exitOnStepError(ctx, err, fmt.Sprintf("updating bigquery table %v partitioning and clustering", *bigqueryTable))
+		}
+	}
+
+	switch {
+	case len(pending) == 0:
+		log.Info().Msgf("Table %v.%v.%v is up to date", *bigqueryProjectID, *bigqueryDataset, *bigqueryTable)
+	case dryRun:
+		log.Info().Msgf("Found %v pending migrations for table %v.%v.%v", len(pending), *bigqueryProjectID, *bigqueryDataset, *bigqueryTable)
+	default:
+		log.Info().Msgf("Applied %v migrations to table %v.%v.%v", len(pending), *bigqueryProjectID, *bigqueryDataset, *bigqueryTable)
+	}
+}
+
+// bigqueryClientOptions returns the options for the configured BigQuery endpoint and credentials
+func bigqueryClientOptions() (opts []option.ClientOption) {
+	if *bigqueryEndpoint != "" {
+		opts = append(opts, option.WithEndpoint(*bigqueryEndpoint))
+	}
+
+	switch {
+	case *bigqueryCredentialsFile != "":
+		opts = append(opts, option.WithCredentialsFile(*bigqueryCredentialsFile))
+	case *bigqueryEndpoint != "":
+		// emulators don't check credentials
+		opts = append(opts, option.WithoutAuthentication())
+	}
+
+	return
+}
+
+// initBigqueryDataset creates the dataset in the configured location if that's enabled and it doesn't exist yet
+func initBigqueryDataset(ctx context.Context, bigqueryClient BigQueryClient, dryRun bool) {
+	if !*createDataset {
+		return
+	}
+
+	log.Debug().Msgf("Checking if dataset %v.%v exists...", *bigqueryProjectID, *bigqueryDataset)
+	if bigqueryClient.CheckIfDatasetExists(ctx, *bigqueryDataset) {
+		return
+	}
+	if dryRun {
+		log.Info().Msgf("Dataset %v.%v doesn't exist, would create it in location %v", *bigqueryProjectID, *bigqueryDataset, *bigqueryLocation)
+		return
+	}
+
+	log.Info().Msgf("Creating dataset %v.%v in location %v...", *bigqueryProjectID, *bigqueryDataset, *bigqueryLocation)
+	err := bigqueryClient.CreateDataset(ctx, *bigqueryDataset, *bigqueryLocation)
 	if err != nil {
-		log.Fatal().Err(err).Msgf("Failed updating secret %v", *sessionSecretName)
+		exitOnStepError(ctx, err, fmt.Sprintf("creating bigquery dataset %v", *bigqueryDataset))
 	}
+}
 
-	log.Info().Msgf("Stored session secret in secret %v...", *sessionSecretName)
+// tableOptions returns the configured partitioning for a table partitioned by partitionField, clustered by clusteringFields if clustering is enabled
+func tableOptions(partitionField string, clusteringFields ...string) TableOptions {
+	options := TableOptions{
+		PartitionField:         partitionField,
+		PartitionType:          bigquery.TimePartitioningType(*partitionType),
+		PartitionExpiration:    time.Duration(*partitionExpirationDays) * 24 * time.Hour,
+		RequirePartitionFilter: *requirePartitionFilter,
+	}
+	if *clusterByLocation {
+		options.ClusteringFields = clusteringFields
+	}
 
-	return sessionSecret
+	return options
 }
 
-func initBigqueryTable(bigqueryClient BigQueryClient) {
+func initBigqueryTable(ctx context.Context, bigqueryClient BigQueryClient, table string, typeForSchema interface{}, options TableOptions) {
 
-	log.Debug().Msgf("Checking if table %v.%v.%v exists...", *bigqueryProjectID, *bigqueryDataset, *bigqueryTable)
-	tableExist := bigqueryClient.CheckIfTableExists(*bigqueryDataset, *bigqueryTable)
+	log.Debug().Msgf("Checking if table %v.%v.%v exists...", *bigqueryProjectID, *bigqueryDataset, table)
+	tableExist := bigqueryClient.CheckIfTableExists(ctx, *bigqueryDataset, table)
 	if !tableExist {
-		log.Debug().Msgf("Creating table %v.%v.%v...", *bigqueryProjectID, *bigqueryDataset, *bigqueryTable)
-		err := bigqueryClient.CreateTable(*bigqueryDataset, *bigqueryTable, BigQueryMeasurement{}, "measured_at", true)
+		log.Debug().Msgf("Creating table %v.%v.%v...", *bigqueryProjectID, *bigqueryDataset, table)
+		err := bigqueryClient.CreateTable(ctx, *bigqueryDataset, table, typeForSchema, options, true)
 		if err != nil {
-			log.Fatal().Err(err).Msg("Failed creating bigquery table")
+			exitOnStepError(ctx, err, fmt.Sprintf("creating bigquery table %v", table))
 		}
 	} else {
-		log.Debug().Msgf("Trying to update table %v.%v.%v schema...", *bigqueryProjectID, *bigqueryDataset, *bigqueryTable)
-		err := bigqueryClient.UpdateTableSchema(*bigqueryDataset, *bigqueryTable, BigQueryMeasurement{})
+		log.Debug().Msgf("Trying to update table %v.%v.%v schema...", *bigqueryProjectID, *bigqueryDataset, table)
+		err := bigqueryClient.UpdateTableSchema(ctx, *bigqueryDataset, table, typeForSchema)
+		if err != nil {
+			exitOnStepError(ctx, err, fmt.Sprintf("updating bigquery table %v schema", table))
+		}
+
+		log.Debug().Msgf("Reconciling table %v.%v.%v partitioning and clustering...", *bigqueryProjectID, *bigqueryDataset, table)
+		err = bigqueryClient.UpdateTableOptions(ctx, *bigqueryDataset, table, options)
 		if err != nil {
-			log.Fatal().Err(err).Msg("Failed updating bigquery table schema")
+			exitOnStepError(ctx, err, fmt.Sprintf("updating bigquery table %v partitioning and clustering", table))
 		}
 	}
 }
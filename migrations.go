@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/rs/zerolog/log"
+)
+
+// migrationTarget identifies the measurements table that migrations are applied to and how it's partitioned and clustered
+type migrationTarget struct {
+	ProjectID string
+	Dataset   string
+	Table     string
+	Options   TableOptions
+}
+
+// migrationsTable is the metadata table recording which migrations have been applied to the target table
+func (t migrationTarget) migrationsTable() string {
+	return t.Table + "_schema_migrations"
+}
+
+func (t migrationTarget) qualifiedName(table string) string {
+	return fmt.Sprintf("`%v.%v.%v`", t.ProjectID, t.Dataset, table)
+}
+
+// schemaMigration is a numbered change to the measurements table or the tables derived from it; once released a migration is never changed, a new one is added instead
+type schemaMigration struct {
+	Version     int
+	Description string
+	Steps       []migrationStep
+}
+
+// migrationStep is a single operation of a migration; steps are rerun if a migration fails halfway, so each step should be safe to repeat
+type migrationStep struct {
+	Description string
+	Apply       func(ctx context.Context, bigqueryClient BigQueryClient) error
+}
+
+// measurementsSchemaV1 is the measurements table schema as inferred from BigQueryMeasurement before migrations were introduced
+var measurementsSchemaV1 = bigquery.Schema{
+	{Name: "location", Type: bigquery.StringFieldType, Required: true},
+	{Name: "measured_at", Type: bigquery.TimestampFieldType, Required: true},
+	{Name: "zones", Type: bigquery.RecordFieldType, Repeated: true, Schema: bigquery.Schema{
+		{Name: "location", Type: bigquery.StringFieldType, Required: true},
+		{Name: "unit", Type: bigquery.StringFieldType, Required: true},
+		{Name: "temperature", Type: bigquery.FloatFieldType},
+		{Name: "heat_setpoint", Type: bigquery.FloatFieldType},
+		{Name: "heat_demand", Type: bigquery.FloatFieldType},
+		{Name: "humidity", Type: bigquery.FloatFieldType},
+	}},
+	{Name: "inserted_at", Type: bigquery.TimestampFieldType, Required: true},
+}
+
+// measurementsMigrations returns all migrations for the target table in the order they're applied
+func measurementsMigrations(target migrationTarget) []schemaMigration {
+	return []schemaMigration{
+		{
+			Version:     1,
+			Description: "Create measurements table partitioned by measured_at",
+			// tables created before migrations existed already match this version and are baselined
+			Steps: []migrationStep{createTableStep(target, target.Table, measurementsSchemaV1, target.Options)},
+		},
+		{
+			Version:     2,
+			Description: "Add location_id column",
+			// nullable, because bigquery doesn't allow adding required columns to rows that already exist
+			Steps: []migrationStep{addColumnsStep(target, target.Table, bigquery.Schema{
+				{Name: "location_id", Type: bigquery.IntegerFieldType},
+			})},
+		},
+		{
+			Version:     3,
+			Description: "Add quality_flags column to zones",
+			Steps: []migrationStep{addColumnsStep(target, target.Table, bigquery.Schema{
+				{Name: "zones", Type: bigquery.RecordFieldType, Repeated: true, Schema: bigquery.Schema{
+					{Name: "quality_flags", Type: bigquery.StringFieldType, Repeated: true},
+				}},
+			})},
+		},
+		{
+			Version:     4,
+			Description: "Add boiler_heat_demand column",
+			Steps: []migrationStep{addColumnsStep(target, target.Table, bigquery.Schema{
+				{Name: "boiler_heat_demand", Type: bigquery.FloatFieldType},
+			})},
+		},
+		{
+			Version:     5,
+			Description: "Add account column",
+			Steps: []migrationStep{addColumnsStep(target, target.Table, bigquery.Schema{
+				{Name: "account", Type: bigquery.StringFieldType},
+			})},
+		},
+		{
+			Version:     6,
+			Description: "Add location_owner column",
+			Steps: []migrationStep{addColumnsStep(target, target.Table, bigquery.Schema{
+				{Name: "location_owner", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+					{Name: "is_owner", Type: bigquery.BooleanFieldType},
+					{Name: "id", Type: bigquery.IntegerFieldType},
+					{Name: "name", Type: bigquery.StringFieldType},
+				}},
+			})},
+		},
+		{
+			Version:     7,
+			Description: "Add time_zone column",
+			Steps: []migrationStep{addColumnsStep(target, target.Table, bigquery.Schema{
+				{Name: "time_zone", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+					{Name: "id", Type: bigquery.StringFieldType},
+					{Name: "current_offset_minutes", Type: bigquery.IntegerFieldType},
+				}},
+			})},
+		},
+	}
+}
+
+// createTableStep creates the table with an explicit schema, leaving an already existing table as is
+func createTableStep(target migrationTarget, table string, schema bigquery.Schema, options TableOptions) migrationStep {
+	return migrationStep{
+		Description: fmt.Sprintf("create table %v if it doesn't exist", target.qualifiedName(table)),
+		Apply: func(ctx context.Context, bigqueryClient BigQueryClient) error {
+			if bigqueryClient.CheckIfTableExists(ctx, target.Dataset, table) {
+				log.Info().Msgf("Table %v already exists, leaving it as is", target.qualifiedName(table))
+				return nil
+			}
+			return bigqueryClient.CreateTable(ctx, target.Dataset, table, schema, options, true)
+		},
+	}
+}
+
+// addColumnsStep adds nullable or repeated columns to the table, skipping columns that already exist
+func addColumnsStep(target migrationTarget, table string, fields bigquery.Schema) migrationStep {
+	names := make([]string, len(fields))
+	for i, f := range fields {
+		names[i] = f.Name
+	}
+
+	return migrationStep{
+		Description: fmt.Sprintf("add columns %v to table %v", names, target.qualifiedName(table)),
+		Apply: func(ctx context.Context, bigqueryClient BigQueryClient) error {
+			return bigqueryClient.AddColumns(ctx, target.Dataset, table, fields)
+		},
+	}
+}
+
+// derivedTableStep creates a table from a query over existing tables, for example to precompute aggregates; partitionExpression can be empty
+func derivedTableStep(target migrationTarget, table, partitionExpression, selectQuery string) migrationStep {
+	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %v%v AS\n%v", target.qualifiedName(table), partitionClause(partitionExpression), selectQuery)
+
+	return migrationStep{
+		Description: fmt.Sprintf("create derived table %v", target.qualifiedName(table)),
+		Apply: func(ctx context.Context, bigqueryClient BigQueryClient) error {
+			return bigqueryClient.RunQuery(ctx, query)
+		},
+	}
+}
+
+// rewriteTableSteps rewrites the table through selectQuery for breaking changes like renaming a column or changing its type: the result goes to a temporary table, which is then copied over the original and removed
+func rewriteTableSteps(target migrationTarget, version int, table, partitionExpression, selectQuery string) []migrationStep {
+	tmpTable := fmt.Sprintf("%v_migration_%v", table, version)
+	query := fmt.Sprintf("CREATE OR REPLACE TABLE %v%v AS\n%v", target.qualifiedName(tmpTable), partitionClause(partitionExpression), selectQuery)
+
+	return []migrationStep{
+		{
+			Description: fmt.Sprintf("write rewritten table %v to %v", target.qualifiedName(table), target.qualifiedName(tmpTable)),
+			Apply: func(ctx context.Context, bigqueryClient BigQueryClient) error {
+				return bigqueryClient.RunQuery(ctx, query)
+			},
+		},
+		{
+			Description: fmt.Sprintf("replace table %v with %v", target.qualifiedName(table), target.qualifiedName(tmpTable)),
+			Apply: func(ctx context.Context, bigqueryClient BigQueryClient) error {
+				return bigqueryClient.CopyTable(ctx, target.Dataset, tmpTable, table)
+			},
+		},
+		{
+			Description: fmt.Sprintf("delete table %v", target.qualifiedName(tmpTable)),
+			Apply: func(ctx context.Context, bigqueryClient BigQueryClient) error {
+				return bigqueryClient.DeleteTable(ctx, target.Dataset, tmpTable)
+			},
+		},
+	}
+}
+
+func partitionClause(partitionExpression string) string {
+	if partitionExpression == "" {
+		return ""
+	}
+	return "\nPARTITION BY " + partitionExpression
+}
+
+// applyMigrations applies the migrations that aren't recorded in the target's migrations table yet, in order, and returns them; with dryRun it only returns and logs them
+func applyMigrations(ctx context.Context, bigqueryClient BigQueryClient, target migrationTarget, migrations []schemaMigration, dryRun bool) (pending []schemaMigration, err error) {
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version <= migrations[i-1].Version {
+			return nil, fmt.Errorf("Migration %v is listed after migration %v, versions have to be unique and increasing", migrations[i].Version, migrations[i-1].Version)
+		}
+	}
+
+	applied := map[int]bool{}
+	if bigqueryClient.CheckIfTableExists(ctx, target.Dataset, target.migrationsTable()) {
+		appliedMigrations, err := bigqueryClient.GetSchemaMigrations(ctx, target.Dataset, target.migrationsTable())
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range appliedMigrations {
+			applied[m.Version] = true
+		}
+	} else if !dryRun {
+		log.Info().Msgf("Creating migrations table %v...", target.qualifiedName(target.migrationsTable()))
+		err = bigqueryClient.CreateTable(ctx, target.Dataset, target.migrationsTable(), BigQuerySchemaMigration{}, TableOptions{}, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, m := range migrations {
+		if !applied[m.Version] {
+			pending = append(pending, m)
+		}
+	}
+
+	for _, m := range pending {
+		if dryRun {
+			log.Info().Msgf("Pending migration %v: %v", m.Version, m.Description)
+			for _, s := range m.Steps {
+				log.Info().Msgf("  would %v", s.Description)
+			}
+			continue
+		}
+
+		log.Info().Msgf("Applying migration %v: %v...", m.Version, m.Description)
+		for _, s := range m.Steps {
+			log.Debug().Msgf("Migration %v: %v...", m.Version, s.Description)
+			if err := s.Apply(ctx, bigqueryClient); err != nil {
+				return nil, fmt.Errorf("Migration %v failed to %v: %w", m.Version, s.Description, err)
+			}
+		}
+
+		err = bigqueryClient.InsertSchemaMigration(ctx, target.Dataset, target.migrationsTable(), BigQuerySchemaMigration{
+			Version:     m.Version,
+			Description: m.Description,
+			AppliedAt:   time.Now().UTC(),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Recording migration %v failed: %w", m.Version, err)
+		}
+	}
+
+	return pending, nil
+}
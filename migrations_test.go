@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeMigrationsClient struct {
+	BigQueryClient
+	existingTables map[string]bool
+	applied        []BigQuerySchemaMigration
+	calls          []string
+}
+
+func (f *fakeMigrationsClient) CheckIfTableExists(ctx context.Context, dataset, table string) bool {
+	return f.existingTables[table]
+}
+
+func (f *fakeMigrationsClient) CreateTable(ctx context.Context, dataset, table string, typeForSchema interface{}, options TableOptions, waitReady bool) error {
+	f.calls = append(f.calls, "create "+table)
+	f.existingTables[table] = true
+	return nil
+}
+
+func (f *fakeMigrationsClient) AddColumns(ctx context.Context, dataset, table string, fields bigquery.Schema) error {
+	f.calls = append(f.calls, "add columns "+table)
+	return nil
+}
+
+func (f *fakeMigrationsClient) RunQuery(ctx context.Context, query string) error {
+	f.calls = append(f.calls, "query")
+	return nil
+}
+
+func (f *fakeMigrationsClient) CopyTable(ctx context.Context, dataset, source, destination string) error {
+	f.calls = append(f.calls, "copy "+source+" to "+destination)
+	return nil
+}
+
+func (f *fakeMigrationsClient) DeleteTable(ctx context.Context, dataset, table string) error {
+	f.calls = append(f.calls, "delete "+table)
+	return nil
+}
+
+func (f *fakeMigrationsClient) GetSchemaMigrations(ctx context.Context, dataset, table string) ([]BigQuerySchemaMigration, error) {
+	return f.applied, nil
+}
+
+func (f *fakeMigrationsClient) InsertSchemaMigration(ctx context.Context, dataset, table string, migration BigQuerySchemaMigration) error {
+	f.calls = append(f.calls, "record "+table)
+	f.applied = append(f.applied, migration)
+	return nil
+}
+
+func TestApplyMigrations(t *testing.T) {
+
+	target := migrationTarget{ProjectID: "project", Dataset: "dataset", Table: "measurements"}
+
+	t.Run("CreatesMigrationsTableAndAppliesAllMigrationsInOrder", func(t *testing.T) {
+
+		client := &fakeMigrationsClient{existingTables: map[string]bool{}}
+
+		// act
+		pending, err := applyMigrations(context.Background(), client, target, measurementsMigrations(target), false)
+
+		assert.Nil(t, err)
+		assert.Equal(t, 7, len(pending))
+		assert.Equal(t, []string{
+			"create measurements_schema_migrations",
+			"create measurements",
+			"record measurements_schema_migrations",
+			"add columns measurements",
+			"record measurements_schema_migrations",
+			"add columns measurements",
+			"record measurements_schema_migrations",
+			"add columns measurements",
+			"record measurements_schema_migrations",
+			"add columns measurements",
+			"record measurements_schema_migrations",
+			"add columns measurements",
+			"record measurements_schema_migrations",
+			"add columns measurements",
+			"record measurements_schema_migrations",
+		}, client.calls)
+		if assert.Equal(t, 7, len(client.applied)) {
+			assert.Equal(t, 1, client.applied[0].Version)
+			assert.Equal(t, 2, client.applied[1].Version)
+			assert.Equal(t, 3, client.applied[2].Version)
+			assert.Equal(t, 4, client.applied[3].Version)
+			assert.Equal(t, 5, client.applied[4].Version)
+			assert.Equal(t, 6, client.applied[5].Version)
+			assert.Equal(t, 7, client.applied[6].Version)
+		}
+	})
+
+	t.Run("BaselinesTableThatExistedBeforeMigrations", func(t *testing.T) {
+
+		client := &fakeMigrationsClient{existingTables: map[string]bool{"measurements": true}}
+
+		// act
+		pending, err := applyMigrations(context.Background(), client, target, measurementsMigrations(target), false)
+
+		assert.Nil(t, err)
+		assert.Equal(t, 7, len(pending))
+		assert.NotContains(t, client.calls, "create measurements")
+		assert.Equal(t, 7, len(client.applied))
+	})
+
+	t.Run("SkipsAppliedMigrations", func(t *testing.T) {
+
+		client := &fakeMigrationsClient{
+			existingTables: map[string]bool{"measurements": true, "measurements_schema_migrations": true},
+			applied:        []BigQuerySchemaMigration{{Version: 1}, {Version: 2}, {Version: 3}, {Version: 4}, {Version: 5}, {Version: 6}},
+		}
+
+		// act
+		pending, err := applyMigrations(context.Background(), client, target, measurementsMigrations(target), false)
+
+		assert.Nil(t, err)
+		if assert.Equal(t, 1, len(pending)) {
+			assert.Equal(t, 7, pending[0].Version)
+		}
+		assert.Equal(t, []string{"add columns measurements", "record measurements_schema_migrations"}, client.calls)
+	})
+
+	t.Run("DryRunOnlyReturnsPendingMigrations", func(t *testing.T) {
+
+		client := &fakeMigrationsClient{existingTables: map[string]bool{}}
+
+		// act
+		pending, err := applyMigrations(context.Background(), client, target, measurementsMigrations(target), true)
+
+		assert.Nil(t, err)
+		assert.Equal(t, 7, len(pending))
+		assert.Equal(t, 0, len(client.calls))
+	})
+
+	t.Run("ReturnsErrorForUnorderedVersions", func(t *testing.T) {
+
+		client := &fakeMigrationsClient{existingTables: map[string]bool{}}
+		migrations := []schemaMigration{{Version: 2}, {Version: 1}}
+
+		// act
+		_, err := applyMigrations(context.Background(), client, target, migrations, false)
+
+		assert.NotNil(t, err)
+		assert.Equal(t, 0, len(client.calls))
+	})
+
+	t.Run("DoesNotRecordMigrationWithFailingStep", func(t *testing.T) {
+
+		client := &fakeMigrationsClient{existingTables: map[string]bool{"measurements_schema_migrations": true}}
+		stepErr := errors.New("step failed")
+		migrations := []schemaMigration{{
+			Version: 1,
+			Steps: []migrationStep{{
+				Description: "fail",
+				Apply:       func(ctx context.Context, bigqueryClient BigQueryClient) error { return stepErr },
+			}},
+		}}
+
+		// act
+		_, err := applyMigrations(context.Background(), client, target, migrations, false)
+
+		assert.True(t, errors.Is(err, stepErr))
+		assert.Equal(t, 0, len(client.applied))
+	})
+
+	t.Run("RewritesTableViaTemporaryCopy", func(t *testing.T) {
+
+		client := &fakeMigrationsClient{existingTables: map[string]bool{"measurements_schema_migrations": true}}
+		migrations := []schemaMigration{{
+			Version: 3,
+			Steps:   rewriteTableSteps(target, 3, "measurements", "DATE(measured_at)", "SELECT * FROM `project.dataset.measurements`"),
+		}}
+
+		// act
+		_, err := applyMigrations(context.Background(), client, target, migrations, false)
+
+		assert.Nil(t, err)
+		assert.Equal(t, []string{
+			"query",
+			"copy measurements_migration_3 to measurements",
+			"delete measurements_migration_3",
+			"record measurements_schema_migrations",
+		}, client.calls)
+	})
+}
+
+func TestDerivedTableStep(t *testing.T) {
+
+	t.Run("CreatesTableFromQueryIfItDoesNotExist", func(t *testing.T) {
+
+		var query string
+		client := &fakeQueryClient{query: &query}
+		target := migrationTarget{ProjectID: "project", Dataset: "dataset", Table: "measurements"}
+
+		// act
+		err := derivedTableStep(target, "daily", "DATE(day)", "SELECT 1 AS x").Apply(context.Background(), client)
+
+		assert.Nil(t, err)
+		assert.Equal(t, "CREATE TABLE IF NOT EXISTS `project.dataset.daily`\nPARTITION BY DATE(day) AS\nSELECT 1 AS x", query)
+	})
+}
+
+type fakeQueryClient struct {
+	BigQueryClient
+	query *string
+}
+
+func (f *fakeQueryClient) RunQuery(ctx context.Context, query string) error {
+	*f.query = query
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter hands out a fixed budget of requests per sliding time window and holds back all requests while the api has asked us to back off
+type rateLimiter struct {
+	budget       int
+	window       time.Duration
+	requestTimes []time.Time
+	blockedUntil time.Time
+	mutex        sync.Mutex
+}
+
+func newRateLimiter(budget int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		budget: budget,
+		window: window,
+	}
+}
+
+// Wait blocks until a request fits within the budget; if that moment lies beyond the context's deadline it returns ErrRateLimited right away instead of waiting in vain
+func (rl *rateLimiter) Wait(ctx context.Context) error {
+	for {
+		delay := rl.reserve(time.Now().UTC())
+		if delay <= 0 {
+			return nil
+		}
+
+		if deadline, ok := ctx.Deadline(); ok && time.Now().UTC().Add(delay).After(deadline) {
+			return ErrRateLimited
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// BlockUntil holds back all requests until the given time, used to honour a Retry-After header
+func (rl *rateLimiter) BlockUntil(t time.Time) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	if t.After(rl.blockedUntil) {
+		rl.blockedUntil = t
+	}
+}
+
+// reserve claims a slot in the current window and returns 0, or returns how long to wait before trying again
+func (rl *rateLimiter) reserve(now time.Time) time.Duration {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	if now.Before(rl.blockedUntil) {
+		return rl.blockedUntil.Sub(now)
+	}
+
+	// forget requests that fell out of the window
+	windowStart := now.Add(-rl.window)
+	for len(rl.requestTimes) > 0 && !rl.requestTimes[0].After(windowStart) {
+		rl.requestTimes = rl.requestTimes[1:]
+	}
+
+	if rl.budget > 0 && len(rl.requestTimes) >= rl.budget {
+		return rl.requestTimes[0].Add(rl.window).Sub(now)
+	}
+
+	rl.requestTimes = append(rl.requestTimes, now)
+
+	return 0
+}
+
+// parseRetryAfter reads a Retry-After header, which holds either a number of seconds or an http date
+func parseRetryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if t, err := http.ParseTime(header); err == nil {
+		if t.Before(now) {
+			return 0, true
+		}
+		return t.Sub(now), true
+	}
+
+	return 0, false
+}
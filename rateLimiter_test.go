@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiterWait(t *testing.T) {
+
+	t.Run("AllowsRequestsWithinBudget", func(t *testing.T) {
+
+		rl := newRateLimiter(3, time.Minute)
+
+		// act
+		for i := 0; i < 3; i++ {
+			err := rl.Wait(context.Background())
+
+			assert.Nil(t, err)
+		}
+	})
+
+	t.Run("ReturnsErrRateLimitedIfBudgetIsExhaustedUntilAfterDeadline", func(t *testing.T) {
+
+		rl := newRateLimiter(1, time.Minute)
+		rl.Wait(context.Background())
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		// act
+		err := rl.Wait(ctx)
+
+		assert.Equal(t, ErrRateLimited, err)
+	})
+
+	t.Run("ReturnsErrRateLimitedIfBlockedUntilAfterDeadline", func(t *testing.T) {
+
+		rl := newRateLimiter(10, time.Minute)
+		rl.BlockUntil(time.Now().UTC().Add(time.Hour))
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		// act
+		err := rl.Wait(ctx)
+
+		assert.Equal(t, ErrRateLimited, err)
+	})
+}
+
+func TestParseRetryAfter(t *testing.T) {
+
+	t.Run("ParsesSeconds", func(t *testing.T) {
+
+		// act
+		retryAfter, ok := parseRetryAfter("120", time.Now().UTC())
+
+		assert.True(t, ok)
+		assert.Equal(t, 2*time.Minute, retryAfter)
+	})
+
+	t.Run("ParsesHTTPDate", func(t *testing.T) {
+
+		now := time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC)
+
+		// act
+		retryAfter, ok := parseRetryAfter("Sun, 01 Nov 2020 12:00:30 GMT", now)
+
+		assert.True(t, ok)
+		assert.Equal(t, 30*time.Second, retryAfter)
+	})
+
+	t.Run("ReturnsFalseForEmptyHeader", func(t *testing.T) {
+
+		// act
+		_, ok := parseRetryAfter("", time.Now().UTC())
+
+		assert.False(t, ok)
+	})
+}
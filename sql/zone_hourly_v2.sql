@@ -0,0 +1,25 @@
+SELECT
+  TIMESTAMP_TRUNC(measured_at, HOUR) AS hour,
+  IFNULL(account, '') AS account,
+  location_id,
+  ARRAY_AGG(location ORDER BY measured_at DESC LIMIT 1)[OFFSET(0)] AS location,
+  zone.location AS zone,
+  AVG(zone.temperature) AS avg_temperature,
+  AVG(zone.heat_setpoint) AS avg_heat_setpoint,
+  AVG(zone.temperature - zone.heat_setpoint) AS avg_setpoint_error,
+  AVG(ABS(zone.temperature - zone.heat_setpoint)) AS avg_abs_setpoint_error,
+  AVG(zone.heat_demand) AS avg_heat_demand,
+  AVG(CASE WHEN zone.heat_demand IS NULL THEN NULL WHEN zone.heat_demand > 0 THEN 1 ELSE 0 END) AS heat_demand_duty_cycle,
+  AVG(zone.humidity) AS avg_humidity,
+  COUNT(*) AS measurements
+FROM
+  `{{.ProjectID}}.{{.Dataset}}.{{.Table}}_deduplicated`,
+  UNNEST(zones) AS zone
+WHERE
+  location_id IS NOT NULL
+  AND location_id != 0
+GROUP BY
+  hour,
+  IFNULL(account, ''),
+  location_id,
+  zone
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// storageWriteStateSecretKey is the key of the storage write state in the session secret
+const storageWriteStateSecretKey = "storage-write.json"
+
+// storageWriteState is kept between runs, so a retried run doesn't append rows that already landed
+type storageWriteState struct {
+	// Streams holds the last stream appended to per destination table
+	Streams map[string]*storageWriteStream `json:"streams"`
+}
+
+// storageWriteStream is a stream rows were appended to in a single append at offset 0
+type storageWriteStream struct {
+	Name      string   `json:"name"`
+	InsertIDs []string `json:"insertIds"`
+
+	// Landed is set once the append is known to be written, and committed for pending streams; until then a retry has to find out whether it did
+	Landed bool `json:"landed"`
+}
+
+// StorageWriteStateStore is the interface for keeping the storage write state between runs
+type StorageWriteStateStore interface {
+	Load(ctx context.Context) (state *storageWriteState, err error)
+	Save(ctx context.Context, state *storageWriteState) error
+}
+
+type fileStorageWriteStateStoreImpl struct {
+	path string
+}
+
+// NewFileStorageWriteStateStore returns a StorageWriteStateStore that keeps the storage write state in a local file, for example on a persistent volume
+func NewFileStorageWriteStateStore(path string) StorageWriteStateStore {
+	return &fileStorageWriteStateStoreImpl{
+		path: path,
+	}
+}
+
+func (fs *fileStorageWriteStateStoreImpl) Load(ctx context.Context) (state *storageWriteState, err error) {
+	data, err := ioutil.ReadFile(fs.path)
+	if os.IsNotExist(err) {
+		return &storageWriteState{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalStorageWriteState(data)
+}
+
+func (fs *fileStorageWriteStateStoreImpl) Save(ctx context.Context, state *storageWriteState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first, so an interrupted run doesn't leave a truncated state behind
+	tempPath := filepath.Join(filepath.Dir(fs.path), "."+filepath.Base(fs.path)+".tmp")
+	if err := ioutil.WriteFile(tempPath, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tempPath, fs.path)
+}
+
+type secretStorageWriteStateStoreImpl struct {
+	kubeClient KubernetesClient
+	namespace  string
+	secretName string
+}
+
+// NewSecretStorageWriteStateStore returns a StorageWriteStateStore that keeps the storage write state in the session secret next to the session
+func NewSecretStorageWriteStateStore(kubeClient KubernetesClient, namespace, secretName string) StorageWriteStateStore {
+	return &secretStorageWriteStateStoreImpl{
+		kubeClient: kubeClient,
+		namespace:  namespace,
+		secretName: secretName,
+	}
+}
+
+func (ss *secretStorageWriteStateStoreImpl) Load(ctx context.Context) (state *storageWriteState, err error) {
+	// read through the api instead of the mounted secret, which takes a while to reflect updates
+	secret, err := ss.kubeClient.GetSecret(ctx, ss.namespace, ss.secretName)
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := secret.Data[storageWriteStateSecretKey]
+	if !ok {
+		return &storageWriteState{}, nil
+	}
+
+	return unmarshalStorageWriteState(data)
+}
+
+func (ss *secretStorageWriteStateStoreImpl) Save(ctx context.Context, state *storageWriteState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	// retrieve the secret again, the session or alert state may have been updated since loading the state
+	secret, err := ss.kubeClient.GetSecret(ctx, ss.namespace, ss.secretName)
+	if err != nil {
+		return err
+	}
+	if secret.Data == nil {
+		secret.Data = make(map[string][]byte)
+	}
+	secret.Data[storageWriteStateSecretKey] = data
+
+	return ss.kubeClient.UpdateSecret(ctx, secret)
+}
+
+func unmarshalStorageWriteState(data []byte) (state *storageWriteState, err error) {
+	state = &storageWriteState{}
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("Unmarshalling storage write state failed: %w", err)
+	}
+
+	return state, nil
+}
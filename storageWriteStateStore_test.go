@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileStorageWriteStateStore(t *testing.T) {
+
+	t.Run("ReturnsEmptyStateIfFileDoesNotExist", func(t *testing.T) {
+
+		store := NewFileStorageWriteStateStore(filepath.Join(t.TempDir(), "storage-write.json"))
+
+		// act
+		state, err := store.Load(context.Background())
+
+		assert.Nil(t, err)
+		assert.Equal(t, &storageWriteState{}, state)
+	})
+}
+
+func TestSecretStorageWriteStateStore(t *testing.T) {
+
+	t.Run("SavesStateNextToSessionAndAlertState", func(t *testing.T) {
+
+		kubeClient := &kubernetesClientMock{secret: &KubernetesSecret{Data: map[string][]byte{"session.json": []byte(`{}`), "alerts.json": []byte(`{}`)}}}
+		store := NewSecretStorageWriteStateStore(kubeClient, "heating", "evohome-bigquery-exporter")
+		stream := &storageWriteStream{Name: "projects/project/datasets/dataset/tables/measurements/streams/abc", InsertIDs: []string{"1234-1604232000"}, Landed: true}
+
+		// act
+		err := store.Save(context.Background(), &storageWriteState{Streams: map[string]*storageWriteStream{"projects/project/datasets/dataset/tables/measurements": stream}})
+
+		assert.Nil(t, err)
+		assert.Equal(t, `{}`, string(kubeClient.secret.Data["session.json"]))
+		assert.Equal(t, `{}`, string(kubeClient.secret.Data["alerts.json"]))
+		state, err := store.Load(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, stream, state.Streams["projects/project/datasets/dataset/tables/measurements"])
+	})
+}
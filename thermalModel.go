@@ -0,0 +1,144 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+)
+
+const (
+	// thermalModelMaxSampleGap is the longest gap between two zone samples that is still used as an observation of the temperature change
+	thermalModelMaxSampleGap = 15 * time.Minute
+
+	// thermalModelMinObservations is the least number of observations needed to fit a zone's model for a week
+	thermalModelMinObservations = 24
+)
+
+type thermalModelKey struct {
+	zone zoneKey
+	week civil.Date
+}
+
+// thermalModelSums accumulates the sums of the least squares fit of the temperature change per hour y on the outdoor minus indoor temperature x1 and the heat demand x2
+type thermalModelSums struct {
+	n                  float64
+	x1x1, x1x2, x2x2   float64
+	x1y, x2y, y, yy    float64
+	indoorTemperature  float64
+	outdoorTemperature float64
+}
+
+// fitThermalModels fits dT/dt = k * (Toutdoor - Tindoor) + h * heatDemand per zone per week with least squares, where k is the heat loss coefficient and h the heating rate, both per hour; weeks start on monday in utc and observations without heat demand or outdoor temperature are skipped; locations are told apart by account and location id and named after their latest sample
+func fitThermalModels(samples []BigQueryZoneSample, computedAt time.Time) []BigQueryThermalModel {
+	samplesPerZone := map[zoneKey][]BigQueryZoneSample{}
+	for _, s := range samples {
+		samplesPerZone[s.zoneKey()] = append(samplesPerZone[s.zoneKey()], s)
+	}
+
+	names := locationNames(samples)
+	sums := map[thermalModelKey]*thermalModelSums{}
+	for zone, zoneSamples := range samplesPerZone {
+		sort.Slice(zoneSamples, func(i, j int) bool {
+			return zoneSamples[i].MeasuredAt.Before(zoneSamples[j].MeasuredAt)
+		})
+
+		for i := 1; i < len(zoneSamples); i++ {
+			previous, current := zoneSamples[i-1], zoneSamples[i]
+			gap := current.MeasuredAt.Sub(previous.MeasuredAt)
+			if gap <= 0 || gap > thermalModelMaxSampleGap || !previous.HeatDemand.Valid || !previous.OutdoorTemperature.Valid || !current.OutdoorTemperature.Valid {
+				continue
+			}
+
+			indoorTemperature := (previous.Temperature + current.Temperature) / 2
+			outdoorTemperature := (previous.OutdoorTemperature.Float64 + current.OutdoorTemperature.Float64) / 2
+			x1 := outdoorTemperature - indoorTemperature
+			x2 := previous.HeatDemand.Float64
+			y := (current.Temperature - previous.Temperature) / gap.Hours()
+
+			key := thermalModelKey{zone: zone, week: weekStart(previous.MeasuredAt)}
+			s, ok := sums[key]
+			if !ok {
+				s = &thermalModelSums{}
+				sums[key] = s
+			}
+			s.n++
+			s.x1x1 += x1 * x1
+			s.x1x2 += x1 * x2
+			s.x2x2 += x2 * x2
+			s.x1y += x1 * y
+			s.x2y += x2 * y
+			s.y += y
+			s.yy += y * y
+			s.indoorTemperature += indoorTemperature
+			s.outdoorTemperature += outdoorTemperature
+		}
+	}
+
+	models := []BigQueryThermalModel{}
+	for key, s := range sums {
+		if s.n < thermalModelMinObservations {
+			continue
+		}
+
+		// without variation in both temperature difference and heat demand the two effects can't be told apart
+		determinant := s.x1x1*s.x2x2 - s.x1x2*s.x1x2
+		if math.Abs(determinant) < 1e-9 {
+			continue
+		}
+
+		k := (s.x1y*s.x2x2 - s.x2y*s.x1x2) / determinant
+		h := (s.x2y*s.x1x1 - s.x1y*s.x1x2) / determinant
+
+		rSquared := 0.0
+		totalSquares := s.yy - s.y*s.y/s.n
+		if totalSquares > 0 {
+			residualSquares := s.yy - 2*k*s.x1y - 2*h*s.x2y + k*k*s.x1x1 + 2*k*h*s.x1x2 + h*h*s.x2x2
+			rSquared = 1 - residualSquares/totalSquares
+		}
+
+		timeConstantHours := bigquery.NullFloat64{}
+		if k > 0 {
+			timeConstantHours = bigquery.NullFloat64{Float64: 1 / k, Valid: true}
+		}
+
+		models = append(models, BigQueryThermalModel{
+			Location:              names[key.zone.location],
+			LocationID:            key.zone.location.locationID,
+			Account:               bigquery.NullString{StringVal: key.zone.location.account, Valid: true},
+			Zone:                  key.zone.zone,
+			Week:                  key.week,
+			HeatLossCoefficient:   k,
+			HeatingRate:           h,
+			TimeConstantHours:     timeConstantHours,
+			RSquared:              rSquared,
+			Samples:               int(s.n),
+			AvgIndoorTemperature:  s.indoorTemperature / s.n,
+			AvgOutdoorTemperature: s.outdoorTemperature / s.n,
+			ComputedAt:            computedAt,
+		})
+	}
+
+	sort.Slice(models, func(i, j int) bool {
+		if models[i].Account != models[j].Account {
+			return models[i].Account.StringVal < models[j].Account.StringVal
+		}
+		if models[i].LocationID != models[j].LocationID {
+			return models[i].LocationID < models[j].LocationID
+		}
+		if models[i].Zone != models[j].Zone {
+			return models[i].Zone < models[j].Zone
+		}
+		return models[i].Week.Before(models[j].Week)
+	})
+
+	return models
+}
+
+// weekStart returns the monday of the week t falls in, in utc
+func weekStart(t time.Time) civil.Date {
+	t = t.UTC()
+	return civil.DateOf(t).AddDays(-(int(t.Weekday()) + 6) % 7)
+}
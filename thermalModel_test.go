@@ -0,0 +1,101 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFitThermalModels(t *testing.T) {
+
+	// monday
+	start := time.Date(2020, 11, 2, 0, 0, 0, 0, time.UTC)
+	computedAt := time.Date(2020, 11, 9, 0, 0, 0, 0, time.UTC)
+
+	// simulates a zone with a heat loss coefficient of 0.1 and a heating rate of 2 per hour, heating every other hour
+	simulate := func(hours int) (samples []BigQueryZoneSample) {
+		step := 5 * time.Minute
+		temperature := 19.0
+		for i := 0; i <= hours*12; i++ {
+			measuredAt := start.Add(time.Duration(i) * step)
+			outdoorTemperature := 5 + 3*math.Sin(float64(i)/40)
+			heatDemand := 0.0
+			if (i/12)%2 == 0 {
+				heatDemand = 1
+			}
+			samples = append(samples, BigQueryZoneSample{
+				Location:           "Thuis",
+				LocationID:         1234,
+				Zone:               "Woonkamer",
+				MeasuredAt:         measuredAt,
+				Temperature:        temperature,
+				HeatDemand:         bigquery.NullFloat64{Float64: heatDemand, Valid: true},
+				OutdoorTemperature: bigquery.NullFloat64{Float64: outdoorTemperature, Valid: true},
+			})
+
+			// take small steps so the midpoint approximation of the fit stays close
+			for j := 0; j < 100; j++ {
+				temperature += (0.1*(outdoorTemperature-temperature) + 2*heatDemand) * step.Hours() / 100
+			}
+		}
+		return
+	}
+
+	t.Run("RecoversParametersOfSimulatedZone", func(t *testing.T) {
+
+		samples := simulate(48)
+
+		// act
+		models := fitThermalModels(samples, computedAt)
+
+		if assert.Equal(t, 1, len(models)) {
+			assert.Equal(t, "Woonkamer", models[0].Zone)
+			assert.Equal(t, 1234, models[0].LocationID)
+			assert.Equal(t, civil.Date{Year: 2020, Month: 11, Day: 2}, models[0].Week)
+			assert.InDelta(t, 0.1, models[0].HeatLossCoefficient, 0.01)
+			assert.InDelta(t, 2.0, models[0].HeatingRate, 0.05)
+			assert.InDelta(t, 10.0, models[0].TimeConstantHours.Float64, 1)
+			assert.Greater(t, models[0].RSquared, 0.95)
+			assert.Equal(t, 48*12, models[0].Samples)
+			assert.Equal(t, computedAt, models[0].ComputedAt)
+		}
+	})
+
+	t.Run("SkipsZonesWithoutHeatDemand", func(t *testing.T) {
+
+		samples := simulate(48)
+		for i := range samples {
+			samples[i].HeatDemand = bigquery.NullFloat64{}
+		}
+
+		// act
+		models := fitThermalModels(samples, computedAt)
+
+		assert.Equal(t, 0, len(models))
+	})
+
+	t.Run("SkipsWeeksWithTooFewObservations", func(t *testing.T) {
+
+		samples := simulate(1)
+
+		// act
+		models := fitThermalModels(samples, computedAt)
+
+		assert.Equal(t, 0, len(models))
+	})
+}
+
+func TestWeekStart(t *testing.T) {
+
+	t.Run("ReturnsMondayOfTheWeek", func(t *testing.T) {
+
+		// act
+		monday := weekStart(time.Date(2020, 11, 8, 23, 0, 0, 0, time.UTC))
+
+		assert.Equal(t, civil.Date{Year: 2020, Month: 11, Day: 2}, monday)
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	// the alpine image has no zoneinfo, so it's embedded
+	_ "time/tzdata"
+)
+
+// windowsTimeZones maps the windows time zone ids evohome reports, normalized by normalizeWindowsTimeZoneID, to their iana time zone
+var windowsTimeZones = map[string]string{
+	"dateline":        "Etc/GMT+12",
+	"utc":             "Etc/UTC",
+	"hawaiian":        "Pacific/Honolulu",
+	"alaskan":         "America/Anchorage",
+	"pacific":         "America/Los_Angeles",
+	"usmountain":      "America/Phoenix",
+	"mountain":        "America/Denver",
+	"canadacentral":   "America/Regina",
+	"central":         "America/Chicago",
+	"eastern":         "America/New_York",
+	"atlantic":        "America/Halifax",
+	"newfoundland":    "America/St_Johns",
+	"azores":          "Atlantic/Azores",
+	"gmt":             "Europe/London",
+	"greenwich":       "Atlantic/Reykjavik",
+	"weurope":         "Europe/Berlin",
+	"romance":         "Europe/Paris",
+	"centraleurope":   "Europe/Budapest",
+	"centraleuropean": "Europe/Warsaw",
+	"eeurope":         "Europe/Chisinau",
+	"fle":             "Europe/Kiev",
+	"gtb":             "Europe/Bucharest",
+	"turkey":          "Europe/Istanbul",
+	"russian":         "Europe/Moscow",
+	"israel":          "Asia/Jerusalem",
+	"southafrica":     "Africa/Johannesburg",
+	"arabian":         "Asia/Dubai",
+	"india":           "Asia/Kolkata",
+	"china":           "Asia/Shanghai",
+	"singapore":       "Asia/Singapore",
+	"tokyo":           "Asia/Tokyo",
+	"waustralia":      "Australia/Perth",
+	"cenaustralia":    "Australia/Adelaide",
+	"eaustralia":      "Australia/Brisbane",
+	"auseastern":      "Australia/Sydney",
+	"tasmania":        "Australia/Hobart",
+	"newzealand":      "Pacific/Auckland",
+}
+
+// normalizeWindowsTimeZoneID lowercases the id and drops punctuation, spaces and the standard time suffix, so W. Europe Standard Time and WEurope match
+func normalizeWindowsTimeZoneID(id string) string {
+	normalized := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return -1
+	}, strings.ToLower(id))
+
+	return strings.TrimSuffix(normalized, "standardtime")
+}
+
+// locationTimeZone returns the iana time zone for the location's time zone, so days across a daylight saving time change get the right boundaries; for unknown ids it falls back to the location's current offset
+func locationTimeZone(timeZone TimeZoneResponse) *time.Location {
+	name, ok := windowsTimeZones[normalizeWindowsTimeZoneID(timeZone.ID)]
+	if !ok && strings.Contains(timeZone.ID, "/") {
+		name, ok = timeZone.ID, true
+	}
+	if ok {
+		if location, err := time.LoadLocation(name); err == nil {
+			return location
+		}
+	}
+
+	return time.FixedZone(timeZone.ID, timeZone.CurrentOffsetMinutes*60)
+}
+
+// recordedTimeZones resolves the time zones recorded with measurements, loading each only once, so the derived tables split days the same way
+type recordedTimeZones map[TimeZoneResponse]*time.Location
+
+// get returns the time zone recorded as id and offsetMinutes, or utc for measurements from before the time zone was recorded
+func (tz recordedTimeZones) get(id string, offsetMinutes int) *time.Location {
+	if id == "" {
+		return time.UTC
+	}
+
+	key := TimeZoneResponse{ID: id, CurrentOffsetMinutes: offsetMinutes}
+	if _, ok := tz[key]; !ok {
+		tz[key] = locationTimeZone(key)
+	}
+
+	return tz[key]
+}
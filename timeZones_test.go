@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocationTimeZone(t *testing.T) {
+
+	winter := time.Date(2020, 1, 15, 12, 0, 0, 0, time.UTC)
+	summer := time.Date(2020, 7, 15, 12, 0, 0, 0, time.UTC)
+
+	t.Run("MapsWindowsTimeZoneIDToIANATimeZone", func(t *testing.T) {
+
+		// act
+		timeZone := locationTimeZone(TimeZoneResponse{ID: "W. Europe Standard Time", CurrentOffsetMinutes: 60})
+
+		assert.Equal(t, "Europe/Berlin", timeZone.String())
+		_, winterOffset := winter.In(timeZone).Zone()
+		_, summerOffset := summer.In(timeZone).Zone()
+		assert.Equal(t, 3600, winterOffset)
+		assert.Equal(t, 7200, summerOffset)
+	})
+
+	t.Run("MapsCompactWindowsTimeZoneID", func(t *testing.T) {
+
+		// act
+		timeZone := locationTimeZone(TimeZoneResponse{ID: "WEurope", CurrentOffsetMinutes: 60})
+
+		assert.Equal(t, "Europe/Berlin", timeZone.String())
+	})
+
+	t.Run("AcceptsIANATimeZoneID", func(t *testing.T) {
+
+		// act
+		timeZone := locationTimeZone(TimeZoneResponse{ID: "Europe/Amsterdam"})
+
+		assert.Equal(t, "Europe/Amsterdam", timeZone.String())
+	})
+
+	t.Run("FallsBackToCurrentOffsetForUnknownID", func(t *testing.T) {
+
+		// act
+		timeZone := locationTimeZone(TimeZoneResponse{ID: "Somewhere", CurrentOffsetMinutes: 120})
+
+		_, summerOffset := summer.In(timeZone).Zone()
+		_, winterOffset := winter.In(timeZone).Zone()
+		assert.Equal(t, 7200, summerOffset)
+		assert.Equal(t, 7200, winterOffset)
+	})
+}
+
+func TestRecordedTimeZones(t *testing.T) {
+
+	t.Run("ReturnsUTCForMeasurementsWithoutTimeZone", func(t *testing.T) {
+
+		timeZones := recordedTimeZones{}
+
+		// act
+		timeZone := timeZones.get("", 0)
+
+		assert.Equal(t, time.UTC, timeZone)
+	})
+
+	t.Run("ResolvesRecordedTimeZoneLikeLocationTimeZone", func(t *testing.T) {
+
+		timeZones := recordedTimeZones{}
+
+		// act
+		timeZone := timeZones.get("W. Europe Standard Time", 60)
+
+		assert.Equal(t, "Europe/Berlin", timeZone.String())
+		assert.Equal(t, 1, len(timeZones))
+	})
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+)
+
+const (
+	qualityFlagTemperatureOutOfRange  = "temperature_out_of_range"
+	qualityFlagHeatSetpointOutOfRange = "heat_setpoint_out_of_range"
+	qualityFlagHumidityOutOfRange     = "humidity_out_of_range"
+)
+
+// valueRange is an inclusive range of plausible values
+type valueRange struct {
+	Min float64
+	Max float64
+}
+
+func (r valueRange) contains(value float64) bool {
+	return value >= r.Min && value <= r.Max
+}
+
+// validationRules are the plausibility ranges zone values are checked against before inserting them
+type validationRules struct {
+	IndoorTemperature  valueRange
+	OutdoorTemperature valueRange
+	Humidity           valueRange
+
+	// HeatSetpoint is used for zones whose thermostat doesn't report its own setpoint limits
+	HeatSetpoint valueRange
+
+	// NullInvalidValues nulls out invalid values on top of flagging them
+	NullInvalidValues bool
+
+	OutdoorZoneName string
+}
+
+// validationReport counts the zone values that failed validation per quality flag
+type validationReport struct {
+	Zones    int
+	Rejected map[string]int
+}
+
+func newValidationReport() validationReport {
+	return validationReport{Rejected: map[string]int{}}
+}
+
+func (r *validationReport) add(other validationReport) {
+	r.Zones += other.Zones
+	for flag, count := range other.Rejected {
+		r.Rejected[flag] += count
+	}
+}
+
+// RejectedTotal returns the number of rejected values over all flags
+func (r validationReport) RejectedTotal() (total int) {
+	for _, count := range r.Rejected {
+		total += count
+	}
+	return
+}
+
+// String lists the rejections per flag in a stable order for logging
+func (r validationReport) String() string {
+	flags := make([]string, 0, len(r.Rejected))
+	for flag := range r.Rejected {
+		flags = append(flags, flag)
+	}
+	sort.Strings(flags)
+
+	parts := make([]string, len(flags))
+	for i, flag := range flags {
+		parts[i] = fmt.Sprintf("%v: %v", flag, r.Rejected[flag])
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// setpointLimitKey identifies a zone of a location for looking up the setpoint limits of its thermostat; the location id is enough, a location shared with several accounts has the same thermostats in each
+func setpointLimitKey(locationID int, zone string) string {
+	return fmt.Sprintf("%v/%v", locationID, zone)
+}
+
+// setpointLimitsFromLocations returns the heat setpoint limits thermostats report themselves, for the ones that do
+func setpointLimitsFromLocations(locations []LocationResponse) map[string]valueRange {
+	limits := map[string]valueRange{}
+	for _, l := range locations {
+		for _, d := range l.Devices {
+			if d.Thermostat.MinHeatSetpoint == 0 && d.Thermostat.MaxHeatSetpoint == 0 {
+				continue
+			}
+			limits[setpointLimitKey(l.LocationID, d.Name)] = valueRange{Min: d.Thermostat.MinHeatSetpoint, Max: d.Thermostat.MaxHeatSetpoint}
+		}
+	}
+
+	return limits
+}
+
+// validateMeasurements checks all zone values against the rules, adds a quality flag per invalid value and nulls it out if configured; setpointLimits takes precedence over the rules' setpoint range
+func validateMeasurements(measurements []BigQueryMeasurement, rules validationRules, setpointLimits map[string]valueRange) validationReport {
+	report := newValidationReport()
+
+	for i := range measurements {
+		for j := range measurements[i].Zones {
+			zone := &measurements[i].Zones[j]
+			report.Zones++
+
+			temperatureRange := rules.IndoorTemperature
+			if zone.Zone == rules.OutdoorZoneName {
+				temperatureRange = rules.OutdoorTemperature
+			}
+			setpointRange, ok := setpointLimits[setpointLimitKey(measurements[i].LocationID, zone.Zone)]
+			if !ok {
+				setpointRange = rules.HeatSetpoint
+			}
+
+			validateValue(zone, &zone.TemperatureValue, temperatureRange, qualityFlagTemperatureOutOfRange, rules, &report)
+			validateValue(zone, &zone.HeatSetPointValue, setpointRange, qualityFlagHeatSetpointOutOfRange, rules, &report)
+			validateValue(zone, &zone.HumidityValue, rules.Humidity, qualityFlagHumidityOutOfRange, rules, &report)
+		}
+	}
+
+	return report
+}
+
+func validateValue(zone *BigQueryZone, value *bigquery.NullFloat64, valid valueRange, flag string, rules validationRules, report *validationReport) {
+	if !value.Valid || valid.contains(value.Float64) {
+		return
+	}
+
+	zone.QualityFlags = append(zone.QualityFlags, flag)
+	report.Rejected[flag]++
+
+	if rules.NullInvalidValues {
+		*value = bigquery.NullFloat64{}
+	}
+}
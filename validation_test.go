@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateMeasurements(t *testing.T) {
+
+	rules := validationRules{
+		IndoorTemperature:  valueRange{Min: 1, Max: 40},
+		OutdoorTemperature: valueRange{Min: -40, Max: 50},
+		Humidity:           valueRange{Min: 0, Max: 100},
+		HeatSetpoint:       valueRange{Min: 5, Max: 35},
+		NullInvalidValues:  true,
+		OutdoorZoneName:    "Outside",
+	}
+
+	newMeasurements := func() []BigQueryMeasurement {
+		return []BigQueryMeasurement{
+			{
+				Location:   "Thuis",
+				LocationID: 1234,
+				MeasuredAt: time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC),
+				Zones: []BigQueryZone{
+					{Zone: "Woonkamer", TemperatureValue: bigquery.NullFloat64{Float64: 128, Valid: true}, HeatSetPointValue: bigquery.NullFloat64{Float64: 20, Valid: true}},
+					{Zone: "Badkamer", TemperatureValue: bigquery.NullFloat64{Float64: 21, Valid: true}, HeatSetPointValue: bigquery.NullFloat64{Float64: 26, Valid: true}},
+					{Zone: "Outside", TemperatureValue: bigquery.NullFloat64{Float64: -5, Valid: true}, HumidityValue: bigquery.NullFloat64{Float64: 120, Valid: true}},
+				},
+			},
+		}
+	}
+
+	t.Run("NullsOutAndFlagsValuesOutsideTheirRange", func(t *testing.T) {
+
+		measurements := newMeasurements()
+
+		// act
+		report := validateMeasurements(measurements, rules, map[string]valueRange{})
+
+		zones := measurements[0].Zones
+		assert.False(t, zones[0].TemperatureValue.Valid)
+		assert.Equal(t, []string{qualityFlagTemperatureOutOfRange}, zones[0].QualityFlags)
+		assert.True(t, zones[0].HeatSetPointValue.Valid)
+		assert.Nil(t, zones[1].QualityFlags)
+		assert.True(t, zones[2].TemperatureValue.Valid)
+		assert.False(t, zones[2].HumidityValue.Valid)
+		assert.Equal(t, []string{qualityFlagHumidityOutOfRange}, zones[2].QualityFlags)
+		assert.Equal(t, 3, report.Zones)
+		assert.Equal(t, 2, report.RejectedTotal())
+		assert.Equal(t, "humidity_out_of_range: 1, temperature_out_of_range: 1", report.String())
+	})
+
+	t.Run("OnlyFlagsValuesIfNotNullingThemOut", func(t *testing.T) {
+
+		measurements := newMeasurements()
+		flagOnlyRules := rules
+		flagOnlyRules.NullInvalidValues = false
+
+		// act
+		report := validateMeasurements(measurements, flagOnlyRules, map[string]valueRange{})
+
+		assert.True(t, measurements[0].Zones[0].TemperatureValue.Valid)
+		assert.Equal(t, 128.0, measurements[0].Zones[0].TemperatureValue.Float64)
+		assert.Equal(t, []string{qualityFlagTemperatureOutOfRange}, measurements[0].Zones[0].QualityFlags)
+		assert.Equal(t, 2, report.RejectedTotal())
+	})
+
+	t.Run("UsesSetpointLimitsReportedByThermostat", func(t *testing.T) {
+
+		measurements := newMeasurements()
+		setpointLimits := map[string]valueRange{setpointLimitKey(1234, "Badkamer"): {Min: 5, Max: 25}}
+
+		// act
+		report := validateMeasurements(measurements, rules, setpointLimits)
+
+		assert.False(t, measurements[0].Zones[1].HeatSetPointValue.Valid)
+		assert.Equal(t, []string{qualityFlagHeatSetpointOutOfRange}, measurements[0].Zones[1].QualityFlags)
+		assert.Equal(t, 1, report.Rejected[qualityFlagHeatSetpointOutOfRange])
+	})
+}
+
+func TestSetpointLimitsFromLocations(t *testing.T) {
+
+	t.Run("SkipsThermostatsWithoutLimits", func(t *testing.T) {
+
+		locations := []LocationResponse{{LocationID: 1234, Name: "Thuis", Devices: []DeviceResponse{{Name: "Woonkamer"}, {Name: "Badkamer"}}}}
+		locations[0].Devices[1].Thermostat.MinHeatSetpoint = 5
+		locations[0].Devices[1].Thermostat.MaxHeatSetpoint = 25
+
+		// act
+		limits := setpointLimitsFromLocations(locations)
+
+		assert.Equal(t, map[string]valueRange{"1234/Badkamer": {Min: 5, Max: 25}}, limits)
+	})
+
+	t.Run("KeepsLimitsOfLocationsWithTheSameName", func(t *testing.T) {
+
+		locations := []LocationResponse{
+			{LocationID: 1234, Name: "Thuis", Devices: []DeviceResponse{{Name: "Badkamer"}}},
+			{LocationID: 5678, Name: "Thuis", Devices: []DeviceResponse{{Name: "Badkamer"}}},
+		}
+		locations[0].Devices[0].Thermostat.MinHeatSetpoint = 5
+		locations[0].Devices[0].Thermostat.MaxHeatSetpoint = 25
+		locations[1].Devices[0].Thermostat.MinHeatSetpoint = 10
+		locations[1].Devices[0].Thermostat.MaxHeatSetpoint = 30
+
+		// act
+		limits := setpointLimitsFromLocations(locations)
+
+		assert.Equal(t, map[string]valueRange{"1234/Badkamer": {Min: 5, Max: 25}, "5678/Badkamer": {Min: 10, Max: 30}}, limits)
+	})
+}
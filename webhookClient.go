@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// WebhookClient is the interface for posting notifications to a webhook
+type WebhookClient interface {
+	Post(ctx context.Context, payload interface{}) error
+}
+
+type webhookClientImpl struct {
+	url        string
+	httpClient *http.Client
+}
+
+// NewWebhookClient returns a WebhookClient that posts payloads as json to url
+func NewWebhookClient(url string) WebhookClient {
+	return &webhookClientImpl{
+		url: url,
+		httpClient: &http.Client{
+			Timeout: time.Second * 10,
+		},
+	}
+}
+
+func (wc *webhookClientImpl) Post(ctx context.Context, payload interface{}) error {
+	payloadJSONBytes, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "POST", wc.url, bytes.NewReader(payloadJSONBytes))
+	if err != nil {
+		return err
+	}
+
+	// add headers
+	request.Header.Add("Content-Type", "application/json")
+
+	// perform actual request
+	response, err := wc.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("Posting to webhook %v failed with status code %v: %v", wc.url, response.StatusCode, string(body))
+	}
+
+	return nil
+}
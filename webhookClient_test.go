@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookClientPost(t *testing.T) {
+
+	t.Run("PostsPayloadAsJSON", func(t *testing.T) {
+
+		var body string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "POST", r.Method)
+			assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+			bytes, _ := ioutil.ReadAll(r.Body)
+			body = string(bytes)
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer server.Close()
+
+		client := NewWebhookClient(server.URL)
+
+		// act
+		err := client.Post(context.Background(), map[string]string{"zone": "Woonkamer"})
+
+		assert.Nil(t, err)
+		assert.Equal(t, `{"zone":"Woonkamer"}`, body)
+	})
+
+	t.Run("ReturnsErrorForUnsuccessfulStatusCode", func(t *testing.T) {
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+		defer server.Close()
+
+		client := NewWebhookClient(server.URL)
+
+		// act
+		err := client.Post(context.Background(), map[string]string{})
+
+		assert.NotNil(t, err)
+	})
+}